@@ -9,6 +9,8 @@ import "container/list"
 
 import "apic"
 
+import "defs"
+import "devfs"
 import "fs"
 import "mem"
 import "msi"
@@ -64,6 +66,9 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 	if ahci.port == nil {
 		panic("nil port")
 	}
+	if req.Cmd == fs.BDEV_DISCARD && !ahci.port.trim {
+		return false
+	}
 	ahci.port.start(req)
 	return true
 }
@@ -75,9 +80,16 @@ func (ahci *ahci_disk_t) Stats() string {
 	return ahci.port.stat.stat()
 }
 
+func (ahci *ahci_disk_t) Nblocks() int {
+	return int(ahci.nsectors * 512 / fs.BSIZE)
+}
+
 func attach_ahci(vid, did int, t pci.Pcitag_t) {
-	if pci.Disk != nil {
-		panic("adding two disks")
+	if pci.Disk != nil || Ahci != nil {
+		bus, dev, fnc := pci.Breakpcitag(t)
+		fmt.Printf("AHCI: ignoring another controller (%v:%v:%v)\n", bus,
+		    dev, fnc)
+		return
 	}
 
 	d := &ahci_disk_t{}
@@ -187,6 +199,13 @@ func attach_ahci(vid, did int, t pci.Pcitag_t) {
 
 	go d.int_handler(vec)
 	Ahci = d
+	// only the first port with a disk is used
+	if err := devfs.Register("rsd0c", defs.D_RAWDISK, 0); err != 0 {
+		fmt.Printf("AHCI: no device file: %v\n", err)
+	}
+	if err := fs.Disk_attach("rsd0c", d); err != 0 {
+		fmt.Printf("AHCI: cannot attach disk: %v\n", err)
+	}
 }
 
 //
@@ -330,6 +349,9 @@ type ahci_port_stat_t struct {
 	Nnoslot   stats.Counter_t
 	Ncoalesce stats.Counter_t
 	Nintr     stats.Counter_t
+	Ntrim     stats.Counter_t
+	Ntrimdrop stats.Counter_t
+	Nerror    stats.Counter_t
 }
 
 type ahci_port_t struct {
@@ -349,6 +371,12 @@ type ahci_port_t struct {
 	block_pa [32]uintptr
 	block    [32]*[512]uint8
 
+	// DATA SET MANAGEMENT TRIM support, the most 512-byte blocks of ranges
+	// per command, and the range pages of in-flight TRIMs
+	trim   bool
+	dsmmax int
+	dsm_pa [32]mem.Pa_t
+
 	rfis_pa uintptr
 	rfis    *ahci_recv_fis
 	cmdh_pa uintptr
@@ -381,8 +409,12 @@ type identify_device_t struct {
 	hwreset       uint16     // Word 93
 	_             [6]uint16  // Words 94-99
 	lba48_sectors uint64     // Words 100-103, assuming little-endian
-	_             [15]uint16 // Words 104-118
+	_             uint16     // Word 104
+	dsm_max       uint16     // Word 105
+	_             [13]uint16 // Words 106-118
 	features119   uint16     // Word 119
+	_             [49]uint16 // Words 120-168
+	dsm_caps      uint16     // Word 169
 }
 
 const (
@@ -402,8 +434,10 @@ const (
 	AHCI_PORT_CMD_FRE    uint32 = (1 << 4)  // FIS receive enable
 	AHCI_PORT_CMD_FR     uint32 = (1 << 14) // FIS receive running
 	AHCI_PORT_CMD_CR     uint32 = (1 << 15) // command list running
+	AHCI_PORT_CMD_CCS    uint32 = 8         // shift of current command slot
 	AHCI_PORT_CMD_ACTIVE uint32 = (1 << 28) // ICC active
 
+	AHCI_PORT_INTR_TFE  = (1 << 30) // Task file error
 	AHCI_PORT_INTR_DPE  = (1 << 5) // Descriptor (PRD) processed
 	AHCI_PORT_INTR_SDBE = (1 << 3) // Set Device Bits FIS received
 	AHCI_PORT_INTR_DSE  = (1 << 2) // DMA Setup FIS received
@@ -412,7 +446,7 @@ const (
 
 	AHCI_PORT_INTR_DEFAULT = AHCI_PORT_INTR_DPE | AHCI_PORT_INTR_SDBE |
 		AHCI_PORT_INTR_DSE | AHCI_PORT_INTR_PSE |
-		AHCI_PORT_INTR_DHRE
+		AHCI_PORT_INTR_DHRE | AHCI_PORT_INTR_TFE
 
 	AHCI_CMD_FLAGS_WRITE uint16 = (1 << 6)
 
@@ -420,6 +454,7 @@ const (
 	SATA_FIS_TYPE_REG_D2H uint8 = 0x34
 	SATA_FIS_REG_CFLAG    uint8 = (1 << 7) // issuing new command
 
+	IDE_CMD_DSM             uint8 = 0x06
 	IDE_CMD_READ_DMA_EXT    uint8 = 0x25
 	IDE_CMD_WRITE_DMA_EXT   uint8 = 0x35
 	IDE_CMD_FLUSH_CACHE_EXT       = 0xea
@@ -437,6 +472,11 @@ const (
 
 	IDE_FEATURE_WCACHE_ENA = 0x02
 	IDE_FEATURE_RLA_ENA    = 0xAA
+	IDE_FEATURE_DSM_TRIM   = 0x01
+
+	IDE_DSM_TRIM      uint16 = (1 << 0) // Word 169
+	IDE_DSM_RANGE_MAX        = 0xffff   // sectors per range entry
+	IDE_DSM_PAGE_MAX         = 8        // 512-byte blocks of ranges per page
 )
 
 func LD(f *uint32) uint32 {
@@ -820,7 +860,8 @@ func (p *ahci_port_t) queue_coalesce(req *fs.Bdev_req_t) {
 	ok := false
 	for e := p.queued.Front(); e != nil; e = e.Next() {
 		r := e.Value.(*fs.Bdev_req_t)
-		if r.Cmd == fs.BDEV_FLUSH || req.Cmd == fs.BDEV_FLUSH {
+		if r.Cmd == fs.BDEV_FLUSH || req.Cmd == fs.BDEV_FLUSH ||
+		    r.Cmd == fs.BDEV_DISCARD || req.Cmd == fs.BDEV_DISCARD {
 			break
 		}
 		if r.Blks.Len() == 0 {
@@ -852,8 +893,9 @@ func (p *ahci_port_t) start(req *fs.Bdev_req_t) {
 	// the non-volatile cache of the storage device.  XXX It might be better
 	// to have a just a barrier operation (i.e., not flushing non-volatile
 	// cache), and tag writes with FUA for writes that need to persist
-	// immediately (instead of flusing the complete on-disk cache).
-	for req.Cmd == fs.BDEV_FLUSH {
+	// immediately (instead of flusing the complete on-disk cache).  TRIM
+	// isn't a queued command either, so discards wait too.
+	for req.Cmd == fs.BDEV_FLUSH || req.Cmd == fs.BDEV_DISCARD {
 		ci := LD(&p.port.ci)
 		sact := LD(&p.port.sact)
 		if ci == 0 { // && sact == 0 {
@@ -902,6 +944,9 @@ func (p *ahci_port_t) startslot(req *fs.Bdev_req_t, s int) {
 	case fs.BDEV_FLUSH:
 		p.stat.Nbarrier++
 		p.issue(s, nil, IDE_CMD_FLUSH_CACHE_EXT)
+	case fs.BDEV_DISCARD:
+		p.stat.Ntrim++
+		p.issue_trim(s, req.Runs)
 	}
 	p.inflight[s] = req
 	dbg("AHCI start: issued slot %v req %v sync %v ci %#x\n",
@@ -959,6 +1004,60 @@ func (p *ahci_port_t) issue(s int, blks *fs.BlkList_t, cmd uint8) {
 	ST(&p.port.ci, (1 << uint(s)))
 }
 
+// issue_trim issues a DATA SET MANAGEMENT TRIM of runs. the ranges go in a
+// page that port_intr frees; runs that don't fit in the page aren't trimmed.
+func (p *ahci_port_t) issue_trim(s int, runs []fs.Bdev_run_t) {
+	_, pa := p.pg_new()
+	ents := (*[512]uint64)(unsafe.Pointer(mem.Physmem.Dmap(pa)))
+	max := p.dsmmax * 512 / 8
+	n := 0
+	for _, r := range runs {
+		lba := uint64(r.Block) * uint64(fs.BSIZE/512)
+		left := uint64(r.N) * uint64(fs.BSIZE/512)
+		for left > 0 && n < max {
+			c := left
+			if c > IDE_DSM_RANGE_MAX {
+				c = IDE_DSM_RANGE_MAX
+			}
+			ents[n] = lba | c<<48
+			lba += c
+			left -= c
+			n++
+		}
+		if left > 0 {
+			p.stat.Ntrimdrop++
+		}
+	}
+	// unused entries must be zero
+	nblk := (n*8 + 511) / 512
+	if nblk == 0 {
+		nblk = 1
+	}
+	for i := n; i < nblk*512/8; i++ {
+		ents[i] = 0
+	}
+	p.dsm_pa[s] = pa
+
+	ST64(&p.cmdt[s].prdt[0].dba, uint64(pa))
+	ST(&p.cmdt[s].prdt[0].dbc, uint32(nblk*512-1))
+	ST16(&p.cmdh[s].prdtl, 1)
+	ST(&p.cmdh[s].prdbc, 0)
+
+	fis := &sata_fis_reg_h2d{}
+	fis.fis_type = SATA_FIS_TYPE_REG_H2D
+	fis.cflag = SATA_FIS_REG_CFLAG
+	fis.command = IDE_CMD_DSM
+	fis.features = IDE_FEATURE_DSM_TRIM
+	fis.dev_head = IDE_DEV_LBA
+	fis.control = IDE_CTL_LBA48
+	fis.sector_count = uint8(nblk & 0xff)
+	fis.sector_count_ex = uint8((nblk >> 8) & 0xff)
+
+	p.fill_fis(s, fis)
+	SET16(&p.cmdh[s].flags, AHCI_CMD_FLAGS_WRITE)
+	ST(&p.port.ci, (1 << uint(s)))
+}
+
 // Clear interrupt status
 func (ahci *ahci_disk_t) clear_is() {
 	// AHCI 1.3, section 10.7.2.1 says we need to first clear the
@@ -1009,6 +1108,17 @@ func (ahci *ahci_disk_t) probe_port(pid int) bool {
 				fmt.Printf("AHCI: NCQ queue depth limited to %d (out of %d)\n",
 					p.nslot, ahci.ncs)
 			}
+			if LD16(&id.dsm_caps)&IDE_DSM_TRIM != 0 {
+				p.trim = true
+				p.dsmmax = int(LD16(&id.dsm_max))
+				if p.dsmmax == 0 {
+					p.dsmmax = 1
+				}
+				if p.dsmmax > IDE_DSM_PAGE_MAX {
+					p.dsmmax = IDE_DSM_PAGE_MAX
+				}
+				dbg("AHCI: TRIM, %v blocks of ranges\n", p.dsmmax)
+			}
 			p.inflight = make([]*fs.Bdev_req_t, p.nslot)
 			p.queued = list.New()
 			_ = p.enable_write_cache()
@@ -1026,10 +1136,45 @@ func (ahci *ahci_disk_t) probe_port(pid int) bool {
 	return false
 }
 
+// tferr recovers the port from a task file error (AHCI 1.3, section
+// 6.2.2.1): the command in the slot the port was executing fails with EIO,
+// and the other issued commands are issued again once the port restarts.
+func (p *ahci_port_t) tferr() {
+	ci := LD(&p.port.ci)
+	s := (LD(&p.port.cmd) >> AHCI_PORT_CMD_CCS) & 0x1f
+	fmt.Printf("AHCI: task file error in slot %v: tfd %#x serr %#x\n", s,
+	    LD(&p.port.tfd), LD(&p.port.serr))
+	p.stat.Nerror++
+	if p.inflight[s] != nil {
+		p.inflight[s].Err = -defs.EIO
+	}
+
+	// stopping the port clears ci
+	CLR(&p.port.cmd, AHCI_PORT_CMD_ST)
+	for c := 0; LD(&p.port.cmd)&AHCI_PORT_CMD_CR != 0; c++ {
+		if c > 100000 {
+			fmt.Printf("AHCI: port doesn't stop\n")
+			return
+		}
+	}
+	ST(&p.port.serr, LD(&p.port.serr))
+	ST(&p.port.is, AHCI_PORT_INTR_TFE)
+	if LD(&p.port.tfd)&IDE_STAT_BSY != 0 {
+		fmt.Printf("AHCI: device busy after error\n")
+	}
+	SET(&p.port.cmd, AHCI_PORT_CMD_ST)
+	if again := ci &^ (1 << s); again != 0 {
+		ST(&p.port.ci, again)
+	}
+}
+
 func (p *ahci_port_t) port_intr(ahci *ahci_disk_t) {
 	defer p.Unlock()
 	p.Lock()
 
+	if LD(&p.port.is)&AHCI_PORT_INTR_TFE != 0 {
+		p.tferr()
+	}
 	ci := LD(&p.port.ci)
 	int := false
 	p.stat.Nintr++
@@ -1044,6 +1189,10 @@ func (p *ahci_port_t) port_intr(ahci *ahci_disk_t) {
 					b.Done("interrupt")
 				})
 			}
+			if p.inflight[s].Cmd == fs.BDEV_DISCARD {
+				p.pg_free(p.dsm_pa[s])
+				p.dsm_pa[s] = 0
+			}
 			if p.inflight[s].Sync {
 				dbg("port_intr: ack inflight %v\n", s)
 				// writing to channel while holding ahci lock, but should be ok
@@ -1146,6 +1295,8 @@ func ata_verify() {
 	chk(&f.features83, 83*2)
 	chk(&f.features86, 86*2)
 	chk(&f.features119, 119*2)
+	chk(&f.dsm_max, 105*2)
+	chk(&f.dsm_caps, 169*2)
 }
 
 func Ahci_init() {
@@ -12,6 +12,7 @@ import "unsafe"
 import "bounds"
 import "circbuf"
 import "defs"
+import "devfs"
 import "fdops"
 import "limits"
 import "mem"
@@ -3012,6 +3013,22 @@ func (tf *Tcpfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (tf *Tcpfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (tf *Tcpfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tf *Tcpfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tf *Tcpfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (tf *Tcpfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3381,6 +3398,22 @@ func (tl *tcplfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (tl *tcplfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (tl *tcplfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tl *tcplfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tl *tcplfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (tl *tcplfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3600,6 +3633,23 @@ func Nic_lookup(lip Ip4_t) (nic_i, bool) {
 	return nic, ok
 }
 
+// Nic_usernet gives n the address that QEMU's user mode network hands its
+// guest, with QEMU as the default gateway, unless another NIC has the
+// address already. returns the address and whether n got it.
+func Nic_usernet(n nic_i) (Ip4_t, bool) {
+	me := Ip4_t(0x0a00020f)
+	gw := Ip4_t(0x0a000202)
+	netmask := Ip4_t(0xffffff00)
+	if _, ok := Nic_lookup(me); ok {
+		return 0, false
+	}
+	Nic_insert(me, n)
+	Routetbl.Defaultgw(me, gw)
+	Routetbl.Insert_local(me, me&netmask, netmask)
+	Routetbl.Dump()
+	return me, true
+}
+
 // network stack processing begins here. pkt references DMA memory and will be
 // clobbered once net_start returns to the caller.
 func Net_start(pkt [][]uint8, tlen int) {
@@ -3683,6 +3733,7 @@ func Net_init(pm mem.Page_i) {
 
 	nics.m = new(map[Ip4_t]nic_i)
 	*nics.m = make(map[Ip4_t]nic_i)
+	devfs.Major(defs.D_NIC, nicopen)
 	arptbl.m = make(map[Ip4_t]*arprec_t)
 	arptbl.waiters = make(map[Ip4_t][]chan bool)
 	arptbl.enttimeout = 20 * time.Minute
@@ -0,0 +1,177 @@
+package bnet
+
+import "sync"
+
+import "defs"
+import "devfs"
+import "fdops"
+import "mem"
+import "stat"
+
+import . "inet"
+
+// the device files of the NICs, which read as the NIC's MAC address
+var nicdevs struct {
+	sync.Mutex
+	// by minor device number
+	l     []nic_i
+	names map[string]int
+}
+
+// Nic_attach registers the device file name for the NIC n
+func Nic_attach(name string, n nic_i) defs.Err_t {
+	nicdevs.Lock()
+	defer nicdevs.Unlock()
+
+	if nicdevs.names == nil {
+		nicdevs.names = make(map[string]int)
+	}
+	if _, ok := nicdevs.names[name]; ok {
+		return -defs.EEXIST
+	}
+	min := len(nicdevs.l)
+	if min > 0xff {
+		return -defs.ENOMEM
+	}
+	if err := devfs.Register(name, defs.D_NIC, min); err != 0 {
+		return err
+	}
+	nicdevs.l = append(nicdevs.l, n)
+	nicdevs.names[name] = min
+	return 0
+}
+
+func nicopen(min int) (fdops.Fdops_i, defs.Err_t) {
+	nicdevs.Lock()
+	defer nicdevs.Unlock()
+
+	if min >= len(nicdevs.l) {
+		return nil, -defs.ENXIO
+	}
+	return &nicfops_t{nic: nicdevs.l[min], minor: min}, 0
+}
+
+type nicfops_t struct {
+	nic   nic_i
+	minor int
+	// protects offset
+	sync.Mutex
+	offset int
+}
+
+func (nf *nicfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	nf.Lock()
+	defer nf.Unlock()
+
+	s := []uint8(Mac2str(nf.nic.Lmac()[:]) + "\n")
+	if nf.offset >= len(s) {
+		return 0, 0
+	}
+	did, err := dst.Uiowrite(s[nf.offset:])
+	nf.offset += did
+	return did, err
+}
+
+func (nf *nicfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EINVAL
+}
+
+func (nf *nicfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (nf *nicfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (nf *nicfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (nf *nicfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (nf *nicfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (nf *nicfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (nf *nicfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (nf *nicfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(defs.D_NIC, nf.minor))
+	return 0
+}
+
+func (nf *nicfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (nf *nicfops_t) Pathi() defs.Inum_t {
+	panic("bad cwd")
+}
+
+func (nf *nicfops_t) Close() defs.Err_t {
+	return 0
+}
+
+func (nf *nicfops_t) Reopen() defs.Err_t {
+	return 0
+}
+
+func (nf *nicfops_t) Lseek(int, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (nf *nicfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & fdops.R_READ, 0
+}
+
+func (nf *nicfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (nf *nicfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (nf *nicfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
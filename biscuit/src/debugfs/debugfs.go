@@ -0,0 +1,383 @@
+package main
+
+import "os"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "bufio"
+import "sort"
+import "strings"
+import "path/filepath"
+import "archive/tar"
+import "time"
+
+import "defs"
+import "fs"
+import "mem"
+import "stat"
+import "ufs"
+import "ustr"
+import "util"
+
+// Inspects and changes an existing disk image. With a command after the image,
+// runs just that command, exiting with status 1 if it fails; otherwise reads
+// commands from stdin.
+
+// bytes copied into the image per append
+const chunk = 16 * fs.BSIZE
+
+type cmd_t struct {
+	// the minimum and maximum number of arguments
+	min   int
+	max   int
+	usage string
+	f     func(*ufs.Ufs_t, []string) error
+}
+
+var cmds = map[string]cmd_t{
+	"ls":     {0, 1, "ls [path]", ls},
+	"stat":   {1, 1, "stat <path>", dostat},
+	"cat":    {1, 1, "cat <path>", cat},
+	"cpin":   {2, 2, "cpin <host file> <path>", cpin},
+	"cpout":  {2, 2, "cpout <path> <host file>", cpout},
+	"rm":     {1, 1, "rm <path>", rm},
+	"mkdir":  {1, 1, "mkdir <path>", mkdir},
+	"export": {2, 2, "export <path> <host dir>", export},
+	"tar":    {2, 2, "tar <path> <host tar file>", dotar},
+	"super":  {0, 0, "super", super},
+}
+
+func ferr(p string, err defs.Err_t) error {
+	return fmt.Errorf("%v: error %v", p, err)
+}
+
+func isdir(st *stat.Stat_t) bool {
+	return st.Mode() == stat.S_IFDIR
+}
+
+func isreg(st *stat.Stat_t) bool {
+	return st.Mode() == stat.S_IFREG
+}
+
+func modestr(st *stat.Stat_t) string {
+	switch {
+	case isdir(st):
+		return "dir"
+	case isreg(st):
+		return "file"
+	default:
+		maj, min := defs.Unmkdev(st.Mode())
+		return fmt.Sprintf("dev %v,%v", maj, min)
+	}
+}
+
+// returns the names in directory p, sorted
+func names(f *ufs.Ufs_t, p string) ([]string, map[string]*stat.Stat_t, error) {
+	d, err := f.Ls(ustr.Ustr(p))
+	if err != 0 {
+		return nil, nil, ferr(p, err)
+	}
+	var ns []string
+	for n := range d {
+		if n != "." && n != ".." {
+			ns = append(ns, n)
+		}
+	}
+	sort.Strings(ns)
+	return ns, d, nil
+}
+
+func ls(f *ufs.Ufs_t, args []string) error {
+	p := "/"
+	if len(args) > 0 {
+		p = args[0]
+	}
+	ns, d, err := names(f, p)
+	if err != nil {
+		return err
+	}
+	for _, n := range ns {
+		st := d[n]
+		fmt.Printf("%6v %-10v %10v %v\n", st.Rino(), modestr(st), st.Size(), n)
+	}
+	return nil
+}
+
+func dostat(f *ufs.Ufs_t, args []string) error {
+	st, err := f.Stat(ustr.Ustr(args[0]))
+	if err != 0 {
+		return ferr(args[0], err)
+	}
+	fmt.Printf("inode %v\ntype %v\nsize %v\nblocks %v\n", st.Rino(),
+		modestr(st), st.Size(), st.Blocks())
+	return nil
+}
+
+func cat(f *ufs.Ufs_t, args []string) error {
+	d, err := f.Read(ustr.Ustr(args[0]))
+	if err != 0 {
+		return ferr(args[0], err)
+	}
+	os.Stdout.Write(d)
+	return nil
+}
+
+// copies the host file src to p, replacing p
+func cpin(f *ufs.Ufs_t, args []string) error {
+	src, p := args[0], ustr.Ustr(args[1])
+	h, uerr := os.Open(src)
+	if uerr != nil {
+		return uerr
+	}
+	defer h.Close()
+	if st, err := f.Stat(p); err == 0 {
+		if !isreg(st) {
+			return fmt.Errorf("%v: not a file", p)
+		}
+		if err := f.Unlink(p); err != 0 {
+			return ferr(args[1], err)
+		}
+	}
+	if err := f.MkFile(p, nil); err != 0 {
+		return ferr(args[1], err)
+	}
+	b := make([]byte, chunk)
+	for {
+		n, uerr := io.ReadFull(h, b)
+		if n > 0 {
+			if err := f.Append(p, ufs.MkBuf(b[:n])); err != 0 {
+				return ferr(args[1], err)
+			}
+		}
+		if uerr == io.EOF || uerr == io.ErrUnexpectedEOF {
+			return nil
+		} else if uerr != nil {
+			return uerr
+		}
+	}
+}
+
+func cpout(f *ufs.Ufs_t, args []string) error {
+	d, err := f.Read(ustr.Ustr(args[0]))
+	if err != 0 {
+		return ferr(args[0], err)
+	}
+	return ioutil.WriteFile(args[1], d, 0644)
+}
+
+func rm(f *ufs.Ufs_t, args []string) error {
+	p := ustr.Ustr(args[0])
+	st, err := f.Stat(p)
+	if err != 0 {
+		return ferr(args[0], err)
+	}
+	if isdir(st) {
+		err = f.UnlinkDir(p)
+	} else {
+		err = f.Unlink(p)
+	}
+	if err != 0 {
+		return ferr(args[0], err)
+	}
+	return nil
+}
+
+func mkdir(f *ufs.Ufs_t, args []string) error {
+	if err := f.MkDir(ustr.Ustr(args[0])); err != 0 {
+		return ferr(args[0], err)
+	}
+	return nil
+}
+
+// calls visit with the path of each file and directory in the tree at p,
+// relative to p, parents before children
+func walk(f *ufs.Ufs_t, p, rel string, st *stat.Stat_t, visit func(string, string, *stat.Stat_t) error) error {
+	if err := visit(p, rel, st); err != nil {
+		return err
+	}
+	if !isdir(st) {
+		return nil
+	}
+	ns, d, err := names(f, p)
+	if err != nil {
+		return err
+	}
+	for _, n := range ns {
+		if err := walk(f, p+"/"+n, rel+"/"+n, d[n], visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tree(f *ufs.Ufs_t, p string, visit func(string, string, *stat.Stat_t) error) error {
+	st, err := f.Stat(ustr.Ustr(p))
+	if err != 0 {
+		return ferr(p, err)
+	}
+	return walk(f, strings.TrimRight(p, "/"), ".", st, visit)
+}
+
+func export(f *ufs.Ufs_t, args []string) error {
+	return tree(f, args[0], func(p, rel string, st *stat.Stat_t) error {
+		dst := filepath.Join(args[1], rel)
+		switch {
+		case isdir(st):
+			return os.MkdirAll(dst, 0755)
+		case isreg(st):
+			d, err := f.Read(ustr.Ustr(p))
+			if err != 0 {
+				return ferr(p, err)
+			}
+			return ioutil.WriteFile(dst, d, 0644)
+		default:
+			fmt.Printf("skipping device %v\n", p)
+			return nil
+		}
+	})
+}
+
+func dotar(f *ufs.Ufs_t, args []string) error {
+	h, uerr := os.Create(args[1])
+	if uerr != nil {
+		return uerr
+	}
+	defer h.Close()
+	tw := tar.NewWriter(h)
+	err := tree(f, args[0], func(p, rel string, st *stat.Stat_t) error {
+		hdr := &tar.Header{Name: rel, ModTime: time.Unix(0, 0)}
+		var d []byte
+		switch {
+		case isdir(st):
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0755
+		case isreg(st):
+			var err defs.Err_t
+			if d, err = f.Read(ustr.Ustr(p)); err != 0 {
+				return ferr(p, err)
+			}
+			hdr.Typeflag = tar.TypeReg
+			hdr.Mode = 0644
+			hdr.Size = int64(len(d))
+		default:
+			fmt.Printf("skipping device %v\n", p)
+			return nil
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(d)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+var image string
+
+func super(f *ufs.Ufs_t, args []string) error {
+	h, uerr := os.Open(image)
+	if uerr != nil {
+		return uerr
+	}
+	defer h.Close()
+	b := make([]byte, fs.BSIZE)
+	if _, uerr := h.ReadAt(b, 0); uerr != nil {
+		return uerr
+	}
+	start := util.Readn(b, 4, fs.FSOFF)
+	d := &fs.Superblock_t{Data: &mem.Bytepg_t{}}
+	if _, uerr := h.ReadAt(d.Data[:], int64(start*fs.BSIZE)); uerr != nil {
+		return uerr
+	}
+	fmt.Printf("superblock at block %v, format version %v\n", start,
+		d.Version())
+	fmt.Printf("log: blocks %v-%v\n", start+1, start+d.Loglen())
+	fmt.Printf("orphan map: blocks %v-%v\n", d.Iorphanblock(),
+		d.Iorphanblock()+d.Iorphanlen()-1)
+	imap := d.Iorphanblock() + d.Iorphanlen()
+	fmt.Printf("inode map: blocks %v-%v\n", imap, imap+d.Imaplen()-1)
+	fmt.Printf("reference map: blocks %v-%v\n", d.Refmapblock(),
+		d.Refmapblock()+d.Refmaplen()-1)
+	fmt.Printf("block map: blocks %v-%v\n", d.Freeblock(),
+		d.Freeblock()+d.Freeblocklen()-1)
+	ifirst := d.Freeblock() + d.Freeblocklen()
+	fmt.Printf("inodes: blocks %v-%v, %v inodes\n", ifirst,
+		ifirst+d.Inodelen()-1, d.Inodelen()*fs.IPERBLK)
+	dfirst := ifirst + d.Inodelen()
+	fmt.Printf("data: blocks %v-%v\n", dfirst, d.Lastblock()-1)
+	for g := 0; g < d.Ngroups(); g++ {
+		n, nl := d.Grouplen(g), d.Groupinodelen(g)
+		fmt.Printf("group %v: blocks %v-%v, %v map blocks, %v inodes\n", g,
+			d.Groupstart(g), d.Groupstart(g)+n-1, n-nl, nl*fs.IPERBLK)
+	}
+	ni, nb := f.Free()
+	fmt.Printf("free: %v inodes, %v blocks\n", ni, nb)
+	fmt.Printf("%v", f.Statistics())
+	return nil
+}
+
+// runs the command in args, returning false if it fails
+func run(f *ufs.Ufs_t, args []string) bool {
+	c, ok := cmds[args[0]]
+	if !ok {
+		var cs []string
+		for n := range cmds {
+			cs = append(cs, n)
+		}
+		sort.Strings(cs)
+		fmt.Printf("commands: %v\n", strings.Join(cs, " "))
+		return false
+	}
+	if len(args)-1 < c.min || len(args)-1 > c.max {
+		fmt.Printf("usage: %v\n", c.usage)
+		return false
+	}
+	if err := c.f(f, args[1:]); err != nil {
+		fmt.Printf("%v: %v\n", args[0], err)
+		return false
+	}
+	return true
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Printf("Usage: debugfs <image> [command args...]\n")
+		os.Exit(1)
+	}
+	image = os.Args[1]
+	if _, err := os.Stat(image); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	f := ufs.BootFS(image)
+	if len(os.Args) > 2 {
+		ok := run(f, os.Args[2:])
+		ufs.ShutdownFS(f)
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	defer ufs.ShutdownFS(f)
+
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("debugfs> ")
+		if !in.Scan() {
+			fmt.Printf("\n")
+			return
+		}
+		args := strings.Fields(in.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "q" {
+			return
+		}
+		run(f, args)
+	}
+}
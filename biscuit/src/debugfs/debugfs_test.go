@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "os"
+
+import "ufs"
+
+func TestRun(t *testing.T) {
+	dst := "tmp.img"
+	ufs.MkDisk(dst, nil, 32, 1, 40)
+	defer os.Remove(dst)
+	image = dst
+
+	fmt.Printf("Test Run %v ...\n", dst)
+
+	data := bytes.Repeat([]byte("debugfs"), (chunk+chunk/2)/7)
+	if err := ioutil.WriteFile("tmp.in", data, 0644); err != nil {
+		t.Fatalf("write tmp.in: %v", err)
+	}
+	defer os.Remove("tmp.in")
+	defer os.Remove("tmp.out")
+
+	f := ufs.BootFS(dst)
+	for _, c := range [][]string{
+		{"mkdir", "d"},
+		{"cpin", "tmp.in", "d/f"},
+		{"ls", "d"},
+		{"stat", "d/f"},
+		{"super"},
+	} {
+		if !run(f, c) {
+			t.Fatalf("%v failed", c)
+		}
+	}
+	for _, c := range [][]string{
+		{"nosuchcmd"},
+		{"stat"},
+		{"cat", "nosuchfile"},
+		{"rm", "d/g"},
+	} {
+		if run(f, c) {
+			t.Fatalf("%v succeeded", c)
+		}
+	}
+	ufs.ShutdownFS(f)
+
+	// the image holds the file after a remount
+	f = ufs.BootFS(dst)
+	if !run(f, []string{"cpout", "d/f", "tmp.out"}) {
+		t.Fatalf("cpout failed")
+	}
+	ufs.ShutdownFS(f)
+	d, err := ioutil.ReadFile("tmp.out")
+	if err != nil || !bytes.Equal(d, data) {
+		t.Fatalf("cpout: %v, %v of %v bytes", err, len(d), len(data))
+	}
+}
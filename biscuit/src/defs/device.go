@@ -9,6 +9,8 @@ const (
 	D_RAWDISK = 5
 	D_STAT    = 6
 	D_PROF    = 7
+	D_NIC     = 8
+	D_LOOP    = 9
 	D_FIRST   = D_CONSOLE
 	D_LAST    = D_SUS
 )
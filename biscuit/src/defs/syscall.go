@@ -35,6 +35,8 @@ const (
 	SEEK_SET            = 0x1
 	SEEK_CUR            = 0x2
 	SEEK_END            = 0x4
+	SEEK_DATA           = 0x8
+	SEEK_HOLE           = 0x10
 	SYS_MMAP            = 9
 	MAP_SHARED          = uint(0x1)
 	MAP_PRIVATE         = uint(0x2)
@@ -47,6 +49,10 @@ const (
 	PROT_EXEC           = 0x4
 	SYS_MUNMAP          = 11
 	SYS_SIGACT          = 13
+	SYS_IOCTL           = 16
+	LOOP_SET_FD         = 0x4c00
+	LOOP_CLR_FD         = 0x4c01
+	FS_IOC_GROW         = 0x6610
 	SYS_READV           = 19
 	SYS_WRITEV          = 20
 	SYS_ACCESS          = 21
@@ -85,54 +91,81 @@ const (
 	// socket levels
 	SOL_SOCKET = 1
 	// socket options
-	SO_SNDBUF        = 1
-	SO_SNDTIMEO      = 2
-	SO_ERROR         = 3
-	SO_RCVBUF        = 5
-	SO_NAME          = 10
-	SO_PEER          = 11
-	SYS_FORK         = 57
-	FORK_PROCESS     = 0x1
-	FORK_THREAD      = 0x2
-	SYS_EXECV        = 59
-	SYS_EXIT         = 60
-	CONTINUED        = 1 << 9
-	EXITED           = 1 << 10
-	SIGNALED         = 1 << 11
-	SIGSHIFT         = 27
-	SYS_WAIT4        = 61
-	WAIT_ANY         = -1
-	WAIT_MYPGRP      = 0
-	WCONTINUED       = 1
-	WNOHANG          = 2
-	WUNTRACED        = 4
-	SYS_KILL         = 62
-	SYS_FCNTL        = 72
-	F_GETFL          = 1
-	F_SETFL          = 2
-	F_GETFD          = 3
-	F_SETFD          = 4
-	SYS_TRUNC        = 76
-	SYS_FTRUNC       = 77
-	SYS_GETCWD       = 79
-	SYS_CHDIR        = 80
-	SYS_RENAME       = 82
-	SYS_MKDIR        = 83
-	SYS_LINK         = 86
-	SYS_UNLINK       = 87
-	SYS_GETTOD       = 96
-	SYS_GETRLMT      = 97
-	RLIMIT_NOFILE    = 1
-	RLIM_INFINITY    = ^uint(0)
-	SYS_GETRUSG      = 98
-	RUSAGE_SELF      = 1
-	RUSAGE_CHILDREN  = 2
-	SYS_MKNOD        = 133
-	SYS_SETRLMT      = 160
-	SYS_SYNC         = 162
-	SYS_REBOOT       = 169
-	SYS_NANOSLEEP    = 230
-	SYS_PIPE2        = 293
+	SO_SNDBUF       = 1
+	SO_SNDTIMEO     = 2
+	SO_ERROR        = 3
+	SO_RCVBUF       = 5
+	SO_NAME         = 10
+	SO_PEER         = 11
+	SYS_FORK        = 57
+	FORK_PROCESS    = 0x1
+	FORK_THREAD     = 0x2
+	SYS_EXECV       = 59
+	SYS_EXIT        = 60
+	CONTINUED       = 1 << 9
+	EXITED          = 1 << 10
+	SIGNALED        = 1 << 11
+	SIGSHIFT        = 27
+	SYS_WAIT4       = 61
+	WAIT_ANY        = -1
+	WAIT_MYPGRP     = 0
+	WCONTINUED      = 1
+	WNOHANG         = 2
+	WUNTRACED       = 4
+	SYS_KILL        = 62
+	SYS_FCNTL       = 72
+	F_GETFL         = 1
+	F_SETFL         = 2
+	F_GETFD         = 3
+	F_SETFD         = 4
+	F_SETLK         = 5
+	F_SETLKW        = 6
+	F_GETLK         = 8
+	F_RDLCK         = 0
+	F_WRLCK         = 1
+	F_UNLCK         = 2
+	SYS_FLOCK       = 73
+	LOCK_SH         = 0x1
+	LOCK_EX         = 0x2
+	LOCK_NB         = 0x4
+	LOCK_UN         = 0x8
+	SYS_FSYNC       = 74
+	SYS_FDATASYNC   = 75
+	SYS_TRUNC       = 76
+	SYS_FTRUNC      = 77
+	SYS_GETCWD      = 79
+	SYS_CHDIR       = 80
+	SYS_RENAME      = 82
+	SYS_MKDIR       = 83
+	SYS_LINK        = 86
+	SYS_UNLINK      = 87
+	SYS_GETTOD      = 96
+	SYS_GETRLMT     = 97
+	RLIMIT_NOFILE   = 1
+	RLIM_INFINITY   = ^uint(0)
+	SYS_GETRUSG     = 98
+	RUSAGE_SELF     = 1
+	RUSAGE_CHILDREN = 2
+	SYS_MKNOD       = 133
+	SYS_SETRLMT     = 160
+	SYS_SYNC        = 162
+	SYS_MOUNT       = 165
+	SYS_UMOUNT2     = 166
+	SYS_REBOOT      = 169
+	SYS_NANOSLEEP   = 230
+	SYS_OPENAT      = 257
+	SYS_MKDIRAT     = 258
+	SYS_MKNODAT     = 259
+	SYS_FSTATAT     = 262
+	SYS_UNLINKAT    = 263
+	SYS_RENAMEAT    = 264
+	SYS_LINKAT      = 265
+	SYS_FACCESSAT   = 269
+	SYS_FALLOCATE   = 285
+	SYS_PIPE2       = 293
+	// copies between files, sharing their aligned blocks
+	SYS_COPY_FILE_RANGE = 326
+	// biscuit's own syscalls
 	SYS_PROF         = 31337
 	PROF_DISABLE     = 1 << 0
 	PROF_GOLANG      = 1 << 1
@@ -164,6 +197,20 @@ const (
 	FUTEX_WAKE       = 2
 	FUTEX_CNDGIVE    = 3
 	SYS_GETTID       = 31343
+	SYS_CRYPTSETUP   = 31344
+)
+
+const (
+	// flags for the *at syscalls
+	AT_FDCWD            = -100
+	AT_SYMLINK_NOFOLLOW = 0x100
+	AT_REMOVEDIR        = 0x200
+	AT_EACCESS          = 0x200
+	AT_SYMLINK_FOLLOW   = 0x400
+	// fallocate modes
+	FALLOC_FL_KEEP_SIZE = 0x1
+	// must be combined with FALLOC_FL_KEEP_SIZE
+	FALLOC_FL_PUNCH_HOLE = 0x2
 )
 
 const (
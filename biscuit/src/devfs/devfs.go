@@ -0,0 +1,513 @@
+package devfs
+
+import "sync"
+
+import "bpath"
+import "defs"
+import "fd"
+import "fdops"
+import "fs"
+import "mem"
+import "stat"
+import "ustr"
+import "util"
+
+// The device file system, mounted at /dev. Drivers register the device files
+// of the devices they attach by name and device number, and unregister them
+// when the devices detach; the subsystem implementing a major device number
+// installs the function that opens its devices. The file system is a single
+// directory of the registered devices, which reads like a ufs directory.
+
+type dev_t struct {
+	name  ustr.Ustr
+	inum  defs.Inum_t
+	major int
+	minor int
+}
+
+const rootinum = defs.Inum_t(1)
+
+var devs struct {
+	sync.Mutex
+	// in the order of registration; unregistered devices leave empty
+	// slots until reused so that the directory offsets of the others
+	// don't change.
+	l        []*dev_t
+	nextinum defs.Inum_t
+	opens    map[int]func(int) (fdops.Fdops_i, defs.Err_t)
+}
+
+// the caller holds the devs lock
+func lookup(name ustr.Ustr) (int, *dev_t) {
+	for i, d := range devs.l {
+		if d != nil && d.name.Eq(name) {
+			return i, d
+		}
+	}
+	return -1, nil
+}
+
+// Register adds the device file name for the device major/minor.
+func Register(name string, major, minor int) defs.Err_t {
+	n := ustr.Ustr(name)
+	if err, ok := crname(n); !ok {
+		return err
+	}
+	devs.Lock()
+	defer devs.Unlock()
+
+	if _, d := lookup(n); d != nil {
+		return -defs.EEXIST
+	}
+	if devs.nextinum == 0 {
+		devs.nextinum = rootinum
+	}
+	devs.nextinum++
+	d := &dev_t{name: n, inum: devs.nextinum, major: major, minor: minor}
+	for i := range devs.l {
+		if devs.l[i] == nil {
+			devs.l[i] = d
+			return 0
+		}
+	}
+	devs.l = append(devs.l, d)
+	return 0
+}
+
+// Unregister removes the device file name. files already open on the device
+// stay open.
+func Unregister(name string) defs.Err_t {
+	devs.Lock()
+	defer devs.Unlock()
+
+	i, d := lookup(ustr.Ustr(name))
+	if d == nil {
+		return -defs.ENOENT
+	}
+	devs.l[i] = nil
+	return 0
+}
+
+// Major installs open as the function that opens the devices with the major
+// device number major, given their minor device numbers.
+func Major(major int, open func(int) (fdops.Fdops_i, defs.Err_t)) {
+	devs.Lock()
+	defer devs.Unlock()
+
+	if devs.opens == nil {
+		devs.opens = make(map[int]func(int) (fdops.Fdops_i, defs.Err_t))
+	}
+	devs.opens[major] = open
+}
+
+func crname(name ustr.Ustr) (defs.Err_t, bool) {
+	if len(name) == 0 || name.Isdot() || name.Isdotdot() ||
+		name.IndexByte('/') != -1 {
+		return -defs.EINVAL, false
+	}
+	if len(name) > fs.DNAMELEN {
+		return -defs.ENAMETOOLONG, false
+	}
+	return 0, true
+}
+
+// the caller holds the devs lock
+func dirsize() int {
+	return util.Roundup(len(devs.l)+2, fs.NDIRENTS) / fs.NDIRENTS * fs.BSIZE
+}
+
+type Devfs_t struct {
+	sync.Mutex
+	// number of open directories, including cwds
+	nopen int
+}
+
+func MkDevfs() *Devfs_t {
+	return &Devfs_t{}
+}
+
+// returns the device at paths, or nil for the directory. since the file
+// system has a single directory, the cwd, if in it, is the directory. the
+// caller holds the devs lock.
+func namei(paths ustr.Ustr) (*dev_t, defs.Err_t) {
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	var d *dev_t
+	for c, ok := pp.Next(); ok; c, ok = pp.Next() {
+		if d != nil {
+			return nil, -defs.ENOTDIR
+		}
+		if c.Isdot() || c.Isdotdot() {
+			continue
+		}
+		if _, d = lookup(c); d == nil {
+			return nil, -defs.ENOENT
+		}
+	}
+	return d, 0
+}
+
+func (dfs *Devfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	devs.Lock()
+	d, err := namei(paths)
+	var open func(int) (fdops.Fdops_i, defs.Err_t)
+	if d != nil {
+		open = devs.opens[d.major]
+	}
+	devs.Unlock()
+
+	creat := flags&defs.O_CREAT != 0
+	if err != 0 {
+		// device files are only created by drivers
+		if err == -defs.ENOENT && creat {
+			return nil, -defs.EPERM
+		}
+		return nil, err
+	}
+	if creat && flags&defs.O_EXCL != 0 {
+		return nil, -defs.EEXIST
+	}
+	if d == nil {
+		if creat || flags&(defs.O_WRONLY|defs.O_RDWR) != 0 {
+			return nil, -defs.EISDIR
+		}
+		dfs.Lock()
+		dfs.nopen++
+		dfs.Unlock()
+		return &fd.Fd_t{Fops: &dirfops_t{dfs: dfs, count: 1}}, 0
+	}
+	if flags&defs.O_DIRECTORY != 0 {
+		return nil, -defs.ENOTDIR
+	}
+	if open == nil {
+		return nil, -defs.ENXIO
+	}
+	fops, err := open(d.minor)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Fd_t{Fops: fops}, 0
+}
+
+func (dfs *Devfs_t) Fs_mknod(paths ustr.Ustr, excl bool, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	devs.Lock()
+	defer devs.Unlock()
+
+	if _, err := namei(paths); err == 0 {
+		return 0, -defs.EEXIST
+	} else if err != -defs.ENOENT {
+		return 0, err
+	}
+	return 0, -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	devs.Lock()
+	defer devs.Unlock()
+
+	d, err := namei(paths)
+	if err != 0 {
+		return err
+	}
+	dstat(d, st)
+	return 0
+}
+
+// the caller holds the devs lock
+func dstat(d *dev_t, st *stat.Stat_t) {
+	st.Wdev(0)
+	if d == nil {
+		st.Wino(uint(rootinum))
+		st.Wmode(stat.S_IFDIR)
+		st.Wsize(uint(dirsize()))
+		return
+	}
+	st.Wino(uint(d.inum))
+	st.Wmode(defs.Mkdev(d.major, d.minor))
+	st.Wrdev(defs.Mkdev(d.major, d.minor))
+}
+
+func (dfs *Devfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	devs.Lock()
+	defer devs.Unlock()
+
+	if _, err := namei(paths); err == 0 {
+		return -defs.EEXIST
+	}
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	devs.Lock()
+	defer devs.Unlock()
+
+	if _, err := namei(paths); err != 0 {
+		return err
+	}
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_linkat(old ustr.Ustr, ocwd *fd.Cwd_t, new ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_renameat(oldp ustr.Ustr, ocwd *fd.Cwd_t, newp ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_atcwd(f *fd.Fd_t) (*fd.Cwd_t, defs.Err_t) {
+	fo, ok := f.Fops.(*dirfops_t)
+	if !ok || fo.dfs != dfs {
+		return nil, -defs.ENOTDIR
+	}
+	nf, err := fd.Copyfd(f)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Cwd_t{Fd: nf}, 0
+}
+
+func (dfs *Devfs_t) Fs_owns(f *fd.Fd_t) bool {
+	fo, ok := f.Fops.(*dirfops_t)
+	return ok && fo.dfs == dfs
+}
+
+func (dfs *Devfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &dirfops_t{dfs: dfs, count: 0}}
+	return fd.MkRootCwd(f)
+}
+
+func (dfs *Devfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+// the devices stay registered
+func (dfs *Devfs_t) Fs_unmount() defs.Err_t {
+	dfs.Lock()
+	defer dfs.Unlock()
+
+	if dfs.nopen != 0 {
+		return -defs.EBUSY
+	}
+	return 0
+}
+
+// the directory open as a file
+type dirfops_t struct {
+	dfs *Devfs_t
+	// protects offset
+	sync.Mutex
+	offset int
+	count  int
+}
+
+// copies the directory, in the ufs directory format, starting at offset to
+// dst.
+func dirread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	devs.Lock()
+	defer devs.Unlock()
+
+	buf := make([]uint8, fs.BSIZE)
+	dd := &fs.Dirdata_t{Data: buf}
+	size := dirsize()
+	c := 0
+	for offset < size && dst.Remain() != 0 {
+		for i := range buf {
+			buf[i] = 0
+		}
+		for i := 0; i < fs.NDIRENTS; i++ {
+			slot := offset/fs.BSIZE*fs.NDIRENTS + i
+			switch {
+			case slot == 0:
+				dd.W_filename(i, ustr.MkUstrDot())
+				dd.W_inodenext(i, rootinum)
+			case slot == 1:
+				dd.W_filename(i, ustr.DotDot)
+				dd.W_inodenext(i, rootinum)
+			case slot-2 < len(devs.l) && devs.l[slot-2] != nil:
+				dd.W_filename(i, devs.l[slot-2].name)
+				dd.W_inodenext(i, devs.l[slot-2].inum)
+			}
+		}
+		wrote, err := dst.Uiowrite(buf[offset%fs.BSIZE:])
+		c += wrote
+		offset += wrote
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+func (fo *dirfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	useoffset := toff != -1
+	offset := fo.offset
+	if useoffset {
+		offset = toff
+	}
+	did, err := dirread(dst, offset)
+	if !useoffset && err == 0 {
+		fo.offset += did
+	}
+	return did, err
+}
+
+func (fo *dirfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return fo._read(dst, -1)
+}
+
+func (fo *dirfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return fo._read(dst, offset)
+}
+
+func (fo *dirfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (fo *dirfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (fo *dirfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (fo *dirfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.EISDIR
+}
+
+func (fo *dirfops_t) Fsync(datasync bool) defs.Err_t {
+	return 0
+}
+
+func (fo *dirfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (fo *dirfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (fo *dirfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	devs.Lock()
+	dstat(nil, st)
+	devs.Unlock()
+	return 0
+}
+
+func (fo *dirfops_t) Close() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.count--
+	fo.dfs.Lock()
+	fo.dfs.nopen--
+	fo.dfs.Unlock()
+	return 0
+}
+
+func (fo *dirfops_t) Pathi() defs.Inum_t {
+	return rootinum
+}
+
+func (fo *dirfops_t) Reopen() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.count++
+	fo.dfs.Lock()
+	fo.dfs.nopen++
+	fo.dfs.Unlock()
+	return 0
+}
+
+func (fo *dirfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		fo.offset = off
+	case defs.SEEK_CUR:
+		fo.offset += off
+	case defs.SEEK_END:
+		devs.Lock()
+		fo.offset = dirsize() + off
+		devs.Unlock()
+	default:
+		return 0, -defs.EINVAL
+	}
+	if fo.offset < 0 {
+		fo.offset = 0
+	}
+	return fo.offset, 0
+}
+
+func (fo *dirfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (fo *dirfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
+}
+
+func (fo *dirfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (fo *dirfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *dirfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -0,0 +1,601 @@
+package e1000
+
+import "fmt"
+import "runtime"
+import "sync"
+import "sync/atomic"
+import "unsafe"
+
+import "apic"
+import "bnet"
+import "bounds"
+import "defs"
+import . "inet"
+import "mem"
+import "pci"
+import "res"
+
+const e1000_debug = false
+
+func dbg(x string, args ...interface{}) {
+	if e1000_debug {
+		fmt.Printf(x, args...)
+	}
+}
+
+//
+// Intel 8254x/8257x gigabit NICs: the 82540EM that QEMU emulates as "e1000"
+// and the 82574L that it emulates as "e1000e". one receive and one transmit
+// ring of descriptors; every transmitted frame starts with a context
+// descriptor describing its headers so that the NIC computes the IPv4 and TCP
+// checksums and, for large TCP frames, segments them. frames are copied to
+// and from pages of the driver. the 82574L interrupts through MSI(-X); the
+// 82540EM has neither and interrupts through the IOAPIC.
+//
+// - 8254x Family of Gigabit Ethernet Controllers Software Developer's Manual
+// - 82574 GbE Controller Family Datasheet
+//
+
+const (
+	PCI_DEV_82540EM = 0x100e
+	PCI_DEV_82574L  = 0x10d3
+)
+
+// registers
+const (
+	CTRL   = 0x0000
+	STATUS = 0x0008
+	EERD   = 0x0014
+	ICR    = 0x00c0
+	ITR    = 0x00c4
+	IMS    = 0x00d0
+	IMC    = 0x00d8
+	IVAR   = 0x00e4
+	RCTL   = 0x0100
+	TCTL   = 0x0400
+	TIPG   = 0x0410
+	RDBAL  = 0x2800
+	RDBAH  = 0x2804
+	RDLEN  = 0x2808
+	RDH    = 0x2810
+	RDT    = 0x2818
+	TDBAL  = 0x3800
+	TDBAH  = 0x3804
+	TDLEN  = 0x3808
+	TDH    = 0x3810
+	TDT    = 0x3818
+	RXCSUM = 0x5000
+	MTA    = 0x5200
+	RAL0   = 0x5400
+	RAH0   = 0x5404
+)
+
+const (
+	CTRL_ASDE = 1 << 5
+	CTRL_SLU  = 1 << 6
+	CTRL_RST  = 1 << 26
+
+	STATUS_LU = 1 << 1
+
+	RCTL_EN    = 1 << 1
+	RCTL_BAM   = 1 << 15
+	RCTL_SECRC = 1 << 26
+
+	TCTL_EN  = 1 << 1
+	TCTL_PSP = 1 << 3
+	// collision threshold and distance, for full duplex
+	TCTL_CT   = 0x0f << 4
+	TCTL_COLD = 0x40 << 12
+
+	RXCSUM_IPOFLD = 1 << 8
+	RXCSUM_TUOFLD = 1 << 9
+
+	RAH_AV = 1 << 31
+)
+
+// interrupt causes
+const (
+	ICR_TXDW   = 1 << 0
+	ICR_LSC    = 1 << 2
+	ICR_RXDMT0 = 1 << 4
+	ICR_RXO    = 1 << 6
+	ICR_RXT0   = 1 << 7
+)
+
+// receive descriptor status and errors
+const (
+	RXD_STAT_DD   = 1 << 0
+	RXD_STAT_EOP  = 1 << 1
+	RXD_STAT_IXSM = 1 << 2
+	RXD_ERR_TCPE  = 1 << 5
+	RXD_ERR_IPE   = 1 << 6
+)
+
+// the command bits of transmit descriptors, in the second quadword
+const (
+	TXD_EOP  uint64 = 1 << 24
+	TXD_IFCS uint64 = 1 << 25
+	TXD_TSE  uint64 = 1 << 26
+	TXD_RS   uint64 = 1 << 27
+	TXD_DEXT uint64 = 1 << 29
+	// descriptor types of extended descriptors
+	TXD_CTXT uint64 = 0 << 20
+	TXD_DATA uint64 = 1 << 20
+	// context descriptor TUCMD
+	TXD_TCP uint64 = 1 << 24
+	TXD_IP  uint64 = 1 << 25
+	// data descriptor POPTS
+	TXD_IXSM uint64 = 1 << 40
+	TXD_TXSM uint64 = 1 << 41
+	TXD_DD   uint64 = 1 << 32
+)
+
+const (
+	nrxdescs = 128
+	ntxdescs = 128
+	// receive buffers hold a maximum size frame
+	rxbufsz = 2048
+)
+
+// a descriptor, in either ring
+type desc_t struct {
+	addr uint64
+	rest uint64
+}
+
+type e1000_t struct {
+	tag  pci.Pcitag_t
+	did  int
+	regs []uint32
+	mac  Mac_t
+	ip   Ip4_t
+	// the IOAPIC pin of the NIC's interrupts, or -1 if it uses MSI
+	pin int
+	// drop received frames whose checksums the NIC found bad
+	rxcsum bool
+	rx     struct {
+		descs *[nrxdescs]desc_t
+		pa    [nrxdescs]mem.Pa_t
+		// the next descriptor the NIC fills
+		next int
+		pkt  [][]uint8
+	}
+	tx struct {
+		sync.Mutex
+		descs *[ntxdescs]desc_t
+		pa    [ntxdescs]mem.Pa_t
+		// the descriptors ending a frame, whose status the NIC reports
+		eop [ntxdescs]bool
+		// the first descriptor the NIC may still use and the next free
+		// one
+		clean int
+		tail  int
+	}
+}
+
+func (e *e1000_t) rl(reg int) uint32 {
+	return atomic.LoadUint32(&e.regs[reg/4])
+}
+
+func (e *e1000_t) rs(reg int, val uint32) {
+	runtime.Store32(&e.regs[reg/4], val)
+}
+
+func (e *e1000_t) log(fm string, args ...interface{}) {
+	b, d, f := pci.Breakpcitag(e.tag)
+	s := fmt.Sprintf("e1000:%d:%d.%d: %s\n", b, d, f, fm)
+	fmt.Printf(s, args...)
+}
+
+func (e *e1000_t) Lmac() *Mac_t {
+	return &e.mac
+}
+
+// returns after buf is enqueued to be trasmitted. buf's contents are copied to
+// the DMA buffer, so buf's memory can be reused/freed
+func (e *e1000_t) Tx_raw(buf [][]uint8) bool {
+	return e._tx_nowait(buf, false, false, false, 0, 0)
+}
+
+func (e *e1000_t) Tx_ipv4(buf [][]uint8) bool {
+	return e._tx_nowait(buf, true, false, false, 0, 0)
+}
+
+func (e *e1000_t) Tx_tcp(buf [][]uint8) bool {
+	return e._tx_nowait(buf, true, true, false, 0, 0)
+}
+
+func (e *e1000_t) Tx_tcp_tso(buf [][]uint8, tcphlen, mss int) bool {
+	return e._tx_nowait(buf, true, true, true, tcphlen, mss)
+}
+
+func (e *e1000_t) _tx_nowait(buf [][]uint8, ipv4, tcp, tso bool, tcphlen,
+	mss int) bool {
+	e.tx.Lock()
+	ok := e._tx(buf, ipv4, tcp, tso, tcphlen, mss)
+	e.tx.Unlock()
+	if !ok {
+		fmt.Printf("tx packet(s) dropped!\n")
+	}
+	return ok
+}
+
+// the number of free transmit descriptors. one is always left unused so that
+// a full ring differs from an empty one.
+func (e *e1000_t) txfree() int {
+	return (e.tx.clean - e.tx.tail - 1 + ntxdescs) % ntxdescs
+}
+
+// caller must hold the tx lock. returns true if buf was copied to the
+// transmission ring.
+func (e *e1000_t) _tx(buf [][]uint8, ipv4, tcp, tso bool, tcphlen,
+	mss int) bool {
+	if tso && !tcp {
+		panic("tso is only for tcp")
+	}
+	tlen := 0
+	for _, b := range buf {
+		tlen += len(b)
+	}
+	if tlen == 0 {
+		panic("wut")
+	}
+	if tlen-ETHERLEN > 1500 && !tso {
+		panic("should use tso")
+	}
+	e.tx_reap()
+	ndata := (tlen + mem.PGSIZE - 1) / mem.PGSIZE
+	if e.txfree() < ndata+1 {
+		return false
+	}
+
+	dcmd, popts := txctxt(&e.tx.descs[e.tx.tail], ipv4, tcp, tso, tlen,
+		tcphlen, mss)
+	e.tx.eop[e.tx.tail] = false
+	e.tx.tail = (e.tx.tail + 1) % ntxdescs
+
+	src := append([][]uint8(nil), buf...)
+	for left := tlen; left > 0; {
+		i := e.tx.tail
+		l := left
+		if l > mem.PGSIZE {
+			l = mem.PGSIZE
+		}
+		dst := mem.Dmaplen(e.tx.pa[i], l)
+		for len(dst) != 0 {
+			did := copy(dst, src[0])
+			dst = dst[did:]
+			src[0] = src[0][did:]
+			if len(src[0]) == 0 {
+				src = src[1:]
+			}
+		}
+		left -= l
+		d := &e.tx.descs[i]
+		d.addr = uint64(e.tx.pa[i])
+		d.rest = dcmd | popts | uint64(l)
+		e.tx.eop[i] = left == 0
+		if left == 0 {
+			d.rest |= TXD_EOP | TXD_RS
+		}
+		e.tx.tail = (i + 1) % ntxdescs
+	}
+	e.rs(TDT, uint32(e.tx.tail))
+	return true
+}
+
+// fills in the context descriptor ctxt, which names the checksums the NIC
+// computes for the data descriptors after it, of a frame of tlen bytes.
+// returns the command and option bits of those data descriptors.
+func txctxt(ctxt *desc_t, ipv4, tcp, tso bool, tlen, tcphlen,
+	mss int) (uint64, uint64) {
+	ipcss := uint64(ETHERLEN)
+	ipcso := ipcss + 10
+	ipcse := ipcss + uint64(IP4LEN) - 1
+	tucss := ipcss + uint64(IP4LEN)
+	tucso := tucss + 16
+	ctxt.addr = ipcss | ipcso<<8 | ipcse<<16 | tucss<<32 | tucso<<40
+	ctxt.rest = TXD_DEXT | TXD_CTXT | TXD_IP
+	popts := uint64(0)
+	if ipv4 {
+		popts |= TXD_IXSM
+	}
+	if tcp {
+		ctxt.rest |= TXD_TCP
+		popts |= TXD_TXSM
+	}
+	dcmd := TXD_DEXT | TXD_DATA | TXD_IFCS
+	if tso {
+		// the checksum field holds the pseudo-header sum without the
+		// length, to which the NIC adds each segment's
+		hlen := ETHERLEN + IP4LEN + tcphlen
+		ctxt.rest |= TXD_TSE | uint64(tlen-hlen) | uint64(hlen)<<40 |
+			uint64(mss)<<48
+		dcmd |= TXD_TSE
+	}
+	return dcmd, popts
+}
+
+// frees the descriptors of sent frames. the NIC reports only the status of a
+// frame's last descriptor. caller must hold the tx lock.
+func (e *e1000_t) tx_reap() {
+	for e.tx.clean != e.tx.tail {
+		end := e.tx.clean
+		for !e.tx.eop[end] {
+			end = (end + 1) % ntxdescs
+		}
+		if atomic.LoadUint64(&e.tx.descs[end].rest)&TXD_DD == 0 {
+			return
+		}
+		e.tx.eop[end] = false
+		e.tx.clean = (end + 1) % ntxdescs
+	}
+}
+
+// hands the frames the NIC received to the network stack and gives their
+// descriptors back to the NIC
+func (e *e1000_t) rx_consume() {
+	last := -1
+	for {
+		i := e.rx.next
+		d := &e.rx.descs[i]
+		v := atomic.LoadUint64(&d.rest)
+		st := (v >> 32) & 0xff
+		if st&RXD_STAT_DD == 0 {
+			break
+		}
+		errs := (v >> 40) & 0xff
+		l := int(v & 0xffff)
+		switch {
+		case st&RXD_STAT_EOP == 0:
+			// frames never span buffers since long frames are
+			// disabled
+			e.log("dropped partial frame")
+		case e.rxcsum && st&RXD_STAT_IXSM == 0 &&
+			errs&(RXD_ERR_IPE|RXD_ERR_TCPE) != 0:
+			dbg("e1000: dropped frame with bad checksum\n")
+		default:
+			pkt := e.rx.pkt[0:1]
+			pkt[0] = mem.Dmaplen(e.rx.pa[i], l)
+			bnet.Net_start(pkt, l)
+		}
+		d.addr = uint64(e.rx.pa[i])
+		d.rest = 0
+		last = i
+		e.rx.next = (i + 1) % nrxdescs
+	}
+	if last != -1 {
+		e.rs(RDT, uint32(last))
+	}
+}
+
+func (e *e1000_t) linkinfo() (bool, string) {
+	st := e.rl(STATUS)
+	speeds := []string{"10Mb/s", "100Mb/s", "1Gb/s", "1Gb/s"}
+	return st&STATUS_LU != 0, speeds[(st>>6)&0x3]
+}
+
+func (e *e1000_t) intr() {
+	// reading ICR clears it, except in MSI-X mode
+	icr := e.rl(ICR)
+	e.rs(ICR, icr)
+	if icr&ICR_LSC != 0 {
+		if up, speed := e.linkinfo(); up {
+			e.log("link up @ %s", speed)
+		} else {
+			e.log("link down")
+		}
+	}
+	e.rx_consume()
+	e.tx.Lock()
+	e.tx_reap()
+	e.tx.Unlock()
+}
+
+// Go routine for handling interrupts
+func (e *e1000_t) int_handler(vec uint) {
+	r := bounds.Bounds(bounds.B_E1000_T_INT_HANDLER)
+	res.Kreswait(r, "e1000 int handler")
+	for {
+		res.Kunres()
+		runtime.IRQsched(vec)
+		res.Kreswait(r, "e1000 int handler")
+
+		e.intr()
+		if e.pin != -1 {
+			// trapstub masked the pin
+			apic.Apic.Irq_unmask(e.pin)
+		}
+	}
+}
+
+// reads a word of the EEPROM, whose read register differs between the models
+func (e *e1000_t) eeprom(addr int) uint16 {
+	start := uint32(1)
+	done := uint32(1 << 4)
+	shift := uint(8)
+	if e.did == PCI_DEV_82574L {
+		done = 1 << 1
+		shift = 2
+	}
+	e.rs(EERD, uint32(addr)<<shift|start)
+	for c := 0; ; c++ {
+		if v := e.rl(EERD); v&done != 0 {
+			return uint16(v >> 16)
+		}
+		if c > 1000000 {
+			e.log("EEPROM read timed out")
+			return 0
+		}
+	}
+}
+
+// the NIC loads its MAC address from the EEPROM into the first receive
+// address register, if the EEPROM has one
+func (e *e1000_t) readmac() {
+	ral, rah := e.rl(RAL0), e.rl(RAH0)
+	if rah&RAH_AV == 0 {
+		for i := 0; i < 3; i++ {
+			w := e.eeprom(i)
+			e.mac[2*i] = uint8(w)
+			e.mac[2*i+1] = uint8(w >> 8)
+		}
+		m := e.mac
+		ral = uint32(m[0]) | uint32(m[1])<<8 | uint32(m[2])<<16 |
+			uint32(m[3])<<24
+		rah = uint32(m[4]) | uint32(m[5])<<8 | RAH_AV
+		e.rs(RAL0, ral)
+		e.rs(RAH0, rah)
+	}
+	for i := 0; i < 4; i++ {
+		e.mac[i] = uint8(ral >> (8 * uint(i)))
+	}
+	e.mac[4] = uint8(rah)
+	e.mac[5] = uint8(rah >> 8)
+}
+
+func pg_new() mem.Pa_t {
+	_, pa, ok := mem.Physmem.Refpg_new()
+	if !ok {
+		panic("oom during e1000 attach")
+	}
+	mem.Physmem.Refup(pa)
+	return pa
+}
+
+func (e *e1000_t) rx_init() {
+	rpa := pg_new()
+	e.rx.descs = (*[nrxdescs]desc_t)(unsafe.Pointer(mem.Physmem.Dmap(rpa)))
+	for i := range e.rx.descs {
+		// two buffers per page
+		if i%2 == 0 {
+			e.rx.pa[i] = pg_new()
+		} else {
+			e.rx.pa[i] = e.rx.pa[i-1] + rxbufsz
+		}
+		e.rx.descs[i].addr = uint64(e.rx.pa[i])
+	}
+	e.rx.pkt = make([][]uint8, 1)
+	e.rs(RDBAL, uint32(rpa))
+	e.rs(RDBAH, uint32(uint64(rpa)>>32))
+	e.rs(RDLEN, nrxdescs*16)
+	e.rs(RDH, 0)
+	e.rs(RDT, nrxdescs-1)
+	if e.rxcsum {
+		e.rs(RXCSUM, RXCSUM_IPOFLD|RXCSUM_TUOFLD)
+	}
+	// 2KB buffers, broadcasts, and no CRC in the buffers
+	e.rs(RCTL, RCTL_EN|RCTL_BAM|RCTL_SECRC)
+}
+
+func (e *e1000_t) tx_init() {
+	tpa := pg_new()
+	e.tx.descs = (*[ntxdescs]desc_t)(unsafe.Pointer(mem.Physmem.Dmap(tpa)))
+	for i := range e.tx.pa {
+		e.tx.pa[i] = pg_new()
+	}
+	e.rs(TDBAL, uint32(tpa))
+	e.rs(TDBAH, uint32(uint64(tpa)>>32))
+	e.rs(TDLEN, ntxdescs*16)
+	e.rs(TDH, 0)
+	e.rs(TDT, 0)
+	// the recommended inter-packet gaps for copper
+	e.rs(TIPG, 8|8<<10|6<<20)
+	e.rs(TCTL, TCTL_EN|TCTL_PSP|TCTL_CT|TCTL_COLD)
+}
+
+// number of attached NICs, which name their device files
+var nattached int
+
+func attach_e1000(vid, did int, t pci.Pcitag_t) {
+	e := &e1000_t{tag: t, did: did, pin: -1, rxcsum: true}
+
+	// enable memory decoding and bus mastering
+	cmd := pci.Pci_read(t, 0x4, 2)
+	cmd |= 0x6
+	pci.Pci_write(t, 0x4, cmd)
+	bar, blen := pci.Pci_bar_mem(t, 0)
+	e.regs = mem.Dmaplen32(bar, blen)
+
+	// mask interrupts across the reset
+	e.rs(IMC, ^uint32(0))
+	e.rs(CTRL, e.rl(CTRL)|CTRL_RST)
+	for c := 0; e.rl(CTRL)&CTRL_RST != 0; c++ {
+		if c > 1000000 {
+			e.log("reset timed out")
+			return
+		}
+	}
+	e.rs(IMC, ^uint32(0))
+	e.rl(ICR)
+
+	vec := uint(0)
+	if v, msix, ok := pci.Pci_msi_attach(t); ok {
+		vec = uint(v)
+		// no legacy interrupts
+		pci.Pci_write(t, 0x4, cmd|1<<10)
+		if msix {
+			// route every cause to MSI-X entry 0
+			e.rs(IVAR, 1<<3|1<<7|1<<11|1<<15|1<<19)
+		}
+	} else {
+		// the BIOS sets the interrupt line to the IRQ, which is the
+		// IOAPIC pin on QEMU's PIIX machines
+		pin := pci.Pci_read(t, 0x3c, 1)
+		if pin == 0 || pin == 0xff || defs.IRQ_BASE+pin >= defs.INT_MSI0 {
+			e.log("no usable interrupt line (%v)", pin)
+			return
+		}
+		e.pin = pin
+		vec = uint(defs.IRQ_BASE + pin)
+	}
+
+	e.rs(CTRL, e.rl(CTRL)|CTRL_SLU|CTRL_ASDE)
+	e.readmac()
+	for i := 0; i < 128; i++ {
+		e.rs(MTA+4*i, 0)
+	}
+	e.rx_init()
+	e.tx_init()
+
+	go e.int_handler(vec)
+	e.rs(ITR, 0)
+	e.rs(IMS, ICR_TXDW|ICR_LSC|ICR_RXDMT0|ICR_RXO|ICR_RXT0)
+	if e.pin != -1 {
+		apic.Apic.Irq_unmask(e.pin)
+	}
+
+	model := "82540EM"
+	if did == PCI_DEV_82574L {
+		model = "82574L"
+	}
+	irq := fmt.Sprintf("MSI %v", vec)
+	if e.pin != -1 {
+		irq = fmt.Sprintf("IRQ %v", e.pin)
+	}
+	e.log("attached %s: MAC %s, rxq %v, txq %v, %s", model,
+		Mac2str(e.mac[:]), nrxdescs, ntxdescs, irq)
+
+	if ip, ok := bnet.Nic_usernet(e); ok {
+		e.ip = ip
+	}
+	name := fmt.Sprintf("e1000%d", nattached)
+	nattached++
+	if err := bnet.Nic_attach(name, e); err != 0 {
+		e.log("no device file %s: %v", name, err)
+	}
+}
+
+func e1000_verify() {
+	if unsafe.Sizeof(desc_t{}) != 16 {
+		panic("desc_t padded?")
+	}
+}
+
+// E1000_init registers the e1000 driver; call it before the PCI bus is
+// attached
+func E1000_init() {
+	e1000_verify()
+	pci.Pci_register_intel(PCI_DEV_82540EM, attach_e1000)
+	pci.Pci_register_intel(PCI_DEV_82574L, attach_e1000)
+}
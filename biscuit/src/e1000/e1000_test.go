@@ -0,0 +1,129 @@
+package e1000
+
+import "testing"
+import "unsafe"
+
+import . "inet"
+
+// checks the offsets and lengths in the context descriptors of plain, TCP,
+// and TSO frames
+func TestTxctxt(t *testing.T) {
+	if unsafe.Sizeof(desc_t{}) != 16 {
+		t.Fatalf("desc_t padded")
+	}
+	field := func(v uint64, lo, n uint) uint64 {
+		return (v >> lo) & (1<<n - 1)
+	}
+	var d desc_t
+	// IPCSS, IPCSO, IPCSE, TUCSS, TUCSO
+	offs := func() {
+		want := []uint64{14, 24, 33, 34, 50}
+		for i, lo := range []uint{0, 8, 16, 32, 40} {
+			n := uint(8)
+			if lo == 16 {
+				n = 16
+			}
+			if f := field(d.addr, lo, n); f != want[i] {
+				t.Fatalf("context field %v: %v", i, f)
+			}
+		}
+	}
+
+	dcmd, popts := txctxt(&d, false, false, false, 60, 0, 0)
+	offs()
+	if d.rest&(TXD_TCP|TXD_TSE) != 0 || popts != 0 ||
+		dcmd&TXD_TSE != 0 {
+		t.Fatalf("raw frame: %#x %#x %#x", d.rest, dcmd, popts)
+	}
+	if dcmd&(TXD_DEXT|TXD_DATA|TXD_IFCS) != TXD_DEXT|TXD_DATA|TXD_IFCS {
+		t.Fatalf("raw frame: dcmd %#x", dcmd)
+	}
+
+	dcmd, popts = txctxt(&d, true, true, false, 1514, 20, 0)
+	offs()
+	if d.rest&TXD_TCP == 0 || d.rest&TXD_TSE != 0 ||
+		popts != TXD_IXSM|TXD_TXSM || dcmd&TXD_TSE != 0 {
+		t.Fatalf("tcp frame: %#x %#x %#x", d.rest, dcmd, popts)
+	}
+
+	const thl = 32
+	const mss = 1448
+	tlen := 40000
+	dcmd, popts = txctxt(&d, true, true, true, tlen, thl, mss)
+	offs()
+	hlen := ETHERLEN + IP4LEN + thl
+	if d.rest&(TXD_TCP|TXD_TSE|TXD_DEXT) != TXD_TCP|TXD_TSE|TXD_DEXT ||
+		dcmd&TXD_TSE == 0 || popts != TXD_IXSM|TXD_TXSM {
+		t.Fatalf("tso frame: %#x %#x %#x", d.rest, dcmd, popts)
+	}
+	if f := field(d.rest, 0, 20); f != uint64(tlen-hlen) {
+		t.Fatalf("tso PAYLEN %v", f)
+	}
+	if f := field(d.rest, 40, 8); f != uint64(hlen) {
+		t.Fatalf("tso HDRLEN %v", f)
+	}
+	if f := field(d.rest, 48, 16); f != mss {
+		t.Fatalf("tso MSS %v", f)
+	}
+}
+
+// queues frames of one to several descriptors the way _tx does, across the
+// end of the ring, and checks that tx_reap frees them only once the NIC has
+// reported their last descriptor done
+func TestTxRing(t *testing.T) {
+	e := &e1000_t{}
+	e.tx.descs = &[ntxdescs]desc_t{}
+	put := func(n int) int {
+		for i := 0; i < n; i++ {
+			e.tx.eop[e.tx.tail] = i == n-1
+			e.tx.descs[e.tx.tail].rest = 0
+			e.tx.tail = (e.tx.tail + 1) % ntxdescs
+		}
+		return (e.tx.tail - 1 + ntxdescs) % ntxdescs
+	}
+	if e.txfree() != ntxdescs-1 {
+		t.Fatalf("empty ring has %v free", e.txfree())
+	}
+	var ends []int
+	nframe := 0
+	for round := 0; round < 10*ntxdescs; round++ {
+		for {
+			n := 1 + nframe%5
+			if e.txfree() < n {
+				break
+			}
+			ends = append(ends, put(n))
+			nframe++
+		}
+		if e.txfree() > 4 {
+			t.Fatalf("ring not filled: %v free", e.txfree())
+		}
+		// the NIC finishes some frames
+		ndone := 1 + round%len(ends)
+		for _, end := range ends[:ndone] {
+			e.tx.descs[end].rest |= TXD_DD
+		}
+		before := e.txfree()
+		e.tx_reap()
+		freed := 0
+		for i := 0; i < ndone; i++ {
+			freed += 1 + (nframe-len(ends)+i)%5
+		}
+		if e.txfree()-before != freed {
+			t.Fatalf("reaped %v descriptors, want %v",
+				e.txfree()-before, freed)
+		}
+		if want := (ends[ndone-1] + 1) % ntxdescs; e.tx.clean != want {
+			t.Fatalf("clean %v, want %v", e.tx.clean, want)
+		}
+		ends = ends[ndone:]
+		// a frame the NIC hasn't finished stops the reaping
+		e.tx_reap()
+		if e.txfree()-before != freed {
+			t.Fatalf("reaped an unfinished frame")
+		}
+	}
+	if nframe < 2*ntxdescs {
+		t.Fatalf("ring did not wrap: %v frames", nframe)
+	}
+}
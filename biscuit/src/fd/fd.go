@@ -18,6 +18,8 @@ type Fd_t struct {
 	// is a reference, not a value
 	Fops  fdops.Fdops_i
 	Perms int
+	// the canonical path by which the file was opened, if any
+	Path ustr.Ustr
 }
 
 func Copyfd(fd *Fd_t) (*Fd_t, defs.Err_t) {
@@ -30,6 +32,13 @@ func Copyfd(fd *Fd_t) (*Fd_t, defs.Err_t) {
 	return nfd, 0
 }
 
+// releases the record locks of process pid on f's file. the locks are
+// released when the process closes any descriptor for the file.
+func Unlock(f *Fd_t, pid int) {
+	lk := &fdops.Flock_t{Type: defs.F_UNLCK, Whence: defs.SEEK_SET}
+	f.Fops.Lockrec(pid, defs.F_SETLK, lk)
+}
+
 func Close_panic(f *Fd_t) {
 	if f.Fops.Close() != 0 {
 		panic("must succeed")
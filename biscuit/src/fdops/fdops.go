@@ -29,6 +29,22 @@ type Userio_i interface {
 	Totalsz() int
 }
 
+// Ioctl_i is implemented by the files of devices that take ioctl(2)
+// requests. for requests whose argument is a file descriptor, argf is the
+// descriptor's open file.
+type Ioctl_i interface {
+	Ioctl(cmd, arg int, argf Fdops_i) (int, defs.Err_t)
+}
+
+// a POSIX record lock; see fcntl(2)
+type Flock_t struct {
+	Type   int
+	Whence int
+	Start  int
+	Len    int
+	Pid    int
+}
+
 type Fdops_i interface {
 	// fd ops
 	Close() defs.Err_t
@@ -41,6 +57,15 @@ type Fdops_i interface {
 	Reopen() defs.Err_t
 	Write(Userio_i) (int, defs.Err_t)
 	Truncate(uint) defs.Err_t
+	// allocate file blocks; mode, offset, length
+	Fallocate(int, int, int) defs.Err_t
+	// commit file changes to disk; only data if the argument is true
+	Fsync(bool) defs.Err_t
+	// advisory locks. Flock takes a LOCK_* op and locks the whole file
+	// for the open file. Lockrec gets (F_GETLK) or sets (F_SETLK,
+	// F_SETLKW) a record lock owned by the process with the given pid.
+	Flock(int) defs.Err_t
+	Lockrec(int, int, *Flock_t) defs.Err_t
 
 	Pread(Userio_i, int) (int, defs.Err_t)
 	Pwrite(Userio_i, int) (int, defs.Err_t)
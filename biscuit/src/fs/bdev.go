@@ -2,6 +2,7 @@ package fs
 
 import "fmt"
 import "sync"
+import "sync/atomic"
 
 import "runtime"
 
@@ -41,14 +42,24 @@ type bcache_t struct {
 	disk  Disk_i
 	sync.Mutex
 	pins map[mem.Pa_t]*Bdev_block_t
+	// number of shared mappings of each pinned block
+	npins map[int]int
+	// number of metadata blocks read whose checksum didn't match
+	ncksumerr int64
 }
 
 func mkBcache(m Blockmem_i, disk Disk_i) *bcache_t {
+	return mkBcache_sized(m, disk, limits.Syslimit.Blocks)
+}
+
+// makes a block cache with a hash table of size buckets
+func mkBcache_sized(m Blockmem_i, disk Disk_i, size int) *bcache_t {
 	bcache := &bcache_t{}
 	bcache.mem = m
 	bcache.disk = disk
-	bcache.cache = mkCache(limits.Syslimit.Blocks)
+	bcache.cache = mkCache(size)
 	bcache.pins = make(map[mem.Pa_t]*Bdev_block_t)
+	bcache.npins = make(map[int]int)
 	return bcache
 }
 
@@ -74,8 +85,42 @@ func (bcache *bcache_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
 	return b
 }
 
+// like Get_fill, but for a metadata block of kind k. if the block's checksum
+// didn't match when read from disk, returns -EIO along with the block, which
+// the caller must still release.
+func (bcache *bcache_t) Get_meta(blkn int, k metakind_t, s string, lock bool) (*Bdev_block_t, defs.Err_t) {
+	b, created := bcache.bref(blkn, s)
+	if b.Evictnow() {
+		runtime.Cacheaccount()
+	}
+
+	if created {
+		b.New_page()
+		b.Read()
+		if !Cksum_ok(b.Data[:]) {
+			b.Bad = true
+			atomic.AddInt64(&bcache.ncksumerr, 1)
+			fmt.Printf("bad checksum: block %v (%v)\n", blkn, s)
+		}
+	}
+	b.Meta = k
+	if !lock {
+		b.Unlock()
+	}
+	if b.Bad {
+		return b, -defs.EIO
+	}
+	return b, 0
+}
+
+// returns the number of metadata blocks whose checksum didn't match
+func (bcache *bcache_t) Cksumerrs() int {
+	return int(atomic.LoadInt64(&bcache.ncksumerr))
+}
+
 // returns locked buf with refcnt on page bumped up by 1. caller must call
-// bcache_relse when done with buf
+// bcache_relse when done with buf. the caller overwrites the block with
+// new contents, which therefore aren't metadata (yet).
 func (bcache *bcache_t) Get_zero(blkn int, s string, lock bool) *Bdev_block_t {
 	b, created := bcache.bref(blkn, s)
 	if bdev_debug {
@@ -84,6 +129,8 @@ func (bcache *bcache_t) Get_zero(blkn int, s string, lock bool) *Bdev_block_t {
 	if created {
 		b.New_page() // zero
 	}
+	b.Meta = META_NONE
+	b.Bad = false
 	if !lock {
 		b.Unlock()
 	}
@@ -244,9 +291,17 @@ func (bcache *bcache_t) pin(b *Bdev_block_t) {
 		panic("uh oh")
 	}
 	bcache.pins[b.Pa] = b
+	bcache.npins[b.Block]++
 	bcache.Unlock()
 }
 
+// returns true if block blkn is mapped shared
+func (bcache *bcache_t) pinned(blkn int) bool {
+	bcache.Lock()
+	defer bcache.Unlock()
+	return bcache.npins[blkn] > 0
+}
+
 func (bcache *bcache_t) unpin(pa mem.Pa_t) {
 	bcache.Lock()
 	defer bcache.Unlock()
@@ -255,6 +310,9 @@ func (bcache *bcache_t) unpin(pa mem.Pa_t) {
 	if !ok {
 		panic("block no pinned")
 	}
+	if bcache.npins[b.Block]--; bcache.npins[b.Block] == 0 {
+		delete(bcache.npins, b.Block)
+	}
 	bcache.Relse(b, "unpin")
 }
 
@@ -304,25 +362,28 @@ func bdev_test(mem Blockmem_i, disk Disk_i, bcache *bcache_t) {
 type bbitmap_t struct {
 	fs    *Fs_t
 	alloc *bitmap_t
-	start int
-	len   int
 	first int
 }
 
-func mkBallocater(fs *Fs_t, start, len, first int) *bbitmap_t {
+func mkBallocater(fs *Fs_t, runs []run_t, first int) *bbitmap_t {
 	balloc := &bbitmap_t{}
-	balloc.alloc = mkAllocater(fs, start, len, fs.fslog)
+	balloc.alloc = mkAllocater(fs, runs, fs.fslog)
 	if bdev_debug {
-		fmt.Printf("bmap start %v bmaplen %v first datablock %v free %d\n", start, len, first,
+		fmt.Printf("bmap runs %v first datablock %v free %d\n", runs, first,
 			balloc.alloc.nfreebits)
 	}
 	balloc.first = first
-	balloc.start = start
-	balloc.len = len
 	balloc.fs = fs
 	return balloc
 }
 
+// the number of bits in the block map
+func (balloc *bbitmap_t) nbits() int {
+	balloc.alloc.Lock()
+	defer balloc.alloc.Unlock()
+	return balloc.alloc.freelen * bitsperblk
+}
+
 func (balloc *bbitmap_t) Balloc(opid opid_t) (int, defs.Err_t) {
 	ret, err := balloc.balloc1(opid)
 	if err != 0 {
@@ -348,6 +409,77 @@ func (balloc *bbitmap_t) Balloc(opid opid_t) (int, defs.Err_t) {
 	return ret, 0
 }
 
+// Ballocrun allocates at most n contiguous blocks starting at block goal, or
+// as close after it as possible if goal is taken; goal 0 means no preference.
+// want is the length of the free run to look for when goal is taken. like
+// Balloc, the new blocks are zeroed through the log. returns the first block
+// and the number of blocks allocated.
+func (balloc *bbitmap_t) Ballocrun(opid opid_t, goal, want, n int) (int, int, defs.Err_t) {
+	bgoal := 0
+	if goal > balloc.first {
+		bgoal = goal - balloc.first
+	}
+	bit, c, err := balloc.alloc.FindAndMarkRun(opid, bgoal, want, n)
+	if err != 0 {
+		return 0, 0, err
+	}
+	ret := bit + balloc.first
+	last := balloc.fs.superb.Lastblock()
+	if ret+c > last {
+		// the bitmap covers more blocks than the disk has
+		var unmark []int
+		b := ret
+		if b < last {
+			b = last
+		}
+		for ; b < ret+c; b++ {
+			unmark = append(unmark, b-balloc.first)
+		}
+		balloc.alloc.MarkUnmark(opid, nil, unmark)
+		balloc.alloc.Lock()
+		balloc.alloc.nfreebits += uint(len(unmark))
+		balloc.alloc.Unlock()
+		c -= len(unmark)
+		if c <= 0 {
+			return 0, 0, -defs.ENOSPC
+		}
+	}
+	for b := ret; b < ret+c; b++ {
+		blk := balloc.fs.bcache.Get_zero(b, "ballocrun", true)
+		var zdata [BSIZE]uint8
+		copy(blk.Data[:], zdata[:])
+		blk.Unlock()
+		balloc.fs.fslog.Write(opid, blk)
+		balloc.fs.bcache.Relse(blk, "ballocrun")
+	}
+	if bdev_debug {
+		fmt.Printf("ballocrun: %v %v free %d\n", ret, c, balloc.alloc.nfreebits)
+	}
+	return ret, c, 0
+}
+
+// Breserve finds at most n free blocks near goal (starting exactly at goal if
+// exact is set) without allocating them, and steers other allocations away
+// from them. returns the first block and the number of blocks found.
+func (balloc *bbitmap_t) Breserve(goal, n int, exact bool) (int, int) {
+	if goal < balloc.first {
+		if exact {
+			return 0, 0
+		}
+		goal = balloc.first
+	}
+	bit, c := balloc.alloc.Reserve(goal-balloc.first, n, exact)
+	if c == 0 {
+		return 0, 0
+	}
+	ret := bit + balloc.first
+	last := balloc.fs.superb.Lastblock()
+	if ret >= last {
+		return 0, 0
+	}
+	return ret, min(c, last-ret)
+}
+
 func (balloc *bbitmap_t) Bfree(opid opid_t, blkno int) {
 	blkno -= balloc.first
 	if bdev_debug {
@@ -356,9 +488,12 @@ func (balloc *bbitmap_t) Bfree(opid opid_t, blkno int) {
 	if blkno < 0 {
 		panic("bfree")
 	}
-	if blkno >= balloc.len*BSIZE*8 {
+	if blkno >= balloc.nbits() {
 		panic("bfree too large")
 	}
+	if balloc.fs.discard != nil {
+		balloc.fs.discard.free(opid, blkno+balloc.first)
+	}
 	balloc.alloc.Unmark(opid, blkno)
 }
 
@@ -377,8 +512,8 @@ func (balloc *bbitmap_t) balloc1(opid opid_t) (int, defs.Err_t) {
 		fmt.Printf("balloc1: %v\n", err)
 		return 0, err
 	}
-	if blkn >= balloc.len*BSIZE*8 {
-		fmt.Printf("balloc1: blkn %v len %v\n", blkn, balloc.len)
+	if blkn >= balloc.nbits() {
+		fmt.Printf("balloc1: blkn %v nbits %v\n", blkn, balloc.nbits())
 		panic("balloc1: too large blkn\n")
 	}
 	if bdev_debug {
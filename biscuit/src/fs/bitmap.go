@@ -9,13 +9,17 @@ import "defs"
 import "res"
 import "stats"
 
-// Bitmap allocater/marker. Used for inodes, blocks, and orphan inodes.
+// Bitmap allocater/marker. Used for inodes, blocks, and orphan inodes. The
+// last bytes of each bitmap block hold the block's checksum. The allocater
+// treats the bits of a block whose checksum doesn't match as allocated, and
+// never writes the block. the bitmap blocks need not be contiguous on disk; a
+// grown file system adds runs of them (see Fs_grow).
 
-const bitsperblk = BSIZE * 8
+const bitsperblk = (BSIZE - CKSUMLEN) * 8
 
 type storage_i interface {
 	Write(opid_t, *Bdev_block_t)
-	Get_fill(int, string, bool) *Bdev_block_t
+	Get_meta(int, metakind_t, string, bool) (*Bdev_block_t, defs.Err_t)
 	Relse(*Bdev_block_t, string)
 }
 
@@ -25,10 +29,35 @@ type bitmapstats_t struct {
 	Nhit   stats.Counter_t
 }
 
+// a run of contiguous blocks
+type run_t struct {
+	start int
+	len   int
+}
+
+// returns the disk block of the i-th block of runs
+func runblock(runs []run_t, i int) int {
+	for _, r := range runs {
+		if i < r.len {
+			return r.start + i
+		}
+		i -= r.len
+	}
+	panic("block past runs")
+}
+
+func runslen(runs []run_t) int {
+	n := 0
+	for _, r := range runs {
+		n += r.len
+	}
+	return n
+}
+
 type bitmap_t struct {
 	sync.Mutex
 	fs        *Fs_t
-	freestart int
+	runs      []run_t
 	freelen   int
 	lastbit   int
 	nfreebits uint
@@ -36,15 +65,20 @@ type bitmap_t struct {
 	stats     bitmapstats_t
 	freemap   []uint8
 	last      int
+	// free bits that can't be allocated until released (see _hold), and
+	// the condition allocations wait on for them
+	held  map[int]bool
+	heldc *sync.Cond
 }
 
 const NFREE = 1000
 
-func mkAllocater(fs *Fs_t, start, len int, s storage_i) *bitmap_t {
+func mkAllocater(fs *Fs_t, runs []run_t, s storage_i) *bitmap_t {
 	a := &bitmap_t{}
+	a.heldc = sync.NewCond(a)
 	a.fs = fs
-	a.freestart = start
-	a.freelen = len
+	a.runs = runs
+	a.freelen = runslen(runs)
 	a.storage = s
 	a.apply(0, func(b, v int) bool {
 		if v == 0 {
@@ -53,7 +87,7 @@ func mkAllocater(fs *Fs_t, start, len int, s storage_i) *bitmap_t {
 		return true
 	})
 	if !fs.diskfs {
-		a.freemap = make([]uint8, (a.freelen * BSIZE))
+		a.freemap = make([]uint8, a.freelen*bitsperblk/8)
 		a.populateFreeMap()
 	}
 	return a
@@ -75,15 +109,20 @@ func byteoffset(bit int) int {
 	return blkoffset(bit) % 8
 }
 
+// returns the disk block holding bit
 func (alloc *bitmap_t) bitmapblkno(bit int) int {
-	return alloc.freestart + blkno(bit)
+	alloc.Lock()
+	defer alloc.Unlock()
+	return runblock(alloc.runs, blkno(bit))
 }
 
-func (alloc *bitmap_t) Fbread(blockno int) *Bdev_block_t {
+// returns the locked bitmap block and true if its checksum matches
+func (alloc *bitmap_t) Fbread(blockno int) (*Bdev_block_t, bool) {
 	if blockno < 0 || blockno >= alloc.freelen {
 		panic("naughty blockno")
 	}
-	return alloc.storage.Get_fill(alloc.freestart+blockno, "fbread", true)
+	b, err := alloc.storage.Get_meta(runblock(alloc.runs, blockno), META_BITMAP, "fbread", true)
+	return b, err == 0
 }
 
 // apply f to every bit starting from start, until f is false.  return true if
@@ -95,6 +134,7 @@ func (alloc *bitmap_t) apply(start int, f func(b, v int) bool) bool {
 	var blk *Bdev_block_t
 	var lastbn = -1
 	var tryevict bool
+	var ok bool
 	for bit := start; bit < alloc.freelen*bitsperblk; bit++ {
 		bn := blkno(bit)
 		if bn != lastbn {
@@ -105,13 +145,16 @@ func (alloc *bitmap_t) apply(start int, f func(b, v int) bool) bool {
 				blk.Unlock()
 				alloc.storage.Relse(blk, "alloc apply")
 			}
-			blk = alloc.Fbread(bn)
+			blk, ok = alloc.Fbread(bn)
 			tryevict = ca.Shouldevict(gimme)
 		}
 		byteoff := byteno(bit)
 		bitoff := byteoffset(bit)
 		byte := blk.Data[byteoff]
 		v := byte & (1 << uint(bitoff))
+		if !ok || alloc.held[bit] {
+			v = 1
+		}
 		if !f(bit, int(v)) {
 			blk.Unlock()
 			alloc.storage.Relse(blk, "alloc apply")
@@ -133,8 +176,8 @@ func (alloc *bitmap_t) CheckAndMark(opid opid_t) (int, defs.Err_t) {
 	byte := byteno(alloc.lastbit)
 	bit := byteoffset(alloc.lastbit)
 
-	blk := alloc.Fbread(blkno)
-	if blk.Data[byte]&(1<<uint(bit)) == 0 {
+	blk, ok := alloc.Fbread(blkno)
+	if ok && blk.Data[byte]&(1<<uint(bit)) == 0 && !alloc.held[bitno] {
 		alloc.lastbit++
 		blk.Data[byte] |= (1 << uint(bit))
 		blk.Unlock()
@@ -149,9 +192,13 @@ func (alloc *bitmap_t) CheckAndMark(opid opid_t) (int, defs.Err_t) {
 
 func (alloc *bitmap_t) populateFreeMap() {
 	for bn := 0; bn < alloc.freelen; bn++ {
-		blk := alloc.Fbread(bn)
-		for i := 0; i < len(blk.Data); i++ {
-			alloc.freemap[bn*4096+i] = blk.Data[i]
+		blk, ok := alloc.Fbread(bn)
+		for i := 0; i < bitsperblk/8; i++ {
+			if ok {
+				alloc.freemap[bn*bitsperblk/8+i] = blk.Data[i]
+			} else {
+				alloc.freemap[bn*bitsperblk/8+i] = 0xff
+			}
 		}
 		blk.Unlock()
 		alloc.storage.Relse(blk, "alloc apply")
@@ -198,13 +245,20 @@ func (alloc *bitmap_t) FindDiskMap(opid opid_t) (int, defs.Err_t) {
 	if err == 0 {
 		alloc.stats.Nhit.Inc()
 	} else {
-		alloc.apply(0, func(b, v int) bool {
-			if v == 0 {
-				alloc.lastbit = b
-				return false
+		for {
+			found := !alloc.apply(0, func(b, v int) bool {
+				if v == 0 {
+					alloc.lastbit = b
+					return false
+				}
+				return true
+			})
+			if found || len(alloc.held) == 0 {
+				break
 			}
-			return true
-		})
+			// the only free bits are held
+			alloc.heldc.Wait()
+		}
 		bit, err = alloc.CheckAndMark(opid)
 		if err != 0 {
 			panic("FindAndMark")
@@ -224,6 +278,231 @@ func (alloc *bitmap_t) FindAndMark(opid opid_t) (int, defs.Err_t) {
 	}
 }
 
+// number of bits past the first free bit findrun() examines while looking for
+// a run of the requested length.
+const runscan = bitsperblk
+
+func (alloc *bitmap_t) _isfree(bit int) bool {
+	if !alloc.fs.diskfs {
+		return alloc.freemap[bit/8]&(1<<uint(bit%8)) == 0
+	}
+	blk, ok := alloc.Fbread(blkno(bit))
+	v := blk.Data[byteno(bit)] & (1 << uint(byteoffset(bit)))
+	blk.Unlock()
+	alloc.storage.Relse(blk, "_isfree")
+	return ok && v == 0 && !alloc.held[bit]
+}
+
+// _hold keeps the free bits [start, start+n) from being allocated until they
+// are released. caller holds alloc lock.
+func (alloc *bitmap_t) _hold(start, n int) {
+	if alloc.held == nil {
+		alloc.held = make(map[int]bool)
+	}
+	for b := start; b < start+n; b++ {
+		alloc.held[b] = true
+	}
+}
+
+// release makes the bits [start, start+n) that _hold held allocatable again
+func (alloc *bitmap_t) release(start, n int) {
+	alloc.Lock()
+	defer alloc.Unlock()
+
+	for b := start; b < start+n; b++ {
+		delete(alloc.held, b)
+	}
+	alloc.heldc.Broadcast()
+}
+
+// scan bits [start, end) until f returns false.
+func (alloc *bitmap_t) _scan(start, end int, f func(b, v int) bool) {
+	if alloc.fs.diskfs {
+		alloc.apply(start, func(b, v int) bool {
+			if b >= end {
+				return false
+			}
+			return f(b, v)
+		})
+		return
+	}
+	for b := start; b < end; b++ {
+		v := int(alloc.freemap[b/8] & (1 << uint(b%8)))
+		if !f(b, v) {
+			return
+		}
+	}
+}
+
+// returns the first bit and length of a run of at most n free bits, searching
+// forward from goal and then from the start of the bitmap. prefers a run of n
+// bits, but settles for the longest run found within runscan bits of the first
+// free bit. returns -1 if there are no free bits. caller holds alloc lock.
+func (alloc *bitmap_t) findrun(goal, n int) (int, int) {
+	nbits := alloc.freelen * bitsperblk
+	if goal < 0 || goal >= nbits {
+		goal = 0
+	}
+	best, bestlen := -1, 0
+	first := -1
+	runs, runlen := -1, 0
+	f := func(b, v int) bool {
+		if v != 0 {
+			runs, runlen = -1, 0
+			return first == -1 || b-first < runscan
+		}
+		if runs == -1 {
+			runs = b
+		}
+		runlen++
+		if first == -1 {
+			first = b
+		}
+		if runlen > bestlen {
+			best, bestlen = runs, runlen
+		}
+		return bestlen < n && b-first < runscan
+	}
+	alloc._scan(goal, nbits, f)
+	if best == -1 && goal != 0 {
+		runs, runlen = -1, 0
+		alloc._scan(0, goal, f)
+	}
+	return best, bestlen
+}
+
+// marks at most n bits starting at start, stopping at the first allocated
+// bit. returns the number of bits marked. caller holds alloc lock.
+func (alloc *bitmap_t) markrun(opid opid_t, start, n int) int {
+	nbits := alloc.freelen * bitsperblk
+	if !alloc.fs.diskfs {
+		c := 0
+		for b := start; c < n && b < nbits; b++ {
+			if alloc.freemap[b/8]&(1<<uint(b%8)) != 0 {
+				break
+			}
+			alloc.freemap[b/8] |= 1 << uint(b%8)
+			c++
+		}
+		return c
+	}
+	var blk *Bdev_block_t
+	var ok bool
+	dirty := false
+	done := func() {
+		blk.Unlock()
+		if dirty {
+			alloc.storage.Write(opid, blk)
+		}
+		alloc.storage.Relse(blk, "markrun")
+		blk = nil
+		dirty = false
+	}
+	c := 0
+	for b := start; c < n && b < nbits; b++ {
+		if blk != nil && blk.Block != runblock(alloc.runs, blkno(b)) {
+			done()
+		}
+		if blk == nil {
+			blk, ok = alloc.Fbread(blkno(b))
+		}
+		byte := byteno(b)
+		bit := uint8(1 << uint(byteoffset(b)))
+		if !ok || blk.Data[byte]&bit != 0 || alloc.held[b] {
+			break
+		}
+		blk.Data[byte] |= bit
+		dirty = true
+		c++
+	}
+	if blk != nil {
+		done()
+	}
+	return c
+}
+
+// move the allocation hint past the run [start, start+n) if it points into
+// it. caller holds alloc lock.
+func (alloc *bitmap_t) _skip(start, n int) {
+	if alloc.lastbit >= start && alloc.lastbit < start+n {
+		alloc.lastbit = start + n
+		if alloc.lastbit >= alloc.freelen*bitsperblk {
+			alloc.lastbit = 0
+		}
+	}
+}
+
+// FindAndMarkRun allocates at most n contiguous bits, starting at goal if
+// that bit is free. otherwise it allocates from a run near goal, preferring a
+// run of want bits so that later allocations can continue it. returns the
+// first bit and the number of bits allocated.
+func (alloc *bitmap_t) FindAndMarkRun(opid opid_t, goal, want, n int) (int, int, defs.Err_t) {
+	alloc.Lock()
+	defer alloc.Unlock()
+
+	if n <= 0 || want < n {
+		panic("bad run")
+	}
+	nbits := alloc.freelen * bitsperblk
+	start := -1
+	if goal > 0 && goal < nbits && alloc._isfree(goal) {
+		start = goal
+		alloc.stats.Nhit.Inc()
+	} else {
+		if goal <= 0 || goal >= nbits {
+			goal = alloc.lastbit
+		}
+		start, _ = alloc.findrun(goal, want)
+		for start == -1 && len(alloc.held) != 0 {
+			// the only free bits are held
+			alloc.heldc.Wait()
+			start, _ = alloc.findrun(goal, want)
+		}
+		if start == -1 {
+			return 0, 0, -defs.ENOSPC
+		}
+	}
+	c := alloc.markrun(opid, start, n)
+	if c == 0 {
+		panic("free bit vanished")
+	}
+	alloc._skip(start, c)
+	alloc.nfreebits -= uint(c)
+	alloc.stats.Nalloc.Add(int64(c))
+	return start, c, 0
+}
+
+// Reserve returns a run of at most n free bits without marking them. if exact
+// is true, the run must start at goal; otherwise it is searched for near goal.
+// the allocation hint is moved past the run so that FindAndMark prefers other
+// bits, which keeps the run available to whoever reserved it.
+func (alloc *bitmap_t) Reserve(goal, n int, exact bool) (int, int) {
+	alloc.Lock()
+	defer alloc.Unlock()
+
+	nbits := alloc.freelen * bitsperblk
+	if n <= 0 || goal < 0 || goal >= nbits {
+		return -1, 0
+	}
+	start, c := goal, 0
+	if exact {
+		alloc._scan(goal, nbits, func(b, v int) bool {
+			if v != 0 {
+				return false
+			}
+			c++
+			return c < n
+		})
+	} else {
+		start, c = alloc.findrun(goal, n)
+	}
+	if c == 0 {
+		return -1, 0
+	}
+	alloc._skip(start, c)
+	return start, c
+}
+
 func (alloc *bitmap_t) Unmark(opid opid_t, bit int) {
 	alloc.Lock()
 
@@ -247,7 +526,14 @@ func (alloc *bitmap_t) Unmark(opid opid_t, bit int) {
 	fblkno := blkno(bit)
 	fbyteoff := byteno(bit)
 	fbitoff := byteoffset(bit)
-	fblk := alloc.Fbread(fblkno)
+	fblk, ok := alloc.Fbread(fblkno)
+	if !ok {
+		// leak the bit rather than write the corrupt block
+		fblk.Unlock()
+		alloc.storage.Relse(fblk, "Unmark")
+		alloc.Unlock()
+		return
+	}
 	fblk.Data[fbyteoff] &= ^(1 << uint(fbitoff))
 	fblk.Unlock()
 	alloc.storage.Write(opid, fblk)
@@ -272,10 +558,12 @@ func (alloc *bitmap_t) Mark(opid opid_t, bit int) {
 	fblkno := blkno(bit)
 	fbyteoff := byteno(bit)
 	fbitoff := byteoffset(bit)
-	fblk := alloc.Fbread(fblkno)
-	fblk.Data[fbyteoff] |= 1 << uint(fbitoff)
+	fblk, ok := alloc.Fbread(fblkno)
+	if ok {
+		fblk.Data[fbyteoff] |= 1 << uint(fbitoff)
+		alloc.storage.Write(opid, fblk)
+	}
 	fblk.Unlock()
-	alloc.storage.Write(opid, fblk)
 	alloc.storage.Relse(fblk, "Mark")
 }
 
@@ -318,6 +606,15 @@ func (alloc *bitmap_t) MarkUnmark(opid opid_t, mark, unmark []int) {
 	}
 
 	var blk *Bdev_block_t
+	var ok bool
+	done := func() {
+		blk.Unlock()
+		if ok {
+			alloc.storage.Write(opid, blk)
+		}
+		alloc.storage.Relse(blk, "MarkUnmark")
+		blk = nil
+	}
 	for len(mark) > 0 || len(unmark) > 0 {
 		bit, op := smallest(mark, unmark)
 		if bit < 0 {
@@ -328,28 +625,84 @@ func (alloc *bitmap_t) MarkUnmark(opid opid_t, mark, unmark []int) {
 		fbitoff := byteoffset(bit)
 
 		// done with this block
-		if blk != nil && blk.Block != fblkno {
-			blk.Unlock()
-			alloc.storage.Write(opid, blk)
-			alloc.storage.Relse(blk, "MarkUnmark")
-			blk = nil
+		if blk != nil && blk.Block != runblock(alloc.runs, fblkno) {
+			done()
 		}
 		if blk == nil {
-			blk = alloc.Fbread(fblkno)
+			blk, ok = alloc.Fbread(fblkno)
 		}
 		if op == MARK {
-			blk.Data[fbyteoff] |= 1 << uint(fbitoff)
+			if ok {
+				blk.Data[fbyteoff] |= 1 << uint(fbitoff)
+			}
 			mark = mark[1:]
 		} else {
-			blk.Data[fbyteoff] &= ^(1 << uint(fbitoff))
+			if ok {
+				blk.Data[fbyteoff] &= ^(1 << uint(fbitoff))
+			}
 			unmark = unmark[1:]
 		}
 	}
 	if blk != nil {
+		done()
+	}
+}
+
+// grow appends the bitmap blocks of run r, which the caller has already
+// written with a bit set for every allocated or nonexistent object. it also
+// clears the bits from from to the end of the existing blocks for which free
+// returns true, and counts the free bits of both. the caller holds no
+// bitmap blocks.
+func (alloc *bitmap_t) grow(opid opid_t, from int, r run_t, free func(int) bool) {
+	alloc.Lock()
+	defer alloc.Unlock()
+
+	if !alloc.fs.diskfs {
+		panic("grow memfs")
+	}
+	old := alloc.freelen * bitsperblk
+	var blk *Bdev_block_t
+	var ok bool
+	dirty := false
+	done := func() {
 		blk.Unlock()
-		alloc.storage.Write(opid, blk)
-		alloc.storage.Relse(blk, "MarkUnmark")
+		if dirty {
+			alloc.storage.Write(opid, blk)
+		}
+		alloc.storage.Relse(blk, "grow")
+		blk = nil
+		dirty = false
+	}
+	var nfree uint
+	for b := from; b < old; b++ {
+		if !free(b) {
+			continue
+		}
+		if blk != nil && blk.Block != runblock(alloc.runs, blkno(b)) {
+			done()
+		}
+		if blk == nil {
+			blk, ok = alloc.Fbread(blkno(b))
+		}
+		if !ok {
+			// leave the bits of a corrupt block allocated
+			continue
+		}
+		blk.Data[byteno(b)] &= ^(1 << uint(byteoffset(b)))
+		dirty = true
+		nfree++
+	}
+	if blk != nil {
+		done()
+	}
+	for b := old; b < old+r.len*bitsperblk; b++ {
+		if free(b) {
+			nfree++
+		}
 	}
+	alloc.runs = append(alloc.runs, r)
+	alloc.freelen += r.len
+	alloc.nfreebits += nfree
 }
 
 func (alloc *bitmap_t) Stats() string {
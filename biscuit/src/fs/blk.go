@@ -4,6 +4,7 @@ import "sync"
 import "fmt"
 import "container/list"
 
+import "defs"
 import "mem"
 
 // If you change this, you must change corresponding constants in litc.c
@@ -33,13 +34,18 @@ type Bdev_block_t struct {
 	Block      int
 	Type       blktype_t
 	_try_evict bool
-	Pa         mem.Pa_t
-	Data       *mem.Bytepg_t
-	Ref        *Objref_t
-	Name       string
-	Mem        Blockmem_i
-	Disk       Disk_i
-	Cb         Block_cb_i
+	// the kind of metadata the block holds, whose checksum the log
+	// computes when logging the block
+	Meta metakind_t
+	// true if the block's checksum didn't match when read from disk
+	Bad  bool
+	Pa   mem.Pa_t
+	Data *mem.Bytepg_t
+	Ref  *Objref_t
+	Name string
+	Mem  Blockmem_i
+	Disk Disk_i
+	Cb   Block_cb_i
 }
 
 type Bdevcmd_t uint
@@ -48,6 +54,10 @@ const (
 	BDEV_WRITE Bdevcmd_t = 1
 	BDEV_READ            = 2
 	BDEV_FLUSH           = 3
+	// tells the disk that the blocks of the request's runs hold nothing
+	// the file system needs (e.g., TRIM); disks that cannot use it
+	// complete it without doing anything
+	BDEV_DISCARD = 4
 )
 
 // A wrapper around List for blocks
@@ -148,6 +158,54 @@ type Bdev_req_t struct {
 	Blks  *BlkList_t
 	AckCh chan bool
 	Sync  bool
+	// set by disks that detect failures (e.g., to -EIO) before they
+	// complete the request
+	Err defs.Err_t
+	// the blocks to discard, for BDEV_DISCARD, which has no Blks
+	Runs []Bdev_run_t
+}
+
+// the blocks Block through Block+N-1
+type Bdev_run_t struct {
+	Block int
+	N     int
+}
+
+// MkDiscard makes a request to discard the blocks of runs
+func MkDiscard(runs []Bdev_run_t, sync bool) *Bdev_req_t {
+	ret := MkRequest(nil, BDEV_DISCARD, sync)
+	ret.Runs = runs
+	return ret
+}
+
+// Inside returns true if req's blocks and runs are all within a disk of nblks
+// blocks
+func (req *Bdev_req_t) Inside(nblks int) bool {
+	if req.Blks != nil {
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if b.Block < 0 || b.Block >= nblks {
+				return false
+			}
+		}
+	}
+	for _, r := range req.Runs {
+		if r.Block < 0 || r.N < 0 || r.Block > nblks-r.N {
+			return false
+		}
+	}
+	return true
+}
+
+// Fail completes req with the error err without doing its I/O. It returns
+// false, as Start does for a completed request.
+func (req *Bdev_req_t) Fail(err defs.Err_t) bool {
+	req.Err = err
+	if req.Cmd == BDEV_WRITE {
+		req.Blks.Apply(func(b *Bdev_block_t) {
+			b.Done("fail")
+		})
+	}
+	return false
 }
 
 func MkRequest(blks *BlkList_t, cmd Bdevcmd_t, sync bool) *Bdev_req_t {
@@ -162,6 +220,149 @@ func MkRequest(blks *BlkList_t, cmd Bdevcmd_t, sync bool) *Bdev_req_t {
 type Disk_i interface {
 	Start(*Bdev_req_t) bool
 	Stats() string
+	// the size of the disk in blocks
+	Nblocks() int
+}
+
+// a disk layered on other disks, like a partition or a mirror
+type Layered_i interface {
+	// the disks under this one
+	Lower() []Disk_i
+}
+
+// the attached disks, by the names of their device files, and the disks that
+// file systems use
+var disks struct {
+	sync.Mutex
+	m       map[string]Disk_i
+	claimed []Disk_i
+}
+
+// Disk_attach makes the disk d available to file systems by name
+func Disk_attach(name string, d Disk_i) defs.Err_t {
+	disks.Lock()
+	defer disks.Unlock()
+
+	if disks.m == nil {
+		disks.m = make(map[string]Disk_i)
+	}
+	if _, ok := disks.m[name]; ok {
+		return -defs.EEXIST
+	}
+	disks.m[name] = d
+	return 0
+}
+
+func Disk_detach(name string) defs.Err_t {
+	disks.Lock()
+	defer disks.Unlock()
+
+	if _, ok := disks.m[name]; !ok {
+		return -defs.ENOENT
+	}
+	delete(disks.m, name)
+	return 0
+}
+
+func Disk_lookup(name string) (Disk_i, bool) {
+	disks.Lock()
+	defer disks.Unlock()
+
+	d, ok := disks.m[name]
+	return d, ok
+}
+
+// Layered returns true if lo is d or a disk under d
+func Layered(d, lo Disk_i) bool {
+	if d == lo {
+		return true
+	}
+	if l, ok := d.(Layered_i); ok {
+		for _, ld := range l.Lower() {
+			if Layered(ld, lo) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Disk_claim records that a file system uses d, failing with -EBUSY if one
+// already uses d, a disk under d, or a disk on top of d. two file systems on
+// the same blocks would overwrite each other's metadata.
+func Disk_claim(d Disk_i) defs.Err_t {
+	disks.Lock()
+	defer disks.Unlock()
+
+	for _, c := range disks.claimed {
+		if Layered(d, c) || Layered(c, d) {
+			return -defs.EBUSY
+		}
+	}
+	disks.claimed = append(disks.claimed, d)
+	return 0
+}
+
+// Disk_release ends the claim of Disk_claim on d
+func Disk_release(d Disk_i) {
+	disks.Lock()
+	defer disks.Unlock()
+
+	for i, c := range disks.claimed {
+		if c == d {
+			copy(disks.claimed[i:], disks.claimed[i+1:])
+			disks.claimed = disks.claimed[:len(disks.claimed)-1]
+			return
+		}
+	}
+}
+
+// Disk_claimed returns true if a file system uses d or a disk on top of d
+func Disk_claimed(d Disk_i) bool {
+	disks.Lock()
+	defer disks.Unlock()
+
+	for _, c := range disks.claimed {
+		if Layered(c, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// the names of the raw disk device files, by minor
+var rawdisks = []string{"rsd0c", "rvd0c", "rnvme0c", "rram0c",
+	"rvd1c", "rvd2c", "rvd3c", "rnvme1c", "rnvme2c", "rnvme3c"}
+
+// Disk_raw returns the disk attached under the name of the raw device
+// with minor min
+func Disk_raw(min int) (Disk_i, bool) {
+	if min < 0 || min >= len(rawdisks) {
+		return nil, false
+	}
+	return Disk_lookup(rawdisks[min])
+}
+
+// Rawdisk_minor returns the minor of the raw device file name, or -1 if
+// there is none
+func Rawdisk_minor(name string) int {
+	for i, n := range rawdisks {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Disk_raws returns the attached raw disks, by minor
+func Disk_raws() []Disk_i {
+	var ret []Disk_i
+	for i := range rawdisks {
+		if d, ok := Disk_raw(i); ok {
+			ret = append(ret, d)
+		}
+	}
+	return ret
 }
 
 func (blk *Bdev_block_t) Key() int {
@@ -209,6 +410,17 @@ func (b *Bdev_block_t) Write() {
 	}
 }
 
+// bdevrw reads or writes b and waits for the disk, returning its error
+func bdevrw(b *Bdev_block_t, cmd Bdevcmd_t) defs.Err_t {
+	l := MkBlkList()
+	l.PushBack(b)
+	req := MkRequest(l, cmd, true)
+	if b.Disk.Start(req) {
+		<-req.AckCh
+	}
+	return req.Err
+}
+
 func (b *Bdev_block_t) Write_async() {
 	if bdev_debug {
 		fmt.Printf("bdev_write_async %v %s\n", b.Block, b.Name)
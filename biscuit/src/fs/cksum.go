@@ -0,0 +1,43 @@
+package fs
+
+import "hash/crc32"
+
+import "util"
+
+// Metadata checksums. The last CKSUMLEN bytes of the superblock, of inode
+// blocks, of bitmap and reference map blocks, and of directory blocks hold a
+// checksum of the rest of the block. The block cache checks the checksum when
+// it reads such a block from disk (Get_meta), and the log computes it when it
+// logs the block. The file system doesn't trust a block whose checksum doesn't
+// match: operations that need it fail with -EIO, and the block is never written
+// back.
+
+type metakind_t int
+
+const (
+	META_NONE metakind_t = iota
+	META_SUPER
+	META_INODE
+	META_BITMAP
+	META_DIR
+	META_REFMAP
+)
+
+const CKSUMLEN = 4
+
+var cksumtab = crc32.MakeTable(crc32.Castagnoli)
+
+func cksum(d []uint8) int {
+	return int(crc32.Checksum(d[:BSIZE-CKSUMLEN], cksumtab))
+}
+
+// Cksum_set stores the checksum of the metadata block d in d
+func Cksum_set(d []uint8) {
+	util.Writen(d, CKSUMLEN, BSIZE-CKSUMLEN, cksum(d))
+}
+
+// Cksum_ok returns true if the checksum stored in the metadata block d matches
+// its contents
+func Cksum_ok(d []uint8) bool {
+	return util.Readn(d, CKSUMLEN, BSIZE-CKSUMLEN) == cksum(d)
+}
@@ -0,0 +1,224 @@
+package fs
+
+import "crypto/aes"
+import "crypto/cipher"
+import "fmt"
+
+import "defs"
+
+// Disk encryption. Crypt_t encrypts the blocks of another disk with AES-XTS,
+// as Linux's dm-crypt does with aes-xts-plain64: each 512-byte sector is an
+// XTS data unit whose tweak is the sector's number. A Crypt_t's key is 32
+// bytes (AES-128) or 64 bytes (AES-256), the first half for the data and the
+// second half for the tweak. The file system and its cache see plaintext;
+// only the disk sees ciphertext.
+
+const XTS_SECTOR = 512
+
+type Xts_t struct {
+	data  cipher.Block
+	tweak cipher.Block
+}
+
+// MkXts returns an AES-XTS cipher with the key k
+func MkXts(k []uint8) (*Xts_t, defs.Err_t) {
+	if len(k) != 32 && len(k) != 64 {
+		return nil, -defs.EINVAL
+	}
+	data, err := aes.NewCipher(k[:len(k)/2])
+	if err != nil {
+		return nil, -defs.EINVAL
+	}
+	tweak, err := aes.NewCipher(k[len(k)/2:])
+	if err != nil {
+		return nil, -defs.EINVAL
+	}
+	return &Xts_t{data: data, tweak: tweak}, 0
+}
+
+// Encrypt encrypts src, the data unit whose tweak is sector, into dst. the
+// length of src must be a multiple of 16.
+func (x *Xts_t) Encrypt(dst, src []uint8, sector uint64) {
+	x.crypt(dst, src, sector, x.data.Encrypt)
+}
+
+// Decrypt decrypts src, the data unit whose tweak is sector, into dst
+func (x *Xts_t) Decrypt(dst, src []uint8, sector uint64) {
+	x.crypt(dst, src, sector, x.data.Decrypt)
+}
+
+func (x *Xts_t) crypt(dst, src []uint8, sector uint64, f func(dst, src []uint8)) {
+	if len(src)%16 != 0 || len(dst) < len(src) {
+		panic("bad XTS data unit")
+	}
+	var t [16]uint8
+	for i := 0; i < 8; i++ {
+		t[i] = uint8(sector >> (8 * uint(i)))
+	}
+	x.tweak.Encrypt(t[:], t[:])
+	var b [16]uint8
+	for off := 0; off < len(src); off += 16 {
+		for i := range b {
+			b[i] = src[off+i] ^ t[i]
+		}
+		f(b[:], b[:])
+		for i := range b {
+			dst[off+i] = b[i] ^ t[i]
+		}
+		// multiply the tweak by x in GF(2^128)
+		carry := t[15] >> 7
+		for i := 15; i > 0; i-- {
+			t[i] = t[i]<<1 | t[i-1]>>7
+		}
+		t[0] <<= 1
+		if carry != 0 {
+			t[0] ^= 0x87
+		}
+	}
+}
+
+// EncryptBlock encrypts src, which is block bn of a disk, into dst
+func (x *Xts_t) EncryptBlock(dst, src []uint8, bn int) {
+	for s := 0; s < BSIZE; s += XTS_SECTOR {
+		x.Encrypt(dst[s:s+XTS_SECTOR], src[s:s+XTS_SECTOR],
+			uint64((bn*BSIZE+s)/XTS_SECTOR))
+	}
+}
+
+// DecryptBlock decrypts src, which is block bn of a disk, into dst
+func (x *Xts_t) DecryptBlock(dst, src []uint8, bn int) {
+	for s := 0; s < BSIZE; s += XTS_SECTOR {
+		x.Decrypt(dst[s:s+XTS_SECTOR], src[s:s+XTS_SECTOR],
+			uint64((bn*BSIZE+s)/XTS_SECTOR))
+	}
+}
+
+type Crypt_t struct {
+	disk Disk_i
+	x    *Xts_t
+	bm   Blockmem_i
+}
+
+// MkCrypt returns a disk that encrypts the blocks of d with the key k
+func MkCrypt(d Disk_i, k []uint8, bm Blockmem_i) (*Crypt_t, defs.Err_t) {
+	x, err := MkXts(k)
+	if err != 0 {
+		return nil, err
+	}
+	return &Crypt_t{disk: d, x: x, bm: bm}, 0
+}
+
+func (c *Crypt_t) Start(req *Bdev_req_t) bool {
+	switch req.Cmd {
+	case BDEV_READ:
+		c.read(req)
+		return false
+	case BDEV_WRITE:
+		return c.write(req)
+	default:
+		return c.disk.Start(req)
+	}
+}
+
+// read reads req's blocks into their pages and decrypts them there
+func (c *Crypt_t) read(req *Bdev_req_t) {
+	blks := MkBlkList()
+	for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+		nb := MkBlock(b.Block, b.Name, b.Mem, c.disk, nil)
+		nb.Pa = b.Pa
+		nb.Data = b.Data
+		blks.PushBack(nb)
+	}
+	nreq := &Bdev_req_t{Cmd: BDEV_READ, Blks: blks, Sync: true}
+	nreq.AckCh = make(chan bool, 1)
+	if c.disk.Start(nreq) {
+		<-nreq.AckCh
+	}
+	req.Err = nreq.Err
+	if req.Err != 0 {
+		return
+	}
+	for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+		c.x.DecryptBlock(b.Data[:], b.Data[:], b.Block)
+	}
+}
+
+// write encrypts copies of req's blocks, since the cache holds the originals,
+// and writes the copies
+func (c *Crypt_t) write(req *Bdev_req_t) bool {
+	blks := MkBlkList()
+	for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+		nb := MkBlock_newpage(b.Block, b.Name, c.bm, c.disk,
+			&cryptcb_t{orig: b})
+		c.x.EncryptBlock(nb.Data[:], b.Data[:], b.Block)
+		blks.PushBack(nb)
+	}
+	nreq := &Bdev_req_t{Cmd: BDEV_WRITE, Blks: blks, Sync: req.Sync}
+	if !req.Sync {
+		return c.disk.Start(nreq)
+	}
+	// wait here, so that req gets nreq's error
+	nreq.AckCh = make(chan bool, 1)
+	if c.disk.Start(nreq) {
+		<-nreq.AckCh
+	}
+	req.Err = nreq.Err
+	return false
+}
+
+func (c *Crypt_t) Lower() []Disk_i {
+	return []Disk_i{c.disk}
+}
+
+func (c *Crypt_t) Stats() string {
+	return c.disk.Stats()
+}
+
+func (c *Crypt_t) Nblocks() int {
+	return c.disk.Nblocks()
+}
+
+type cryptcb_t struct {
+	orig *Bdev_block_t
+}
+
+// frees the ciphertext copy and completes the original
+func (cb *cryptcb_t) Relse(b *Bdev_block_t, s string) {
+	b.Free_page()
+	cb.orig.Done(s)
+}
+
+// Crypt_attach attaches the disk name, encrypted with the key k, as the disk
+// crypt-<name>. an empty key detaches crypt-<name>.
+func Crypt_attach(name string, k []uint8, bm Blockmem_i) defs.Err_t {
+	cn := "crypt-" + name
+	if len(k) == 0 {
+		disks.Lock()
+		c, ok := disks.m[cn].(*Crypt_t)
+		disks.Unlock()
+		if !ok {
+			return -defs.ENXIO
+		}
+		if Disk_claimed(c) {
+			return -defs.EBUSY
+		}
+		Disk_detach(cn)
+		return 0
+	}
+	d, ok := Disk_lookup(name)
+	if !ok {
+		return -defs.ENXIO
+	}
+	if _, ok := d.(*Crypt_t); ok {
+		return -defs.EINVAL
+	}
+	c, err := MkCrypt(d, k, bm)
+	if err != 0 {
+		return err
+	}
+	if err := Disk_attach(cn, c); err != 0 {
+		return err
+	}
+	fmt.Printf("%v: encrypted as %v\n", name, cn)
+	return 0
+}
@@ -177,6 +177,7 @@ func (idm *imemnode_t) _denextempty(opid opid_t) (int, defs.Err_t) {
 
 	b.Unlock()
 	idm.fs.fslog.Write(opid, b) // log empty dir block, later writes absorpt it hopefully
+	idm.dirty(opid, true)
 	idm.fs.fslog.Relse(b, "_denextempty")
 
 	idm.size = newsz
@@ -205,6 +206,7 @@ func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t)
 	b.Unlock()
 	idm.fs.fslog.Write(opid, b)
 	idm.fs.fslog.Relse(b, "_deinsert")
+	idm.dirty(opid, true)
 
 	icd := &icdent_t{offset: noff, inum: inum, name: name}
 	ok := idm._dceadd(name, icd)
@@ -312,6 +314,7 @@ func (idm *imemnode_t) _deremove(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 		b.Unlock()
 		idm.fs.fslog.Write(opid, b)
 		idm.fs.fslog.Relse(b, "_deremove")
+		idm.dirty(opid, true)
 	}
 	idm._deremove_dent(de)
 	idm._deaddempty(de.offset)
@@ -440,13 +443,19 @@ func (idm *imemnode_t) ilookup(opid opid_t, name ustr.Ustr) (*imemnode_t, defs.E
 				panic("parent reffed, must be in icache")
 			}
 		} else {
-			im = idm.fs.icache.Iref(de.inum, "ilookup")
+			im, err = idm.fs.icache.Iget(de.inum, "ilookup")
+			if err != 0 {
+				return nil, err
+			}
 		}
 		atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&de.idm)), unsafe.Pointer(im))
 	} else {
 		if _, ok := de.idm.Refup("ilookup"); !ok {
 			// target imemnode was evicted
-			i := idm.fs.icache.Iref(de.inum, "ilookup")
+			i, err := idm.fs.icache.Iget(de.inum, "ilookup")
+			if err != 0 {
+				return nil, err
+			}
 			atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&de.idm)), unsafe.Pointer(i))
 		}
 	}
@@ -463,7 +472,11 @@ func (idm *imemnode_t) ilookup_validate(opid opid_t, name ustr.Ustr, child *imem
 		if name.Isdot() {
 			de.idm = idm
 		} else {
-			de.idm = idm.fs.icache.Iref(de.inum, "ilookup")
+			i, err := idm.fs.icache.Iget(de.inum, "ilookup")
+			if err != 0 {
+				return false, err
+			}
+			de.idm = i
 		}
 	}
 	return de.idm.inum == child.inum, 0
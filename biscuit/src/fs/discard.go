@@ -0,0 +1,134 @@
+package fs
+
+import "sort"
+import "sync"
+
+// Discards. Bfree notes the transaction that freed each data block; once that
+// transaction has committed, the discarder tells the disk (BDEV_DISCARD) that
+// the block holds nothing the file system needs, batching the freed blocks
+// into runs. The discarder doesn't force commits. With the block allocator's
+// lock held, it skips blocks that were allocated again since they were freed
+// and blocks whose latest free hasn't committed, which a crash would undo, and
+// holds the runs it will discard so that no block is allocated and written
+// while its discard is in flight; it discards without the lock, so
+// allocations of other blocks go on. Only disk file systems discard.
+
+// the most runs in one discard request
+const DISCARD_RUNS = 64
+
+type discard_t struct {
+	sync.Mutex
+	cond *sync.Cond
+	fs   *Fs_t
+	// the freed blocks, with the sequence number of the transaction that
+	// last freed each
+	freed map[int]uint64
+	stop  bool
+	stopc chan bool
+}
+
+func mkDiscard(fs *Fs_t) *discard_t {
+	d := &discard_t{fs: fs}
+	d.cond = sync.NewCond(d)
+	d.freed = make(map[int]uint64)
+	d.stopc = make(chan bool)
+	go d.discarder()
+	return d
+}
+
+// free notes that op opid frees block blkn. the caller must note the free
+// before it marks the block free.
+func (d *discard_t) free(opid opid_t, blkn int) {
+	seq := d.fs.fslog.Opseq(opid)
+	d.Lock()
+	d.freed[blkn] = seq
+	d.Unlock()
+	d.cond.Signal()
+}
+
+// halt discards the blocks freed by committed transactions and stops the
+// discarder. the log must have stopped.
+func (d *discard_t) halt() {
+	d.Lock()
+	d.stop = true
+	d.Unlock()
+	d.cond.Signal()
+	<-d.stopc
+}
+
+func (d *discard_t) discarder() {
+	for {
+		d.Lock()
+		for len(d.freed) == 0 && !d.stop {
+			d.cond.Wait()
+		}
+		stop := d.stop
+		oldest := ^uint64(0)
+		for _, seq := range d.freed {
+			if seq < oldest {
+				oldest = seq
+			}
+		}
+		d.Unlock()
+
+		committed := d.fs.fslog.Waitcommit(oldest)
+		d.discard(committed)
+		if stop {
+			d.stopc <- true
+			return
+		}
+	}
+}
+
+// discard discards the free blocks whose latest free is in a transaction no
+// later than committed
+func (d *discard_t) discard(committed uint64) {
+	balloc := d.fs.balloc
+	balloc.alloc.Lock()
+
+	var blks []int
+	d.Lock()
+	for b, seq := range d.freed {
+		if seq <= committed {
+			delete(d.freed, b)
+			blks = append(blks, b)
+		}
+	}
+	d.Unlock()
+
+	sort.Ints(blks)
+	var runs []Bdev_run_t
+	for _, b := range blks {
+		if !balloc.alloc._isfree(b - balloc.first) {
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1].Block+runs[n-1].N == b {
+			runs[n-1].N++
+			continue
+		}
+		runs = append(runs, Bdev_run_t{Block: b, N: 1})
+	}
+	for _, r := range runs {
+		balloc.alloc._hold(r.Block-balloc.first, r.N)
+	}
+	balloc.alloc.Unlock()
+
+	for i := 0; i < len(runs); i += DISCARD_RUNS {
+		j := i + DISCARD_RUNS
+		if j > len(runs) {
+			j = len(runs)
+		}
+		d.issue(runs[i:j])
+	}
+	for _, r := range runs {
+		balloc.alloc.release(r.Block-balloc.first, r.N)
+	}
+}
+
+// issue discards runs and waits for the disk
+func (d *discard_t) issue(runs []Bdev_run_t) {
+	req := MkDiscard(runs, true)
+	if d.fs.ahci.Start(req) {
+		<-req.AckCh
+	}
+}
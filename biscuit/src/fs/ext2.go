@@ -0,0 +1,855 @@
+package fs
+
+import "sync"
+
+import "bpath"
+import "defs"
+import "fd"
+import "fdops"
+import "mem"
+import "stat"
+import "ustr"
+import "util"
+
+// Ext2_t is a read-only ext2 file system on a disk, read through its own block
+// cache. Since ext2 blocks may be smaller than the cache's blocks, the file
+// system reads byte ranges of the disk rather than blocks. Directories read
+// like ufs directories, omitting the entries whose names are too long for
+// them. Lookups follow symbolic links; absolute link targets are relative to
+// the root of the ext2 file system.
+
+const (
+	ext2_magic   = 0xef53
+	ext2_rootino = defs.Inum_t(2)
+	ext2_ndir    = 12
+	// the only incompatible feature supported: file types in dirents
+	ext2_filetype = 0x2
+	// inode modes
+	ext2_ifmt  = 0xf000
+	ext2_ifreg = 0x8000
+	ext2_ifdir = 0x4000
+	ext2_iflnk = 0xa000
+	ext2_ifchr = 0x2000
+	ext2_ifblk = 0x6000
+	// symbolic links followed by one lookup
+	ext2_maxlinks = 8
+)
+
+type Ext2_t struct {
+	disk    Disk_i
+	bcache  *bcache_t
+	bsize   int
+	nblocks int
+	ninodes int
+	ipg     int
+	isize   int
+	// block of the group descriptor table
+	gdstart int
+	root    *e2inode_t
+	// protects the open inodes
+	sync.Mutex
+	open map[defs.Inum_t]*e2node_t
+	// number of open files, including cwds
+	nopen int
+}
+
+// an inode, which never changes
+type e2inode_t struct {
+	mode   int
+	size   int
+	nsects int
+	blocks [15]int
+	// fast symbolic links store the target in place of the block numbers
+	iblock [60]uint8
+}
+
+// an open inode
+type e2node_t struct {
+	e    *Ext2_t
+	inum defs.Inum_t
+	ino  *e2inode_t
+	// protected by the ext2 lock
+	refs   int
+	flocks filelocks_t
+}
+
+// mounts the ext2 file system on disk d, which no other file system may use
+// until it is unmounted
+func MkExt2(bm Blockmem_i, d Disk_i) (*Ext2_t, defs.Err_t) {
+	if err := Disk_claim(d); err != 0 {
+		return nil, err
+	}
+	e, err := mkExt2(bm, d)
+	if err != 0 {
+		Disk_release(d)
+	}
+	return e, err
+}
+
+func mkExt2(bm Blockmem_i, d Disk_i) (*Ext2_t, defs.Err_t) {
+	e := &Ext2_t{disk: d, bcache: mkBcache(bm, d)}
+	e.open = make(map[defs.Inum_t]*e2node_t)
+
+	sb := make([]uint8, 1024)
+	e.readat(sb, 1024)
+	if util.Readn(sb, 2, 56) != ext2_magic {
+		return nil, -defs.EINVAL
+	}
+	if util.Readn(sb, 4, 96)&^ext2_filetype != 0 {
+		return nil, -defs.EINVAL
+	}
+	e.ninodes = util.Readn(sb, 4, 0)
+	e.nblocks = util.Readn(sb, 4, 4)
+	e.bsize = 1024 << uint(util.Readn(sb, 4, 24))
+	e.ipg = util.Readn(sb, 4, 40)
+	e.isize = 128
+	if util.Readn(sb, 4, 76) >= 1 {
+		e.isize = util.Readn(sb, 2, 88)
+	}
+	if e.bsize > BSIZE || e.ipg == 0 || e.isize < 128 {
+		return nil, -defs.EINVAL
+	}
+	e.gdstart = util.Readn(sb, 4, 20) + 1
+
+	root, err := e.iget(ext2_rootino)
+	if err != 0 {
+		return nil, err
+	}
+	if root.mode&ext2_ifmt != ext2_ifdir {
+		return nil, -defs.EINVAL
+	}
+	e.root = root
+	return e, 0
+}
+
+// copies the bytes of the disk at off into dst
+func (e *Ext2_t) readat(dst []uint8, off int) {
+	for len(dst) != 0 {
+		b := e.bcache.Get_fill(off/BSIZE, "ext2", false)
+		c := copy(dst, b.Data[off%BSIZE:])
+		e.bcache.Relse(b, "ext2")
+		dst = dst[c:]
+		off += c
+	}
+}
+
+func (e *Ext2_t) iget(inum defs.Inum_t) (*e2inode_t, defs.Err_t) {
+	if inum < 1 || int(inum) > e.ninodes {
+		return nil, -defs.EIO
+	}
+	g := int(inum-1) / e.ipg
+	i := int(inum-1) % e.ipg
+	gd := make([]uint8, 32)
+	e.readat(gd, e.gdstart*e.bsize+g*32)
+	itable := util.Readn(gd, 4, 8)
+	if itable == 0 || itable >= e.nblocks {
+		return nil, -defs.EIO
+	}
+
+	raw := make([]uint8, 128)
+	e.readat(raw, itable*e.bsize+i*e.isize)
+	ino := &e2inode_t{}
+	ino.mode = util.Readn(raw, 2, 0)
+	ino.size = util.Readn(raw, 4, 4)
+	if ino.mode&ext2_ifmt == ext2_ifreg {
+		ino.size |= util.Readn(raw, 4, 108) << 32
+	}
+	ino.nsects = util.Readn(raw, 4, 28)
+	for j := range ino.blocks {
+		ino.blocks[j] = util.Readn(raw, 4, 40+4*j)
+	}
+	copy(ino.iblock[:], raw[40:100])
+	return ino, 0
+}
+
+// returns the disk block of the file's block fbn, or 0 if it is a hole
+func (e *Ext2_t) bmap(ino *e2inode_t, fbn int) (int, defs.Err_t) {
+	var blk int
+	if fbn < ext2_ndir {
+		blk = ino.blocks[fbn]
+	} else {
+		// the number of block numbers per indirect block
+		apb := e.bsize / 4
+		fbn -= ext2_ndir
+		var level int
+		switch {
+		case fbn < apb:
+			blk, level = ino.blocks[12], 1
+		case fbn < apb+apb*apb:
+			fbn -= apb
+			blk, level = ino.blocks[13], 2
+		case fbn < apb+apb*apb+apb*apb*apb:
+			fbn -= apb + apb*apb
+			blk, level = ino.blocks[14], 3
+		default:
+			return 0, -defs.EFBIG
+		}
+		buf := make([]uint8, 4)
+		for ; level > 0 && blk != 0; level-- {
+			if blk >= e.nblocks {
+				return 0, -defs.EIO
+			}
+			div := 1
+			for i := 1; i < level; i++ {
+				div *= apb
+			}
+			e.readat(buf, blk*e.bsize+fbn/div*4)
+			fbn %= div
+			blk = util.Readn(buf, 4, 0)
+		}
+	}
+	if blk >= e.nblocks {
+		return 0, -defs.EIO
+	}
+	return blk, 0
+}
+
+// copies the file's bytes at offset into dst and returns the number copied
+func (e *Ext2_t) fread(ino *e2inode_t, dst []uint8, offset int) (int, defs.Err_t) {
+	c := 0
+	for c < len(dst) && offset < ino.size {
+		s := offset % e.bsize
+		m := min(min(e.bsize-s, ino.size-offset), len(dst)-c)
+		blk, err := e.bmap(ino, offset/e.bsize)
+		if err != 0 {
+			return c, err
+		}
+		if blk == 0 {
+			copy(dst[c:c+m], zeroblk[:])
+		} else {
+			e.readat(dst[c:c+m], blk*e.bsize+s)
+		}
+		c += m
+		offset += m
+	}
+	return c, 0
+}
+
+// calls f with the name and inode number of each entry of the directory until
+// f returns true. f must copy the name to keep it.
+func (e *Ext2_t) diriter(ino *e2inode_t, f func(ustr.Ustr, defs.Inum_t) bool) defs.Err_t {
+	if ino.mode&ext2_ifmt != ext2_ifdir {
+		return -defs.ENOTDIR
+	}
+	buf := make([]uint8, e.bsize)
+	for off := 0; off < ino.size; off += e.bsize {
+		blk, err := e.bmap(ino, off/e.bsize)
+		if err != 0 {
+			return err
+		}
+		if blk == 0 {
+			continue
+		}
+		e.readat(buf, blk*e.bsize)
+		for p := 0; p+8 <= e.bsize; {
+			inum := util.Readn(buf, 4, p)
+			reclen := util.Readn(buf, 2, p+4)
+			namelen := int(buf[p+6])
+			if reclen < 8 || p+reclen > e.bsize || 8+namelen > reclen {
+				return -defs.EIO
+			}
+			name := ustr.Ustr(buf[p+8 : p+8+namelen])
+			if inum != 0 && f(name, defs.Inum_t(inum)) {
+				return 0
+			}
+			p += reclen
+		}
+	}
+	return 0
+}
+
+func (e *Ext2_t) lookup(dir *e2inode_t, name ustr.Ustr) (defs.Inum_t, defs.Err_t) {
+	var ret defs.Inum_t
+	err := e.diriter(dir, func(n ustr.Ustr, inum defs.Inum_t) bool {
+		if n.Eq(name) {
+			ret = inum
+			return true
+		}
+		return false
+	})
+	if err != 0 {
+		return 0, err
+	}
+	if ret == 0 {
+		return 0, -defs.ENOENT
+	}
+	return ret, 0
+}
+
+func (e *Ext2_t) readlink(ino *e2inode_t) (ustr.Ustr, defs.Err_t) {
+	if ino.size >= BSIZE {
+		return nil, -defs.ENAMETOOLONG
+	}
+	if ino.nsects == 0 && ino.size < len(ino.iblock) {
+		return append(ustr.Ustr{}, ino.iblock[:ino.size]...), 0
+	}
+	ret := make([]uint8, ino.size)
+	if _, err := e.fread(ino, ret, 0); err != 0 {
+		return nil, err
+	}
+	return ustr.Ustr(ret), 0
+}
+
+// returns the inode at paths, relative to the directory cwd, following
+// symbolic links
+func (e *Ext2_t) namei(paths ustr.Ustr, cwd *fd.Cwd_t) (defs.Inum_t, *e2inode_t, defs.Err_t) {
+	start := ext2_rootino
+	if !paths.IsAbsolute() {
+		fo, ok := cwd.Fd.Fops.(*e2fops_t)
+		if !ok || fo.node.e != e {
+			return 0, nil, -defs.ENOENT
+		}
+		start = fo.node.inum
+	}
+	nlinks := 0
+	return e._namei(start, paths, &nlinks)
+}
+
+func (e *Ext2_t) _namei(inum defs.Inum_t, paths ustr.Ustr, nlinks *int) (defs.Inum_t, *e2inode_t, defs.Err_t) {
+	ino, err := e.iget(inum)
+	if err != 0 {
+		return 0, nil, err
+	}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for c, ok := pp.Next(); ok; c, ok = pp.Next() {
+		if ino.mode&ext2_ifmt != ext2_ifdir {
+			return 0, nil, -defs.ENOTDIR
+		}
+		if c.Isdot() {
+			continue
+		}
+		next, err := e.lookup(ino, c)
+		if err != 0 {
+			return 0, nil, err
+		}
+		nino, err := e.iget(next)
+		if err != 0 {
+			return 0, nil, err
+		}
+		if nino.mode&ext2_ifmt == ext2_iflnk {
+			if *nlinks++; *nlinks > ext2_maxlinks {
+				return 0, nil, -defs.ELOOP
+			}
+			target, err := e.readlink(nino)
+			if err != 0 {
+				return 0, nil, err
+			}
+			base := inum
+			if target.IsAbsolute() {
+				base = ext2_rootino
+			}
+			next, nino, err = e._namei(base, target, nlinks)
+			if err != 0 {
+				return 0, nil, err
+			}
+		}
+		inum, ino = next, nino
+	}
+	return inum, ino, 0
+}
+
+func (e *Ext2_t) stat(inum defs.Inum_t, ino *e2inode_t, st *stat.Stat_t) {
+	st.Wdev(0)
+	st.Wino(uint(inum))
+	var maj, min int
+	switch ino.mode & ext2_ifmt {
+	case ext2_ifdir:
+		st.Wmode(stat.S_IFDIR)
+	case ext2_ifreg:
+		st.Wmode(stat.S_IFREG)
+	default:
+		if t := ino.mode & ext2_ifmt; t == ext2_ifchr || t == ext2_ifblk {
+			// the old encoding, or else the new one
+			if d := ino.blocks[0]; d != 0 {
+				maj, min = d>>8&0xff, d&0xff
+			} else {
+				d = ino.blocks[1]
+				maj, min = d>>8&0xfff, d&0xff
+			}
+		}
+		st.Wmode(defs.Mkdev(maj, min))
+	}
+	st.Wsize(uint(ino.size))
+	st.Wrdev(defs.Mkdev(maj, min))
+	st.Wblocks(uint(ino.nsects))
+}
+
+// returns the open inode inum, opening it if necessary
+func (e *Ext2_t) iopen(inum defs.Inum_t, ino *e2inode_t) *e2node_t {
+	e.Lock()
+	defer e.Unlock()
+
+	n, ok := e.open[inum]
+	if !ok {
+		n = &e2node_t{e: e, inum: inum, ino: ino}
+		e.open[inum] = n
+	}
+	n.refs++
+	e.nopen++
+	return n
+}
+
+func (e *Ext2_t) iclose(n *e2node_t) {
+	e.Lock()
+	defer e.Unlock()
+
+	n.refs--
+	e.nopen--
+	if n.refs == 0 {
+		delete(e.open, n.inum)
+	}
+}
+
+func (e *Ext2_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	creat := flags&defs.O_CREAT != 0
+	inum, ino, err := e.namei(paths, cwd)
+	if err != 0 {
+		if err == -defs.ENOENT && creat {
+			return nil, -defs.EROFS
+		}
+		return nil, err
+	}
+	if creat && flags&defs.O_EXCL != 0 {
+		return nil, -defs.EEXIST
+	}
+	isdir := ino.mode&ext2_ifmt == ext2_ifdir
+	wantwrite := flags&(defs.O_WRONLY|defs.O_RDWR) != 0
+	if flags&defs.O_DIRECTORY != 0 && !isdir {
+		return nil, -defs.ENOTDIR
+	}
+	if (creat || wantwrite) && isdir {
+		return nil, -defs.EISDIR
+	}
+	if wantwrite {
+		return nil, -defs.EROFS
+	}
+	if t := ino.mode & ext2_ifmt; t != ext2_ifreg && t != ext2_ifdir {
+		return nil, -defs.ENXIO
+	}
+	n := e.iopen(inum, ino)
+	return &fd.Fd_t{Fops: &e2fops_t{node: n, count: 1}}, 0
+}
+
+func (e *Ext2_t) Fs_mknod(paths ustr.Ustr, excl bool, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	return 0, -defs.EROFS
+}
+
+func (e *Ext2_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	inum, ino, err := e.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	e.stat(inum, ino, st)
+	return 0
+}
+
+func (e *Ext2_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (e *Ext2_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (e *Ext2_t) Fs_linkat(old ustr.Ustr, ocwd *fd.Cwd_t, new ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (e *Ext2_t) Fs_renameat(oldp ustr.Ustr, ocwd *fd.Cwd_t, newp ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (e *Ext2_t) Fs_atcwd(f *fd.Fd_t) (*fd.Cwd_t, defs.Err_t) {
+	fo, ok := f.Fops.(*e2fops_t)
+	if !ok || fo.node.e != e || fo.node.ino.mode&ext2_ifmt != ext2_ifdir {
+		return nil, -defs.ENOTDIR
+	}
+	nf, err := fd.Copyfd(f)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Cwd_t{Fd: nf}, 0
+}
+
+func (e *Ext2_t) Fs_owns(f *fd.Fd_t) bool {
+	fo, ok := f.Fops.(*e2fops_t)
+	return ok && fo.node.e == e && fo.node.ino.mode&ext2_ifmt == ext2_ifdir
+}
+
+func (e *Ext2_t) MkRootCwd() *fd.Cwd_t {
+	n := &e2node_t{e: e, inum: ext2_rootino, ino: e.root}
+	f := &fd.Fd_t{Fops: &e2fops_t{node: n, count: 0}}
+	return fd.MkRootCwd(f)
+}
+
+func (e *Ext2_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+func (e *Ext2_t) Fs_unmount() defs.Err_t {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.nopen != 0 {
+		return -defs.EBUSY
+	}
+	Disk_release(e.disk)
+	return 0
+}
+
+type e2fops_t struct {
+	node *e2node_t
+	// protects offset
+	sync.Mutex
+	offset int
+	count  int
+	// true if the open file may hold a flock lock
+	flocked bool
+}
+
+// copies the directory, in the ufs directory format, starting at offset to
+// dst
+func (fo *e2fops_t) dirread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	var names []ustr.Ustr
+	var inums []defs.Inum_t
+	e := fo.node.e
+	err := e.diriter(fo.node.ino, func(n ustr.Ustr, inum defs.Inum_t) bool {
+		if len(n) <= DNAMELEN {
+			names = append(names, append(ustr.Ustr{}, n...))
+			inums = append(inums, inum)
+		}
+		return false
+	})
+	if err != 0 {
+		return 0, err
+	}
+	buf := make([]uint8, BSIZE)
+	dd := &Dirdata_t{Data: buf}
+	size := util.Roundup(len(names), NDIRENTS) / NDIRENTS * BSIZE
+	c := 0
+	for offset < size && dst.Remain() != 0 {
+		copy(buf, zeroblk[:])
+		for i := 0; i < NDIRENTS; i++ {
+			if slot := offset/BSIZE*NDIRENTS + i; slot < len(names) {
+				dd.W_filename(i, names[slot])
+				dd.W_inodenext(i, inums[slot])
+			}
+		}
+		wrote, err := dst.Uiowrite(buf[offset%BSIZE:])
+		c += wrote
+		offset += wrote
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+func (fo *e2fops_t) fileread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	buf := make([]uint8, BSIZE)
+	c := 0
+	for dst.Remain() != 0 {
+		n, err := fo.node.e.fread(fo.node.ino, buf[:min(BSIZE, dst.Remain())], offset)
+		if err != 0 {
+			return c, err
+		}
+		if n == 0 {
+			break
+		}
+		wrote, err := dst.Uiowrite(buf[:n])
+		c += wrote
+		offset += wrote
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+func (fo *e2fops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	useoffset := toff != -1
+	offset := fo.offset
+	if useoffset {
+		offset = toff
+	}
+	var did int
+	var err defs.Err_t
+	if fo.node.ino.mode&ext2_ifmt == ext2_ifdir {
+		did, err = fo.dirread(dst, offset)
+	} else {
+		did, err = fo.fileread(dst, offset)
+	}
+	if !useoffset && err == 0 {
+		fo.offset += did
+	}
+	return did, err
+}
+
+func (fo *e2fops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return fo._read(dst, -1)
+}
+
+func (fo *e2fops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return fo._read(dst, offset)
+}
+
+func (fo *e2fops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EROFS
+}
+
+func (fo *e2fops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.EROFS
+}
+
+func (fo *e2fops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (fo *e2fops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (fo *e2fops_t) Fsync(datasync bool) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	return 0
+}
+
+func (fo *e2fops_t) Flock(op int) defs.Err_t {
+	switch op &^ defs.LOCK_NB {
+	case defs.LOCK_SH, defs.LOCK_EX, defs.LOCK_UN:
+	default:
+		return -defs.EINVAL
+	}
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	fo.flocked = true
+	// don't hold fo's lock while waiting for the lock
+	fo.Unlock()
+	return fo.node.flocks.flock(fo, op)
+}
+
+func (fo *e2fops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	if err := lkcheck(cmd, lk); err != 0 {
+		return err
+	}
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	base := 0
+	switch lk.Whence {
+	case defs.SEEK_SET:
+	case defs.SEEK_CUR:
+		base = fo.offset
+	case defs.SEEK_END:
+		base = fo.node.ino.size
+	default:
+		fo.Unlock()
+		return -defs.EINVAL
+	}
+	// don't hold fo's lock while waiting for the lock
+	fo.Unlock()
+	return fo.node.flocks.lockrec(pid, cmd, lk, base)
+}
+
+func (fo *e2fops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.node.e.stat(fo.node.inum, fo.node.ino, st)
+	return 0
+}
+
+func (fo *e2fops_t) Close() defs.Err_t {
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	fo.count--
+	if fo.count == 0 && fo.flocked {
+		fo.node.flocks.funlock(fo)
+	}
+	fo.Unlock()
+	fo.node.e.iclose(fo.node)
+	return 0
+}
+
+func (fo *e2fops_t) Pathi() defs.Inum_t {
+	return fo.node.inum
+}
+
+func (fo *e2fops_t) Reopen() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.node.e.iopen(fo.node.inum, fo.node.ino)
+	fo.count++
+	return 0
+}
+
+func (fo *e2fops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	ino := fo.node.ino
+	switch whence {
+	case defs.SEEK_SET:
+		fo.offset = off
+	case defs.SEEK_CUR:
+		fo.offset += off
+	case defs.SEEK_END:
+		fo.offset = ino.size + off
+	case defs.SEEK_DATA, defs.SEEK_HOLE:
+		n, err := fo.node.e.seekhole(ino, off, whence == defs.SEEK_HOLE)
+		if err != 0 {
+			return 0, err
+		}
+		fo.offset = n
+	default:
+		return 0, -defs.EINVAL
+	}
+	if fo.offset < 0 {
+		fo.offset = 0
+	}
+	return fo.offset, 0
+}
+
+func (e *Ext2_t) seekhole(ino *e2inode_t, off int, hole bool) (int, defs.Err_t) {
+	if off < 0 || off >= ino.size {
+		return 0, -defs.ENXIO
+	}
+	for fbn := off / e.bsize; fbn*e.bsize < ino.size; fbn++ {
+		blk, err := e.bmap(ino, fbn)
+		if err != 0 {
+			return 0, err
+		}
+		if (blk == 0) == hole {
+			if fbn*e.bsize > off {
+				off = fbn * e.bsize
+			}
+			return off, 0
+		}
+	}
+	if hole {
+		return ino.size, 0
+	}
+	return 0, -defs.ENXIO
+}
+
+// returns copies of the file's pages, which never change
+func (fo *e2fops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return nil, -defs.EBADF
+	}
+
+	e := fo.node.e
+	ino := fo.node.ino
+	if ino.mode&ext2_ifmt != ext2_ifreg {
+		return nil, -defs.ENODEV
+	}
+	if offset >= ino.size {
+		return nil, -defs.EINVAL
+	}
+	if len == -1 || offset+len > ino.size {
+		len = ino.size - offset
+	}
+	o := util.Rounddown(offset, mem.PGSIZE)
+	len = util.Roundup(offset+len, mem.PGSIZE) - o
+	ret := make([]mem.Mmapinfo_t, len/mem.PGSIZE)
+	for i := range ret {
+		pa, pg, ok := e.bcache.mem.Alloc()
+		if !ok {
+			for _, mi := range ret[:i] {
+				e.bcache.mem.Free(mi.Phys)
+			}
+			return nil, -defs.ENOMEM
+		}
+		ret[i].Pg = mem.Bytepg2pg(pg)
+		ret[i].Phys = pa
+		n, err := e.fread(ino, pg[:], o+i*mem.PGSIZE)
+		if err != 0 {
+			for _, mi := range ret[:i+1] {
+				e.bcache.mem.Free(mi.Phys)
+			}
+			return nil, err
+		}
+		copy(pg[n:], zeroblk[:])
+	}
+	return ret, 0
+}
+
+// the pages of mappings are copies, thus need no pinning
+func (fo *e2fops_t) Unpin(pa mem.Pa_t) {
+}
+
+func (fo *e2fops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
+}
+
+func (fo *e2fops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (fo *e2fops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *e2fops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
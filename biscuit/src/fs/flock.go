@@ -0,0 +1,295 @@
+package fs
+
+import "sync"
+
+import "defs"
+import "fdops"
+import "proc"
+
+// Advisory file locks.  As on Linux, a file has two independent kinds of
+// locks: flock(2) locks, which lock the whole file and are owned by an open
+// file (and thus shared by dup'ed and inherited descriptors), and POSIX record
+// locks (fcntl(2)), which lock a byte range and are owned by a process.  Both
+// kinds are kept in the inode's lock list.  The inode stays in the icache
+// while it has locks, since the open files of the owners hold references, and
+// the locks are released when the owners close the file.
+
+// the end of a lock that extends to the end of the file, however large the
+// file grows
+const lkeof = int(^uint(0) >> 1)
+
+type filelock_t struct {
+	excl  bool
+	start int
+	end   int           // exclusive
+	pid   int           // owner of a record lock
+	fo    fdops.Fdops_i // owner of a flock lock; nil for record locks
+}
+
+func (l *filelock_t) overlaps(start, end int) bool {
+	return l.start < end && start < l.end
+}
+
+type filelocks_t struct {
+	sync.Mutex
+	cond  *sync.Cond
+	locks []*filelock_t
+}
+
+// returns non-zero if the caller was killed while waiting
+func (fl *filelocks_t) wait() defs.Err_t {
+	if fl.cond == nil {
+		fl.cond = sync.NewCond(fl)
+	}
+	return proc.KillableWait(fl.cond)
+}
+
+func (fl *filelocks_t) wakeup() {
+	if fl.cond != nil {
+		fl.cond.Broadcast()
+	}
+}
+
+// removes the locks for which f returns true
+func (fl *filelocks_t) remove(f func(*filelock_t) bool) {
+	nl := fl.locks[:0]
+	for _, l := range fl.locks {
+		if !f(l) {
+			nl = append(nl, l)
+		}
+	}
+	if len(nl) != len(fl.locks) {
+		for i := len(nl); i < len(fl.locks); i++ {
+			fl.locks[i] = nil
+		}
+		fl.locks = nl
+		fl.wakeup()
+	}
+}
+
+// returns a flock lock of another open file than fo that conflicts with
+// locking the file shared or exclusive
+func (fl *filelocks_t) flockconflict(fo fdops.Fdops_i, excl bool) *filelock_t {
+	for _, l := range fl.locks {
+		if l.fo != nil && l.fo != fo && (excl || l.excl) {
+			return l
+		}
+	}
+	return nil
+}
+
+// acquires, converts, or releases fo's flock lock. converting a lock releases
+// the old lock first, as on Linux.
+func (fl *filelocks_t) flock(fo fdops.Fdops_i, op int) defs.Err_t {
+	fl.Lock()
+	defer fl.Unlock()
+
+	fl.remove(func(l *filelock_t) bool {
+		return l.fo == fo
+	})
+	if op&defs.LOCK_UN != 0 {
+		return 0
+	}
+	excl := op&defs.LOCK_EX != 0
+	for fl.flockconflict(fo, excl) != nil {
+		if op&defs.LOCK_NB != 0 {
+			return -defs.EWOULDBLOCK
+		}
+		if err := fl.wait(); err != 0 {
+			return err
+		}
+	}
+	nl := &filelock_t{excl: excl, start: 0, end: lkeof, fo: fo}
+	fl.locks = append(fl.locks, nl)
+	return 0
+}
+
+// releases fo's flock lock, if any
+func (fl *filelocks_t) funlock(fo fdops.Fdops_i) {
+	fl.Lock()
+	fl.remove(func(l *filelock_t) bool {
+		return l.fo == fo
+	})
+	fl.Unlock()
+}
+
+// returns a record lock of another process than pid that conflicts with a
+// shared or exclusive lock of [start, end)
+func (fl *filelocks_t) recconflict(pid int, excl bool, start, end int) *filelock_t {
+	for _, l := range fl.locks {
+		if l.fo == nil && l.pid != pid && l.overlaps(start, end) &&
+			(excl || l.excl) {
+			return l
+		}
+	}
+	return nil
+}
+
+// sets the type of pid's lock on [start, end), which unlocks the range if typ
+// is F_UNLCK. pid's locks overlapping the range are trimmed or split.
+func (fl *filelocks_t) recset(pid, typ, start, end int) {
+	nl := make([]*filelock_t, 0, len(fl.locks)+2)
+	for _, l := range fl.locks {
+		if l.fo != nil || l.pid != pid || !l.overlaps(start, end) {
+			nl = append(nl, l)
+			continue
+		}
+		if l.start < start {
+			nl = append(nl, &filelock_t{excl: l.excl, start: l.start,
+				end: start, pid: pid})
+		}
+		if l.end > end {
+			nl = append(nl, &filelock_t{excl: l.excl, start: end,
+				end: l.end, pid: pid})
+		}
+	}
+	if typ != defs.F_UNLCK {
+		nl = append(nl, &filelock_t{excl: typ == defs.F_WRLCK,
+			start: start, end: end, pid: pid})
+	}
+	fl.locks = nl
+	fl.wakeup()
+}
+
+// sets pid's lock on [start, end), waiting for conflicting locks to be
+// released if wait is true.
+func (fl *filelocks_t) reclock(pid, typ, start, end int, wait bool) defs.Err_t {
+	fl.Lock()
+	defer fl.Unlock()
+
+	if typ == defs.F_UNLCK {
+		for _, l := range fl.locks {
+			if l.fo == nil && l.pid == pid {
+				fl.recset(pid, typ, start, end)
+				break
+			}
+		}
+		return 0
+	}
+	for {
+		l := fl.recconflict(pid, typ == defs.F_WRLCK, start, end)
+		if l == nil {
+			break
+		}
+		if !wait {
+			return -defs.EAGAIN
+		}
+		if !lkwaits.add(pid, l.pid) {
+			return -defs.EDEADLK
+		}
+		err := fl.wait()
+		lkwaits.del(pid)
+		if err != 0 {
+			return err
+		}
+	}
+	fl.recset(pid, typ, start, end)
+	return 0
+}
+
+// describes in lk the first lock of another process than pid that conflicts
+// with lk, or sets lk's type to F_UNLCK if there is none.
+func (fl *filelocks_t) getlk(pid int, lk *fdops.Flock_t, start, end int) {
+	fl.Lock()
+	defer fl.Unlock()
+
+	l := fl.recconflict(pid, lk.Type == defs.F_WRLCK, start, end)
+	if l == nil {
+		lk.Type = defs.F_UNLCK
+		return
+	}
+	lk.Type = defs.F_RDLCK
+	if l.excl {
+		lk.Type = defs.F_WRLCK
+	}
+	lk.Whence = defs.SEEK_SET
+	lk.Start = l.start
+	lk.Len = 0
+	if l.end != lkeof {
+		lk.Len = l.end - l.start
+	}
+	lk.Pid = l.pid
+}
+
+// returns an error if lk isn't a valid lock for cmd
+func lkcheck(cmd int, lk *fdops.Flock_t) defs.Err_t {
+	switch lk.Type {
+	case defs.F_RDLCK, defs.F_WRLCK:
+	case defs.F_UNLCK:
+		if cmd == defs.F_GETLK {
+			return -defs.EINVAL
+		}
+	default:
+		return -defs.EINVAL
+	}
+	return 0
+}
+
+// gets (F_GETLK) or sets (F_SETLK, F_SETLKW) pid's record lock lk, whose range
+// is relative to base
+func (fl *filelocks_t) lockrec(pid, cmd int, lk *fdops.Flock_t, base int) defs.Err_t {
+	start, end, err := lkrange(lk, base)
+	if err != 0 {
+		return err
+	}
+	switch cmd {
+	case defs.F_GETLK:
+		fl.getlk(pid, lk, start, end)
+	case defs.F_SETLK, defs.F_SETLKW:
+		err = fl.reclock(pid, lk.Type, start, end, cmd == defs.F_SETLKW)
+	default:
+		err = -defs.EINVAL
+	}
+	return err
+}
+
+// converts the range of lk, relative to base, to [start, end)
+func lkrange(lk *fdops.Flock_t, base int) (int, int, defs.Err_t) {
+	start := base + lk.Start
+	end := lkeof
+	if lk.Len > 0 {
+		end = start + lk.Len
+	} else if lk.Len < 0 {
+		end = start
+		start += lk.Len
+	}
+	if start < 0 || end < start {
+		return 0, 0, -defs.EINVAL
+	}
+	return start, end, 0
+}
+
+// the processes that wait for a record lock, and the owner of the lock each
+// waits for. a process that would wait, transitively, for itself deadlocks.
+type lkwaits_t struct {
+	sync.Mutex
+	waits map[int]int
+}
+
+var lkwaits = &lkwaits_t{waits: make(map[int]int)}
+
+// records that pid waits for owner, unless that deadlocks
+func (lw *lkwaits_t) add(pid, owner int) bool {
+	lw.Lock()
+	defer lw.Unlock()
+
+	o := owner
+	for i := 0; i <= len(lw.waits); i++ {
+		if o == pid {
+			return false
+		}
+		next, ok := lw.waits[o]
+		if !ok {
+			break
+		}
+		o = next
+	}
+	lw.waits[pid] = owner
+	return true
+}
+
+func (lw *lkwaits_t) del(pid int) {
+	lw.Lock()
+	delete(lw.waits, pid)
+	lw.Unlock()
+}
@@ -27,14 +27,18 @@ type Fs_t struct {
 	ahci         Disk_i
 	superb_start int
 	superb       Superblock_t
+	growl        sync.Mutex // serializes Fs_grow
 	bcache       *bcache_t
 	icache       *icache_t
 	fslog        *log_t
 	ialloc       *ibitmap_t
 	balloc       *bbitmap_t
+	refmap       *refmap_t
+	discard      *discard_t // nil if the file system doesn't discard
 	istats       *inode_stats_t
 	root         *imemnode_t
 	diskfs       bool // disk or in-mem file system?
+	claimed      bool // the disk was claimed by MountFS
 }
 
 func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd.Fd_t, *Fs_t) {
@@ -47,6 +51,84 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	// reset taken
 	limits.Syslimit = limits.MkSysLimit()
 
+	fs := startfs(mem, disk, diskfs)
+	return &fd.Fd_t{Fops: &fsfops_t{priv: iroot, fs: fs, count: 1}}, fs
+}
+
+// MountFS starts the file system on disk for mount(2). Unlike StartFS, which
+// trusts the boot disk, it first checks that the disk holds a file system
+// whose metadata fits on it, and that no other file system uses the disk
+// (Disk_claim) until the file system is unmounted.
+func MountFS(mem Blockmem_i, disk Disk_i) (*Fs_t, defs.Err_t) {
+	if err := Disk_claim(disk); err != 0 {
+		return nil, err
+	}
+	if err := Fs_ok(mem, disk); err != 0 {
+		Disk_release(disk)
+		return nil, err
+	}
+	fs := startfs(mem, disk, true)
+	fs.claimed = true
+	return fs, 0
+}
+
+// File_disk returns the disk that stores the file open as f, if f is open on
+// a disk file system
+func File_disk(f fdops.Fdops_i) (Disk_i, bool) {
+	switch fo := f.(type) {
+	case *fsfops_t:
+		return fo.fs.ahci, fo.fs.diskfs
+	case *e2fops_t:
+		return fo.node.e.disk, true
+	}
+	return nil, false
+}
+
+// Fs_ok returns -EINVAL unless disk has a superblock with a good checksum and
+// a geometry that fits on the disk
+func Fs_ok(mem Blockmem_i, disk Disk_i) defs.Err_t {
+	n := disk.Nblocks()
+	b := MkBlock_newpage(0, "fsok", mem, disk, nil)
+	defer b.Free_page()
+	if n < 2 {
+		return -defs.EINVAL
+	}
+	if err := bdevrw(b, BDEV_READ); err != 0 {
+		return err
+	}
+	start := util.Readn(b.Data[:], 4, FSOFF)
+	if start <= 0 || start >= n {
+		return -defs.EINVAL
+	}
+	b.Block = start
+	if err := bdevrw(b, BDEV_READ); err != 0 {
+		return err
+	}
+	sb := Superblock_t{b.Data}
+	if m := sb.Version_err(); m != "" {
+		fmt.Printf("%v\n", m)
+		return -defs.EINVAL
+	}
+	if !Cksum_ok(b.Data[:]) {
+		return -defs.EINVAL
+	}
+	if sb.Loglen() <= 0 || sb.Loglen() > n-start-1 ||
+		sb.Iorphanlen() != sb.Imaplen() || sb.Lastblock() > n ||
+		sb.Ngroups() < 0 || sb.Ngroups() > MAXGROUPS {
+		return -defs.EINVAL
+	}
+	l := sb.layout()
+	for _, runs := range [][]run_t{l.orphan, l.imap, l.refmap, l.bmap, l.inodes} {
+		for _, r := range runs {
+			if r.start <= start || r.len < 0 || r.start > n-r.len {
+				return -defs.EINVAL
+			}
+		}
+	}
+	return 0
+}
+
+func startfs(mem Blockmem_i, disk Disk_i, diskfs bool) *Fs_t {
 	fs := &Fs_t{}
 	fs.diskfs = diskfs
 	fs.ahci = disk
@@ -67,10 +149,17 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	}
 	fs.bcache.Relse(b, "fs_init")
 
-	// superblock is never changed, so reading before recovery is fine
-	b = fs.bcache.Get_fill(fs.superb_start, "super", false) // don't relse b, because superb is global
-
+	// only Fs_grow changes the superblock, and never its log length, so
+	// reading the log length before recovery is fine. recovery installs
+	// the superblock of a committed grow into b.
+	b, err := fs.bcache.Get_meta(fs.superb_start, META_SUPER, "super", false) // don't relse b, because superb is global
 	fs.superb = Superblock_t{b.Data}
+	if m := fs.superb.Version_err(); m != "" {
+		panic(m)
+	}
+	if err != 0 {
+		panic("bad superblock checksum")
+	}
 
 	logstart := fs.superb_start + 1
 	loglen := fs.superb.Loglen()
@@ -79,34 +168,30 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 		panic("Startlog failed")
 	}
 
-	iorphanstart := fs.superb.Iorphanblock()
-	iorphanlen := fs.superb.Iorphanlen()
-	imapstart := iorphanstart + iorphanlen
-	imaplen := fs.superb.Imaplen()
-	//fmt.Printf("orphanstart %v orphan len %v\n", iorphanstart, iorphanlen)
-	//fmt.Printf("imapstart %v imaplen %v\n", imapstart, imaplen)
-	if iorphanlen != imaplen {
+	if fs.superb.Iorphanlen() != fs.superb.Imaplen() {
 		panic("number of iorphan map blocks != inode map block")
 	}
+	if fs.superb.Ngroups() > MAXGROUPS {
+		panic("too many groups")
+	}
+	l := fs.superb.layout()
+	//fmt.Printf("layout %v\n", l)
 
-	bmapstart := fs.superb.Freeblock()
-	bmaplen := fs.superb.Freeblocklen()
-	//fmt.Printf("bmapstart %v bmaplen %v\n", bmapstart, bmaplen)
-
-	inodelen := fs.superb.Inodelen()
-	//fmt.Printf("inodestart %v inodelen %v\n", bmapstart+bmaplen, inodelen)
-
-	fs.ialloc = mkIalloc(fs, imapstart, imaplen, bmapstart+bmaplen, inodelen)
-	fs.balloc = mkBallocater(fs, bmapstart, bmaplen, bmapstart+bmaplen+inodelen)
+	firstdata := fs.superb.Freeblock() + fs.superb.Freeblocklen() + fs.superb.Inodelen()
+	fs.ialloc = mkIalloc(fs, l.imap, l.inodes)
+	fs.balloc = mkBallocater(fs, l.bmap, firstdata)
+	fs.refmap = mkRefmap(fs, l.refmap, firstdata)
+	if fs.diskfs {
+		fs.discard = mkDiscard(fs)
+	}
 
-	fs.icache = mkIcache(fs, iorphanstart, iorphanlen)
+	fs.icache = mkIcache(fs, l.orphan)
 	fs.icache.RecoverOrphans()
 
 	fs.Fs_sync() // commits ifrees() and clears orphan bitmap
 
 	fs.root = fs.icache.Iref(iroot, "fs_namei_root")
-
-	return &fd.Fd_t{Fops: &fsfops_t{priv: iroot, fs: fs, count: 1}}, fs
+	return fs
 }
 
 func (fs *Fs_t) Sizes() (int, int) {
@@ -115,6 +200,22 @@ func (fs *Fs_t) Sizes() (int, int) {
 
 func (fs *Fs_t) StopFS() {
 	fs.fslog.StopLog()
+	if fs.discard != nil {
+		fs.discard.halt()
+	}
+}
+
+// stops the file system unless a file other than the root directory is in
+// use, or the root directory is the cwd of a process.
+func (fs *Fs_t) Fs_unmount() defs.Err_t {
+	if fs.icache.busy() {
+		return -defs.EBUSY
+	}
+	fs.StopFS()
+	if fs.claimed {
+		Disk_release(fs.ahci)
+	}
+	return 0
 }
 
 func (fs *Fs_t) Fs_size() (uint, uint) {
@@ -127,28 +228,57 @@ func (fs *Fs_t) IrefRoot() *imemnode_t {
 	return r
 }
 
+// returns true if f is open on the file system
+func (fs *Fs_t) Fs_owns(f *fd.Fd_t) bool {
+	fo, ok := f.Fops.(*fsfops_t)
+	return ok && fo.fs == fs
+}
+
 func (fs *Fs_t) MkRootCwd() *fd.Cwd_t {
 	f := &fd.Fd_t{Fops: &fsfops_t{priv: iroot, fs: fs, count: 0}}
 	cwd := fd.MkRootCwd(f)
 	return cwd
 }
 
+// returns a Cwd_t for resolving paths relative to the directory open as f,
+// for the *at system calls. the returned Cwd_t has its own reference to the
+// directory, which the caller drops by closing the Cwd_t's Fd. its Path is
+// empty, since the directory's path is unknown.
+func (fs *Fs_t) Fs_atcwd(f *fd.Fd_t) (*fd.Cwd_t, defs.Err_t) {
+	fo, ok := f.Fops.(*fsfops_t)
+	if !ok || fo.fs != fs {
+		return nil, -defs.ENOTDIR
+	}
+	idm := fs.icache.Iref_locked(fo.priv, "Fs_atcwd")
+	isdir := idm.itype == I_DIR
+	idm.iunlock_refdown("Fs_atcwd")
+	if !isdir {
+		return nil, -defs.ENOTDIR
+	}
+	nf, err := fd.Copyfd(f)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Cwd_t{Fd: nf}, 0
+}
+
 func (fs *Fs_t) Unpin(pa mem.Pa_t) {
 	fs.bcache.unpin(pa)
 }
 
-func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t, defs.Err_t) {
+// old is resolved relative to ocwd and new relative to ncwd
+func (fs *Fs_t) Fs_op_link(old ustr.Ustr, ocwd *fd.Cwd_t, new ustr.Ustr, ncwd *fd.Cwd_t) ([]*imemnode_t, defs.Err_t) {
 	opid := fs.fslog.Op_begin("Fs_link")
 	defer fs.fslog.Op_end(opid)
 
 	if fs_debug {
-		fmt.Printf("Fs_link: %v %v %v\n", old, new, cwd)
+		fmt.Printf("Fs_link: %v %v %v %v\n", old, ocwd, new, ncwd)
 	}
 
 	fs.istats.Nilink.Inc()
 
 	var deads []*imemnode_t
-	orig, dead, err := fs.fs_namei_locked(opid, old, cwd, "Fs_link_org")
+	orig, dead, err := fs.fs_namei_locked(opid, old, ocwd, "Fs_link_org")
 	if err != 0 {
 		if dead != nil {
 			deads = append(deads, dead)
@@ -166,7 +296,7 @@ func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imem
 	orig.iunlock("fs_link_orig")
 
 	dirs, fn := bpath.Sdirname(new)
-	newd, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "fs_link_newd")
+	newd, dead, err := fs.fs_namei_locked(opid, dirs, ncwd, "fs_link_newd")
 	if err != 0 {
 		if dead != nil {
 			deads = append(deads, dead)
@@ -192,7 +322,11 @@ undo:
 }
 
 func (fs *Fs_t) Fs_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
-	deads, err := fs.Fs_op_link(old, new, cwd)
+	return fs.Fs_linkat(old, cwd, new, cwd)
+}
+
+func (fs *Fs_t) Fs_linkat(old ustr.Ustr, ocwd *fd.Cwd_t, new ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	deads, err := fs.Fs_op_link(old, ocwd, new, ncwd)
 	for _, dead := range deads {
 		dead.Free()
 	}
@@ -291,8 +425,8 @@ func (fs *Fs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err
 var _renamelock = sync.Mutex{}
 
 // first return value is inodes to refdown, second return is inode which needs
-// to be freed...
-func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+// to be freed... oldp is resolved relative to ocwd and newp relative to ncwd.
+func (fs *Fs_t) Fs_op_rename(oldp ustr.Ustr, ocwd *fd.Cwd_t, newp ustr.Ustr, ncwd *fd.Cwd_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
 	odirs, ofn := bpath.Sdirname(oldp)
 	ndirs, nfn := bpath.Sdirname(newp)
 	var refs []*imemnode_t
@@ -310,13 +444,13 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	fs.istats.Nrename.Inc()
 
 	if fs_debug {
-		fmt.Printf("fs_rename: src %v dst %v %v\n", oldp, newp, cwd)
+		fmt.Printf("fs_rename: src %v %v dst %v %v\n", oldp, ocwd, newp, ncwd)
 	}
 
 	// lookup all inode references, but we will release locks and lock them
 	// together when we know all references.  the references to the inodes
 	// cannot disppear, so unlocking temporarily is fine.
-	opar, dead, err := fs.fs_namei_locked(opid, odirs, cwd, "fs_rename_opar")
+	opar, dead, err := fs.fs_namei_locked(opid, odirs, ocwd, "fs_rename_opar")
 	if err != 0 {
 		return refs, dead, err
 	}
@@ -330,7 +464,7 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	// unlock par after we have ref to child
 	opar.iunlock("fs_rename_par")
 
-	npar, dead, err := fs.fs_namei_locked(opid, ndirs, cwd, "")
+	npar, dead, err := fs.fs_namei_locked(opid, ndirs, ncwd, "")
 	if err != 0 {
 		return []*imemnode_t{opar, ochild}, dead, err
 	}
@@ -502,9 +636,13 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 }
 
 func (fs *Fs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
-	refs, dead, err := fs.Fs_op_rename(oldp, newp, cwd)
+	return fs.Fs_renameat(oldp, cwd, newp, cwd)
+}
+
+func (fs *Fs_t) Fs_renameat(oldp ustr.Ustr, ocwd *fd.Cwd_t, newp ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	refs, dead, err := fs.Fs_op_rename(oldp, ocwd, newp, ncwd)
 	for _, r := range refs {
-		del := r.Refdown("Fs_rename")
+		del := r.Refdown("Fs_renameat")
 		if del {
 			r.Free()
 		}
@@ -583,6 +721,8 @@ type fsfops_t struct {
 	offset int
 	append bool
 	count  int
+	// true if the open file may hold a flock lock
+	flocked bool
 	//hack	*imemnode_t
 }
 
@@ -680,6 +820,96 @@ func (fo *fsfops_t) Truncate(newlen uint) defs.Err_t {
 	return err
 }
 
+func (fo *fsfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+
+	idm := fo.fs.icache.Iref(fo.priv, "fallocate")
+	err := idm.do_fallocate(mode, offset, length)
+	idm.Refdown("fallocate")
+	return err
+}
+
+func (fo *fsfops_t) Fsync(datasync bool) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+
+	idm := fo.fs.icache.Iref(fo.priv, "fsync")
+	err := idm.do_fsync(datasync)
+	idm.Refdown("fsync")
+	return err
+}
+
+func (fo *fsfops_t) Flock(op int) defs.Err_t {
+	switch op &^ defs.LOCK_NB {
+	case defs.LOCK_SH, defs.LOCK_EX, defs.LOCK_UN:
+	default:
+		return -defs.EINVAL
+	}
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	fo.flocked = true
+	idm := fo.fs.icache.Iref(fo.priv, "flock")
+	// don't hold fo's lock while waiting for the lock
+	fo.Unlock()
+
+	err := idm.flocks.flock(fo, op)
+	idm.Refdown("flock")
+	return err
+}
+
+// Ioctl takes FS_IOC_GROW, which grows the file system to the end of its
+// disk, if the disk has grown since the file system was made
+func (fo *fsfops_t) Ioctl(cmd, arg int, argf fdops.Fdops_i) (int, defs.Err_t) {
+	switch cmd {
+	case defs.FS_IOC_GROW:
+		return 0, fo.fs.Fs_grow(fo.fs.ahci.Nblocks())
+	default:
+		return 0, -defs.ENOTTY
+	}
+}
+
+func (fo *fsfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	if err := lkcheck(cmd, lk); err != 0 {
+		return err
+	}
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	idm := fo.fs.icache.Iref(fo.priv, "lockrec")
+	base := 0
+	switch lk.Whence {
+	case defs.SEEK_SET:
+	case defs.SEEK_CUR:
+		base = fo.offset
+	case defs.SEEK_END:
+		idm.ilock("lockrec")
+		base = idm.size
+		idm.iunlock("lockrec")
+	default:
+		fo.Unlock()
+		idm.Refdown("lockrec")
+		return -defs.EINVAL
+	}
+	// don't hold fo's lock while waiting for the lock
+	fo.Unlock()
+
+	err := idm.flocks.lockrec(pid, cmd, lk, base)
+	idm.Refdown("lockrec")
+	return err
+}
+
 func (fo *fsfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return fo._write(src, offset)
 }
@@ -716,6 +946,11 @@ func (fo *fsfops_t) Close() defs.Err_t {
 		fmt.Printf("Close: %d cnt %d\n", fo.priv, fo.count)
 
 	}
+	if fo.count == 0 && fo.flocked {
+		idm := fo.fs.icache.Iref(fo.priv, "close")
+		idm.flocks.funlock(fo)
+		idm.Refdown("close")
+	}
 	fo.Unlock()
 	return fo.fs.Fs_close(fo.priv)
 }
@@ -765,6 +1000,14 @@ func (fo *fsfops_t) Lseek(off, whence int) (int, defs.Err_t) {
 		st := &stat.Stat_t{}
 		fo.fstat(st)
 		fo.offset = int(st.Size()) + off
+	case defs.SEEK_DATA, defs.SEEK_HOLE:
+		idm := fo.fs.icache.Iref_locked(fo.priv, "lseek")
+		n, err := idm.seekhole(off, whence == defs.SEEK_HOLE)
+		idm.iunlock_refdown("lseek")
+		if err != 0 {
+			return 0, err
+		}
+		fo.offset = n
 	default:
 		return 0, -defs.EINVAL
 	}
@@ -786,12 +1029,27 @@ func (fo *fsfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err
 
 	idm := fo.fs.icache.Iref_locked(fo.priv, "mmapi")
 	mmi, err := idm.do_mmapi(offset, len, inc)
+	for err == -defs.EAGAIN {
+		// a shared mapping covers a hole or a shared block; give the
+		// file its own blocks for it
+		idm.iunlock("mmapi")
+		err = idm.fillholes(offset, len)
+		idm.ilock("mmapi")
+		if err == 0 {
+			mmi, err = idm.do_mmapi(offset, len, inc)
+		}
+	}
 	idm.iunlock_refdown("mmapi")
 
 	fo.Unlock()
 	return mmi, err
 }
 
+// unpins the file's page pa, which a shared mapping of the file used
+func (fo *fsfops_t) Unpin(pa mem.Pa_t) {
+	fo.fs.Unpin(pa)
+}
+
 func (fo *fsfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	return nil, 0, -defs.ENOTSOCK
 }
@@ -977,6 +1235,22 @@ func (df *Devfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (df *Devfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (df *Devfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (df *Devfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (df *Devfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (df *Devfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	df._sane()
 	return 0, -defs.ESPIPE
@@ -1079,25 +1353,32 @@ type rawdfops_t struct {
 	sync.Mutex
 	minor  int
 	offset int
-	fs     *Fs_t
+	disk   Disk_i
+	mem    Blockmem_i
 }
 
 func (raw *rawdfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
 	raw.Lock()
 	defer raw.Unlock()
+	b := MkBlock_newpage(0, "rawread", raw.mem, raw.disk, &_nop_relse)
+	defer b.Free_page()
 	var did int
 	for dst.Remain() != 0 {
 		blkno := raw.offset / BSIZE
-		b := raw.fs.fslog.Get_fill(blkno, "read", false)
+		if blkno >= raw.disk.Nblocks() {
+			break
+		}
+		b.Block = blkno
+		if err := bdevrw(b, BDEV_READ); err != 0 {
+			return did, err
+		}
 		boff := raw.offset % BSIZE
 		c, err := dst.Uiowrite(b.Data[boff:])
 		if err != 0 {
-			raw.fs.fslog.Relse(b, "read")
 			return 0, err
 		}
 		raw.offset += c
 		did += c
-		raw.fs.fslog.Relse(b, "read")
 	}
 	return did, 0
 }
@@ -1105,26 +1386,33 @@ func (raw *rawdfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
 func (raw *rawdfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
 	raw.Lock()
 	defer raw.Unlock()
+	b := MkBlock_newpage(0, "rawwrite", raw.mem, raw.disk, &_nop_relse)
+	defer b.Free_page()
 	var did int
 	for src.Remain() != 0 {
 		blkno := raw.offset / BSIZE
-		boff := raw.offset % BSIZE
-		buf, err := raw.fs.bcache.raw(blkno)
-		if err != 0 {
-			return 0, err
+		if blkno >= raw.disk.Nblocks() {
+			if did == 0 {
+				return 0, -defs.ENOSPC
+			}
+			break
 		}
+		b.Block = blkno
+		boff := raw.offset % BSIZE
 		if boff != 0 || src.Remain() < BSIZE {
-			buf.Read()
+			if err := bdevrw(b, BDEV_READ); err != 0 {
+				return did, err
+			}
 		}
-		c, err := src.Uioread(buf.Data[boff:])
+		c, err := src.Uioread(b.Data[boff:])
 		if err != 0 {
-			buf.EvictDone()
 			return 0, err
 		}
-		buf.Write()
+		if err := bdevrw(b, BDEV_WRITE); err != 0 {
+			return did, err
+		}
 		raw.offset += c
 		did += c
-		buf.EvictDone()
 	}
 	return did, 0
 }
@@ -1133,6 +1421,22 @@ func (raw *rawdfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (raw *rawdfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (raw *rawdfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (raw *rawdfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (raw *rawdfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (raw *rawdfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1459,17 +1763,11 @@ func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.C
 		if fs.Fs_close(fsf.Inum) != 0 {
 			panic("must succeed")
 		}
-		switch maj {
-		case defs.D_CONSOLE, defs.D_DEVNULL, defs.D_STAT, defs.D_PROF:
-			if maj == defs.D_STAT {
-				stats_string = fs.Fs_statistics()
-			}
-			ret.Fops = &Devfops_t{Maj: maj, Min: min}
-		case defs.D_RAWDISK:
-			ret.Fops = &rawdfops_t{minor: min, fs: fs}
-		default:
-			panic("bad dev")
+		fops, err := fs.Devopen(maj, min)
+		if err != 0 {
+			return nil, err
 		}
+		ret.Fops = fops
 	} else {
 		apnd := flags&defs.O_APPEND != 0
 		ret.Fops = &fsfops_t{priv: priv, fs: fs, append: apnd, count: 1}
@@ -1477,6 +1775,25 @@ func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.C
 	return ret, 0
 }
 
+// returns the fops of the device maj/min, which the file system implements
+func (fs *Fs_t) Devopen(maj, min int) (fdops.Fdops_i, defs.Err_t) {
+	switch maj {
+	case defs.D_CONSOLE, defs.D_DEVNULL, defs.D_STAT, defs.D_PROF:
+		if maj == defs.D_STAT {
+			stats_string = fs.Fs_statistics()
+		}
+		return &Devfops_t{Maj: maj, Min: min}, 0
+	case defs.D_RAWDISK:
+		d, ok := Disk_raw(min)
+		if !ok {
+			return nil, -defs.ENXIO
+		}
+		return &rawdfops_t{minor: min, disk: d, mem: fs.bcache.mem}, 0
+	default:
+		return nil, -defs.ENXIO
+	}
+}
+
 func (fs *Fs_t) Fs_close(priv defs.Inum_t) defs.Err_t {
 	opid := fs.fslog.Op_begin("Fs_close")
 
@@ -1499,6 +1816,23 @@ func (fs *Fs_t) Fs_close(priv defs.Inum_t) defs.Err_t {
 	return 0
 }
 
+// creates the special file paths, or uses the existing one unless excl is
+// true, and returns its inode number
+func (fs *Fs_t) Fs_mknod(paths ustr.Ustr, excl bool, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	flags := defs.O_CREAT
+	if excl {
+		flags |= defs.O_EXCL
+	}
+	fsf, err := fs.Fs_open_inner(paths, flags, 0, cwd, major, minor)
+	if err != 0 {
+		return 0, err
+	}
+	if fs.Fs_close(fsf.Inum) != 0 {
+		panic("must succeed")
+	}
+	return fsf.Inum, 0
+}
+
 func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
 	opid := opid_t(0)
 
@@ -1520,8 +1854,8 @@ func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err
 	return err
 }
 
-// Sync the file system to disk. XXX If Biscuit supported fsync, we could be
-// smarter and flush only the dirty blocks of particular inode.
+// Sync the file system to disk. Fsync on a file flushes only the
+// transactions with that file's changes.
 func (fs *Fs_t) Fs_sync() defs.Err_t {
 	if !fs.diskfs {
 		return 0
@@ -1572,16 +1906,14 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 		}
 		idm = n
 		if lastc {
-			// ilookup_lockfree already locked n
-			if start != n {
-				if start.Refdown("") {
-					// unlucky; cwd unlinked out from under
-					// us
-					if n.iunlock_refdown("") {
-						panic("huh?")
-					}
-					return nil, start, -defs.ENOENT
+			// ilookup_lockfree already locked and referenced n,
+			// even if n is start (e.g., ".")
+			if start.Refdown("") {
+				// unlucky; cwd unlinked out from under us
+				if n.iunlock_refdown("") {
+					panic("huh?")
 				}
+				return nil, start, -defs.ENOENT
 			}
 			return n, nil, 0
 		}
@@ -1665,5 +1997,11 @@ func (fs *Fs_t) Fs_statistics() string {
 	s += fs.bcache.Stats()
 	s += fs.icache.Stats()
 	s += fs.ahci.Stats()
+	s += fmt.Sprintf("checksum errors: %v\n", fs.bcache.Cksumerrs())
 	return s
 }
+
+// returns the number of metadata blocks read whose checksum didn't match
+func (fs *Fs_t) Fs_cksumerrs() int {
+	return fs.bcache.Cksumerrs()
+}
@@ -0,0 +1,737 @@
+// +build !kernel
+
+package fs
+
+import "fmt"
+
+import "defs"
+import "mem"
+import "ustr"
+import "util"
+
+// Fsck_t checks a file system offline. It replays the log, reads the inode
+// table, walks the directory tree from the root, and compares what it finds
+// with the link counts, the inode, orphan, and block maps, and the reference
+// map. In repair mode it fixes what it can by writing the affected metadata
+// blocks directly, without the log: link counts, map bits, reference counts,
+// and invalid directory entries. Without repair it doesn't write the disk: the
+// log is replayed into memory. Unreferenced inodes are put on the orphan
+// list, so that the next mount frees them. A data block claimed by more than
+// one inode is shared, and its reference count is made to match; an indirect
+// block claimed more than once is only reported.
+
+type fsckinode_t struct {
+	itype int
+	links int
+	// the inode's block has a bad checksum
+	bad bool
+	// reachable from the root
+	reached bool
+	// number of directory entries naming the inode, not counting "." and
+	// ".."
+	nrefs  int
+	parent defs.Inum_t
+}
+
+type Fsck_t struct {
+	// the inconsistencies found
+	Problems []string
+	// the number of them repaired
+	Nfixed int
+
+	bcache *bcache_t
+	sb     Superblock_t
+	repair bool
+
+	iruns  []run_t
+	ilen   int
+	dfirst int
+	last   int
+
+	inodes []fsckinode_t
+	imap   *fsckmap_t
+	orphan *fsckmap_t
+	bmap   *fsckmap_t
+	refmap *fsckrefmap_t
+	// inode that first claims each block, -1 if none, fsck_meta for the
+	// blocks of a group
+	owner []int
+	// number of inodes in use that claim each block
+	nclaims []int
+	// blocks claimed as indirect blocks
+	indirect []bool
+	// number of inodes being freed that hold each block, which may or may
+	// not have released it yet
+	dying []int
+}
+
+// a copy of an on-disk bitmap
+type fsckmap_t struct {
+	name  string
+	runs  []run_t
+	bits  []uint8
+	bad   []bool
+	dirty []bool
+}
+
+// a copy of the on-disk reference map
+type fsckrefmap_t struct {
+	runs   []run_t
+	counts []int
+	bad    []bool
+	dirty  []bool
+}
+
+const fsck_nbuckets = 1024
+
+const fsck_meta = -2
+
+func (fk *Fsck_t) problem(f string, args ...interface{}) {
+	fk.Problems = append(fk.Problems, fmt.Sprintf(f, args...))
+}
+
+func (fk *Fsck_t) fixed() {
+	fk.Nfixed++
+}
+
+// fsckdisk_t keeps the blocks written to it in memory and reads them back from
+// there, so that checking without repair leaves the disk as it was
+type fsckdisk_t struct {
+	disk Disk_i
+	blks map[int]*mem.Bytepg_t
+}
+
+func mkFsckdisk(d Disk_i) *fsckdisk_t {
+	return &fsckdisk_t{disk: d, blks: make(map[int]*mem.Bytepg_t)}
+}
+
+func (d *fsckdisk_t) Start(req *Bdev_req_t) bool {
+	switch req.Cmd {
+	case BDEV_READ:
+		ondisk := MkBlkList()
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if pg, ok := d.blks[b.Block]; ok {
+				*b.Data = *pg
+				continue
+			}
+			nb := MkBlock(b.Block, b.Name, b.Mem, d.disk, nil)
+			nb.Pa = b.Pa
+			nb.Data = b.Data
+			ondisk.PushBack(nb)
+		}
+		if ondisk.Len() == 0 {
+			return false
+		}
+		nreq := &Bdev_req_t{Cmd: BDEV_READ, Blks: ondisk, Sync: true}
+		nreq.AckCh = make(chan bool, 1)
+		if d.disk.Start(nreq) {
+			<-nreq.AckCh
+		}
+		req.Err = nreq.Err
+	case BDEV_WRITE:
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			pg := &mem.Bytepg_t{}
+			*pg = *b.Data
+			d.blks[b.Block] = pg
+			b.Done("fsckdisk")
+		}
+	}
+	return false
+}
+
+func (d *fsckdisk_t) Stats() string {
+	return d.disk.Stats()
+}
+
+func (d *fsckdisk_t) Nblocks() int {
+	return d.disk.Nblocks()
+}
+
+// Fsck checks, and if repair is true repairs, the file system on disk
+func Fsck(mem Blockmem_i, disk Disk_i, repair bool) *Fsck_t {
+	fk := &Fsck_t{repair: repair}
+	if !repair {
+		disk = mkFsckdisk(disk)
+	}
+	// the checker reads each block about once; a cache sized for the
+	// whole system would take longer to make than checking a small disk
+	fk.bcache = mkBcache_sized(mem, disk, fsck_nbuckets)
+
+	b := fk.bcache.Get_fill(0, "fsoff", false)
+	superb := util.Readn(b.Data[:], 4, FSOFF)
+	fk.bcache.Relse(b, "fsck")
+	if superb <= 0 {
+		fk.problem("bad superblock start %v", superb)
+		return fk
+	}
+	b, err := fk.bcache.Get_meta(superb, META_SUPER, "super", false)
+	fk.sb = Superblock_t{b.Data}
+	if m := fk.sb.Version_err(); m != "" {
+		fk.problem("superblock: %v", m)
+		return fk
+	}
+	if err != 0 {
+		fk.problem("superblock: bad checksum")
+		return fk
+	}
+
+	l := &log_t{}
+	l.mk_log(superb+1, fk.sb.Loglen(), fk.bcache, true)
+	l.recover()
+
+	fk.dfirst = fk.sb.Freeblock() + fk.sb.Freeblocklen() + fk.sb.Inodelen()
+	fk.last = fk.sb.Lastblock()
+	if fk.sb.Iorphanlen() != fk.sb.Imaplen() || fk.last < fk.dfirst ||
+		fk.sb.Ngroups() < 0 || fk.sb.Ngroups() > MAXGROUPS {
+		fk.problem("superblock: bad geometry")
+		return fk
+	}
+	fk.owner = make([]int, fk.last-fk.dfirst)
+	for i := range fk.owner {
+		fk.owner[i] = -1
+	}
+	lay := fk.sb.layout()
+	if runslen(lay.refmap)*REFPERBLK < fk.last-fk.dfirst {
+		fk.problem("superblock: reference map too short")
+		return fk
+	}
+	for g := 0; g < fk.sb.Ngroups(); g++ {
+		s := fk.sb.Groupstart(g)
+		e := s + fk.sb.Grouplen(g)
+		if s < fk.dfirst || e > fk.last || e < s {
+			fk.problem("superblock: bad geometry of group %v", g)
+			return fk
+		}
+		for b := s; b < e; b++ {
+			if fk.owner[b-fk.dfirst] != -1 {
+				fk.problem("superblock: group %v overlaps another", g)
+				return fk
+			}
+			fk.owner[b-fk.dfirst] = fsck_meta
+		}
+	}
+	fk.iruns = lay.inodes
+	fk.ilen = runslen(lay.inodes)
+
+	fk.imap = fk.readmap("inode map", lay.imap)
+	fk.orphan = fk.readmap("orphan map", lay.orphan)
+	fk.bmap = fk.readmap("block map", lay.bmap)
+	fk.refmap = fk.readrefmap(lay.refmap)
+	fk.readinodes()
+
+	fk.nclaims = make([]int, fk.last-fk.dfirst)
+	fk.indirect = make([]bool, fk.last-fk.dfirst)
+	fk.dying = make([]int, fk.last-fk.dfirst)
+	for i := range fk.inodes {
+		fk.claim(defs.Inum_t(i))
+	}
+
+	fk.walk()
+	fk.checkinodes()
+	fk.checkpadding()
+	fk.checkblocks()
+	fk.checkrefs()
+
+	fk.writemap(fk.imap)
+	fk.writemap(fk.orphan)
+	fk.writemap(fk.bmap)
+	fk.writerefmap()
+	return fk
+}
+
+func (fk *Fsck_t) readmap(name string, runs []run_t) *fsckmap_t {
+	m := &fsckmap_t{name: name, runs: runs}
+	len := runslen(runs)
+	m.bits = make([]uint8, len*bitsperblk/8)
+	m.bad = make([]bool, len)
+	m.dirty = make([]bool, len)
+	for i := 0; i < len; i++ {
+		blkn := runblock(runs, i)
+		b, err := fk.bcache.Get_meta(blkn, META_BITMAP, "fsck", false)
+		if err != 0 {
+			fk.problem("%v block %v: bad checksum", name, blkn)
+			m.bad[i] = true
+			m.dirty[i] = true
+		} else {
+			copy(m.bits[i*bitsperblk/8:], b.Data[:bitsperblk/8])
+		}
+		fk.bcache.Relse(b, "fsck")
+	}
+	return m
+}
+
+func (fk *Fsck_t) readrefmap(runs []run_t) *fsckrefmap_t {
+	len := runslen(runs)
+	m := &fsckrefmap_t{runs: runs}
+	m.counts = make([]int, len*REFPERBLK)
+	m.bad = make([]bool, len)
+	m.dirty = make([]bool, len)
+	for i := 0; i < len; i++ {
+		blkn := runblock(runs, i)
+		b, err := fk.bcache.Get_meta(blkn, META_REFMAP, "fsck", false)
+		if err != 0 {
+			fk.problem("reference map block %v: bad checksum", blkn)
+			m.bad[i] = true
+			m.dirty[i] = true
+		} else {
+			for j := 0; j < REFPERBLK; j++ {
+				m.counts[i*REFPERBLK+j] = util.Readn(b.Data[:], 2, j*2)
+			}
+		}
+		fk.bcache.Relse(b, "fsck")
+	}
+	return m
+}
+
+func (fk *Fsck_t) writerefmap() {
+	if !fk.repair {
+		return
+	}
+	m := fk.refmap
+	for i, d := range m.dirty {
+		if !d {
+			continue
+		}
+		b, _ := fk.bcache.Get_meta(runblock(m.runs, i), META_REFMAP, "fsck", true)
+		for j := 0; j < REFPERBLK; j++ {
+			util.Writen(b.Data[:], 2, j*2, m.counts[i*REFPERBLK+j])
+		}
+		fk.writemeta(b)
+	}
+}
+
+func (m *fsckmap_t) get(bit int) bool {
+	return m.bits[bit/8]&(1<<uint(bit%8)) != 0
+}
+
+// returns false if the bit is unknown because its block is corrupt
+func (m *fsckmap_t) known(bit int) bool {
+	return !m.bad[blkno(bit)]
+}
+
+func (m *fsckmap_t) set(bit int, v bool) {
+	if v {
+		m.bits[bit/8] |= 1 << uint(bit%8)
+	} else {
+		m.bits[bit/8] &^= 1 << uint(bit%8)
+	}
+	m.dirty[blkno(bit)] = true
+}
+
+// rewrites the blocks of m that changed or were corrupt
+func (fk *Fsck_t) writemap(m *fsckmap_t) {
+	if !fk.repair {
+		return
+	}
+	for i, d := range m.dirty {
+		if !d {
+			continue
+		}
+		b, _ := fk.bcache.Get_meta(runblock(m.runs, i), META_BITMAP, "fsck", true)
+		copy(b.Data[:], m.bits[i*bitsperblk/8:(i+1)*bitsperblk/8])
+		fk.writemeta(b)
+	}
+}
+
+// writes the locked metadata block b with its checksum and releases it
+func (fk *Fsck_t) writemeta(b *Bdev_block_t) {
+	Cksum_set(b.Data[:])
+	b.Bad = false
+	b.Unlock()
+	fk.bcache.Write(b)
+	fk.bcache.Relse(b, "fsck")
+}
+
+func (fk *Fsck_t) readinodes() {
+	fk.inodes = make([]fsckinode_t, fk.ilen*IPERBLK)
+	for i := 0; i < fk.ilen; i++ {
+		blkn := runblock(fk.iruns, i)
+		b, err := fk.bcache.Get_meta(blkn, META_INODE, "fsck", false)
+		if err != 0 {
+			fk.problem("inode block %v: bad checksum", blkn)
+		}
+		for j := 0; j < IPERBLK; j++ {
+			fi := &fk.inodes[i*IPERBLK+j]
+			if err != 0 {
+				fi.bad = true
+				continue
+			}
+			ind := Inode_t{b, j}
+			fi.itype = fieldr(b.Data, ifield(j, 0))
+			fi.links = ind.linkcount()
+		}
+		fk.bcache.Relse(b, "fsck")
+	}
+}
+
+// returns the locked block holding inode inum
+func (fk *Fsck_t) iblock(inum defs.Inum_t) (*Bdev_block_t, *Inode_t) {
+	b, _ := fk.bcache.Get_meta(runblock(fk.iruns, int(inum)/IPERBLK), META_INODE, "fsck", true)
+	return b, &Inode_t{b, int(inum) % IPERBLK}
+}
+
+// the type of an inode is authoritative, since the transaction that allocates
+// or frees an inode also writes its type
+func (fk *Fsck_t) inuse(inum defs.Inum_t) bool {
+	fi := &fk.inodes[inum]
+	return !fi.bad && fi.itype > I_INVALID && fi.itype <= I_VALID
+}
+
+func (fk *Fsck_t) datablock(blkn int) bool {
+	return blkn >= fk.dfirst && blkn < fk.last
+}
+
+// calls f with each block of the inode, and the logical index of each data
+// block (-1 for indirect blocks)
+func (fk *Fsck_t) blocks(inum defs.Inum_t, f func(int, int)) {
+	b, ind := fk.iblock(inum)
+	var addrs [NIADDRS]int
+	for i := range addrs {
+		addrs[i] = ind.addr(i)
+	}
+	indir := ind.indirect()
+	dindir := ind.dindirect()
+	b.Unlock()
+	fk.bcache.Relse(b, "fsck")
+
+	for i, a := range addrs {
+		if a != 0 {
+			f(a, i)
+		}
+	}
+	ind1 := func(blkn, first int) {
+		f(blkn, -1)
+		if !fk.datablock(blkn) {
+			return
+		}
+		ib := fk.bcache.Get_fill(blkn, "fsck", false)
+		for i := 0; i < INDADDR; i++ {
+			if a := util.Readn(ib.Data[:], 8, i*8); a != 0 {
+				f(a, first+i)
+			}
+		}
+		fk.bcache.Relse(ib, "fsck")
+	}
+	if indir != 0 {
+		ind1(indir, NIADDRS)
+	}
+	if dindir != 0 {
+		f(dindir, -1)
+		if !fk.datablock(dindir) {
+			return
+		}
+		db := fk.bcache.Get_fill(dindir, "fsck", false)
+		for i := 0; i < INDADDR; i++ {
+			if a := util.Readn(db.Data[:], 8, i*8); a != 0 {
+				ind1(a, NIADDRS+INDADDR+i*INDADDR)
+			}
+		}
+		fk.bcache.Relse(db, "fsck")
+	}
+}
+
+// records the blocks of inode inum. the blocks of an inode with no links are
+// being freed, and may already be free or even reused.
+func (fk *Fsck_t) claim(inum defs.Inum_t) {
+	if !fk.inuse(inum) {
+		return
+	}
+	dying := fk.inodes[inum].links == 0
+	fk.blocks(inum, func(blkn, idx int) {
+		if !fk.datablock(blkn) {
+			if !dying {
+				fk.problem("inode %v: block %v out of range", inum, blkn)
+			}
+			return
+		}
+		i := blkn - fk.dfirst
+		if fk.owner[i] == fsck_meta {
+			if !dying {
+				fk.problem("inode %v: block %v is group metadata", inum, blkn)
+			}
+		} else if dying {
+			fk.dying[i]++
+		} else if fk.owner[i] != -1 && (idx < 0 || fk.indirect[i]) {
+			fk.problem("block %v: claimed by inodes %v and %v", blkn,
+				fk.owner[i], inum)
+		} else {
+			if fk.owner[i] == -1 {
+				fk.owner[i] = int(inum)
+			}
+			fk.nclaims[i]++
+			fk.indirect[i] = idx < 0
+		}
+	})
+}
+
+// walks the directory tree from the root, counting the entries naming each
+// inode and checking that they name inodes in use
+func (fk *Fsck_t) walk() {
+	if !fk.inuse(iroot) || fk.inodes[iroot].itype != I_DIR {
+		fk.problem("root inode isn't a directory")
+		return
+	}
+	fk.inodes[iroot].reached = true
+	fk.inodes[iroot].parent = iroot
+	q := []defs.Inum_t{iroot}
+	for len(q) > 0 {
+		dir := q[0]
+		q = q[1:]
+		fk.blocks(dir, func(blkn, idx int) {
+			if idx < 0 || !fk.datablock(blkn) {
+				return
+			}
+			fk.dirblock(dir, blkn, &q)
+		})
+	}
+}
+
+func (fk *Fsck_t) dirblock(dir defs.Inum_t, blkn int, q *[]defs.Inum_t) {
+	b, err := fk.bcache.Get_meta(blkn, META_DIR, "fsck", true)
+	if err != 0 {
+		fk.problem("directory %v block %v: bad checksum", dir, blkn)
+		b.Unlock()
+		fk.bcache.Relse(b, "fsck")
+		return
+	}
+	dd := &Dirdata_t{b.Data[:]}
+	dirty := false
+	for j := 0; j < NDIRENTS; j++ {
+		fn := dd.Filename(j)
+		if len(fn) == 0 {
+			continue
+		}
+		inum := dd.inodenext(j)
+		if ok := fk.dirent(dir, fn, inum, q); !ok && fk.repair {
+			dd.W_filename(j, ustr.MkUstr())
+			dd.W_inodenext(j, 0)
+			dirty = true
+			fk.fixed()
+		}
+	}
+	if dirty {
+		fk.writemeta(b)
+	} else {
+		b.Unlock()
+		fk.bcache.Relse(b, "fsck")
+	}
+}
+
+// checks the entry fn of directory dir; returns false if the entry should be
+// removed
+func (fk *Fsck_t) dirent(dir defs.Inum_t, fn ustr.Ustr, inum defs.Inum_t, q *[]defs.Inum_t) bool {
+	if inum < 0 || int(inum) >= len(fk.inodes) {
+		fk.problem("directory %v: entry %q names bad inode %v", dir, fn, inum)
+		return false
+	}
+	if fk.inodes[inum].bad {
+		// don't remove entries just because their inode is unreadable
+		return true
+	}
+	if !fk.inuse(inum) {
+		fk.problem("directory %v: entry %q names free inode %v", dir, fn, inum)
+		return false
+	}
+	if fn.Isdot() {
+		if inum != dir {
+			fk.problem("directory %v: \".\" names %v", dir, inum)
+		}
+		return true
+	}
+	if fn.Isdotdot() {
+		if inum != fk.inodes[dir].parent {
+			fk.problem("directory %v: \"..\" names %v, not %v", dir,
+				inum, fk.inodes[dir].parent)
+		}
+		return true
+	}
+	fi := &fk.inodes[inum]
+	fi.nrefs++
+	if fi.itype == I_DIR {
+		if fi.reached {
+			fk.problem("directory %v: entry %q names directory %v, "+
+				"which has another name", dir, fn, inum)
+			return false
+		}
+		fi.parent = dir
+		*q = append(*q, inum)
+	}
+	fi.reached = true
+	return true
+}
+
+func (fk *Fsck_t) checkinodes() {
+	for i := range fk.inodes {
+		inum := defs.Inum_t(i)
+		fi := &fk.inodes[i]
+		if fi.bad {
+			continue
+		}
+		if fi.itype < I_FIRST || fi.itype > I_LAST {
+			fk.problem("inode %v: bad type %v", inum, fi.itype)
+		}
+		valid := fk.inuse(inum)
+		if !fk.imap.known(i) {
+			if fk.repair {
+				fk.imap.set(i, valid)
+			}
+		} else if fk.imap.get(i) != valid {
+			if valid {
+				fk.problem("inode %v: in use but free in the inode map", inum)
+			} else {
+				fk.problem("inode %v: free but allocated in the inode map", inum)
+			}
+			if fk.repair {
+				fk.imap.set(i, valid)
+				fk.fixed()
+			}
+		}
+		if !fk.orphan.known(i) && fk.repair {
+			fk.orphan.set(i, valid && !fi.reached && fi.links == 0)
+		}
+		orphan := fk.orphan.known(i) && fk.orphan.get(i)
+		if !valid {
+			if orphan {
+				fk.problem("inode %v: free but on the orphan list", inum)
+				fk.setorphan(i, false)
+			}
+			continue
+		}
+
+		want := fi.nrefs
+		if inum == iroot {
+			want = 1
+		}
+		if fi.reached {
+			if fi.links != want {
+				fk.problem("inode %v: link count %v, should be %v",
+					inum, fi.links, want)
+				fk.setlinks(inum, want)
+			}
+			if orphan {
+				fk.problem("inode %v: linked but on the orphan list", inum)
+				fk.setorphan(i, false)
+			}
+		} else if fi.links != 0 {
+			// hand it to the next mount to free
+			fk.problem("inode %v: unreferenced, with %v links", inum, fi.links)
+			fk.setlinks(inum, 0)
+			if !orphan && fk.repair {
+				fk.orphan.set(i, true)
+			}
+		} else if !orphan && fk.orphan.known(i) {
+			fk.problem("inode %v: unreferenced but not on the orphan list", inum)
+			fk.setorphan(i, true)
+		}
+	}
+}
+
+// bits past the last inode stay allocated in the inode map, and clear in the
+// orphan map
+func (fk *Fsck_t) checkpadding() {
+	for i := len(fk.inodes); i < len(fk.imap.bits)*8; i++ {
+		if fk.repair && !fk.imap.known(i) {
+			fk.imap.set(i, true)
+		}
+		if fk.repair && !fk.orphan.known(i) {
+			fk.orphan.set(i, false)
+		}
+	}
+}
+
+func (fk *Fsck_t) setorphan(bit int, v bool) {
+	if fk.repair {
+		fk.orphan.set(bit, v)
+		fk.fixed()
+	}
+}
+
+func (fk *Fsck_t) setlinks(inum defs.Inum_t, n int) {
+	if !fk.repair {
+		return
+	}
+	b, ind := fk.iblock(inum)
+	ind.W_linkcount(n)
+	fk.writemeta(b)
+	fk.inodes[inum].links = n
+	fk.fixed()
+}
+
+func (fk *Fsck_t) checkblocks() {
+	for i := range fk.owner {
+		if !fk.bmap.known(i) {
+			continue
+		}
+		used := fk.owner[i] != -1
+		set := fk.bmap.get(i)
+		if used && !set && fk.owner[i] == fsck_meta {
+			fk.problem("block %v: group metadata but free in the block map",
+				fk.dfirst+i)
+		} else if used && !set {
+			fk.problem("block %v: in use by inode %v but free in the "+
+				"block map", fk.dfirst+i, fk.owner[i])
+		} else if !used && set && fk.dying[i] == 0 {
+			fk.problem("block %v: unused but allocated in the block map",
+				fk.dfirst+i)
+		} else {
+			continue
+		}
+		if fk.repair {
+			fk.bmap.set(i, used)
+			fk.fixed()
+		}
+	}
+	// bits past the last block stay allocated
+	for i := len(fk.owner); i < len(fk.bmap.bits)*8; i++ {
+		if fk.repair && !fk.bmap.known(i) {
+			fk.bmap.set(i, true)
+		}
+	}
+	// in a corrupt block of the block map, a block is allocated iff it is
+	// used or may be
+	for i := range fk.owner {
+		if fk.repair && !fk.bmap.known(i) {
+			fk.bmap.set(i, fk.owner[i] != -1 || fk.dying[i] > 0)
+		}
+	}
+}
+
+// the count of a block in the reference map is the number of claims on it
+// beyond the first. inodes being freed may or may not have dropped their
+// claims.
+func (fk *Fsck_t) checkrefs() {
+	m := fk.refmap
+	for i := range fk.owner {
+		lo, hi := fk.nclaims[i]-1, fk.nclaims[i]+fk.dying[i]-1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi < 0 {
+			hi = 0
+		}
+		if hi > maxref {
+			hi = maxref
+		}
+		n := m.counts[i]
+		if m.bad[i/REFPERBLK] {
+			// count every claim that may remain, so that the
+			// block isn't freed while shared
+			m.counts[i] = hi
+			continue
+		}
+		if n >= lo && n <= hi {
+			continue
+		}
+		fk.problem("block %v: %v claims but a reference count of %v",
+			fk.dfirst+i, fk.nclaims[i], n)
+		if fk.repair {
+			if n < lo {
+				m.counts[i] = lo
+			} else {
+				m.counts[i] = hi
+			}
+			m.dirty[i/REFPERBLK] = true
+			fk.fixed()
+		}
+	}
+}
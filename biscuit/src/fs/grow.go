@@ -0,0 +1,155 @@
+package fs
+
+import "fmt"
+
+import "defs"
+import "util"
+
+// Growing a file system. Fs_grow adds a group (see Superblock_t) at the old
+// end of the file system holding the orphan map, inode map, reference map,
+// block map and inode blocks that the added blocks need. it writes the group's blocks before
+// anything references them, and then a single log operation adds the group to
+// the superblock, moves Lastblock, and clears the bits of the new blocks and
+// inodes in the maps. a crash therefore leaves either the old or the grown file
+// system.
+
+// the number of map blocks to add to a map of have blocks so that it holds at
+// least nbits bits
+func growmaplen(nbits, have int) int {
+	n := util.Roundup(nbits, bitsperblk)/bitsperblk - have
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// writes block blkn of a new group. if free isn't nil, the block is a map
+// block whose first bit is bit from, and the bits for which free returns false
+// are set.
+func (fs *Fs_t) growblock(blkn int, kind metakind_t, from int, free func(int) bool) {
+	b := fs.bcache.Get_zero(blkn, "grow", true)
+	var zdata [BSIZE]uint8
+	copy(b.Data[:], zdata[:])
+	if free != nil {
+		for i := 0; i < bitsperblk; i++ {
+			if !free(from + i) {
+				b.Data[i/8] |= 1 << uint(i%8)
+			}
+		}
+	}
+	b.Meta = kind
+	Cksum_set(b.Data[:])
+	b.Unlock()
+	fs.bcache.Write(b)
+	fs.bcache.Relse(b, "grow")
+}
+
+// Fs_grow extends the file system to end before block newlast of its disk,
+// keeping the ratio of inode blocks to data blocks if the added blocks have
+// room for them.
+func (fs *Fs_t) Fs_grow(newlast int) defs.Err_t {
+	if !fs.diskfs {
+		return -defs.EINVAL
+	}
+	fs.growl.Lock()
+	defer fs.growl.Unlock()
+
+	sb := &fs.superb
+	last := sb.Lastblock()
+	g := sb.Ngroups()
+	if newlast <= last || g >= MAXGROUPS {
+		return -defs.EINVAL
+	}
+	first := fs.balloc.first
+	added := newlast - last
+	// only Fs_grow changes the sizes of the maps and the inode blocks
+	oinodelen := fs.ialloc.inodelen
+	oimaplen := fs.ialloc.alloc.freelen
+	obmaplen := fs.balloc.alloc.freelen
+	orefmaplen := runslen(fs.refmap.runs)
+
+	inodelen := added * oinodelen / (last - first)
+	var imaplen, refmaplen, bmaplen, meta int
+	size := func() {
+		imaplen = growmaplen((oinodelen+inodelen)*IPERBLK, oimaplen)
+		refmaplen = util.Roundup(newlast-first, REFPERBLK)/REFPERBLK - orefmaplen
+		if refmaplen < 0 {
+			refmaplen = 0
+		}
+		bmaplen = growmaplen(newlast-first, obmaplen)
+		meta = 2*imaplen + refmaplen + bmaplen + inodelen
+	}
+	size()
+	if meta >= added && inodelen != 0 {
+		inodelen = 0
+		size()
+	}
+	if meta >= added {
+		return -defs.EINVAL
+	}
+
+	start := last
+	ninode := (oinodelen + inodelen) * IPERBLK
+	ifree := func(bit int) bool {
+		return bit < ninode
+	}
+	bfree := func(bit int) bool {
+		b := first + bit
+		return b < newlast && (b < start || b >= start+meta)
+	}
+	nofree := func(int) bool {
+		return false
+	}
+	blkn := start
+	for i := 0; i < imaplen; i++ {
+		fs.growblock(blkn, META_BITMAP, 0, nil)
+		blkn++
+	}
+	for i := 0; i < imaplen; i++ {
+		fs.growblock(blkn, META_BITMAP, (oimaplen+i)*bitsperblk, ifree)
+		blkn++
+	}
+	for i := 0; i < refmaplen; i++ {
+		fs.growblock(blkn, META_REFMAP, 0, nil)
+		blkn++
+	}
+	for i := 0; i < bmaplen; i++ {
+		fs.growblock(blkn, META_BITMAP, (obmaplen+i)*bitsperblk, bfree)
+		blkn++
+	}
+	for i := 0; i < inodelen; i++ {
+		fs.growblock(blkn, META_INODE, 0, nil)
+		blkn++
+	}
+
+	opid := fs.fslog.Op_begin("Fs_grow")
+	sbb, err := fs.fslog.Get_meta(fs.superb_start, META_SUPER, "grow", true)
+	if err != 0 {
+		sbb.Unlock()
+		fs.fslog.Relse(sbb, "grow")
+		fs.fslog.Op_end(opid)
+		return err
+	}
+	// update Lastblock before freeing any new block, because the block
+	// allocator refuses blocks past it
+	sb.SetGroup(g, start, imaplen, refmaplen, bmaplen, inodelen)
+	sb.SetNgroups(g + 1)
+	sb.SetLastblock(newlast)
+	sbb.Unlock()
+	fs.fslog.Write(opid, sbb)
+	fs.fslog.Relse(sbb, "grow")
+
+	// the new inodes need their blocks and orphan bits before the inode
+	// allocator can hand them out
+	fs.ialloc.addinodes(run_t{start + 2*imaplen + refmaplen + bmaplen, inodelen})
+	fs.icache.orphanbitmap.grow(opid, oimaplen*bitsperblk, run_t{start, imaplen}, nofree)
+	fs.ialloc.alloc.grow(opid, oinodelen*IPERBLK, run_t{start + imaplen, imaplen}, ifree)
+	fs.refmap.grow(run_t{start + 2*imaplen, refmaplen})
+	fs.balloc.alloc.grow(opid, last-first, run_t{start + 2*imaplen + refmaplen, bmaplen}, bfree)
+	fs.fslog.Op_end(opid)
+	fs.Fs_syncapply()
+
+	fmt.Printf("grew fs from %v to %v blocks: %v inode blocks, %v map blocks\n",
+		last, newlast, inodelen, meta-inodelen)
+	return 0
+}
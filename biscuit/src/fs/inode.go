@@ -39,7 +39,15 @@ type inode_stats_t struct {
 	Nmkdir      stats.Counter_t
 	Nclose      stats.Counter_t
 	Nsync       stats.Counter_t
+	Nfsync      stats.Counter_t
 	Nreopen     stats.Counter_t
+	Ndalloc     stats.Counter_t
+	Ndallochit  stats.Counter_t
+	Nprealloc   stats.Counter_t
+	Nfallocate  stats.Counter_t
+	Npunch      stats.Counter_t
+	Nunshare    stats.Counter_t
+	Nclone      stats.Counter_t
 	CWrite      stats.Cycles_t
 	Cwrite      stats.Cycles_t
 	Ciwrite     stats.Cycles_t
@@ -77,6 +85,8 @@ const (
 	// number of address in indirect block
 	INDADDR = (BSIZE / 8)
 	ISIZE   = 128
+	// inodes per inode block; the last slot holds the block's checksum
+	IPERBLK = BSIZE/ISIZE - 1
 )
 
 func ifield(iidx int, fieldn int) int {
@@ -185,6 +195,31 @@ type imemnode_t struct {
 	indir  int
 	dindir int
 	addrs  [NIADDRS]int
+	// in-memory preallocation state for data blocks. [next, end) is a
+	// run of free blocks reserved for this file's upcoming allocations;
+	// it is only a hint and is not reflected in the block bitmap until
+	// the blocks are used. last is the most recently allocated data
+	// block, the goal for the next allocation once the run is used up.
+	prealloc struct {
+		next int
+		end  int
+		last int
+	}
+	// number of data and indirect blocks of the file, or -1 if it has not
+	// been counted yet
+	blkcnt int
+	// true if the inode's block was corrupt when the inode was read; the
+	// other fields are then invalid
+	ioerr bool
+	// sequence numbers of the last log transactions that modified the
+	// inode and that modified the inode's data or the metadata needed to
+	// read it back; fsync and fdatasync force these transactions.
+	syncseq struct {
+		meta uint64
+		data uint64
+	}
+	// advisory locks; see flock.go
+	flocks filelocks_t
 	// inode specific metadata blocks
 	dentc struct {
 		// true iff all non-empty directory entries are cached, thus
@@ -253,6 +288,9 @@ func (idm *imemnode_t) EvictDone() {
 
 func (idm *imemnode_t) Free() {
 	// no need to lock...
+	if idm.ioerr {
+		return
+	}
 	if idm.links != 0 {
 		panic("non-zero links")
 	}
@@ -285,9 +323,13 @@ func (idm *imemnode_t) idm_init(inum defs.Inum_t) {
 	if fs_debug {
 		fmt.Printf("idm_init: read inode %v\n", inum)
 	}
-	blk := idm.idibread()
-	idm.fs.istats.Nifill.Inc()
-	idm.fill(blk, inum)
+	blk, err := idm.idibread()
+	if err != 0 {
+		idm.ioerr = true
+	} else {
+		idm.fs.istats.Nifill.Inc()
+		idm.fill(blk, inum)
+	}
 	blk.Unlock()
 	idm.fs.fslog.Relse(blk, "idm_init")
 }
@@ -308,10 +350,16 @@ func (idm *imemnode_t) _iupdate(opid opid_t) defs.Err_t {
 	}
 	if idm.fs.diskfs {
 		idm.fs.istats.Niupdate.Inc()
-		iblk := idm.idibread()
-		if idm.flushto(iblk, idm.inum) {
+		iblk, err := idm.idibread()
+		if err != 0 {
+			iblk.Unlock()
+			idm.fs.fslog.Relse(iblk, "_iupdate")
+			return err
+		}
+		if changed, data := idm.flushto(iblk, idm.inum); changed {
 			iblk.Unlock()
 			idm.fs.fslog.Write(opid, iblk)
+			idm.dirty(opid, data)
 		} else {
 			iblk.Unlock()
 		}
@@ -348,6 +396,19 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 	}
 
 	idm.fs.istats.Ndo_write.Inc()
+
+	if idm.fs.diskfs {
+		idm.ilock("prealloc")
+		off := offset
+		if app {
+			off = idm.size
+		}
+		if nb := idm.newblocks(off, sz); nb > 1 {
+			idm.preallocate(nb)
+		}
+		idm.iunlock("prealloc")
+	}
+
 	for i < sz {
 		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_WRITE)
 		if !res.Resadd_noblock(gimme) {
@@ -371,6 +432,17 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 		if app {
 			off = idm.size
 		}
+		// copying the shared blocks the write covers may use up the
+		// operation
+		end, err := idm.unshare(opid, off, off+n)
+		if err != 0 {
+			idm.iunlock("")
+			idm.fs.fslog.Op_end(opid)
+			return i, err
+		}
+		if end < off+n {
+			n = end - off
+		}
 		s1 := stats.Rdtsc()
 		wrote, err := idm.iwrite(opid, src, off, n)
 		idm.fs.istats.Ciwrite.Add(s1)
@@ -395,6 +467,356 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 	return i, 0
 }
 
+// allocates the blocks backing [offset, offset+length) of the file, and gives
+// the file its own copies of shared blocks in the range, or frees the blocks if
+// mode asks to punch a hole. the blocks are allocated in several operations
+// since an operation may only log MaxBlkPerOp blocks.
+func (idm *imemnode_t) do_fallocate(mode, offset, length int) defs.Err_t {
+	punch := mode == defs.FALLOC_FL_PUNCH_HOLE|defs.FALLOC_FL_KEEP_SIZE
+	if !punch && mode&^defs.FALLOC_FL_KEEP_SIZE != 0 {
+		return -defs.EOPNOTSUPP
+	}
+	if offset < 0 || length <= 0 {
+		return -defs.EINVAL
+	}
+	end := offset + length
+	if end < offset || end/BSIZE >= NIADDRS+INDADDR+INDADDR*INDADDR {
+		return -defs.EFBIG
+	}
+	keepsize := mode&defs.FALLOC_FL_KEEP_SIZE != 0
+
+	idm.fs.istats.Nfallocate.Inc()
+
+	idm.ilock("fallocate")
+	if idm.itype != I_FILE {
+		idm.iunlock("fallocate")
+		if idm.itype == I_DIR {
+			return -defs.EISDIR
+		}
+		return -defs.ENODEV
+	}
+	if punch {
+		idm.iunlock("fallocate")
+		return idm.punch(offset, end)
+	}
+	if idm.fs.diskfs {
+		idm.preallocate(idm.newblocks(offset, length))
+	}
+	idm.iunlock("fallocate")
+
+	// account for indirect blocks
+	max := (MaxBlkPerOp - 3) * BSIZE
+	for off := util.Rounddown(offset, BSIZE); off < end; {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_WRITE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		last := min(off+max, end)
+		opid := idm.fs.fslog.Op_begin("fallocate")
+		idm.ilock("fallocate")
+		last, err := idm.unshare(opid, off, last)
+		for b := off; b < last && err == 0; b += BSIZE {
+			_, _, err = idm.offsetblk(opid, b, true)
+		}
+		if err == 0 && !keepsize && last > idm.size {
+			idm.size = last
+		}
+		idm._iupdate(opid)
+		idm.iunlock("fallocate")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 {
+			return err
+		}
+		off = last
+	}
+	return 0
+}
+
+// zeroes the bytes [offset, end) of a single block of the file, unless the
+// block is a hole.
+func (idm *imemnode_t) zerorange(offset, end int) defs.Err_t {
+	opid := idm.fs.fslog.Op_begin("zerorange")
+	defer idm.fs.fslog.Op_end(opid)
+
+	idm.ilock("zerorange")
+	defer idm.iunlock("zerorange")
+	if _, err := idm.unshare(opid, offset, end); err != 0 {
+		return err
+	}
+	b, err := idm.off2buf(opid, offset, end-offset, false, true, "zerorange")
+	if err != 0 || b == nil {
+		return err
+	}
+	s := offset % BSIZE
+	copy(b.Data[s:s+end-offset], zeroblk[:])
+	b.Unlock()
+	idm.fs.fslog.Write_ordered(opid, b)
+	idm.fs.fslog.Relse(b, "zerorange")
+	idm.dirty(opid, true)
+	return 0
+}
+
+// removes the block for fbn from the file's block map, logging the indirect
+// block that referred to it. returns the block number, or 0 if fbn is a hole,
+// and the indirect block that was modified, if any.
+func (idm *imemnode_t) unmapb(opid opid_t, fbn int) (int, int) {
+	if fbn < NIADDRS {
+		blkn := idm.addrs[fbn]
+		idm.addrs[fbn] = 0
+		return blkn, 0
+	}
+	fbn -= NIADDRS
+	indno := idm.indir
+	slot := fbn
+	if fbn >= INDADDR {
+		fbn -= INDADDR
+		if idm.dindir == 0 {
+			return 0, 0
+		}
+		dindblk := idm.mbread(idm.dindir)
+		indno = util.Readn(dindblk.Data[:], 8, (fbn/INDADDR)*8)
+		idm.fs.fslog.Relse(dindblk, "unmapb")
+		slot = fbn % INDADDR
+	}
+	if indno == 0 {
+		return 0, 0
+	}
+	indblk := idm.mbread(indno)
+	blkn := util.Readn(indblk.Data[:], 8, slot*8)
+	if blkn != 0 {
+		util.Writen(indblk.Data[:], 8, slot*8, 0)
+		idm.fs.fslog.Write(opid, indblk)
+		idm.dirty(opid, true)
+	}
+	idm.fs.fslog.Relse(indblk, "unmapb")
+	return blkn, indno
+}
+
+// maps fbn of the file to block blkn, allocating indirect blocks as needed and
+// logging the indirect block that refers to blkn. returns the block fbn mapped
+// before, or 0 if fbn was a hole.
+func (idm *imemnode_t) remapb(opid opid_t, fbn, blkn int) (int, defs.Err_t) {
+	if fbn < NIADDRS {
+		old := idm.addrs[fbn]
+		idm.addrs[fbn] = blkn
+		return old, 0
+	}
+	fbn -= NIADDRS
+	var indno int
+	if fbn < INDADDR {
+		n, isnew, err := idm.ensureb(opid, idm.indir, true, false)
+		if err != 0 {
+			return 0, err
+		}
+		if isnew {
+			idm.indir = n
+		}
+		indno = n
+	} else {
+		fbn -= INDADDR
+		dindno, isnew, err := idm.ensureb(opid, idm.dindir, true, false)
+		if err != 0 {
+			return 0, err
+		}
+		if isnew {
+			idm.dindir = dindno
+		}
+		dindblk := idm.mbread(dindno)
+		indno, err = idm.ensureind(opid, dindblk, fbn/INDADDR, true, false)
+		idm.fs.fslog.Relse(dindblk, "remapb")
+		if err != 0 {
+			return 0, err
+		}
+		fbn %= INDADDR
+	}
+	indblk := idm.mbread(indno)
+	old := util.Readn(indblk.Data[:], 8, fbn*8)
+	util.Writen(indblk.Data[:], 8, fbn*8, blkn)
+	idm.fs.fslog.Write(opid, indblk)
+	idm.fs.fslog.Relse(indblk, "remapb")
+	idm.dirty(opid, true)
+	return old, 0
+}
+
+// copies the block blkn to a new block of the file. returns the new block.
+func (idm *imemnode_t) bcopy(opid opid_t, blkn int) (int, defs.Err_t) {
+	nblkn, err := idm.dalloc(opid)
+	if err != 0 {
+		return 0, err
+	}
+	ob := idm.fs.fslog.Get_fill(blkn, "bcopy", true)
+	nb := idm.fs.fslog.Get_fill(nblkn, "bcopy", true)
+	copy(nb.Data[:], ob.Data[:])
+	ob.Unlock()
+	nb.Unlock()
+	idm.fs.fslog.Write_ordered(opid, nb)
+	idm.fs.fslog.Relse(ob, "bcopy")
+	idm.fs.fslog.Relse(nb, "bcopy")
+	return nblkn, 0
+}
+
+// gives the file its own copy of each shared block in [offset, end). returns
+// the offset up to which the range has no shared blocks, which is past offset
+// if offset is before end, but before end if the caller couldn't also write
+// the rest of the range in the operation. as in do_write, an operation has
+// room for MaxBlkPerOp-3 blocks besides the inode and indirect blocks, and
+// writing a block of the range may log the block map block of its
+// allocation. a copy logs two instead: the block map block of the copy, and
+// the refmap or block map block of the shared block. caller holds the inode
+// lock.
+func (idm *imemnode_t) unshare(opid opid_t, offset, end int) (int, defs.Err_t) {
+	if idm.itype != I_FILE {
+		return end, 0
+	}
+	// shared blocks are within the file
+	last := min(end, util.Roundup(idm.size, BSIZE))
+	room := MaxBlkPerOp - 3
+	for off := util.Rounddown(offset, BSIZE); off < end; off += BSIZE {
+		fbn := off / BSIZE
+		blkn := 0
+		if off < last {
+			b, _, err := idm.fbn2block(opid, fbn, false)
+			if err != 0 {
+				return off, err
+			}
+			if b != 0 && idm.fs.refmap.get(b) != 0 {
+				blkn = b
+			}
+		}
+		cost := 1
+		if blkn != 0 {
+			cost = 2
+		}
+		if cost > room {
+			return off, 0
+		}
+		room -= cost
+		if blkn == 0 {
+			continue
+		}
+		nblkn, err := idm.bcopy(opid, blkn)
+		if err != 0 {
+			return off, err
+		}
+		idm.remapb(opid, fbn, nblkn)
+		idm.fs.bput(opid, blkn)
+		if idm.blkcnt >= 0 {
+			idm.blkcnt--
+		}
+		idm.fs.istats.Nunshare.Inc()
+	}
+	return end, 0
+}
+
+// punches a hole in [offset, end) of the file: partial blocks at the ends of
+// the range are zeroed and the whole blocks in between are freed. indirect
+// blocks are kept even if they become empty. the file size is unchanged.
+func (idm *imemnode_t) punch(offset, end int) defs.Err_t {
+	idm.fs.istats.Npunch.Inc()
+	first := util.Roundup(offset, BSIZE)
+	last := util.Rounddown(end, BSIZE)
+	if first > last {
+		// the range is within a single block
+		return idm.zerorange(offset, end)
+	}
+	if offset < first {
+		if err := idm.zerorange(offset, first); err != 0 {
+			return err
+		}
+	}
+	if last < end {
+		if err := idm.zerorange(last, end); err != 0 {
+			return err
+		}
+	}
+
+	fbn := first / BSIZE
+	for fbn < last/BSIZE {
+		opid := idm.fs.fslog.Op_begin("punch")
+		idm.ilock("punch")
+		// set of blocks written by this operation, including the
+		// inode block
+		distinct := map[int]bool{idm.fs.ialloc.Iblock(idm.inum): true}
+		for ; fbn < last/BSIZE && len(distinct) < MaxBlkPerOp-1; fbn++ {
+			blkn, indno := idm.unmapb(opid, fbn)
+			if indno != 0 {
+				distinct[indno] = true
+			}
+			if blkn == 0 {
+				continue
+			}
+			distinct[idm.fs.bput(opid, blkn)] = true
+			if idm.blkcnt >= 0 {
+				idm.blkcnt--
+			}
+		}
+		idm._iupdate(opid)
+		idm.iunlock("punch")
+		idm.fs.fslog.Op_end(opid)
+	}
+	return 0
+}
+
+// returns the offset of the first byte at or after off that is in a hole, if
+// hole is set, or in data otherwise. the end of the file counts as a hole.
+func (idm *imemnode_t) seekhole(off int, hole bool) (int, defs.Err_t) {
+	if off < 0 || off >= idm.size {
+		return 0, -defs.ENXIO
+	}
+	for fbn := off / BSIZE; fbn*BSIZE < idm.size; fbn++ {
+		blkn, _, err := idm.fbn2block(opid_t(0), fbn, false)
+		if err != 0 {
+			return 0, err
+		}
+		if (blkn == 0) == hole {
+			if fbn*BSIZE > off {
+				off = fbn * BSIZE
+			}
+			return off, 0
+		}
+	}
+	if hole {
+		return idm.size, 0
+	}
+	return 0, -defs.ENXIO
+}
+
+// fills the holes of the file in the pages covering [offset, offset+len), or
+// to the end of the file if len is -1, so that they can be mapped shared.
+func (idm *imemnode_t) fillholes(offset, len int) defs.Err_t {
+	idm.ilock("fillholes")
+	end := idm.size
+	if len != -1 && offset+len < end {
+		end = offset + len
+	}
+	end = min(util.Roundup(end, mem.PGSIZE), util.Roundup(idm.size, BSIZE))
+	offset = util.Rounddown(offset, mem.PGSIZE)
+	idm.iunlock("fillholes")
+	if offset >= end {
+		return 0
+	}
+	return idm.do_fallocate(defs.FALLOC_FL_KEEP_SIZE, offset, end-offset)
+}
+
+// returns the number of data and indirect blocks allocated to the file
+func (idm *imemnode_t) nblocks() int {
+	if idm.blkcnt >= 0 {
+		return idm.blkcnt
+	}
+	n := 0
+	bl := &blockiter_t{}
+	bl.bi_init(idm, false)
+	for which, ok, remains := 0, false, true; remains; {
+		_, ok, which, remains = bl.next(which)
+		if ok {
+			n++
+		}
+	}
+	bl.release()
+	idm.blkcnt = n
+	return n
+}
+
 func (idm *imemnode_t) do_stat(st *stat.Stat_t) defs.Err_t {
 	idm.fs.istats.Nistat.Inc()
 	st.Wdev(0)
@@ -402,6 +824,7 @@ func (idm *imemnode_t) do_stat(st *stat.Stat_t) defs.Err_t {
 	st.Wmode(idm.mkmode())
 	st.Wsize(uint(idm.size))
 	st.Wrdev(defs.Mkdev(idm.major, idm.minor))
+	st.Wblocks(uint(idm.nblocks() * (BSIZE / 512)))
 	return 0
 }
 
@@ -519,25 +942,32 @@ func (ic *imemnode_t) fill(blk *Bdev_block_t, inum defs.Inum_t) {
 	for i := 0; i < NIADDRS; i++ {
 		ic.addrs[i] = inode.addr(i)
 	}
+	ic.blkcnt = -1
 	if ic.itype == I_DIR {
 		ic.dentc.dents = hashtable.MkHash(100)
 	}
 }
 
-// returns true if the inode data changed, and thus needs to be flushed to disk
-func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
+// returns true if the inode data changed, and thus needs to be flushed to
+// disk. the second return value is true if a field needed to read the file's
+// data (its size or block map) changed.
+func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) (bool, bool) {
 	inode := Inode_t{blk, ioffset(inum)}
 	j := inode
 	k := ic
 	ret := false
+	data := false
 	if j.itype() != k.itype || j.linkcount() != k.links ||
-		j.size() != k.size || j.major() != k.major ||
-		j.minor() != k.minor || j.indirect() != k.indir {
+		j.major() != k.major || j.minor() != k.minor {
 		ret = true
 	}
+	if j.size() != k.size || j.indirect() != k.indir ||
+		j.dindirect() != k.dindir {
+		data = true
+	}
 	for i, v := range ic.addrs {
 		if inode.addr(i) != v {
-			ret = true
+			data = true
 		}
 	}
 	inode.W_itype(ic.itype)
@@ -550,30 +980,152 @@ func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
 	for i := 0; i < NIADDRS; i++ {
 		inode.W_addr(i, ic.addrs[i])
 	}
-	return ret
+	return ret || data, data
+}
+
+// records that the transaction of opid modified the inode. data is true if
+// the change is needed to read the file's data back.
+func (idm *imemnode_t) dirty(opid opid_t, data bool) {
+	seq := idm.fs.fslog.Opseq(opid)
+	idm.syncseq.meta = seq
+	if data {
+		idm.syncseq.data = seq
+	}
+}
+
+// forces the log transactions with the inode's changes to disk, but not the
+// ones after it. if datasync is true, changes that are not needed to read the
+// file's data back (e.g., its link count) are not forced.
+func (idm *imemnode_t) do_fsync(datasync bool) defs.Err_t {
+	if !idm.fs.diskfs {
+		return 0
+	}
+	idm.ilock("fsync")
+	seq := idm.syncseq.meta
+	if datasync {
+		seq = idm.syncseq.data
+	}
+	idm.iunlock("fsync")
+	idm.fs.istats.Nfsync.Inc()
+	idm.fs.fslog.Forceseq(seq)
+	return 0
+}
+
+// maximum number of blocks reserved for a file at once
+const maxprealloc = 256
+
+// number of blocks reserved after a data block allocated without a reservation
+const minprealloc = 8
+
+// allocates a data block, preferring the next block of the file's reserved run
+// or otherwise the block following the file's last allocated block, so that
+// sequential writes lay the file out contiguously.
+func (idm *imemnode_t) dalloc(opid opid_t) (int, defs.Err_t) {
+	pa := &idm.prealloc
+	goal := 0
+	if pa.next < pa.end {
+		goal = pa.next
+	} else if pa.last != 0 {
+		goal = pa.last + 1
+	}
+	blkn, _, err := idm.fs.balloc.Ballocrun(opid, goal, minprealloc, 1)
+	if err != 0 {
+		return 0, err
+	}
+	idm.fs.istats.Ndalloc.Inc()
+	if idm.blkcnt >= 0 {
+		idm.blkcnt++
+	}
+	if blkn == goal {
+		idm.fs.istats.Ndallochit.Inc()
+	}
+	if blkn == goal && pa.next < pa.end {
+		pa.next++
+	} else {
+		// the run was lost to another file or there was none; start
+		// a new one after this block.
+		pa.next, pa.end = 0, 0
+		st, n := idm.fs.balloc.Breserve(blkn+1, minprealloc, true)
+		if n > 0 {
+			pa.next, pa.end = st, st+n
+		}
+	}
+	pa.last = blkn
+	return blkn, 0
+}
+
+// reserves a run of free blocks for the next n data blocks the file
+// allocates. the allocation of blocks for a write is thus decided once the
+// extent of the whole write is known rather than block by block.
+func (idm *imemnode_t) preallocate(n int) {
+	if n > maxprealloc {
+		n = maxprealloc
+	}
+	pa := &idm.prealloc
+	have := pa.end - pa.next
+	if n <= have {
+		return
+	}
+	if have > 0 {
+		// try to extend the current run
+		_, c := idm.fs.balloc.Breserve(pa.end, n-have, true)
+		pa.end += c
+		if pa.end-pa.next >= n {
+			return
+		}
+	}
+	goal := pa.last + 1
+	if pa.last == 0 {
+		goal = 0
+	}
+	st, c := idm.fs.balloc.Breserve(goal, n, false)
+	if c > pa.end-pa.next {
+		pa.next, pa.end = st, st+c
+	}
+	idm.fs.istats.Nprealloc.Inc()
+}
+
+// returns the number of new data blocks a write of n bytes at offset requires
+func (idm *imemnode_t) newblocks(offset, n int) int {
+	have := util.Roundup(idm.size, BSIZE) / BSIZE
+	need := util.Roundup(offset+n, BSIZE) / BSIZE
+	if need <= have {
+		return 0
+	}
+	return need - have
 }
 
 // ensure block exists
-func (idm *imemnode_t) ensureb(opid opid_t, blkno int, writing bool) (int, bool, defs.Err_t) {
+func (idm *imemnode_t) ensureb(opid opid_t, blkno int, writing, data bool) (int, bool, defs.Err_t) {
 	if !writing || blkno != 0 {
 		return blkno, false, 0
 	}
-	nblkno, err := idm.fs.balloc.Balloc(opid)
+	var nblkno int
+	var err defs.Err_t
+	if data {
+		nblkno, err = idm.dalloc(opid)
+	} else {
+		nblkno, err = idm.fs.balloc.Balloc(opid)
+		if err == 0 && idm.blkcnt >= 0 {
+			idm.blkcnt++
+		}
+	}
 	return nblkno, true, err
 }
 
 // ensure entry in indirect block exists
-func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writing bool) (int, defs.Err_t) {
+func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writing, data bool) (int, defs.Err_t) {
 	off := slot * 8
 	s := blk.Data[:]
 	blkn := util.Readn(s, 8, off)
-	blkn, isnew, err := idm.ensureb(opid, blkn, writing)
+	blkn, isnew, err := idm.ensureb(opid, blkn, writing, data)
 	if err != 0 {
 		return 0, err
 	}
 	if isnew {
 		util.Writen(s, 8, off, blkn)
 		idm.fs.fslog.Write(opid, blk)
+		idm.dirty(opid, true)
 	}
 	return blkn, 0
 }
@@ -582,10 +1134,10 @@ func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writi
 // XXX change to wrap blockiter_t instead
 func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool, defs.Err_t) {
 	if fbn < NIADDRS {
-		if idm.addrs[fbn] != 0 {
+		if idm.addrs[fbn] != 0 || !writing {
 			return idm.addrs[fbn], false, 0
 		}
-		blkn, err := idm.fs.balloc.Balloc(opid)
+		blkn, err := idm.dalloc(opid)
 		if err != 0 {
 			return 0, false, err
 		}
@@ -597,7 +1149,10 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 		fbn -= NIADDRS
 		if fbn < INDADDR {
 			indno := idm.indir
-			indno, isnew, err := idm.ensureb(opid, indno, writing)
+			if indno == 0 && !writing {
+				return 0, false, 0
+			}
+			indno, isnew, err := idm.ensureb(opid, indno, writing, false)
 			if err != 0 {
 				return 0, false, err
 			}
@@ -606,13 +1161,16 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 				idm.indir = indno
 			}
 			indblk := idm.mbread(indno)
-			blkn, err := idm.ensureind(opid, indblk, fbn, writing)
+			blkn, err := idm.ensureind(opid, indblk, fbn, writing, true)
 			idm.fs.fslog.Relse(indblk, "indblk")
 			return blkn, false, err
 		} else if fbn < INDADDR*INDADDR {
 			fbn -= INDADDR
 			dindno := idm.dindir
-			dindno, isnew, err := idm.ensureb(opid, dindno, writing)
+			if dindno == 0 && !writing {
+				return 0, false, 0
+			}
+			dindno, isnew, err := idm.ensureb(opid, dindno, writing, false)
 			if err != 0 {
 				return 0, false, err
 			}
@@ -621,11 +1179,14 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 				idm.dindir = dindno
 			}
 			dindblk := idm.mbread(dindno)
-			indno, err := idm.ensureind(opid, dindblk, fbn/INDADDR, writing)
+			indno, err := idm.ensureind(opid, dindblk, fbn/INDADDR, writing, false)
 			idm.fs.fslog.Relse(dindblk, "dindblk")
+			if err != 0 || indno == 0 {
+				return 0, false, err
+			}
 
 			indblk := idm.mbread(indno)
-			blkn, err := idm.ensureind(opid, indblk, fbn%INDADDR, writing)
+			blkn, err := idm.ensureind(opid, indblk, fbn%INDADDR, writing, true)
 			idm.fs.fslog.Relse(indblk, "indblk2")
 			return blkn, false, err
 		} else {
@@ -636,40 +1197,24 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 	}
 }
 
+// blocks between the old end of the file and whichblk are not allocated; they
+// are holes that read back as zeros.
 func (idm *imemnode_t) bmapfill(opid opid_t, lastblk int, whichblk int, writing bool) (int, bool, defs.Err_t) {
-	blkn := 0
-	new := false
-	var err defs.Err_t
-
-	if whichblk >= lastblk { // a hole?
-		// allocate the missing blocks
-		if whichblk > lastblk && writing {
-			idm.fs.istats.Nfillhole.Inc()
-		} else if writing {
-			idm.fs.istats.Ngrow.Inc()
-		}
-		for b := lastblk; b <= whichblk; b++ {
-			gimme := bounds.Bounds(bounds.B_IMEMNODE_T_BMAPFILL)
-			if !res.Resadd_noblock(gimme) {
-				return 0, false, -defs.ENOHEAP
-			}
-			// XXX we could remember where the last slot was
-			blkn, new, err = idm.fbn2block(opid, b, writing)
-			if err != 0 {
-				return blkn, new, err
-			}
-		}
-	} else {
-		blkn, new, err = idm.fbn2block(opid, whichblk, writing)
-		if err != 0 {
-			return blkn, new, err
-		}
+	if whichblk > lastblk && writing {
+		idm.fs.istats.Nfillhole.Inc()
+	} else if whichblk == lastblk && writing {
+		idm.fs.istats.Ngrow.Inc()
 	}
-	return blkn, new, 0
+	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_BMAPFILL)
+	if !res.Resadd_noblock(gimme) {
+		return 0, false, -defs.ENOHEAP
+	}
+	return idm.fbn2block(opid, whichblk, writing)
 }
 
 // Takes as input the file offset and whether the operation is a write and
-// returns the block number of the block responsible for that offset.
+// returns the block number of the block responsible for that offset. returns
+// block 0 if the offset is in a hole and the operation is not a write.
 func (idm *imemnode_t) offsetblk(opid opid_t, offset int, writing bool) (int, bool, defs.Err_t) {
 	if writing && opid == 0 && idm.fs.diskfs {
 		panic("offsetblk: writing but no opid\n")
@@ -680,13 +1225,17 @@ func (idm *imemnode_t) offsetblk(opid opid_t, offset int, writing bool) (int, bo
 	if err != 0 {
 		return blkn, new, err
 	}
+	if blkn == 0 && !writing {
+		return 0, false, 0
+	}
 	if blkn <= 0 || blkn >= idm.fs.superb.Lastblock() {
 		panic("offsetblk: bad data blocks")
 	}
 	return blkn, new, 0
 }
 
-// Return locked buffer for offset
+// Return locked buffer for offset. returns nil if the offset is in a hole and
+// fillhole is false.
 func (idm *imemnode_t) off2buf(opid opid_t, offset int, len int, fillhole bool, fill bool, s string) (*Bdev_block_t, defs.Err_t) {
 	if offset%mem.PGSIZE+len > mem.PGSIZE {
 		panic("off2buf")
@@ -695,11 +1244,26 @@ func (idm *imemnode_t) off2buf(opid opid_t, offset int, len int, fillhole bool,
 	if err != 0 {
 		return nil, err
 	}
+	if blkno == 0 {
+		return nil, 0
+	}
 	var b *Bdev_block_t
 	if fill && !new {
-		b = idm.fs.fslog.Get_fill(blkno, s, true)
+		if idm.itype == I_DIR {
+			b, err = idm.fs.fslog.Get_meta(blkno, META_DIR, s, true)
+			if err != 0 {
+				b.Unlock()
+				idm.fs.fslog.Relse(b, s)
+				return nil, err
+			}
+		} else {
+			b = idm.fs.fslog.Get_fill(blkno, s, true)
+		}
 	} else {
 		b = idm.fs.fslog.Get_nofill(blkno, s, true)
+		if idm.itype == I_DIR {
+			b.Meta = META_DIR
+		}
 	}
 	return b, 0
 }
@@ -711,6 +1275,8 @@ func min(a, b int) int {
 	return b
 }
 
+var zeroblk [BSIZE]uint8
+
 func (idm *imemnode_t) iread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	idm.fs.istats.Niread.Inc()
 	isz := idm.size
@@ -726,6 +1292,16 @@ func (idm *imemnode_t) iread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 		if err != 0 {
 			return c, err
 		}
+		if b == nil {
+			// a hole
+			wrote, err := dst.Uiowrite(zeroblk[:m])
+			c += wrote
+			offset += wrote
+			if err != 0 {
+				return c, err
+			}
+			continue
+		}
 		s := offset % BSIZE
 		src := b.Data[s : s+m]
 
@@ -776,6 +1352,7 @@ func (idm *imemnode_t) iwrite(opid opid_t, src fdops.Userio_i, offset int, n int
 		idm.fs.istats.Ciwritecopy.Add(ts)
 		idm.fs.fslog.Write_ordered(opid, b)
 		idm.fs.fslog.Relse(b, "iwrite")
+		idm.dirty(opid, true)
 		if err != 0 {
 			return c, err
 		}
@@ -790,16 +1367,11 @@ func (idm *imemnode_t) iwrite(opid opid_t, src fdops.Userio_i, offset int, n int
 }
 
 func (idm *imemnode_t) itrunc(opid opid_t, newlen uint) defs.Err_t {
-	if newlen > uint(idm.size) {
-		// this will cause the hole to filled in with zero blocks which
-		// are logged to disk
-		_, _, err := idm.offsetblk(opid, int(newlen), true)
-		if err != 0 {
-			return err
-		}
-
-	}
+	// growing the file leaves a hole, which reads back as zeros
 	idm.fs.istats.Nitrunc.Inc()
+	if newlen < uint(idm.size) {
+		idm.prealloc.next, idm.prealloc.end = 0, 0
+	}
 	// inode is flushed by do_itrunc
 	idm.size = int(newlen)
 	return 0
@@ -815,9 +1387,11 @@ func (idm *imemnode_t) create_undo(opid opid_t, childi defs.Inum_t, childn ustr.
 	if ci != childi {
 		panic("inconsistent")
 	}
-	ib := idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(childi), "create_undo", true)
-	ni := &Inode_t{ib, ioffset(childi)}
-	ni.W_itype(I_DEAD)
+	ib, err := idm.fs.fslog.Get_meta(idm.fs.ialloc.Iblock(childi), META_INODE, "create_undo", true)
+	if err == 0 {
+		ni := &Inode_t{ib, ioffset(childi)}
+		ni.W_itype(I_DEAD)
+	}
 	ib.Unlock()
 	idm.fs.fslog.Relse(ib, "create_undo")
 	idm.fs.ialloc.Ifree(opid, childi)
@@ -857,7 +1431,14 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		if err != 0 {
 			return nil, err
 		}
-		newiblk := idm.fs.fslog.Get_fill(newbn, "icreate", true)
+		newiblk, err := idm.fs.fslog.Get_meta(newbn, META_INODE, "icreate", true)
+		if err != 0 {
+			// leave the inode allocated, so that it isn't handed out
+			// again
+			newiblk.Unlock()
+			idm.fs.fslog.Relse(newiblk, "icreate")
+			return nil, err
+		}
 		if fs_debug {
 			fmt.Printf("ialloc: %v %v %v\n", newbn, newioff, newinum)
 		}
@@ -877,6 +1458,8 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		idm.fs.fslog.Write(opid, newiblk)
 		idm.fs.fslog.Relse(newiblk, "icreate")
 		newidm = idm.fs.icache.Iref(newinum, "icreate")
+		// no one else can reference the new inode yet
+		newidm.dirty(opid, true)
 	} else {
 		// insert in icache
 		newidm = idm.fs.icache.Iref_locked_nofill(newinum, "icreate")
@@ -924,10 +1507,32 @@ func (idm *imemnode_t) immapinfo(offset, len int, mapshared bool) ([]mem.Mmapinf
 		if !res.Resadd_noblock(gimme) {
 			return nil, -defs.ENOHEAP
 		}
+		pgn := i / mem.PGSIZE
 		buf, err := idm.off2buf(opid_t(0), o+i, mem.PGSIZE, false, true, "immapinfo")
 		if err != 0 {
 			return nil, err
 		}
+		if buf == nil {
+			// a hole. writes through a shared mapping must reach
+			// the file, so the caller must fill the hole first.
+			if mapshared {
+				return nil, -defs.EAGAIN
+			}
+			pa, pg, ok := idm.fs.bcache.mem.Alloc()
+			if !ok {
+				return nil, -defs.ENOMEM
+			}
+			ret[pgn].Pg = (*mem.Pg_t)(unsafe.Pointer(pg))
+			ret[pgn].Phys = pa
+			continue
+		}
+		if mapshared && idm.fs.refmap.get(buf.Block) != 0 {
+			// writes through the mapping would reach the
+			// other files sharing the block
+			buf.Unlock()
+			idm.fs.fslog.Relse(buf, "immapinfo")
+			return nil, -defs.EAGAIN
+		}
 		buf.Unlock()
 
 		// the VM system is going to use the page
@@ -940,7 +1545,6 @@ func (idm *imemnode_t) immapinfo(offset, len int, mapshared bool) ([]mem.Mmapinf
 			idm.fs.bcache.pin(buf)
 		}
 
-		pgn := i / mem.PGSIZE
 		wpg := (*mem.Pg_t)(unsafe.Pointer(buf.Data))
 		ret[pgn].Pg = wpg
 		ret[pgn].Phys = buf.Pa
@@ -949,8 +1553,9 @@ func (idm *imemnode_t) immapinfo(offset, len int, mapshared bool) ([]mem.Mmapinf
 	return ret, 0
 }
 
-func (idm *imemnode_t) idibread() *Bdev_block_t {
-	return idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(idm.inum), "idibread", true)
+// returns the locked inode block, and -EIO if its checksum doesn't match
+func (idm *imemnode_t) idibread() (*Bdev_block_t, defs.Err_t) {
+	return idm.fs.fslog.Get_meta(idm.fs.ialloc.Iblock(idm.inum), META_INODE, "idibread", true)
 }
 
 // a type to iterate over the data and indirect blocks of an imemnode_t without
@@ -1042,46 +1647,55 @@ func (bl *blockiter_t) next1(which int) (int, int) {
 		panic("none left")
 	}
 
+	// files may have holes, thus a missing block does not imply that the
+	// following blocks are missing too. skip over the whole range mapped by
+	// a missing indirect block, though.
 	ret := -1
 	w := which
 	if w < DBLOCKS {
 		if w < NIADDRS {
 			blkno := bl.idm.addrs[w]
 			if blkno == 0 {
-				return -1, DBLOCKS
+				return -1, which + 1
 			}
 			ret = blkno
 		} else if w < NIADDRS+INDADDR {
 			w -= NIADDRS
-			blkno := 0
 			single, ok := bl._isind(bl.idm.indir)
-			if ok {
-				blkno = util.Readn(single.Data[:], 8, w*8)
+			if !ok {
+				return -1, NIADDRS + INDADDR
 			}
-			if !ok || blkno == 0 {
-				return -1, DBLOCKS
+			blkno := util.Readn(single.Data[:], 8, w*8)
+			if blkno == 0 {
+				return -1, which + 1
 			}
 			ret = blkno
 		} else {
 			w -= NIADDRS + INDADDR
 			dslot := w / INDADDR
 			islot := w % INDADDR
-			blkno := 0
+			if _, ok := bl._isdub(); !ok {
+				return -1, DBLOCKS
+			}
 			single, _, ok := bl._isdubind(dslot, true)
-			if ok {
-				blkno = util.Readn(single.Data[:], 8, islot*8)
+			if !ok {
+				return -1, NIADDRS + INDADDR + (dslot+1)*INDADDR
 			}
-			if !ok || blkno == 0 {
-				return -1, DBLOCKS
+			blkno := util.Readn(single.Data[:], 8, islot*8)
+			if blkno == 0 {
+				return -1, which + 1
 			}
 			ret = blkno
 		}
 	} else if w < INDBLOCKS {
 		w -= DBLOCKS
 		dslot := w % INDADDR
+		if _, ok := bl._isdub(); !ok {
+			return -1, IMD1
+		}
 		_, sblkno, ok := bl._isdubind(dslot, false)
 		if !ok || sblkno == 0 {
-			return -1, IMD1
+			return -1, which + 1
 		}
 		ret = sblkno
 	} else if w < ALL {
@@ -1176,9 +1790,7 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 			var ok bool
 			blkno, ok, which, remains = bliter.next(which)
 			if ok {
-				idm.fs.balloc.Bfree(opid, blkno)
-				freeblk := idm.fs.balloc.alloc.bitmapblkno(blkno)
-				distinct[freeblk] = true
+				distinct[idm.fs.bput(opid, blkno)] = true
 			}
 		}
 		bliter.release()
@@ -1194,13 +1806,17 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 		if idm.fs.diskfs {
 			// must lock the inode block before marking it free, to prevent
 			// clobbering a newly, concurrently allocated/created inode
-			iblk := idm.idibread()
+			iblk, err := idm.idibread()
 			if tryevict {
 				iblk.Tryevict()
 			}
-			idm.flushto(iblk, idm.inum)
+			if err == 0 {
+				idm.flushto(iblk, idm.inum)
+			}
 			iblk.Unlock()
-			idm.fs.fslog.Write(opid, iblk)
+			if err == 0 {
+				idm.fs.fslog.Write(opid, iblk)
+			}
 			idm.fs.fslog.Relse(iblk, "ifree")
 		}
 		idm.fs.fslog.Op_end(opid)
@@ -1253,11 +1869,11 @@ type icache_t struct {
 
 const maxinodepersys = 4
 
-func mkIcache(fs *Fs_t, start, len int) *icache_t {
+func mkIcache(fs *Fs_t, orphanruns []run_t) *icache_t {
 	icache := &icache_t{}
 	icache.cache = mkCache(limits.Syslimit.Vnodes)
 	icache.fs = fs
-	icache.orphanbitmap = mkAllocater(fs, start, len, fs.fslog)
+	icache.orphanbitmap = mkAllocater(fs, orphanruns, fs.fslog)
 	return icache
 }
 
@@ -1285,6 +1901,11 @@ func (icache *icache_t) freeOrphan(inum defs.Inum_t) {
 		fmt.Printf("freeOrphan: %v\n", inum)
 	}
 	imem := icache.Iref(inum, "freeOrphan")
+	if imem.ioerr {
+		// leak the orphan rather than trust its corrupt inode
+		imem.Refdown("freeOrphan")
+		return
+	}
 	v := imem.ref.Down()
 	if v != 0 {
 		panic("freeOrphan")
@@ -1330,10 +1951,34 @@ func (icache *icache_t) Stats() string {
 	return "icache " + icache.cache.Stats()
 }
 
+// returns true if an inode other than the root is referenced, or the root is
+// referenced by more than the file system itself. the caches of directories
+// don't hold references, thus only open files and cwds count.
+func (icache *icache_t) busy() bool {
+	for _, p := range icache.cache.cache.Elems() {
+		e := p.Value.(*Objref_t)
+		n := e.Refcnt() &^ REMOVE
+		if n > 1 || (n == 1 && e.Key != int(iroot)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (icache *icache_t) Iref(inum defs.Inum_t, s string) *imemnode_t {
 	return icache._iref(inum, true, false)
 }
 
+// like Iref, but fails with -EIO if the inode's block is corrupt
+func (icache *icache_t) Iget(inum defs.Inum_t, s string) (*imemnode_t, defs.Err_t) {
+	ret := icache._iref(inum, true, false)
+	if ret.ioerr {
+		ret.Refdown(s)
+		return nil, -defs.EIO
+	}
+	return ret, 0
+}
+
 func (icache *icache_t) Iref_locked(inum defs.Inum_t, s string) *imemnode_t {
 	return icache._iref(inum, true, true)
 }
@@ -1398,25 +2043,22 @@ func iref_lockall(imems []*imemnode_t) []*imemnode_t {
 //
 
 type ibitmap_t struct {
-	alloc    *bitmap_t
-	start    int
-	len      int
-	first    int
+	alloc *bitmap_t
+	// protects the inode block runs, which Fs_grow extends
+	sync.Mutex
+	iruns    []run_t
 	inodelen int
 	maxinode int
 }
 
-func mkIalloc(fs *Fs_t, start, len, first, inodelen int) *ibitmap_t {
+func mkIalloc(fs *Fs_t, mapruns, iruns []run_t) *ibitmap_t {
 	ialloc := &ibitmap_t{}
-	ialloc.alloc = mkAllocater(fs, start, len, fs.fslog)
-	ialloc.start = start
-	ialloc.len = len
-	ialloc.first = first
-	ialloc.inodelen = inodelen
-	ialloc.maxinode = inodelen * (BSIZE / ISIZE)
-	//fmt.Printf("ialloc: mapstart %v maplen %v inode start %v inode len %v max inode# %v nfree %d\n",
-	//	ialloc.start, ialloc.len, ialloc.first, ialloc.inodelen, ialloc.maxinode,
-	//	ialloc.alloc.nfreebits)
+	ialloc.alloc = mkAllocater(fs, mapruns, fs.fslog)
+	ialloc.iruns = iruns
+	ialloc.inodelen = runslen(iruns)
+	ialloc.maxinode = ialloc.inodelen * IPERBLK
+	//fmt.Printf("ialloc: map %v inodes %v max inode# %v nfree %d\n",
+	//	mapruns, ialloc.iruns, ialloc.maxinode, ialloc.alloc.nfreebits)
 	return ialloc
 }
 
@@ -1429,7 +2071,10 @@ func (ialloc *ibitmap_t) Ialloc(opid opid_t) (defs.Inum_t, defs.Err_t) {
 		fmt.Printf("ialloc %d freebits %d\n", n, ialloc.alloc.nfreebits)
 	}
 	// we may have more bits in inode bitmap blocks than inodes on disk
-	if n >= ialloc.maxinode {
+	ialloc.Lock()
+	max := ialloc.maxinode
+	ialloc.Unlock()
+	if n >= max {
 		panic("Ialloc; higher inodes should have been marked in use")
 	}
 	inum := defs.Inum_t(n)
@@ -1447,17 +2092,30 @@ func (ialloc *ibitmap_t) Ifree(opid opid_t, inum defs.Inum_t) {
 }
 
 func (ialloc *ibitmap_t) Iblock(inum defs.Inum_t) int {
-	b := int(inum) / (BSIZE / ISIZE)
-	b += ialloc.first
-	if b < ialloc.first || b >= ialloc.first+ialloc.inodelen {
+	ialloc.Lock()
+	defer ialloc.Unlock()
+
+	b := int(inum) / IPERBLK
+	if b < 0 || b >= ialloc.inodelen {
 		fmt.Printf("inum=%v b = %d\n", inum, b)
 		panic("Iblock: too big inum")
 	}
-	return b
+	return runblock(ialloc.iruns, b)
+}
+
+// adds the inode blocks of run r. the caller must add their bits to the inode
+// map after calling addinodes.
+func (ialloc *ibitmap_t) addinodes(r run_t) {
+	ialloc.Lock()
+	defer ialloc.Unlock()
+
+	ialloc.iruns = append(ialloc.iruns, r)
+	ialloc.inodelen += r.len
+	ialloc.maxinode = ialloc.inodelen * IPERBLK
 }
 
 func ioffset(inum defs.Inum_t) int {
-	o := int(inum) % (BSIZE / ISIZE)
+	o := int(inum) % IPERBLK
 	return o
 }
 
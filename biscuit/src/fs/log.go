@@ -1,8 +1,10 @@
 package fs
 
 import "fmt"
+import "hash/crc32"
 import "sync"
 
+import "defs"
 import "mem"
 import "stats"
 import "util"
@@ -20,6 +22,12 @@ const log_debug = false
 // all its data structures, and use ordered writes only for file data.  The file
 // system must guarantee that it performs no more than maxblkspersys logged
 // writes in an operation, to ensure that its operation will fit in the log.
+//
+// The commit block of a transaction ends with a checksum of the transaction
+// (its position in the log, its commit block, and its logged blocks), which
+// recovery checks before installing the transaction. Recovery stops at the
+// first transaction whose checksum doesn't match (e.g., because of a torn
+// write), dropping it and the transactions after it.
 
 const LogOffset = 1 // log block 0 is used for head
 
@@ -27,7 +35,7 @@ const LogOffset = 1 // log block 0 is used for head
 // necessary in order to guarantee that the log is long enough for the allowed
 // number of concurrent fs syscalls.
 const MaxBlkPerOp = 10
-const MaxDescriptor = BSIZE / 8
+const MaxDescriptor = BSIZE/8 - 1 // the last field holds the checksum
 const MaxOrdered = 3000
 const EndDescriptor = 0
 const NCommitBlk = 1
@@ -115,11 +123,67 @@ func (log *log_t) Force(doapply bool) {
 	log.Lock()
 	defer log.Unlock()
 
-	t := log.curtrans
+	log.stats.Nforce++
+	log.force(log.curtrans, doapply)
+}
 
-	s := stats.Rdtsc()
+// Returns the sequence number of the transaction that opid belongs to.  The
+// caller must be in opid, so that the transaction cannot commit yet.
+func (log *log_t) Opseq(opid opid_t) uint64 {
+	if !log.logging {
+		return 0
+	}
+	log.Lock()
+	defer log.Unlock()
+	return log.curtrans.seq
+}
 
-	log.stats.Nforce++
+// Waits until the transaction with sequence number seq has committed, without
+// forcing it, or until the log stops.  Returns the sequence number of the last
+// committed transaction.
+func (log *log_t) Waitcommit(seq uint64) uint64 {
+	log.Lock()
+	defer log.Unlock()
+
+	for seq > log.committed && !log.stop {
+		log.synccond.Wait()
+	}
+	return log.committed
+}
+
+// Ensure the transaction with sequence number seq and the ones preceding it are
+// committed to disk, but unlike Force don't commit later transactions.  Returns
+// immediately if seq has already committed.
+func (log *log_t) Forceseq(seq uint64) {
+	if !log.logging {
+		return
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	log.stats.Nforceseq++
+
+	if seq <= log.committed {
+		log.stats.Nforceseqdone++
+		return
+	}
+	for seq > log.committed {
+		t := log.curtrans
+		if t.seq == seq && !t.isempty() {
+			log.force(t, false)
+		} else if t.seq == seq {
+			// nothing logged in seq; wait for the preceding ones
+			seq--
+		} else {
+			// seq is committing
+			log.synccond.Wait()
+		}
+	}
+}
+
+func (log *log_t) force(t *trans_t, doapply bool) {
+	s := stats.Rdtsc()
 
 	if t.isempty() || t.forcedone {
 		log.stats.Nbatchforce++
@@ -182,6 +246,13 @@ func (log *log_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
 	return r
 }
 
+func (log *log_t) Get_meta(blkn int, k metakind_t, s string, lock bool) (*Bdev_block_t, defs.Err_t) {
+	t := stats.Rdtsc()
+	r, err := log.ml.bcache.Get_meta(blkn, k, s, lock)
+	log.stats.Readcycles.Add(t)
+	return r, err
+}
+
 func (log *log_t) Get_zero(blkn int, s string, lock bool) *Bdev_block_t {
 	return log.ml.bcache.Get_zero(blkn, s, lock)
 }
@@ -218,6 +289,7 @@ func (log *log_t) StopLog() {
 
 	log.stop = true
 	log.commitcond.Signal()
+	log.synccond.Broadcast()
 	if log_debug {
 		fmt.Printf("Wait for logging system to stop\n")
 	}
@@ -252,6 +324,7 @@ type memlogstat_t struct {
 	Nwriteordered     stats.Counter_t
 	Nrevokeblk        stats.Counter_t
 
+	Ncorrupt     stats.Counter_t
 	Napply       stats.Counter_t
 	Nblkapply    stats.Counter_t
 	Nabsorbapply stats.Counter_t
@@ -369,6 +442,19 @@ func (ml *memlog_t) almosthalffull(tail, head index_t) bool {
 	return full
 }
 
+// returns the checksum of the transaction at start, whose commit block is db,
+// and whose logged blocks are blks
+func (ml *memlog_t) cksum(start index_t, db *logdescriptor_t, blks []*mem.Bytepg_t) int {
+	var idx [8]uint8
+	util.Writen(idx[:], 8, 0, int(start))
+	c := crc32.Update(0, cksumtab, idx[:])
+	c = crc32.Update(c, cksumtab, db.data[:CKSUM*8])
+	for _, b := range blks {
+		c = crc32.Update(c, cksumtab, b[:])
+	}
+	return int(c)
+}
+
 type revokelist_t struct {
 	revoked *BlkList_t
 	index   int
@@ -417,6 +503,7 @@ func (rl *revokelist_t) addRevokeRecord(blkno int, ml *memlog_t) {
 type trans_t struct {
 	forcecond      *sync.Cond
 	ml             *memlog_t
+	seq            uint64 // increases by one for each transaction
 	start          index_t
 	head           index_t
 	inprogress     int        // ops in progress this transaction
@@ -434,6 +521,8 @@ type trans_t struct {
 
 func (log *log_t) mk_trans(start index_t, ml *memlog_t) *trans_t {
 	t := &trans_t{start: start, head: start + NCommitBlk}
+	t.seq = log.nextseq
+	log.nextseq++
 	t.ml = ml
 	t.forcecond = sync.NewCond(log)
 	t.logged = MkBlkList()      // bounded by MaxDescriptor
@@ -573,6 +662,9 @@ func (trans *trans_t) copylogged(ml *memlog_t) {
 		l.Type = b.Type
 		l.Block = b.Block
 		copy(l.Data[:], b.Data[:])
+		if b.Meta != META_NONE {
+			Cksum_set(l.Data[:])
+		}
 		i += 1
 	})
 	if i != trans.head {
@@ -624,6 +716,12 @@ func (trans *trans_t) commit(tail index_t, ml *memlog_t) {
 	}
 	db.w_logdest(j, EndDescriptor) // marker
 
+	logged := make([]*mem.Bytepg_t, 0, j)
+	for i := trans.start + 1; i < trans.head; i++ {
+		logged = append(logged, ml.getmemlog(i).Data)
+	}
+	db.w_cksum(ml.cksum(trans.start, db, logged))
+
 	if log_debug {
 		fmt.Printf("commit: commit descriptor block at %d:\n", trans.start)
 		for k := 1; k < j; k++ {
@@ -663,9 +761,11 @@ type logstat_t struct {
 	Opbegincycles stats.Cycles_t
 	Opendcycles   stats.Cycles_t
 
-	Nforce      stats.Counter_t
-	Nbatchforce stats.Counter_t
-	Forcecycles stats.Cycles_t
+	Nforce        stats.Counter_t
+	Nbatchforce   stats.Counter_t
+	Nforceseq     stats.Counter_t
+	Nforceseqdone stats.Counter_t
+	Forcecycles   stats.Cycles_t
 
 	Nlogwrite       stats.Counter_t
 	Norderedwrite   stats.Counter_t
@@ -692,6 +792,10 @@ type log_t struct {
 	logging bool
 	nextop  opid_t
 	stats   logstat_t
+
+	synccond  *sync.Cond // signaled when a transaction committed
+	nextseq   uint64     // sequence number of the next transaction
+	committed uint64     // sequence number of last committed transaction
 }
 
 // first log header block format
@@ -729,6 +833,17 @@ type logdescriptor_t struct {
 	max  int
 }
 
+// the field of the commit block holding the transaction's checksum
+const CKSUM = BSIZE/8 - 1
+
+func (ld *logdescriptor_t) r_cksum() int {
+	return fieldr(ld.data, CKSUM)
+}
+
+func (ld *logdescriptor_t) w_cksum(n int) {
+	fieldw(ld.data, CKSUM, n)
+}
+
 func (ld *logdescriptor_t) r_logdest(p int) int {
 	if p < 0 || p >= ld.max {
 		panic("bad dnum")
@@ -747,6 +862,8 @@ func (log *log_t) mk_log(ls, ll int, bcache *bcache_t, logging bool) {
 	log.ml = mk_memlog(ls, ll, bcache)
 	log.admissioncond = sync.NewCond(log)
 	log.commitcond = sync.NewCond(log)
+	log.synccond = sync.NewCond(log)
+	log.nextseq = 1
 	log.stopc = make(chan bool)
 	log.translog = mkTransLog()
 	log.nextop = opid_t(1)
@@ -893,6 +1010,8 @@ func (log *log_t) committer() {
 
 			t.forcedone = true
 			t.forcecond.Broadcast()
+			log.committed = t.seq
+			log.synccond.Broadcast()
 
 			if t.forceapply || log.ml.almosthalffull(log.tail, t.head) {
 				log.cancel(log.tail, t.head, t.revokel)
@@ -1057,6 +1176,45 @@ func (log *log_t) install(tail, head index_t) {
 	}
 }
 
+// returns the end of the longest sequence of transactions starting at tail
+// whose checksums match
+func (log *log_t) verify(tail, head index_t) index_t {
+	for i := tail; i != head; {
+		db, dblk := log.ml.readdescriptor(i)
+		// the number of blocks of the transaction, including its commit
+		// block
+		n := 1
+		for ; n < log.ml.maxtrans; n++ {
+			if db.r_logdest(n) == EndDescriptor {
+				break
+			}
+		}
+		ok := n < log.ml.maxtrans && int(head-i) >= n
+		if ok {
+			blks := make([]*Bdev_block_t, 0, n-1)
+			logged := make([]*mem.Bytepg_t, 0, n-1)
+			for k := 1; k < n; k++ {
+				b := log.ml.bcache.Get_fill(log.ml.diskindex(i+index_t(k)), "verify", false)
+				blks = append(blks, b)
+				logged = append(logged, b.Data)
+			}
+			ok = log.ml.cksum(i, db, logged) == db.r_cksum()
+			for _, b := range blks {
+				log.ml.bcache.Relse(b, "verify")
+			}
+		}
+		log.ml.bcache.Relse(dblk, "verify")
+		if !ok {
+			log.ml.stats.Ncorrupt.Inc()
+			fmt.Printf("FS recovery: bad transaction at %d, dropping %d till %d\n",
+				i, i, head)
+			return i
+		}
+		i += index_t(n)
+	}
+	return head
+}
+
 func (log *log_t) recover() {
 	lh, headblk := log.ml.readhdr()
 	tail := lh.r_tail()
@@ -1072,6 +1230,13 @@ func (log *log_t) recover() {
 		return
 	}
 	fmt.Printf("starting FS recovery start %d end %d\n", tail, head)
+	if end := log.verify(tail, head); end != head {
+		// forget the dropped transactions before installing, so that
+		// a crash doesn't let a later recovery find them again
+		head = end
+		log.ml.commit_head(head)
+		log.head = head
+	}
 	log.install(tail, head)
 	log.ml.commit_tail(head)
 	log.tail = head
@@ -0,0 +1,314 @@
+package fs
+
+import "fmt"
+import "hash/crc32"
+import "strings"
+import "unicode/utf16"
+
+import "defs"
+import "util"
+
+// Partitions. Disk_partitions reads the GPT or MBR partition table of each
+// attached disk and attaches each partition as a disk of its own, named after
+// the disk's device file with the partition's number in place of the trailing
+// "c" (e.g., rsd0p1 for the first partition of rsd0c). A partition presents
+// its blocks to file systems as blocks 0 through Nblocks()-1; it offsets block
+// numbers by the partition's start and refuses blocks outside of it. Only
+// partitions that start on a file system block boundary are supported, and
+// MBR extended (logical) partitions are ignored.
+
+type Part_t struct {
+	disk  Disk_i
+	start int
+	nblks int
+	// the partition's number, starting at 1
+	Num int
+	// the GPT unique partition GUID, or, for an MBR partition, the disk
+	// signature and partition number as Linux names them (SSSSSSSS-NN)
+	Uuid string
+	// the GPT partition name; MBR partitions have none
+	Label string
+}
+
+func (p *Part_t) Start(req *Bdev_req_t) bool {
+	if req.Cmd == BDEV_FLUSH {
+		return p.disk.Start(req)
+	}
+	if !req.Inside(p.nblks) {
+		fmt.Printf("partition %v: request outside of partition\n", p.Num)
+		return req.Fail(-defs.EIO)
+	}
+	nreq := &Bdev_req_t{Cmd: req.Cmd, Sync: req.Sync}
+	if req.Cmd == BDEV_DISCARD {
+		for _, r := range req.Runs {
+			nreq.Runs = append(nreq.Runs,
+				Bdev_run_t{Block: p.start + r.Block, N: r.N})
+		}
+	} else {
+		// the disk sees a copy of each block with the partition's
+		// block number. the copies share the original's page, and
+		// completing a copy completes the original.
+		nreq.Blks = MkBlkList()
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			nb := MkBlock(p.start+b.Block, b.Name, b.Mem, p.disk,
+				&partcb_t{orig: b})
+			nb.Pa = b.Pa
+			nb.Data = b.Data
+			nreq.Blks.PushBack(nb)
+		}
+	}
+	if !req.Sync {
+		return p.disk.Start(nreq)
+	}
+	// wait here, so that req gets nreq's error
+	nreq.AckCh = make(chan bool, 1)
+	if p.disk.Start(nreq) {
+		<-nreq.AckCh
+	}
+	req.Err = nreq.Err
+	return false
+}
+
+func (p *Part_t) Lower() []Disk_i {
+	return []Disk_i{p.disk}
+}
+
+func (p *Part_t) Stats() string {
+	return p.disk.Stats()
+}
+
+func (p *Part_t) Nblocks() int {
+	return p.nblks
+}
+
+// Match returns true if spec names p, either as PARTUUID=<uuid> or as
+// PARTLABEL=<label>
+func (p *Part_t) Match(spec string) bool {
+	if s := strings.TrimPrefix(spec, "PARTUUID="); s != spec {
+		return strings.EqualFold(s, p.Uuid)
+	}
+	if s := strings.TrimPrefix(spec, "PARTLABEL="); s != spec {
+		return p.Label != "" && s == p.Label
+	}
+	return false
+}
+
+type partcb_t struct {
+	orig *Bdev_block_t
+}
+
+func (cb *partcb_t) Relse(b *Bdev_block_t, s string) {
+	cb.orig.Done(s)
+}
+
+// Disk_parts returns the partitions of d. A disk without a partition table,
+// such as a whole-disk file system image, has no partitions.
+func Disk_parts(d Disk_i, bm Blockmem_i) ([]*Part_t, defs.Err_t) {
+	if d.Nblocks() < 1 {
+		return nil, 0
+	}
+	b0 := partread(d, bm, 0, BSIZE)
+	// the GPT header is in the second sector, whose size we don't know
+	for _, ss := range []int{512, BSIZE} {
+		var hdr []uint8
+		if ss < BSIZE {
+			hdr = b0[ss : 2*ss]
+		} else if d.Nblocks() > 1 {
+			hdr = partread(d, bm, BSIZE, ss)
+		} else {
+			break
+		}
+		if string(hdr[:8]) == "EFI PART" {
+			return gptparts(d, bm, hdr, ss)
+		}
+	}
+	return mbrparts(d, b0)
+}
+
+// partread reads n bytes of d starting at byte off
+func partread(d Disk_i, bm Blockmem_i, off, n int) []uint8 {
+	ret := make([]uint8, 0, n)
+	for bn := off / BSIZE; len(ret) < n; bn++ {
+		b := MkBlock_newpage(bn, "partition table", bm, d, nil)
+		b.Read()
+		s := 0
+		if bn == off/BSIZE {
+			s = off % BSIZE
+		}
+		e := util.Min(BSIZE, s+n-len(ret))
+		ret = append(ret, b.Data[s:e]...)
+		b.Free_page()
+	}
+	return ret
+}
+
+// mkPart makes partition num of d from its first sector and number of
+// sectors of size ss, which come from the partition table and so are checked
+// before computing byte offsets from them
+func mkPart(d Disk_i, num int, first, n, ss int) (*Part_t, bool) {
+	nsect := d.Nblocks() * (BSIZE / ss)
+	if first < 0 || n <= 0 || first > nsect || n > nsect-first {
+		fmt.Printf("partition %v: bad size\n", num)
+		return nil, false
+	}
+	off := first * ss
+	sz := n * ss
+	if off%BSIZE != 0 {
+		fmt.Printf("partition %v: start not block aligned\n", num)
+		return nil, false
+	}
+	p := &Part_t{disk: d, Num: num}
+	p.start = off / BSIZE
+	p.nblks = sz / BSIZE
+	if p.nblks == 0 || p.start+p.nblks > d.Nblocks() {
+		fmt.Printf("partition %v: bad size\n", num)
+		return nil, false
+	}
+	return p, true
+}
+
+func gptparts(d Disk_i, bm Blockmem_i, hdr []uint8, ss int) ([]*Part_t, defs.Err_t) {
+	hsz := util.Readn(hdr, 4, 12)
+	if hsz < 92 || hsz > ss {
+		return nil, -defs.EINVAL
+	}
+	h := make([]uint8, hsz)
+	copy(h, hdr)
+	util.Writen(h, 4, 16, 0)
+	if int(crc32.ChecksumIEEE(h)) != util.Readn(hdr, 4, 16) {
+		fmt.Printf("GPT header checksum mismatch\n")
+		return nil, -defs.EINVAL
+	}
+	elba := util.Readn(hdr, 8, 72)
+	nent := util.Readn(hdr, 4, 80)
+	esz := util.Readn(hdr, 4, 84)
+	if esz < 128 || nent*esz > 1<<20 || elba < 2 ||
+		elba > d.Nblocks()*BSIZE/ss || elba*ss+nent*esz > d.Nblocks()*BSIZE {
+		return nil, -defs.EINVAL
+	}
+	ents := partread(d, bm, elba*ss, nent*esz)
+	if int(crc32.ChecksumIEEE(ents)) != util.Readn(hdr, 4, 88) {
+		fmt.Printf("GPT entries checksum mismatch\n")
+		return nil, -defs.EINVAL
+	}
+	var ret []*Part_t
+	for i := 0; i < nent; i++ {
+		e := ents[i*esz : (i+1)*esz]
+		used := false
+		for _, c := range e[:16] {
+			if c != 0 {
+				used = true
+			}
+		}
+		if !used {
+			continue
+		}
+		first := util.Readn(e, 8, 32)
+		last := util.Readn(e, 8, 40)
+		if last < first {
+			continue
+		}
+		p, ok := mkPart(d, i+1, first, last-first+1, ss)
+		if !ok {
+			continue
+		}
+		p.Uuid = guid(e[16:32])
+		var name []uint16
+		for j := 56; j+1 < 128; j += 2 {
+			c := uint16(util.Readn(e, 2, j))
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		p.Label = string(utf16.Decode(name))
+		ret = append(ret, p)
+	}
+	return ret, 0
+}
+
+// guid formats the mixed-endian GUID g
+func guid(g []uint8) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		util.Readn(g, 4, 0), util.Readn(g, 2, 4), util.Readn(g, 2, 6),
+		g[8], g[9], g[10], g[11], g[12], g[13], g[14], g[15])
+}
+
+func mbrparts(d Disk_i, b0 []uint8) ([]*Part_t, defs.Err_t) {
+	if b0[510] != 0x55 || b0[511] != 0xaa {
+		return nil, 0
+	}
+	// a boot sector that isn't an MBR (e.g., a FAT boot sector) has
+	// garbage where the MBR's status bytes are
+	for i := 0; i < 4; i++ {
+		if s := b0[446+16*i]; s != 0 && s != 0x80 {
+			return nil, 0
+		}
+	}
+	sig := util.Readn(b0, 4, 440)
+	var ret []*Part_t
+	for i := 0; i < 4; i++ {
+		e := b0[446+16*i : 446+16*(i+1)]
+		switch e[4] {
+		// unused, extended, and GPT protective partitions
+		case 0, 0x05, 0x0f, 0x85, 0xee:
+			continue
+		}
+		first := util.Readn(e, 4, 8)
+		n := util.Readn(e, 4, 12)
+		// biscuit's boot block has an entry of size 0
+		if first == 0 || n == 0 {
+			continue
+		}
+		p, ok := mkPart(d, i+1, first, n, 512)
+		if !ok {
+			continue
+		}
+		p.Uuid = fmt.Sprintf("%08x-%02x", sig, i+1)
+		ret = append(ret, p)
+	}
+	return ret, 0
+}
+
+// Disk_partitions attaches the partitions of each attached disk
+func Disk_partitions(bm Blockmem_i) {
+	disks.Lock()
+	var names []string
+	for n, d := range disks.m {
+		if _, ok := d.(*Part_t); !ok {
+			names = append(names, n)
+		}
+	}
+	disks.Unlock()
+
+	for _, n := range names {
+		d, ok := Disk_lookup(n)
+		if !ok {
+			continue
+		}
+		parts, err := Disk_parts(d, bm)
+		if err != 0 {
+			fmt.Printf("%v: bad partition table: %v\n", n, err)
+			continue
+		}
+		for _, p := range parts {
+			pn := fmt.Sprintf("%vp%v", strings.TrimSuffix(n, "c"), p.Num)
+			if err := Disk_attach(pn, p); err != 0 {
+				fmt.Printf("cannot attach %v: %v\n", pn, err)
+			}
+		}
+	}
+}
+
+// Part_lookup returns the attached partition that spec names (see Match)
+func Part_lookup(spec string) (*Part_t, bool) {
+	disks.Lock()
+	defer disks.Unlock()
+
+	for _, d := range disks.m {
+		if p, ok := d.(*Part_t); ok && p.Match(spec) {
+			return p, true
+		}
+	}
+	return nil, false
+}
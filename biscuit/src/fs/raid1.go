@@ -0,0 +1,802 @@
+package fs
+
+import "fmt"
+import "sync"
+import "sync/atomic"
+
+import "defs"
+import "stats"
+import "util"
+
+// Software RAID-1. Raid1_t mirrors its blocks on two or more member disks.
+// It writes each request to every member that isn't failed and reads from the
+// in-sync member with the fewest requests in flight. A member whose request
+// fails (Bdev_req_t.Err) is marked failed and gets no more I/O; each member
+// has a bitmap of the regions written while it was failed. Replace puts a new
+// disk in place of a failed member and Readd returns a failed member whose
+// disk recovered; both resynchronize the member's dirty regions in the
+// background, during which the member gets writes but no reads.
+//
+// Each member holds the mirror's metadata: a header in its last block and,
+// after the mirror's blocks, the dirty bitmaps of all members. The members
+// that aren't failed get the metadata whenever a dirty bit is set or a member
+// changes state, before the write that caused it completes, so that
+// Raid1_assemble knows which regions a member missed even after a crash. The
+// header also says whether the mirror was shut down cleanly (Markclean); if
+// not, writes in flight may have reached only some members, and assembly
+// resynchronizes all of them from one member.
+
+// blocks per bit of a member's dirty bitmap
+const RAID_REGION = 64
+
+// the most members a mirror can have
+const RAID_MAXMEM = 8
+
+// the header of a member's metadata
+const (
+	raidmagic   = "BSCRAID1"
+	rh_nmem     = 8
+	rh_index    = 12
+	rh_events   = 16
+	rh_nblks    = 24
+	rh_clean    = 32
+	rh_id       = 40
+	rh_states   = 64
+	raidfailed  = 1
+	raidhdrsize = rh_states + 4*RAID_MAXMEM
+)
+
+type Raidst_t int
+
+const (
+	RAID_OK Raidst_t = iota
+	RAID_FAILED
+	RAID_RESYNC
+)
+
+type raidmem_t struct {
+	disk  Disk_i
+	state Raidst_t
+	// requests in flight
+	inflight int32
+	// the regions the member missed writes to
+	dirty []uint64
+}
+
+type Raid1_t struct {
+	sync.Mutex
+	mems  []*raidmem_t
+	bm    Blockmem_i
+	nblks int
+	// blocks of each member's dirty bitmap
+	nbm int
+	// writes in flight, and resyncs copying a region; a resync copies a
+	// region only once no write is in flight and holds off new writes
+	// while it copies.
+	nwrites int
+	npause  int
+	cond    *sync.Cond
+	// the mirror's identity, the number of times its metadata has been
+	// written, and whether no write happened since Markclean
+	id     int
+	events int
+	clean  bool
+	// the version of the metadata in memory, and the version the members
+	// have; saving is true while savemeta writes them
+	metagen  int
+	savedgen int
+	saving   bool
+}
+
+// the blocks of a dirty bitmap for a mirror of nblks blocks
+func raidnbm(nblks int) int {
+	nregions := (nblks + RAID_REGION - 1) / RAID_REGION
+	return (nregions + BSIZE*8 - 1) / (BSIZE * 8)
+}
+
+// Raid1_blocks returns the blocks each of nmem members needs for a mirror of
+// nblks blocks
+func Raid1_blocks(nblks, nmem int) int {
+	return nblks + 1 + nmem*raidnbm(nblks)
+}
+
+func mkRaid1(nmem, nblks int, bm Blockmem_i) *Raid1_t {
+	r := &Raid1_t{bm: bm, nblks: nblks, nbm: raidnbm(nblks)}
+	r.cond = sync.NewCond(&r.Mutex)
+	nregions := (r.nblks + RAID_REGION - 1) / RAID_REGION
+	for i := 0; i < nmem; i++ {
+		m := &raidmem_t{state: RAID_FAILED}
+		m.dirty = make([]uint64, (nregions+63)/64)
+		r.mems = append(r.mems, m)
+	}
+	return r
+}
+
+// MkRaid1 makes a new mirror of disks, which must be in sync, and writes its
+// metadata to them. The mirror is smaller than the smallest disk by the size
+// of the metadata.
+func MkRaid1(disks []Disk_i, bm Blockmem_i) (*Raid1_t, defs.Err_t) {
+	if len(disks) < 2 || len(disks) > RAID_MAXMEM {
+		return nil, -defs.EINVAL
+	}
+	n := disks[0].Nblocks()
+	for _, d := range disks {
+		if d.Nblocks() < n {
+			n = d.Nblocks()
+		}
+	}
+	nblks := n - 1 - len(disks)*raidnbm(n)
+	for Raid1_blocks(nblks+1, len(disks)) <= n {
+		nblks++
+	}
+	if nblks <= 0 {
+		return nil, -defs.EINVAL
+	}
+	r := mkRaid1(len(disks), nblks, bm)
+	r.id = int(stats.Rdtsc())
+	r.clean = true
+	for i, d := range disks {
+		r.mems[i].disk = d
+		r.mems[i].state = RAID_OK
+	}
+	if err := r.savemeta(); err != 0 {
+		return nil, err
+	}
+	return r, 0
+}
+
+// Raid1_assemble assembles the mirror whose members are among disks, as the
+// metadata of the disks says, and resynchronizes in the background the
+// members that missed writes. The metadata of the member that was written
+// last is authoritative; disks without metadata, or with that of another
+// mirror, are ignored.
+func Raid1_assemble(disks []Disk_i, bm Blockmem_i) (*Raid1_t, defs.Err_t) {
+	var hdrs [][]uint8
+	var mds []Disk_i
+	fresh := -1
+	for _, d := range disks {
+		h, ok := raidhdr(d, bm)
+		if !ok {
+			continue
+		}
+		if len(hdrs) > 0 && util.Readn(h, 8, rh_id) != util.Readn(hdrs[0], 8, rh_id) {
+			continue
+		}
+		hdrs = append(hdrs, h)
+		mds = append(mds, d)
+		if fresh < 0 || util.Readn(h, 8, rh_events) > util.Readn(hdrs[fresh], 8, rh_events) {
+			fresh = len(hdrs) - 1
+		}
+	}
+	if fresh < 0 {
+		return nil, -defs.ENODEV
+	}
+	fh := hdrs[fresh]
+	r := mkRaid1(util.Readn(fh, 4, rh_nmem), util.Readn(fh, 8, rh_nblks), bm)
+	r.id = util.Readn(fh, 8, rh_id)
+	r.events = util.Readn(fh, 8, rh_events)
+	for i, m := range r.mems {
+		bits := make([]uint8, r.nbm*BSIZE)
+		if err := r.metaio(mds[fresh], r.nblks+i*r.nbm, bits, BDEV_READ); err != 0 {
+			return nil, err
+		}
+		for j := range m.dirty {
+			m.dirty[j] = uint64(util.Readn(bits, 8, 8*j))
+		}
+	}
+	for j, h := range hdrs {
+		i := util.Readn(h, 4, rh_index)
+		m := r.mems[i]
+		if m.disk != nil || util.Readn(h, 4, rh_nmem) != len(r.mems) ||
+			util.Readn(h, 8, rh_nblks) != r.nblks {
+			continue
+		}
+		m.disk = mds[j]
+		m.state = RAID_RESYNC
+		if util.Readn(fh, 4, rh_states+4*i) == raidfailed {
+			continue
+		}
+		if util.Readn(h, 8, rh_events) == r.events {
+			m.state = RAID_OK
+		} else {
+			// the member missed the last metadata while believed in
+			// sync, so it may have missed any write
+			m.setall(r.nblks)
+		}
+	}
+	ref := -1
+	for i, m := range r.mems {
+		if m.state != RAID_OK {
+			continue
+		}
+		if ref < 0 {
+			ref = i
+		} else if util.Readn(fh, 4, rh_clean) == 0 {
+			// writes in flight at the crash may have reached only
+			// some members
+			m.state = RAID_RESYNC
+			m.setall(r.nblks)
+		}
+	}
+	if ref < 0 {
+		fmt.Printf("raid1: no member in sync\n")
+		return nil, -defs.EIO
+	}
+	if err := r.savemeta(); err != 0 {
+		return nil, err
+	}
+	for i, m := range r.mems {
+		if m.state == RAID_RESYNC {
+			fmt.Printf("raid1: resyncing member %v\n", i)
+			go r.resync(m, i)
+		}
+	}
+	return r, 0
+}
+
+// raidhdr reads the metadata header of d, returning false if d has none
+func raidhdr(d Disk_i, bm Blockmem_i) ([]uint8, bool) {
+	n := d.Nblocks()
+	if n < 2 {
+		return nil, false
+	}
+	b := MkBlock_newpage(n-1, "raidhdr", bm, d, raidcb)
+	defer b.Free_page()
+	if bdevrw(b, BDEV_READ) != 0 || string(b.Data[:len(raidmagic)]) != raidmagic {
+		return nil, false
+	}
+	h := make([]uint8, raidhdrsize)
+	copy(h, b.Data[:])
+	nmem := util.Readn(h, 4, rh_nmem)
+	nblks := util.Readn(h, 8, rh_nblks)
+	if nmem < 2 || nmem > RAID_MAXMEM || util.Readn(h, 4, rh_index) >= nmem ||
+		nblks <= 0 || Raid1_blocks(nblks, nmem) > n {
+		return nil, false
+	}
+	return h, true
+}
+
+// metaio reads or writes buf, which is a multiple of the block size, from or
+// to member disk d starting at block bn, one block per request
+func (r *Raid1_t) metaio(d Disk_i, bn int, buf []uint8, cmd Bdevcmd_t) defs.Err_t {
+	b := MkBlock_newpage(0, "raidmeta", r.bm, d, raidcb)
+	defer b.Free_page()
+	for i := 0; i*BSIZE < len(buf); i++ {
+		b.Block = bn + i
+		if cmd == BDEV_WRITE {
+			copy(b.Data[:], buf[i*BSIZE:])
+		}
+		if err := bdevrw(b, cmd); err != 0 {
+			return err
+		}
+		if cmd == BDEV_READ {
+			copy(buf[i*BSIZE:], b.Data[:])
+		}
+	}
+	return 0
+}
+
+// savemeta writes the metadata to the members that aren't failed, and returns
+// once they have a version at least as new as the one in memory when it was
+// called. a member that fails to take it is failed, which changes the
+// metadata again. it returns -EIO if no member took the metadata.
+func (r *Raid1_t) savemeta() defs.Err_t {
+	r.Lock()
+	defer r.Unlock()
+
+	r.metagen++
+	want := r.metagen
+	for r.savedgen < want {
+		if r.saving {
+			r.cond.Wait()
+			continue
+		}
+		r.saving = true
+		gen := r.metagen
+		r.events++
+		hdr := make([]uint8, BSIZE)
+		copy(hdr, raidmagic)
+		util.Writen(hdr, 4, rh_nmem, len(r.mems))
+		util.Writen(hdr, 8, rh_events, r.events)
+		util.Writen(hdr, 8, rh_nblks, r.nblks)
+		if r.clean {
+			util.Writen(hdr, 4, rh_clean, 1)
+		}
+		util.Writen(hdr, 8, rh_id, r.id)
+		bits := make([]uint8, len(r.mems)*r.nbm*BSIZE)
+		for i, m := range r.mems {
+			if m.state != RAID_OK {
+				util.Writen(hdr, 4, rh_states+4*i, raidfailed)
+			}
+			for j, w := range m.dirty {
+				util.Writen(bits, 8, i*r.nbm*BSIZE+8*j, int(w))
+			}
+		}
+		var live []*raidmem_t
+		for _, m := range r.mems {
+			if m.state != RAID_FAILED {
+				live = append(live, m)
+			}
+		}
+		r.Unlock()
+
+		var failed []*raidmem_t
+		for _, m := range live {
+			h := make([]uint8, BSIZE)
+			copy(h, hdr)
+			for i := range r.mems {
+				if r.mems[i] == m {
+					util.Writen(h, 4, rh_index, i)
+				}
+			}
+			// the bitmaps before the header, which makes them current
+			err := r.metaio(m.disk, r.nblks, bits, BDEV_WRITE)
+			if err == 0 {
+				err = r.metaio(m.disk, m.disk.Nblocks()-1, h, BDEV_WRITE)
+			}
+			if err == 0 {
+				fl := MkRequest(nil, BDEV_FLUSH, true)
+				if m.disk.Start(fl) {
+					<-fl.AckCh
+				}
+				err = fl.Err
+			}
+			if err != 0 {
+				failed = append(failed, m)
+			}
+		}
+
+		r.Lock()
+		r.saving = false
+		r.savedgen = gen
+		for _, m := range failed {
+			r._fail(m)
+		}
+		r.cond.Broadcast()
+		if len(failed) == len(live) {
+			fmt.Printf("raid1: no member took the metadata\n")
+			return -defs.EIO
+		}
+		if len(failed) != 0 {
+			// the others must learn of the failures
+			r.metagen++
+			want = r.metagen
+		}
+	}
+	return 0
+}
+
+// Markclean flushes the members and records that the mirror is in sync, until
+// the next write. Call it before shutting down.
+func (r *Raid1_t) Markclean() defs.Err_t {
+	r.flush(MkRequest(nil, BDEV_FLUSH, true))
+	r.Lock()
+	if r.nwrites == 0 {
+		r.clean = true
+	}
+	r.Unlock()
+	return r.savemeta()
+}
+
+func (r *Raid1_t) Start(req *Bdev_req_t) bool {
+	if !req.Inside(r.nblks) {
+		fmt.Printf("raid1: request outside of mirror\n")
+		return req.Fail(-defs.EIO)
+	}
+	switch req.Cmd {
+	case BDEV_READ:
+		r.read(req)
+	case BDEV_WRITE:
+		r.write(req)
+	case BDEV_FLUSH:
+		r.flush(req)
+	case BDEV_DISCARD:
+		r.discard(req)
+	}
+	// read and sync requests are done
+	return false
+}
+
+func (r *Raid1_t) Stats() string {
+	r.Lock()
+	defer r.Unlock()
+
+	s := "raid1:"
+	for i, m := range r.mems {
+		s += fmt.Sprintf(" %v:%v", i, []string{"ok", "failed", "resync"}[m.state])
+	}
+	return s + "\n"
+}
+
+func (r *Raid1_t) Lower() []Disk_i {
+	r.Lock()
+	defer r.Unlock()
+
+	var ret []Disk_i
+	for _, m := range r.mems {
+		if m.disk != nil {
+			ret = append(ret, m.disk)
+		}
+	}
+	return ret
+}
+
+func (r *Raid1_t) Nblocks() int {
+	return r.nblks
+}
+
+// State returns the state of member i
+func (r *Raid1_t) State(i int) Raidst_t {
+	r.Lock()
+	defer r.Unlock()
+	return r.mems[i].state
+}
+
+// Fail marks member i failed, e.g., to take it out of the mirror
+func (r *Raid1_t) Fail(i int) defs.Err_t {
+	if i < 0 || i >= len(r.mems) {
+		return -defs.EINVAL
+	}
+	r.fail(r.mems[i])
+	return r.savemeta()
+}
+
+// Replace puts disk d in place of the failed member i and copies the mirror's
+// blocks to d in the background
+func (r *Raid1_t) Replace(i int, d Disk_i) defs.Err_t {
+	r.Lock()
+	if i < 0 || i >= len(r.mems) ||
+		d.Nblocks() < Raid1_blocks(r.nblks, len(r.mems)) {
+		r.Unlock()
+		return -defs.EINVAL
+	}
+	m := r.mems[i]
+	if m.state != RAID_FAILED {
+		r.Unlock()
+		return -defs.EBUSY
+	}
+	m.disk = d
+	m.setall(r.nblks)
+	m.state = RAID_RESYNC
+	r.Unlock()
+
+	// the new disk gets the metadata, and the others learn that it needs
+	// all blocks
+	if err := r.savemeta(); err != 0 {
+		return err
+	}
+	go r.resync(m, i)
+	return 0
+}
+
+// Readd returns the failed member i to the mirror, copying to it the regions
+// it missed in the background
+func (r *Raid1_t) Readd(i int) defs.Err_t {
+	r.Lock()
+	defer r.Unlock()
+
+	if i < 0 || i >= len(r.mems) || r.mems[i].disk == nil {
+		return -defs.EINVAL
+	}
+	m := r.mems[i]
+	if m.state != RAID_FAILED {
+		return -defs.EBUSY
+	}
+	m.state = RAID_RESYNC
+	go r.resync(m, i)
+	return 0
+}
+
+func (m *raidmem_t) setdirty(region int) {
+	m.dirty[region/64] |= 1 << uint(region%64)
+}
+
+func (m *raidmem_t) isdirty(region int) bool {
+	return m.dirty[region/64]&(1<<uint(region%64)) != 0
+}
+
+func (m *raidmem_t) cleardirty(region int) {
+	m.dirty[region/64] &^= 1 << uint(region%64)
+}
+
+// marks all regions of a mirror of nblks blocks dirty
+func (m *raidmem_t) setall(nblks int) {
+	for j := 0; j < nblks; j += RAID_REGION {
+		m.setdirty(j / RAID_REGION)
+	}
+}
+
+func (r *Raid1_t) fail(m *raidmem_t) {
+	r.Lock()
+	defer r.Unlock()
+	r._fail(m)
+}
+
+func (r *Raid1_t) _fail(m *raidmem_t) {
+	if m.state == RAID_FAILED {
+		return
+	}
+	m.state = RAID_FAILED
+	for i := range r.mems {
+		if r.mems[i] == m {
+			fmt.Printf("raid1: member %v failed\n", i)
+		}
+	}
+}
+
+// marks the regions of req's blocks dirty for the failed member m
+func (r *Raid1_t) markdirty(m *raidmem_t, req *Bdev_req_t) {
+	r.Lock()
+	req.Blks.Apply(func(b *Bdev_block_t) {
+		m.setdirty(b.Block / RAID_REGION)
+	})
+	r.Unlock()
+	r.savemeta()
+}
+
+type raidcb_t struct {
+}
+
+func (cb *raidcb_t) Relse(*Bdev_block_t, string) {
+}
+
+var raidcb = &raidcb_t{}
+
+// mkreq makes a request for member disk d with copies of req's blocks that
+// share their pages
+func (r *Raid1_t) mkreq(req *Bdev_req_t, d Disk_i) *Bdev_req_t {
+	var blks *BlkList_t
+	if req.Blks != nil {
+		blks = MkBlkList()
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			nb := MkBlock(b.Block, b.Name, b.Mem, d, raidcb)
+			nb.Pa = b.Pa
+			nb.Data = b.Data
+			blks.PushBack(nb)
+		}
+	}
+	// buffered so that members completing out of order don't block each
+	// other's completions
+	ret := &Bdev_req_t{Cmd: req.Cmd, Blks: blks, Runs: req.Runs, Sync: true}
+	ret.AckCh = make(chan bool, 1)
+	return ret
+}
+
+// do issues req to member m and waits for it to complete
+func (r *Raid1_t) do(m *raidmem_t, d Disk_i, req *Bdev_req_t) defs.Err_t {
+	mr := r.mkreq(req, d)
+	atomic.AddInt32(&m.inflight, 1)
+	if d.Start(mr) {
+		<-mr.AckCh
+	}
+	atomic.AddInt32(&m.inflight, -1)
+	return mr.Err
+}
+
+// pick returns the in-sync member with the fewest requests in flight
+func (r *Raid1_t) pick() (*raidmem_t, Disk_i, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	var best *raidmem_t
+	for _, m := range r.mems {
+		if m.state != RAID_OK {
+			continue
+		}
+		if best == nil ||
+			atomic.LoadInt32(&m.inflight) < atomic.LoadInt32(&best.inflight) {
+			best = m
+		}
+	}
+	if best == nil {
+		return nil, nil, false
+	}
+	return best, best.disk, true
+}
+
+func (r *Raid1_t) read(req *Bdev_req_t) {
+	for {
+		m, d, ok := r.pick()
+		if !ok {
+			fmt.Printf("raid1: no member to read from\n")
+			req.Err = -defs.EIO
+			return
+		}
+		if err := r.do(m, d, req); err == 0 {
+			return
+		}
+		r.fail(m)
+	}
+}
+
+type raidw_t struct {
+	m  *raidmem_t
+	d  Disk_i
+	mr *Bdev_req_t
+	// true if the caller must wait for mr's ack
+	wait bool
+}
+
+func (r *Raid1_t) write(req *Bdev_req_t) {
+	r.Lock()
+	for r.npause > 0 {
+		r.cond.Wait()
+	}
+	r.nwrites++
+	// the members must know of a new dirty region, and that the mirror
+	// isn't clean, before the write can reach any of them
+	save := r.clean
+	r.clean = false
+	var ws []raidw_t
+	for _, m := range r.mems {
+		if m.state == RAID_FAILED {
+			// before a Readd can start copying the regions
+			req.Blks.Apply(func(b *Bdev_block_t) {
+				if !m.isdirty(b.Block / RAID_REGION) {
+					m.setdirty(b.Block / RAID_REGION)
+					save = true
+				}
+			})
+		} else {
+			ws = append(ws, raidw_t{m: m, d: m.disk,
+				mr: r.mkreq(req, m.disk)})
+		}
+	}
+	r.Unlock()
+	if save {
+		r.savemeta()
+	}
+
+	for i := range ws {
+		w := &ws[i]
+		atomic.AddInt32(&w.m.inflight, 1)
+		w.wait = w.d.Start(w.mr)
+	}
+	if req.Sync {
+		r.wdone(req, ws)
+	} else {
+		go r.wdone(req, ws)
+	}
+}
+
+// wdone waits for the members to finish writing req and then completes req
+func (r *Raid1_t) wdone(req *Bdev_req_t, ws []raidw_t) {
+	nok := 0
+	for _, w := range ws {
+		if w.wait {
+			<-w.mr.AckCh
+		}
+		atomic.AddInt32(&w.m.inflight, -1)
+		if w.mr.Err != 0 {
+			r.fail(w.m)
+			r.markdirty(w.m, req)
+		} else {
+			nok++
+		}
+	}
+	if nok == 0 {
+		fmt.Printf("raid1: no member took a write\n")
+		req.Err = -defs.EIO
+	}
+	req.Blks.Apply(func(b *Bdev_block_t) {
+		b.Done("raid1")
+	})
+
+	r.Lock()
+	r.nwrites--
+	if r.nwrites == 0 {
+		r.cond.Broadcast()
+	}
+	r.Unlock()
+}
+
+// live returns the members that aren't failed and their disks
+func (r *Raid1_t) live() ([]*raidmem_t, []Disk_i) {
+	r.Lock()
+	defer r.Unlock()
+
+	var ms []*raidmem_t
+	var ds []Disk_i
+	for _, m := range r.mems {
+		if m.state != RAID_FAILED {
+			ms = append(ms, m)
+			ds = append(ds, m.disk)
+		}
+	}
+	return ms, ds
+}
+
+func (r *Raid1_t) flush(req *Bdev_req_t) {
+	ms, ds := r.live()
+	for i, m := range ms {
+		if err := r.do(m, ds[i], req); err != 0 {
+			r.fail(m)
+			// the member may not have the blocks of earlier writes
+			r.Lock()
+			m.setall(r.nblks)
+			r.Unlock()
+			r.savemeta()
+		}
+	}
+}
+
+// discard discards req's runs on the members that aren't failed. discards
+// are advisory, so a member that fails one stays in the mirror.
+func (r *Raid1_t) discard(req *Bdev_req_t) {
+	ms, ds := r.live()
+	for i, m := range ms {
+		r.do(m, ds[i], req)
+	}
+}
+
+// resync copies the dirty regions of member m (number i) from the in-sync
+// members, one region at a time
+func (r *Raid1_t) resync(m *raidmem_t, i int) {
+	for region := 0; region*RAID_REGION < r.nblks; region++ {
+		r.Lock()
+		if m.state != RAID_RESYNC {
+			r.Unlock()
+			return
+		}
+		if !m.isdirty(region) {
+			r.Unlock()
+			continue
+		}
+		r.npause++
+		for r.nwrites > 0 {
+			r.cond.Wait()
+		}
+		d := m.disk
+		r.Unlock()
+
+		err := r.copyregion(m, d, region)
+
+		r.Lock()
+		if err == 0 {
+			m.cleardirty(region)
+		}
+		r.npause--
+		r.cond.Broadcast()
+		r.Unlock()
+		if err != 0 {
+			r.fail(m)
+			r.savemeta()
+			fmt.Printf("raid1: resync of member %v failed\n", i)
+			return
+		}
+	}
+	r.Lock()
+	ok := m.state == RAID_RESYNC
+	if ok {
+		m.state = RAID_OK
+		fmt.Printf("raid1: member %v in sync\n", i)
+	}
+	r.Unlock()
+	if ok {
+		r.savemeta()
+	}
+}
+
+func (r *Raid1_t) copyregion(m *raidmem_t, d Disk_i, region int) defs.Err_t {
+	end := (region + 1) * RAID_REGION
+	if end > r.nblks {
+		end = r.nblks
+	}
+	for bn := region * RAID_REGION; bn < end; bn++ {
+		b := MkBlock_newpage(bn, "resync", r.bm, r, raidcb)
+		l := MkBlkList()
+		l.PushBack(b)
+		req := MkRequest(l, BDEV_READ, true)
+		r.read(req)
+		err := req.Err
+		if err == 0 {
+			req.Cmd = BDEV_WRITE
+			err = r.do(m, d, req)
+		}
+		b.Free_page()
+		if err != 0 {
+			return err
+		}
+	}
+	return 0
+}
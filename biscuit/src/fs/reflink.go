@@ -0,0 +1,215 @@
+package fs
+
+import "bounds"
+import "defs"
+import "fdops"
+import "res"
+import "vm"
+
+// Copying a range of one file to another. when the range starts at a block
+// boundary in both files, the destination shares the source's blocks instead
+// of copying them: each shared block gets a reference in the reference map
+// (see refmap.go), and the first write to it by either file gives the writer
+// its own copy. the bytes that can't be shared are copied.
+
+// bytes copied through the kernel per step of an unshared copy
+const copychunk = 4 * BSIZE
+
+// returns the inode of the open file f, referenced, or an error if f is
+// closed
+func (fo *fsfops_t) iref(s string) (*imemnode_t, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return nil, -defs.EBADF
+	}
+	return fo.fs.icache.Iref(fo.priv, s), 0
+}
+
+// Copy_range copies n bytes at offset soff of the file open as src to offset
+// doff of the file open as dst. both must be regular files of the same file
+// system. returns the number of bytes copied, which is less than n if the
+// source ends first.
+func Copy_range(src, dst fdops.Fdops_i, soff, doff, n int) (int, defs.Err_t) {
+	sfo, ok1 := src.(*fsfops_t)
+	dfo, ok2 := dst.(*fsfops_t)
+	if !ok1 || !ok2 || sfo.fs != dfo.fs {
+		return 0, -defs.EXDEV
+	}
+	if soff < 0 || doff < 0 || n < 0 || doff+n < doff {
+		return 0, -defs.EINVAL
+	}
+	if (doff+n)/BSIZE >= NIADDRS+INDADDR+INDADDR*INDADDR {
+		return 0, -defs.EFBIG
+	}
+	if dfo.append {
+		return 0, -defs.EBADF
+	}
+	fs := sfo.fs
+	sidm, err := sfo.iref("copy_range")
+	if err != 0 {
+		return 0, err
+	}
+	defer sidm.Refdown("copy_range")
+	didm, err := dfo.iref("copy_range")
+	if err != 0 {
+		return 0, err
+	}
+	defer didm.Refdown("copy_range")
+
+	sidm.ilock("copy_range")
+	ssize, stype := sidm.size, sidm.itype
+	sidm.iunlock("copy_range")
+	didm.ilock("copy_range")
+	dtype := didm.itype
+	didm.iunlock("copy_range")
+	if stype == I_DIR || dtype == I_DIR {
+		return 0, -defs.EISDIR
+	}
+	if stype != I_FILE || dtype != I_FILE {
+		return 0, -defs.EINVAL
+	}
+	if soff >= ssize {
+		return 0, 0
+	}
+	n = min(n, ssize-soff)
+	if sidm == didm && soff < doff+n && doff < soff+n {
+		return 0, -defs.EINVAL
+	}
+
+	c := 0
+	if soff%BSIZE == 0 && doff%BSIZE == 0 {
+		c, err = fs.clone(sidm, didm, soff, doff, n)
+		if err != 0 {
+			return c, err
+		}
+	}
+	buf := make([]uint8, copychunk)
+	ub := &vm.Fakeubuf_t{}
+	for c < n {
+		ub.Fake_init(buf[:min(copychunk, n-c)])
+		r, err := sfo.Pread(ub, soff+c)
+		if err != 0 || r == 0 {
+			return c, err
+		}
+		ub.Fake_init(buf[:r])
+		w, err := dfo.Pwrite(ub, doff+c)
+		c += w
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+// makes didm share the blocks of [soff, soff+n) of sidm at doff, in as many
+// operations as needed. returns the number of bytes shared, which may stop
+// short of n at the source's last, partial, block.
+func (fs *Fs_t) clone(sidm, didm *imemnode_t, soff, doff, n int) (int, defs.Err_t) {
+	c := 0
+	for c < n {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_WRITE)
+		if !res.Resadd_noblock(gimme) {
+			return c, -defs.ENOHEAP
+		}
+		opid := fs.fslog.Op_begin("clone")
+		locked := iref_lockall([]*imemnode_t{sidm, didm})
+		did, err := didm.clone(opid, sidm, soff+c, doff+c, n-c)
+		didm._iupdate(opid)
+		for _, idm := range locked {
+			idm.iunlock("clone")
+		}
+		fs.fslog.Op_end(opid)
+		c += did
+		if err != 0 || did == 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+// maps the blocks of [soff, soff+n) of src at doff in the file, until the
+// operation would log more blocks than allowed; both offsets are block
+// aligned. as in do_write, an operation has room for MaxBlkPerOp-3 blocks
+// besides the inode and indirect blocks. mapping a block logs the refmap block
+// of the source block, or the block map block of its copy, and replacing a
+// block logs its refmap or block map block. a partial last block is shared only if it ends both files, since
+// the bytes after the end of the range would otherwise change. a source
+// block that is mapped shared, and thus may change without a copy, or that
+// has as many references as the map can count, is copied instead. returns
+// the number of bytes mapped. caller holds both inode locks.
+func (idm *imemnode_t) clone(opid opid_t, src *imemnode_t, soff, doff, n int) (int, defs.Err_t) {
+	fs := idm.fs
+	room := MaxBlkPerOp - 3
+	c := 0
+	var err defs.Err_t
+	for ; c < n; c += BSIZE {
+		if c+BSIZE > n && (soff+n < src.size || doff+n < idm.size) {
+			break
+		}
+		sfbn := (soff + c) / BSIZE
+		dfbn := (doff + c) / BSIZE
+		var sblkn, dblkn int
+		if sblkn, _, err = src.fbn2block(opid, sfbn, false); err != 0 {
+			break
+		}
+		if dblkn, _, err = idm.fbn2block(opid, dfbn, false); err != 0 {
+			break
+		}
+		if sblkn == dblkn {
+			// both holes, or already shared
+			continue
+		}
+		cost := 0
+		if sblkn != 0 {
+			cost++
+		}
+		if dblkn != 0 {
+			cost++
+		}
+		if cost > room {
+			break
+		}
+		room -= cost
+		if sblkn == 0 {
+			old, _ := idm.unmapb(opid, dfbn)
+			fs.bput(opid, old)
+			if idm.blkcnt >= 0 {
+				idm.blkcnt--
+			}
+			continue
+		}
+		nblkn := sblkn
+		ok := false
+		if !fs.bcache.pinned(sblkn) {
+			_, ok = fs.refmap.up(opid, sblkn)
+		}
+		if ok {
+			if idm.blkcnt >= 0 {
+				idm.blkcnt++
+			}
+		} else if nblkn, err = idm.bcopy(opid, sblkn); err != 0 {
+			break
+		}
+		old, err := idm.remapb(opid, dfbn, nblkn)
+		if err != 0 {
+			fs.bput(opid, nblkn)
+			if idm.blkcnt >= 0 {
+				idm.blkcnt--
+			}
+			return c, err
+		}
+		if old != 0 {
+			fs.bput(opid, old)
+			if idm.blkcnt >= 0 {
+				idm.blkcnt--
+			}
+		}
+		fs.istats.Nclone.Inc()
+	}
+	c = min(c, n)
+	if doff+c > idm.size {
+		idm.size = doff + c
+	}
+	return c, err
+}
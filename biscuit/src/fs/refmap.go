@@ -0,0 +1,118 @@
+package fs
+
+import "sync"
+
+import "util"
+
+// Reference map. Copy_range lets files share data blocks; the reference map
+// holds, for each data block, the number of references to it beyond the
+// first, as a 16-bit count. a block with count 0 has a single owner (or none,
+// if it is free), so only shared blocks cost anything. writes to a shared
+// block first give the file its own copy (see unshare), and dropping a
+// reference to a block frees it only once its count is 0 (see bput). like the
+// bitmaps, the map's blocks end with a checksum and a grown file system adds
+// runs of them. a block whose count can't be read because its map block is
+// corrupt counts as shared by too many files to share further, and is never
+// freed.
+
+// the number of counts per reference map block
+const REFPERBLK = (BSIZE - CKSUMLEN) / 2
+
+// the largest count
+const maxref = 0xffff
+
+type refmap_t struct {
+	sync.Mutex
+	fs    *Fs_t
+	runs  []run_t
+	first int
+}
+
+func mkRefmap(fs *Fs_t, runs []run_t, first int) *refmap_t {
+	rm := &refmap_t{fs: fs, runs: runs, first: first}
+	return rm
+}
+
+// returns the map block holding the count of data block blkn and the offset
+// of the count in it
+func (rm *refmap_t) where(blkn int) (int, int) {
+	i := blkn - rm.first
+	if i < 0 {
+		panic("refmap: not a data block")
+	}
+	rm.Lock()
+	defer rm.Unlock()
+	return runblock(rm.runs, i/REFPERBLK), (i % REFPERBLK) * 2
+}
+
+// returns the locked map block holding the count of blkn, the offset of the
+// count, and whether the block's checksum matches
+func (rm *refmap_t) read(blkn int) (*Bdev_block_t, int, bool) {
+	mb, off := rm.where(blkn)
+	b, err := rm.fs.fslog.Get_meta(mb, META_REFMAP, "refmap", true)
+	return b, off, err == 0
+}
+
+// returns the number of extra references to data block blkn
+func (rm *refmap_t) get(blkn int) int {
+	b, off, ok := rm.read(blkn)
+	n := util.Readn(b.Data[:], 2, off)
+	b.Unlock()
+	rm.fs.fslog.Relse(b, "refmap get")
+	if !ok {
+		return maxref
+	}
+	return n
+}
+
+// adds a reference to data block blkn. returns the map block written, and
+// false if the count is already at its maximum.
+func (rm *refmap_t) up(opid opid_t, blkn int) (int, bool) {
+	b, off, ok := rm.read(blkn)
+	n := util.Readn(b.Data[:], 2, off)
+	if ok && n < maxref {
+		util.Writen(b.Data[:], 2, off, n+1)
+	}
+	b.Unlock()
+	if ok && n < maxref {
+		rm.fs.fslog.Write(opid, b)
+	}
+	rm.fs.fslog.Relse(b, "refmap up")
+	return b.Block, ok && n < maxref
+}
+
+// drops an extra reference to data block blkn. returns the map block written,
+// and false if blkn has no extra references, in which case the caller holds
+// the last one.
+func (rm *refmap_t) down(opid opid_t, blkn int) (int, bool) {
+	b, off, ok := rm.read(blkn)
+	n := util.Readn(b.Data[:], 2, off)
+	if ok && n > 0 {
+		util.Writen(b.Data[:], 2, off, n-1)
+	}
+	b.Unlock()
+	if ok && n > 0 {
+		rm.fs.fslog.Write(opid, b)
+	}
+	rm.fs.fslog.Relse(b, "refmap down")
+	// leak the block rather than free one that may be shared
+	return b.Block, !ok || n > 0
+}
+
+// appends the map blocks of run r, which the caller has already written with
+// zero counts
+func (rm *refmap_t) grow(r run_t) {
+	rm.Lock()
+	defer rm.Unlock()
+	rm.runs = append(rm.runs, r)
+}
+
+// drops a reference to data block blkn, freeing it if it was the last one.
+// returns the map block written.
+func (fs *Fs_t) bput(opid opid_t, blkn int) int {
+	if mb, ok := fs.refmap.down(opid, blkn); ok {
+		return mb
+	}
+	fs.balloc.Bfree(opid, blkn)
+	return fs.balloc.alloc.bitmapblkno(blkn - fs.balloc.first)
+}
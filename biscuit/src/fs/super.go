@@ -1,5 +1,7 @@
 package fs
 
+import "fmt"
+
 import "mem"
 
 type Superblock_t struct {
@@ -71,3 +73,139 @@ func (sb *Superblock_t) SetInodelen(n int) {
 func (sb *Superblock_t) SetLastblock(n int) {
 	fieldw(sb.Data, 7, n)
 }
+
+// the reference map, which counts the extra references to shared data blocks
+// (see refmap.go)
+
+func (sb *Superblock_t) Refmapblock() int {
+	return fieldr(sb.Data, 8)
+}
+
+func (sb *Superblock_t) Refmaplen() int {
+	return fieldr(sb.Data, 9)
+}
+
+func (sb *Superblock_t) SetRefmapblock(n int) {
+	fieldw(sb.Data, 8, n)
+}
+
+func (sb *Superblock_t) SetRefmaplen(n int) {
+	fieldw(sb.Data, 9, n)
+}
+
+// growth groups. Fs_grow places a group at the old end of the file system:
+// orphan map blocks, inode map blocks, reference map blocks, block map blocks
+// and inode blocks, in that order. a group's maps continue the maps of the
+// groups before it, and its inode blocks continue their inodes.
+
+const MAXGROUPS = 64
+
+const groupfield = 11
+
+const groupfields = 5
+
+func (sb *Superblock_t) Ngroups() int {
+	return fieldr(sb.Data, 10)
+}
+
+func (sb *Superblock_t) Groupstart(g int) int {
+	return fieldr(sb.Data, groupfield+groupfields*g)
+}
+
+// the number of orphan map blocks equals the number of inode map blocks
+func (sb *Superblock_t) Groupimaplen(g int) int {
+	return fieldr(sb.Data, groupfield+groupfields*g+1)
+}
+
+func (sb *Superblock_t) Grouprefmaplen(g int) int {
+	return fieldr(sb.Data, groupfield+groupfields*g+2)
+}
+
+func (sb *Superblock_t) Groupbmaplen(g int) int {
+	return fieldr(sb.Data, groupfield+groupfields*g+3)
+}
+
+func (sb *Superblock_t) Groupinodelen(g int) int {
+	return fieldr(sb.Data, groupfield+groupfields*g+4)
+}
+
+// the number of blocks of group g
+func (sb *Superblock_t) Grouplen(g int) int {
+	return 2*sb.Groupimaplen(g) + sb.Grouprefmaplen(g) + sb.Groupbmaplen(g) +
+		sb.Groupinodelen(g)
+}
+
+func (sb *Superblock_t) SetNgroups(n int) {
+	fieldw(sb.Data, 10, n)
+}
+
+func (sb *Superblock_t) SetGroup(g, start, imaplen, refmaplen, bmaplen, inodelen int) {
+	f := groupfield + groupfields*g
+	fieldw(sb.Data, f, start)
+	fieldw(sb.Data, f+1, imaplen)
+	fieldw(sb.Data, f+2, refmaplen)
+	fieldw(sb.Data, f+3, bmaplen)
+	fieldw(sb.Data, f+4, inodelen)
+}
+
+// the version of the on-disk format, which changes whenever a kernel cannot
+// use images of the version before. version 1 added metadata checksums, and
+// with them the inode slot that IPERBLK leaves for the checksum; images from
+// before have no version field and read as version 0.
+const FSVERSION = 1
+
+const versionfield = groupfield + groupfields*MAXGROUPS
+
+func (sb *Superblock_t) Version() int {
+	return fieldr(sb.Data, versionfield)
+}
+
+func (sb *Superblock_t) SetVersion(n int) {
+	fieldw(sb.Data, versionfield, n)
+}
+
+// Version_err returns why this kernel cannot use a file system with the
+// superblock sb, or "" if it can. it does not need the superblock's checksum,
+// which images of version 0 lack.
+func (sb *Superblock_t) Version_err() string {
+	switch v := sb.Version(); {
+	case v == 0:
+		return "file system image predates metadata checksums; " +
+			"rebuild it with mkfs"
+	case v != FSVERSION:
+		return fmt.Sprintf("file system image has format version %v, "+
+			"not %v", v, FSVERSION)
+	}
+	return ""
+}
+
+// the runs of blocks holding each part of the file system's metadata
+type layout_t struct {
+	orphan []run_t
+	imap   []run_t
+	refmap []run_t
+	bmap   []run_t
+	inodes []run_t
+}
+
+func (sb *Superblock_t) layout() *layout_t {
+	l := &layout_t{}
+	oblk, olen := sb.Iorphanblock(), sb.Iorphanlen()
+	bblk, blen := sb.Freeblock(), sb.Freeblocklen()
+	l.orphan = []run_t{{oblk, olen}}
+	l.imap = []run_t{{oblk + olen, sb.Imaplen()}}
+	l.refmap = []run_t{{sb.Refmapblock(), sb.Refmaplen()}}
+	l.bmap = []run_t{{bblk, blen}}
+	l.inodes = []run_t{{bblk + blen, sb.Inodelen()}}
+	for g := 0; g < sb.Ngroups(); g++ {
+		s := sb.Groupstart(g)
+		il, rl := sb.Groupimaplen(g), sb.Grouprefmaplen(g)
+		bl := sb.Groupbmaplen(g)
+		l.orphan = append(l.orphan, run_t{s, il})
+		l.imap = append(l.imap, run_t{s + il, il})
+		l.refmap = append(l.refmap, run_t{s + 2*il, rl})
+		l.bmap = append(l.bmap, run_t{s + 2*il + rl, bl})
+		l.inodes = append(l.inodes, run_t{s + 2*il + rl + bl, sb.Groupinodelen(g)})
+	}
+	return l
+}
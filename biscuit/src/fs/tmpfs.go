@@ -0,0 +1,1093 @@
+package fs
+
+import "sync"
+
+import "bpath"
+import "defs"
+import "fd"
+import "fdops"
+import "limits"
+import "mem"
+import "stat"
+import "stats"
+import "ustr"
+import "util"
+
+// Tmpfs_t is a file system that keeps its files in memory only; nothing is
+// logged or written to disk. A file's data live in reference-counted pages
+// from the block memory allocator, which mmap maps directly, and every page
+// is charged to limits.Syslimit.Mfspgs. Directories read like ufs directories
+// so that user programs can list them.
+type Tmpfs_t struct {
+	// protects the name space: the directory entries, link and open
+	// counts, and the parents of directories
+	sync.Mutex
+	mem      Blockmem_i
+	root     *tmpnode_t
+	nextinum defs.Inum_t
+	// number of open files, including cwds
+	nopen  int
+	tstats tmpfs_stats_t
+}
+
+type tmpfs_stats_t struct {
+	Nopen    stats.Counter_t
+	Ncreate  stats.Counter_t
+	Nunlink  stats.Counter_t
+	Nrename  stats.Counter_t
+	Npgalloc stats.Counter_t
+	Npgfree  stats.Counter_t
+}
+
+func (ts *tmpfs_stats_t) Stats() string {
+	s := "tmpfs" + stats.Stats2String(*ts)
+	*ts = tmpfs_stats_t{}
+	return s
+}
+
+type tmppage_t struct {
+	pa mem.Pa_t
+	pg *mem.Bytepg_t
+}
+
+type tmpent_t struct {
+	name ustr.Ustr
+	node *tmpnode_t
+}
+
+type tmpnode_t struct {
+	tfs   *Tmpfs_t
+	inum  defs.Inum_t
+	itype int
+	major int
+	minor int
+	// protected by the tmpfs lock
+	nlink  int
+	nopen  int
+	parent *tmpnode_t
+	// a directory's entries; ents[i] is the dirent with index i+2, after
+	// "." and "..". removed entries stay empty until reused so that the
+	// offsets of the others don't change while the directory is read.
+	ents  []tmpent_t
+	names map[string]int
+	free  []int
+	// protects the file's data
+	sync.Mutex
+	size   int
+	pages  map[int]*tmppage_t
+	flocks filelocks_t
+}
+
+const tmpmaxoff = int(^uint(0) >> 1)
+
+func MkTmpfs(bm Blockmem_i) *Tmpfs_t {
+	tfs := &Tmpfs_t{mem: bm}
+	tfs.root = tfs.mknode(I_DIR, 0, 0)
+	tfs.root.parent = tfs.root
+	tfs.root.nlink = 1
+	return tfs
+}
+
+func (tfs *Tmpfs_t) mknode(itype, major, minor int) *tmpnode_t {
+	tfs.nextinum++
+	n := &tmpnode_t{tfs: tfs, inum: tfs.nextinum, itype: itype,
+		major: major, minor: minor}
+	n.pages = make(map[int]*tmppage_t)
+	if itype == I_DIR {
+		n.names = make(map[string]int)
+	}
+	return n
+}
+
+func (n *tmpnode_t) lookup(name ustr.Ustr) (*tmpnode_t, bool) {
+	i, ok := n.names[string(name)]
+	if !ok {
+		return nil, false
+	}
+	return n.ents[i].node, true
+}
+
+func (n *tmpnode_t) insert(name ustr.Ustr, c *tmpnode_t) {
+	e := tmpent_t{name: append(ustr.Ustr{}, name...), node: c}
+	if l := len(n.free); l != 0 {
+		i := n.free[l-1]
+		n.free = n.free[:l-1]
+		n.ents[i] = e
+		n.names[string(name)] = i
+		return
+	}
+	n.names[string(name)] = len(n.ents)
+	n.ents = append(n.ents, e)
+}
+
+func (n *tmpnode_t) remove(name ustr.Ustr) {
+	i := n.names[string(name)]
+	delete(n.names, string(name))
+	n.ents[i] = tmpent_t{}
+	n.free = append(n.free, i)
+}
+
+func (n *tmpnode_t) dirsize() int {
+	return util.Roundup(len(n.ents)+2, NDIRENTS) / NDIRENTS * BSIZE
+}
+
+// returns the node at paths, relative to cwd. the caller holds the tmpfs
+// lock.
+func (tfs *Tmpfs_t) namei(paths ustr.Ustr, cwd *fd.Cwd_t) (*tmpnode_t, defs.Err_t) {
+	n := tfs.root
+	if !paths.IsAbsolute() {
+		fo, ok := cwd.Fd.Fops.(*tmpfops_t)
+		if !ok || fo.node.tfs != tfs {
+			return nil, -defs.ENOENT
+		}
+		n = fo.node
+	}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for c, ok := pp.Next(); ok; c, ok = pp.Next() {
+		if n.itype != I_DIR {
+			return nil, -defs.ENOTDIR
+		}
+		if c.Isdot() {
+			continue
+		} else if c.Isdotdot() {
+			n = n.parent
+			continue
+		}
+		next, ok := n.lookup(c)
+		if !ok {
+			return nil, -defs.ENOENT
+		}
+		n = next
+	}
+	return n, 0
+}
+
+// returns the directory in which to create or remove an entry. the caller
+// holds the tmpfs lock.
+func (tfs *Tmpfs_t) namei_dir(dirs ustr.Ustr, cwd *fd.Cwd_t) (*tmpnode_t, defs.Err_t) {
+	par, err := tfs.namei(dirs, cwd)
+	if err != 0 {
+		return nil, err
+	}
+	if par.itype != I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	// a removed directory cannot get new entries
+	if par.nlink == 0 {
+		return nil, -defs.ENOENT
+	}
+	return par, 0
+}
+
+// frees the file's pages once it is neither linked nor open. the caller
+// holds the tmpfs lock.
+func (tfs *Tmpfs_t) release(n *tmpnode_t) {
+	if n.nlink == 0 && n.nopen == 0 {
+		n.Lock()
+		n.punch(0, tmpmaxoff)
+		n.Unlock()
+	}
+}
+
+func (tfs *Tmpfs_t) close(n *tmpnode_t) {
+	tfs.Lock()
+	n.nopen--
+	tfs.nopen--
+	tfs.release(n)
+	tfs.Unlock()
+}
+
+// returns page pgn of the file, allocating it if it is a hole. the caller
+// holds the node's lock.
+func (n *tmpnode_t) page(pgn int) (*tmppage_t, defs.Err_t) {
+	if p, ok := n.pages[pgn]; ok {
+		return p, 0
+	}
+	if !limits.Syslimit.Mfspgs.Take() {
+		return nil, -defs.ENOSPC
+	}
+	pa, pg, ok := n.tfs.mem.Alloc()
+	if !ok {
+		limits.Syslimit.Mfspgs.Give()
+		return nil, -defs.ENOMEM
+	}
+	n.tfs.tstats.Npgalloc.Inc()
+	p := &tmppage_t{pa: pa, pg: pg}
+	n.pages[pgn] = p
+	return p, 0
+}
+
+func (n *tmpnode_t) freepage(pgn int) {
+	p := n.pages[pgn]
+	delete(n.pages, pgn)
+	n.tfs.mem.Free(p.pa)
+	n.tfs.tstats.Npgfree.Inc()
+	limits.Syslimit.Mfspgs.Give()
+}
+
+// zeroes the bytes [off, end) of the file, freeing the pages in the range.
+// the caller holds the node's lock.
+func (n *tmpnode_t) punch(off, end int) {
+	for pgn, p := range n.pages {
+		s := pgn * mem.PGSIZE
+		e := s + mem.PGSIZE
+		if s >= end || e <= off {
+			continue
+		}
+		if s >= off && e <= end {
+			n.freepage(pgn)
+			continue
+		}
+		zs, ze := 0, mem.PGSIZE
+		if off > s {
+			zs = off - s
+		}
+		if end < e {
+			ze = end - s
+		}
+		copy(p.pg[zs:ze], zeroblk[:])
+	}
+}
+
+func (n *tmpnode_t) read(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	n.Lock()
+	defer n.Unlock()
+
+	c := 0
+	for offset < n.size && dst.Remain() != 0 {
+		s := offset % mem.PGSIZE
+		m := min(mem.PGSIZE-s, n.size-offset)
+		var src []uint8
+		if p, ok := n.pages[offset/mem.PGSIZE]; ok {
+			src = p.pg[s : s+m]
+		} else {
+			src = zeroblk[:m]
+		}
+		wrote, err := dst.Uiowrite(src)
+		c += wrote
+		offset += wrote
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+func (n *tmpnode_t) write(src fdops.Userio_i, offset int, app bool) (int, defs.Err_t) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.itype != I_FILE {
+		return 0, -defs.EISDIR
+	}
+	if app {
+		offset = n.size
+	}
+	c := 0
+	for src.Remain() != 0 {
+		p, err := n.page(offset / mem.PGSIZE)
+		if err != 0 {
+			return c, err
+		}
+		s := offset % mem.PGSIZE
+		m := min(mem.PGSIZE-s, src.Remain())
+		did, err := src.Uioread(p.pg[s : s+m])
+		c += did
+		offset += did
+		if offset > n.size {
+			n.size = offset
+		}
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+func (n *tmpnode_t) truncate(newlen int) defs.Err_t {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.itype != I_FILE {
+		return -defs.EINVAL
+	}
+	// also drops the pages preallocated past the end of the file
+	n.punch(min(n.size, newlen), tmpmaxoff)
+	n.size = newlen
+	return 0
+}
+
+func (n *tmpnode_t) fallocate(mode, offset, length int) defs.Err_t {
+	punch := mode == defs.FALLOC_FL_PUNCH_HOLE|defs.FALLOC_FL_KEEP_SIZE
+	if !punch && mode&^defs.FALLOC_FL_KEEP_SIZE != 0 {
+		return -defs.EOPNOTSUPP
+	}
+	if offset < 0 || length <= 0 {
+		return -defs.EINVAL
+	}
+	end := offset + length
+	if end < offset {
+		return -defs.EFBIG
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if n.itype != I_FILE {
+		return -defs.EISDIR
+	}
+	if punch {
+		n.punch(offset, end)
+		return 0
+	}
+	for pgn := offset / mem.PGSIZE; pgn*mem.PGSIZE < end; pgn++ {
+		if _, err := n.page(pgn); err != 0 {
+			return err
+		}
+	}
+	if mode&defs.FALLOC_FL_KEEP_SIZE == 0 && end > n.size {
+		n.size = end
+	}
+	return 0
+}
+
+func (n *tmpnode_t) seekhole(off int, hole bool) (int, defs.Err_t) {
+	n.Lock()
+	defer n.Unlock()
+
+	if off < 0 || off >= n.size {
+		return 0, -defs.ENXIO
+	}
+	for pgn := off / mem.PGSIZE; pgn*mem.PGSIZE < n.size; pgn++ {
+		if _, ok := n.pages[pgn]; ok != hole {
+			if pgn*mem.PGSIZE > off {
+				off = pgn * mem.PGSIZE
+			}
+			return off, 0
+		}
+	}
+	if hole {
+		return n.size, 0
+	}
+	return 0, -defs.ENXIO
+}
+
+// returns the pages of the file covering [offset, offset+len), or to the end
+// of the file if len is -1, allocating the holes. mappings share the pages
+// with the file.
+func (n *tmpnode_t) mmapi(offset, len int) ([]mem.Mmapinfo_t, defs.Err_t) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.itype != I_FILE {
+		return nil, -defs.ENODEV
+	}
+	if offset >= n.size {
+		return nil, -defs.EINVAL
+	}
+	if len == -1 || offset+len > n.size {
+		len = n.size - offset
+	}
+	o := util.Rounddown(offset, mem.PGSIZE)
+	len = util.Roundup(offset+len, mem.PGSIZE) - o
+	ret := make([]mem.Mmapinfo_t, len/mem.PGSIZE)
+	for i := range ret {
+		p, err := n.page(o/mem.PGSIZE + i)
+		if err != 0 {
+			for _, mi := range ret[:i] {
+				n.tfs.mem.Free(mi.Phys)
+			}
+			return nil, err
+		}
+		// the VM system is going to use the page
+		n.tfs.mem.Refup(p.pa)
+		ret[i].Pg = mem.Bytepg2pg(p.pg)
+		ret[i].Phys = p.pa
+	}
+	return ret, 0
+}
+
+// the caller holds the tmpfs lock
+func (n *tmpnode_t) stat(st *stat.Stat_t) {
+	n.Lock()
+	defer n.Unlock()
+
+	st.Wdev(0)
+	st.Wino(uint(n.inum))
+	size := n.size
+	switch n.itype {
+	case I_DIR:
+		size = n.dirsize()
+		st.Wmode(uint(n.itype << 16))
+	case I_FILE:
+		st.Wmode(uint(n.itype << 16))
+	default:
+		st.Wmode(defs.Mkdev(n.major, n.minor))
+	}
+	st.Wsize(uint(size))
+	st.Wrdev(defs.Mkdev(n.major, n.minor))
+	st.Wblocks(uint(len(n.pages) * (mem.PGSIZE / 512)))
+}
+
+// copies the directory, in the ufs directory format, starting at offset to
+// dst. the caller holds the tmpfs lock.
+func (n *tmpnode_t) dirread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	buf := make([]uint8, BSIZE)
+	dd := &Dirdata_t{Data: buf}
+	size := n.dirsize()
+	c := 0
+	for offset < size && dst.Remain() != 0 {
+		copy(buf, zeroblk[:])
+		for i := 0; i < NDIRENTS; i++ {
+			slot := offset/BSIZE*NDIRENTS + i
+			switch {
+			case slot == 0:
+				dd.W_filename(i, ustr.MkUstrDot())
+				dd.W_inodenext(i, n.inum)
+			case slot == 1:
+				dd.W_filename(i, ustr.DotDot)
+				dd.W_inodenext(i, n.parent.inum)
+			case slot-2 < len(n.ents) && n.ents[slot-2].node != nil:
+				dd.W_filename(i, n.ents[slot-2].name)
+				dd.W_inodenext(i, n.ents[slot-2].node.inum)
+			}
+		}
+		wrote, err := dst.Uiowrite(buf[offset%BSIZE:])
+		c += wrote
+		offset += wrote
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+// returns the node to open, creating it if necessary. the caller holds the
+// tmpfs lock.
+func (tfs *Tmpfs_t) _open(paths ustr.Ustr, flags defs.Fdopt_t, cwd *fd.Cwd_t, major, minor int) (*tmpnode_t, defs.Err_t) {
+	trunc := flags&defs.O_TRUNC != 0
+	creat := flags&defs.O_CREAT != 0
+	nodir := false
+	var n *tmpnode_t
+	if creat {
+		nodir = true
+		isdev := major != 0 || minor != 0
+
+		dirs, fn := bpath.Sdirname(paths)
+		if err, ok := crname(fn, -defs.EEXIST); !ok {
+			return nil, err
+		}
+		if len(fn) > DNAMELEN {
+			return nil, -defs.ENAMETOOLONG
+		}
+		par, err := tfs.namei_dir(dirs, cwd)
+		if err != 0 {
+			return nil, err
+		}
+		if c, ok := par.lookup(fn); ok {
+			if flags&defs.O_EXCL != 0 || isdev {
+				return nil, -defs.EEXIST
+			}
+			n = c
+		} else {
+			itype := I_FILE
+			if isdev {
+				itype = I_DEV
+			}
+			n = tfs.mknode(itype, major, minor)
+			n.nlink = 1
+			par.insert(fn, n)
+			tfs.tstats.Ncreate.Inc()
+		}
+	} else {
+		var err defs.Err_t
+		n, err = tfs.namei(paths, cwd)
+		if err != 0 {
+			return nil, err
+		}
+	}
+
+	o_dir := flags&defs.O_DIRECTORY != 0
+	if flags&(defs.O_WRONLY|defs.O_RDWR) != 0 {
+		nodir = true
+	}
+	if o_dir && n.itype != I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	if nodir && n.itype == I_DIR {
+		return nil, -defs.EISDIR
+	}
+	if nodir && trunc && n.itype == I_FILE {
+		n.truncate(0)
+	}
+	return n, 0
+}
+
+func (tfs *Tmpfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	tfs.tstats.Nopen.Inc()
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	n, err := tfs._open(paths, flags, cwd, major, minor)
+	if err != 0 {
+		return nil, err
+	}
+	ret := &fd.Fd_t{}
+	if n.itype == I_DEV {
+		switch n.major {
+		case defs.D_CONSOLE, defs.D_DEVNULL, defs.D_STAT, defs.D_PROF:
+			if n.major == defs.D_STAT {
+				stats_string = tfs.Fs_statistics()
+			}
+			ret.Fops = &Devfops_t{Maj: n.major, Min: n.minor}
+		case defs.D_SUD, defs.D_SUS:
+			return nil, -defs.EPERM
+		default:
+			return nil, -defs.ENXIO
+		}
+		return ret, 0
+	}
+	n.nopen++
+	tfs.nopen++
+	apnd := flags&defs.O_APPEND != 0
+	ret.Fops = &tmpfops_t{node: n, append: apnd, count: 1}
+	return ret, 0
+}
+
+func (tfs *Tmpfs_t) Fs_mknod(paths ustr.Ustr, excl bool, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	flags := defs.O_CREAT
+	if excl {
+		flags |= defs.O_EXCL
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	n, err := tfs._open(paths, flags, cwd, major, minor)
+	if err != 0 {
+		return 0, err
+	}
+	return n.inum, 0
+}
+
+func (tfs *Tmpfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	n, err := tfs.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	n.stat(st)
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	dirs, fn := bpath.Sdirname(paths)
+	if err, ok := crname(fn, -defs.EINVAL); !ok {
+		return err
+	}
+	if len(fn) > DNAMELEN {
+		return -defs.ENAMETOOLONG
+	}
+
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	par, err := tfs.namei_dir(dirs, cwd)
+	if err != 0 {
+		return err
+	}
+	if _, ok := par.lookup(fn); ok {
+		return -defs.EEXIST
+	}
+	n := tfs.mknode(I_DIR, 0, 0)
+	n.nlink = 1
+	n.parent = par
+	par.insert(fn, n)
+	tfs.tstats.Ncreate.Inc()
+	return 0
+}
+
+func (n *tmpnode_t) dirchk(wantdir bool) defs.Err_t {
+	amdir := n.itype == I_DIR
+	if wantdir && !amdir {
+		return -defs.ENOTDIR
+	} else if !wantdir && amdir {
+		return -defs.EISDIR
+	} else if amdir && len(n.names) != 0 {
+		return -defs.ENOTEMPTY
+	}
+	return 0
+}
+
+// removes the entry name, for the node n, from the directory par. the caller
+// holds the tmpfs lock.
+func (tfs *Tmpfs_t) unlink(par *tmpnode_t, name ustr.Ustr, n *tmpnode_t) {
+	par.remove(name)
+	n.nlink--
+	tfs.release(n)
+}
+
+func (tfs *Tmpfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	dirs, fn := bpath.Sdirname(paths)
+	if fn.Isdot() || fn.Isdotdot() {
+		return -defs.EPERM
+	}
+	tfs.tstats.Nunlink.Inc()
+
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	par, err := tfs.namei(dirs, cwd)
+	if err != 0 {
+		return err
+	}
+	if par.itype != I_DIR {
+		return -defs.ENOTDIR
+	}
+	n, ok := par.lookup(fn)
+	if !ok {
+		return -defs.ENOENT
+	}
+	if err := n.dirchk(wantdir); err != 0 {
+		return err
+	}
+	tfs.unlink(par, fn, n)
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_linkat(old ustr.Ustr, ocwd *fd.Cwd_t, new ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	dirs, fn := bpath.Sdirname(new)
+	if err, ok := crname(fn, -defs.EEXIST); !ok {
+		return err
+	}
+	if len(fn) > DNAMELEN {
+		return -defs.ENAMETOOLONG
+	}
+
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	n, err := tfs.namei(old, ocwd)
+	if err != 0 {
+		return err
+	}
+	if n.itype != I_FILE {
+		return -defs.EINVAL
+	}
+	par, err := tfs.namei_dir(dirs, ncwd)
+	if err != 0 {
+		return err
+	}
+	if _, ok := par.lookup(fn); ok {
+		return -defs.EEXIST
+	}
+	par.insert(fn, n)
+	n.nlink++
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_renameat(oldp ustr.Ustr, ocwd *fd.Cwd_t, newp ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	odirs, ofn := bpath.Sdirname(oldp)
+	ndirs, nfn := bpath.Sdirname(newp)
+	if err, ok := crname(ofn, -defs.EINVAL); !ok {
+		return err
+	}
+	if err, ok := crname(nfn, -defs.EINVAL); !ok {
+		return err
+	}
+	if len(nfn) > DNAMELEN {
+		return -defs.ENAMETOOLONG
+	}
+	tfs.tstats.Nrename.Inc()
+
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	opar, err := tfs.namei(odirs, ocwd)
+	if err != 0 {
+		return err
+	}
+	if opar.itype != I_DIR {
+		return -defs.ENOTDIR
+	}
+	n, ok := opar.lookup(ofn)
+	if !ok {
+		return -defs.ENOENT
+	}
+	npar, err := tfs.namei_dir(ndirs, ncwd)
+	if err != 0 {
+		return err
+	}
+	isdir := n.itype == I_DIR
+	// a directory cannot be moved below itself
+	if isdir {
+		for a := npar; ; a = a.parent {
+			if a == n {
+				return -defs.EINVAL
+			}
+			if a == a.parent {
+				break
+			}
+		}
+	}
+	if old, ok := npar.lookup(nfn); ok {
+		if old == n {
+			return 0
+		}
+		if err := old.dirchk(isdir); err != 0 {
+			return err
+		}
+		tfs.unlink(npar, nfn, old)
+	}
+	opar.remove(ofn)
+	npar.insert(nfn, n)
+	if isdir {
+		n.parent = npar
+	}
+	return 0
+}
+
+// returns a Cwd_t for resolving paths relative to the directory open as f.
+// the returned Cwd_t has its own reference to the directory.
+func (tfs *Tmpfs_t) Fs_atcwd(f *fd.Fd_t) (*fd.Cwd_t, defs.Err_t) {
+	fo, ok := f.Fops.(*tmpfops_t)
+	if !ok || fo.node.tfs != tfs || fo.node.itype != I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	nf, err := fd.Copyfd(f)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Cwd_t{Fd: nf}, 0
+}
+
+func (tfs *Tmpfs_t) Fs_owns(f *fd.Fd_t) bool {
+	fo, ok := f.Fops.(*tmpfops_t)
+	return ok && fo.node.tfs == tfs && fo.node.itype == I_DIR
+}
+
+func (tfs *Tmpfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &tmpfops_t{node: tfs.root, count: 0}}
+	return fd.MkRootCwd(f)
+}
+
+func (tfs *Tmpfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+// frees the pages of all files, which are lost
+func (tfs *Tmpfs_t) Fs_unmount() defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	if tfs.nopen != 0 {
+		return -defs.EBUSY
+	}
+	var freeall func(*tmpnode_t)
+	freeall = func(n *tmpnode_t) {
+		for _, e := range n.ents {
+			if e.node != nil {
+				freeall(e.node)
+			}
+		}
+		n.Lock()
+		n.punch(0, tmpmaxoff)
+		n.Unlock()
+	}
+	freeall(tfs.root)
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_statistics() string {
+	return tfs.tstats.Stats()
+}
+
+type tmpfops_t struct {
+	node *tmpnode_t
+	// protects offset
+	sync.Mutex
+	offset int
+	append bool
+	count  int
+	// true if the open file may hold a flock lock
+	flocked bool
+}
+
+func (fo *tmpfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	useoffset := toff != -1
+	offset := fo.offset
+	if useoffset {
+		offset = toff
+	}
+	var did int
+	var err defs.Err_t
+	if n := fo.node; n.itype == I_DIR {
+		n.tfs.Lock()
+		did, err = n.dirread(dst, offset)
+		n.tfs.Unlock()
+	} else {
+		did, err = n.read(dst, offset)
+	}
+	if !useoffset && err == 0 {
+		fo.offset += did
+	}
+	return did, err
+}
+
+func (fo *tmpfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return fo._read(dst, -1)
+}
+
+func (fo *tmpfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return fo._read(dst, offset)
+}
+
+func (fo *tmpfops_t) _write(src fdops.Userio_i, toff int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	useoffset := toff != -1
+	offset := fo.offset
+	append := fo.append
+	if useoffset {
+		offset = toff
+		append = false
+	}
+	did, err := fo.node.write(src, offset, append)
+	if !useoffset && err == 0 {
+		fo.offset += did
+	}
+	return did, err
+}
+
+func (fo *tmpfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return fo._write(src, -1)
+}
+
+func (fo *tmpfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return fo._write(src, offset)
+}
+
+func (fo *tmpfops_t) Truncate(newlen uint) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	return fo.node.truncate(int(newlen))
+}
+
+func (fo *tmpfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	return fo.node.fallocate(mode, offset, length)
+}
+
+// there is no disk to write to
+func (fo *tmpfops_t) Fsync(datasync bool) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	return 0
+}
+
+func (fo *tmpfops_t) Flock(op int) defs.Err_t {
+	switch op &^ defs.LOCK_NB {
+	case defs.LOCK_SH, defs.LOCK_EX, defs.LOCK_UN:
+	default:
+		return -defs.EINVAL
+	}
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	fo.flocked = true
+	// don't hold fo's lock while waiting for the lock
+	fo.Unlock()
+	return fo.node.flocks.flock(fo, op)
+}
+
+func (fo *tmpfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	if err := lkcheck(cmd, lk); err != 0 {
+		return err
+	}
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	base := 0
+	switch lk.Whence {
+	case defs.SEEK_SET:
+	case defs.SEEK_CUR:
+		base = fo.offset
+	case defs.SEEK_END:
+		fo.node.Lock()
+		base = fo.node.size
+		fo.node.Unlock()
+	default:
+		fo.Unlock()
+		return -defs.EINVAL
+	}
+	// don't hold fo's lock while waiting for the lock
+	fo.Unlock()
+	return fo.node.flocks.lockrec(pid, cmd, lk, base)
+}
+
+// caller holds fo lock
+func (fo *tmpfops_t) fstat(st *stat.Stat_t) defs.Err_t {
+	fo.node.tfs.Lock()
+	fo.node.stat(st)
+	fo.node.tfs.Unlock()
+	return 0
+}
+
+func (fo *tmpfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	return fo.fstat(st)
+}
+
+func (fo *tmpfops_t) Close() defs.Err_t {
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	fo.count--
+	if fo.count == 0 && fo.flocked {
+		fo.node.flocks.funlock(fo)
+	}
+	fo.Unlock()
+	fo.node.tfs.close(fo.node)
+	return 0
+}
+
+func (fo *tmpfops_t) Pathi() defs.Inum_t {
+	return fo.node.inum
+}
+
+func (fo *tmpfops_t) Reopen() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	tfs := fo.node.tfs
+	tfs.Lock()
+	fo.node.nopen++
+	tfs.nopen++
+	tfs.Unlock()
+	fo.count++
+	return 0
+}
+
+func (fo *tmpfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		fo.offset = off
+	case defs.SEEK_CUR:
+		fo.offset += off
+	case defs.SEEK_END:
+		st := &stat.Stat_t{}
+		fo.fstat(st)
+		fo.offset = int(st.Size()) + off
+	case defs.SEEK_DATA, defs.SEEK_HOLE:
+		n, err := fo.node.seekhole(off, whence == defs.SEEK_HOLE)
+		if err != 0 {
+			return 0, err
+		}
+		fo.offset = n
+	default:
+		return 0, -defs.EINVAL
+	}
+	if fo.offset < 0 {
+		fo.offset = 0
+	}
+	return fo.offset, 0
+}
+
+func (fo *tmpfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return nil, -defs.EBADF
+	}
+	return fo.node.mmapi(offset, len)
+}
+
+// the pages of a tmpfs file are never evicted, thus need no pinning
+func (fo *tmpfops_t) Unpin(pa mem.Pa_t) {
+}
+
+func (fo *tmpfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
+}
+
+func (fo *tmpfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (fo *tmpfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *tmpfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -0,0 +1,44 @@
+package main
+
+import "os"
+import "fmt"
+
+import "ufs"
+
+// exit codes, as e2fsck's
+const (
+	clean     = 0
+	corrected = 1
+	errors    = 4
+	usage     = 8
+)
+
+func main() {
+	repair := false
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "-r" {
+		repair = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Printf("Usage: fsck [-r] <image>\n")
+		os.Exit(usage)
+	}
+
+	fk := ufs.Fsck(args[0], repair)
+	for _, p := range fk.Problems {
+		fmt.Printf("%v\n", p)
+	}
+	switch {
+	case len(fk.Problems) == 0:
+		fmt.Printf("%v: clean\n", args[0])
+		os.Exit(clean)
+	case fk.Nfixed == len(fk.Problems):
+		fmt.Printf("%v: %v problems, all repaired\n", args[0], len(fk.Problems))
+		os.Exit(corrected)
+	default:
+		fmt.Printf("%v: %v problems, %v repaired\n", args[0],
+			len(fk.Problems), fk.Nfixed)
+		os.Exit(errors)
+	}
+}
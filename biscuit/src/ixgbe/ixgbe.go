@@ -1656,8 +1656,17 @@ func attach_ixgbe(vid, did int, t pci.Pcitag_t) {
 	macs := Mac2str(x.mac[:])
 	x.log("attached: MAC %s, rxq %v, txq %v, MSI %v, %vKB", macs,
 		x.rx.ndescs, ntx, vec, x.pgs<<2)
+
+	name := fmt.Sprintf("ixgbe%d", nattached)
+	nattached++
+	if err := bnet.Nic_attach(name, &x); err != 0 {
+		x.log("no device file %s: %v", name, err)
+	}
 }
 
+// number of attached NICs, which name their device files
+var nattached int
+
 var numpkts int
 var dropints int
 var waits int
@@ -9,27 +9,36 @@ import "sync"
 import "time"
 import "unsafe"
 import "sort"
+import "strconv"
+import "encoding/hex"
 
 import "ahci"
 import "apic"
 import "bnet"
 import "caller"
 import "defs"
+import "devfs"
 import "inet"
 import "fd"
 import "fdops"
 import "fs"
 
+import "e1000"
 import "ixgbe"
+import "loop"
 import "mem"
+import "nvme"
 import "pci"
 import "proc"
+import "ramdisk"
 import "res"
 import "stat"
 import "stats"
 import "tinfo"
 import "ustr"
 import "util"
+import "vfs"
+import "virtio"
 import "vm"
 
 const (
@@ -54,8 +63,11 @@ func trapstub(tf *[defs.TFSIZE]uintptr) {
 
 	stats.Nirqs[trapno]++
 	stats.Irqs++
-	switch trapno {
-	case defs.INT_KBD, defs.INT_COM1:
+	switch {
+	case trapno < defs.INT_MSI0:
+		// an IO APIC pin: the keyboard, COM1, or the interrupt line of
+		// a PCI device without MSI, like the e1000. pins are masked
+		// until a driver unmasks them.
 		runtime.IRQwake(uint(trapno))
 		// we need to mask the interrupt on the IOAPIC since my
 		// hardware's LAPIC automatically send EOIs to IOAPICS when the
@@ -71,8 +83,7 @@ func trapstub(tf *[defs.TFSIZE]uintptr) {
 		// in the runtime...
 		irqno := int(trapno - defs.IRQ_BASE)
 		apic.Apic.Irq_mask(irqno)
-	case defs.INT_MSI0, defs.INT_MSI1, defs.INT_MSI2, defs.INT_MSI3,
-		defs.INT_MSI4, defs.INT_MSI5, defs.INT_MSI6, defs.INT_MSI7:
+	case trapno <= defs.INT_MSI7:
 		// MSI dispatch doesn't use the IO APIC, thus no need for
 		// irq_mask
 		runtime.IRQwake(uint(trapno))
@@ -635,6 +646,8 @@ type cons_t struct {
 	reqc    chan int
 	pollc   chan fdops.Pollmsg_t
 	pollret chan fdops.Ready_t
+	// non-zero while typed characters aren't echoed
+	noecho int32
 }
 
 var cons = cons_t{}
@@ -773,7 +786,9 @@ func kbd_daemon(cons *cons_t, km map[int]byte) {
 	var lastpk time.Time
 	pkcount := 0
 	addprint := func(c byte) {
-		fmt.Printf("%c", c)
+		if atomic.LoadInt32(&cons.noecho) == 0 {
+			fmt.Printf("%c", c)
+		}
 		if len(data) > 1024 {
 			fmt.Printf("key dropped!\n")
 			return
@@ -941,14 +956,63 @@ func kbd_get(cnt int) ([]byte, defs.Err_t) {
 	return <-cons.reader, 0
 }
 
+// kbd_secret reads a line from the console without echoing it, for a
+// password or key. the caller should zero the line after use.
+func kbd_secret() []byte {
+	atomic.StoreInt32(&cons.noecho, 1)
+	defer atomic.StoreInt32(&cons.noecho, 0)
+	var line []byte
+	for {
+		b, err := kbd_get(1)
+		if err != 0 || len(b) == 0 {
+			continue
+		}
+		switch b[0] {
+		case '\n', '\r':
+			fmt.Printf("\n")
+			return line
+		case '\b':
+			if len(line) > 0 {
+				line[len(line)-1] = 0
+				line = line[:len(line)-1]
+			}
+		default:
+			line = append(line, b[0])
+		}
+	}
+}
+
 func attach_devs() int {
 	// must occur before devices attach (drivers may use Bsp_apic_id to
 	// route interrupts to the BSP)
 	apic.Bsp_init()
 
+	// devices implemented by the kernel itself
+	for _, d := range []struct {
+		name     string
+		maj, min int
+	}{{"console", defs.D_CONSOLE, 0}, {"null", defs.D_DEVNULL, 0},
+		{"stats", defs.D_STAT, 0}, {"prof", defs.D_PROF, 0}} {
+		if err := devfs.Register(d.name, d.maj, d.min); err != 0 {
+			panic("register dev")
+		}
+	}
+	loop.Loop_init()
+
 	ixgbe.Ixgbe_init()
+	e1000.E1000_init()
 	ahci.Ahci_init()
+	virtio.Virtio_init()
 	ncpu := apic.Acpi_attach()
+	// NVMe gives each CPU its own queues
+	nvme.Nvme_init(ncpu)
+	if ramdisksz != "" {
+		mb, err := strconv.Atoi(ramdisksz)
+		if err != nil {
+			panic("bad RAM disk size")
+		}
+		ramdisk.Ramdisk_init(mb, ahci.Blockmem)
+	}
 	pci.Pcibus_attach()
 	return ncpu
 }
@@ -1605,9 +1669,162 @@ func structchk() {
 var lhits int
 var physmem *mem.Physmem_t
 var thefs *fs.Fs_t
+var thevfs *vfs.Vfs_t
 
 const diskfs = false
 
+// the partition that holds the root file system, as PARTUUID=<uuid> or
+// PARTLABEL=<label>, "ram" for a copy of the boot disk in the RAM disk, or
+// "raid" for the RAID-1 mirror of the disks; the whole disk if empty. set by
+// the build (ROOT=).
+var rootpart string
+
+// the mirror that holds the root file system, if ROOT=raid
+var rootraid *fs.Raid1_t
+
+// the size of the RAM disk in MB; none if empty. set by the build (RAMDISK=).
+var ramdisksz string
+
+// the root file system's disk is encrypted with AES-XTS if non-empty, and the
+// kernel asks for the key on the console. set by the build (CRYPT=).
+var rootcrypt string
+
+// cryptroot asks on the console for the AES-XTS key, in hex, of the encrypted
+// disk, until the key decrypts a file system on it. the key is never stored.
+func cryptroot(disk fs.Disk_i) fs.Disk_i {
+	for {
+		fmt.Printf("key of the root disk: ")
+		line := kbd_secret()
+		k := make([]uint8, hex.DecodedLen(len(line)))
+		_, err := hex.Decode(k, line)
+		for i := range line {
+			line[i] = 0
+		}
+		if err != nil {
+			fmt.Printf("the key must be in hex\n")
+			continue
+		}
+		c, kerr := fs.MkCrypt(disk, k, ahci.Blockmem)
+		for i := range k {
+			k[i] = 0
+		}
+		if kerr != 0 {
+			fmt.Printf("the key must be 32 or 64 bytes\n")
+			continue
+		}
+		if fs.Fs_ok(ahci.Blockmem, c) != 0 {
+			fmt.Printf("wrong key\n")
+			continue
+		}
+		return c
+	}
+}
+
+// ramroot copies the boot disk src to the RAM disk, which then holds the root
+// file system
+func ramroot(src fs.Disk_i) fs.Disk_i {
+	if ramdisk.Disk == nil || src == nil {
+		panic("no RAM disk or no boot disk")
+	}
+	fmt.Printf("copying the boot disk to the RAM disk...\n")
+	if err := ramdisk.Disk.Copy(src, ahci.Blockmem); err != 0 {
+		panic(fmt.Sprintf("RAM disk too small for the boot disk: %v", err))
+	}
+	return ramdisk.Disk
+}
+
+// raidroot assembles the mirror whose members are among the disks, which then
+// holds the root file system
+func raidroot() fs.Disk_i {
+	r, err := fs.Raid1_assemble(fs.Disk_raws(), ahci.Blockmem)
+	if err != 0 {
+		panic(fmt.Sprintf("cannot assemble the root mirror: %v", err))
+	}
+	if err := fs.Disk_attach("md0", r); err != 0 {
+		fmt.Printf("cannot attach the root mirror: %v\n", err)
+	}
+	fmt.Printf("root mirror of %v blocks: %v", r.Nblocks(), r.Stats())
+	rootraid = r
+	return r
+}
+
+func mktmpfs(ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+	return fs.MkTmpfs(ahci.Blockmem), 0
+}
+
+func mkdevfs(ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+	return devfs.MkDevfs(), 0
+}
+
+// returns the disk that src, such as /dev/rsd0c, names
+func srcdisk(src ustr.Ustr) (fs.Disk_i, defs.Err_t) {
+	name := src.String()
+	if len(name) > 5 && name[:5] == "/dev/" {
+		name = name[5:]
+	}
+	d, ok := fs.Disk_lookup(name)
+	if !ok {
+		return nil, -defs.ENXIO
+	}
+	return d, 0
+}
+
+// mounts the ext2 file system on the disk src
+func mkext2(src ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+	d, err := srcdisk(src)
+	if err != 0 {
+		return nil, err
+	}
+	efs, err := fs.MkExt2(ahci.Blockmem, d)
+	if err != 0 {
+		return nil, err
+	}
+	return efs, 0
+}
+
+// mounts the native file system on the disk src, such as a loop device
+// holding an image made by mkfs
+func mkbiscuit(src ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+	d, err := srcdisk(src)
+	if err != 0 {
+		return nil, err
+	}
+	bfs, err := fs.MountFS(ahci.Blockmem, d)
+	if err != 0 {
+		return nil, err
+	}
+	return bfs, 0
+}
+
+// mounts nfs on the directory p of the root file system, creating the
+// directory if necessary
+func bootmount(p string, nfs vfs.Fs_i) {
+	dir := ustr.Ustr(p)
+	cwd := thefs.MkRootCwd()
+	if err := thefs.Fs_mkdir(dir, 0755, cwd); err != 0 && err != -defs.EEXIST {
+		panic(fmt.Sprintf("mkdir %v: %v", p, err))
+	}
+	if err := thevfs.Mount(dir, cwd, nfs); err != 0 {
+		panic(fmt.Sprintf("mount %v: %v", p, err))
+	}
+}
+
+// mounts the device file system on /dev and a tmpfs on /tmp
+func mount_init() {
+	// the file system implements the devices of these majors
+	for _, maj := range []int{defs.D_CONSOLE, defs.D_DEVNULL,
+		defs.D_RAWDISK, defs.D_STAT, defs.D_PROF} {
+		maj := maj
+		devfs.Major(maj, func(min int) (fdops.Fdops_i, defs.Err_t) {
+			return thefs.Devopen(maj, min)
+		})
+	}
+	dfs, _ := mkdevfs(nil)
+	bootmount("/dev", dfs)
+	tfs, _ := mktmpfs(nil)
+	bootmount("/tmp", tfs)
+}
+
 func main() {
 	res.Kernel = true
 	//runtime.GCDebug(1)
@@ -1664,8 +1881,37 @@ func main() {
 	tinfo.SetCurrent(&tinfo.Tnote_t{})
 	manymeg := &res.Res_t{Objs: runtime.Resobjs_t{1: 100 << 20}}
 	res.Resbegin(manymeg)
-	rf, fs := fs.StartFS(ahci.Blockmem, ahci.Ahci, console, diskfs)
+	// prefer an NVMe disk, and then a virtio disk, which QEMU emulates
+	// faster than AHCI
+	disk := ahci.Ahci
+	if nvme.Disk != nil {
+		disk = nvme.Disk
+	} else if virtio.Disk != nil {
+		disk = virtio.Disk
+	}
+	fs.Disk_partitions(ahci.Blockmem)
+	if rootpart == "ram" {
+		disk = ramroot(disk)
+	} else if rootpart == "raid" {
+		disk = raidroot()
+	} else if rootpart != "" {
+		p, ok := fs.Part_lookup(rootpart)
+		if !ok {
+			panic(fmt.Sprintf("no root partition %v", rootpart))
+		}
+		disk = p
+	}
+	if rootcrypt != "" {
+		disk = cryptroot(disk)
+	}
+	// mount(2) mustn't start another file system on the root's blocks
+	if err := fs.Disk_claim(disk); err != 0 {
+		panic("root disk claimed")
+	}
+	rf, fs := fs.StartFS(ahci.Blockmem, disk, console, diskfs)
 	thefs = fs
+	thevfs = vfs.MkVfs(thefs)
+	mount_init()
 
 	proc.Oom_init(thefs.Fs_evict)
 
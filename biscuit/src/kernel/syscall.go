@@ -11,6 +11,7 @@ import "sync/atomic"
 import "time"
 import "unsafe"
 
+import "ahci"
 import "bnet"
 import "bounds"
 import "bpath"
@@ -27,6 +28,7 @@ import "stat"
 import "tinfo"
 import "ustr"
 import "util"
+import "vfs"
 import "vm"
 
 var _sysbounds = []*res.Res_t{
@@ -67,6 +69,10 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_WAIT4:      bounds.Bounds(bounds.B_SYS_WAIT4),
 	defs.SYS_KILL:       bounds.Bounds(bounds.B_SYS_KILL),
 	defs.SYS_FCNTL:      bounds.Bounds(bounds.B_SYS_FCNTL),
+	defs.SYS_IOCTL:      bounds.Bounds(bounds.B_SYS_IOCTL),
+	defs.SYS_FLOCK:      bounds.Bounds(bounds.B_SYS_FLOCK),
+	defs.SYS_FSYNC:      bounds.Bounds(bounds.B_SYS_FSYNC),
+	defs.SYS_FDATASYNC:  bounds.Bounds(bounds.B_SYS_FDATASYNC),
 	defs.SYS_TRUNC:      bounds.Bounds(bounds.B_SYS_TRUNCATE),
 	defs.SYS_FTRUNC:     bounds.Bounds(bounds.B_SYS_FTRUNCATE),
 	defs.SYS_GETCWD:     bounds.Bounds(bounds.B_SYS_GETCWD),
@@ -81,8 +87,20 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_MKNOD:      bounds.Bounds(bounds.B_SYS_MKNOD),
 	defs.SYS_SETRLMT:    bounds.Bounds(bounds.B_SYS_SETRLIMIT),
 	defs.SYS_SYNC:       bounds.Bounds(bounds.B_SYS_SYNC),
+	defs.SYS_MOUNT:      bounds.Bounds(bounds.B_SYS_MOUNT),
+	defs.SYS_UMOUNT2:    bounds.Bounds(bounds.B_SYS_UMOUNT2),
 	defs.SYS_REBOOT:     bounds.Bounds(bounds.B_SYS_REBOOT),
 	defs.SYS_NANOSLEEP:  bounds.Bounds(bounds.B_SYS_NANOSLEEP),
+	defs.SYS_OPENAT:     bounds.Bounds(bounds.B_SYS_OPENAT),
+	defs.SYS_MKDIRAT:    bounds.Bounds(bounds.B_SYS_MKDIRAT),
+	defs.SYS_MKNODAT:    bounds.Bounds(bounds.B_SYS_MKNODAT),
+	defs.SYS_FSTATAT:    bounds.Bounds(bounds.B_SYS_FSTATAT),
+	defs.SYS_UNLINKAT:   bounds.Bounds(bounds.B_SYS_UNLINKAT),
+	defs.SYS_RENAMEAT:   bounds.Bounds(bounds.B_SYS_RENAMEAT),
+	defs.SYS_LINKAT:     bounds.Bounds(bounds.B_SYS_LINKAT),
+	defs.SYS_FACCESSAT:  bounds.Bounds(bounds.B_SYS_FACCESSAT),
+	defs.SYS_FALLOCATE:  bounds.Bounds(bounds.B_SYS_FALLOCATE),
+	defs.SYS_COPY_FILE_RANGE: bounds.Bounds(bounds.B_SYS_COPY_FILE_RANGE),
 	defs.SYS_PIPE2:      bounds.Bounds(bounds.B_SYS_PIPE2),
 	defs.SYS_PROF:       bounds.Bounds(bounds.B_SYS_PROF),
 	defs.SYS_THREXIT:    bounds.Bounds(bounds.B_SYS_THREXIT),
@@ -91,6 +109,7 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_PWRITE:     bounds.Bounds(bounds.B_SYS_PWRITE),
 	defs.SYS_FUTEX:      bounds.Bounds(bounds.B_SYS_FUTEX),
 	defs.SYS_GETTID:     bounds.Bounds(bounds.B_SYS_GETTID),
+	defs.SYS_CRYPTSETUP: bounds.Bounds(bounds.B_SYS_CRYPTSETUP),
 }
 
 // Implements Syscall_i
@@ -206,6 +225,14 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_kill(p, a1, a2)
 	case defs.SYS_FCNTL:
 		ret = sys_fcntl(p, a1, a2, a3)
+	case defs.SYS_IOCTL:
+		ret = sys_ioctl(p, a1, a2, a3)
+	case defs.SYS_FLOCK:
+		ret = sys_flock(p, a1, a2)
+	case defs.SYS_FSYNC:
+		ret = sys_fsync(p, a1, false)
+	case defs.SYS_FDATASYNC:
+		ret = sys_fsync(p, a1, true)
 	case defs.SYS_TRUNC:
 		ret = sys_truncate(p, a1, uint(a2))
 	case defs.SYS_FTRUNC:
@@ -234,10 +261,34 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_setrlimit(p, a1, a2)
 	case defs.SYS_SYNC:
 		ret = sys_sync(p)
+	case defs.SYS_MOUNT:
+		ret = sys_mount(p, a1, a2, a3, a4, a5)
+	case defs.SYS_UMOUNT2:
+		ret = sys_umount2(p, a1, a2)
 	case defs.SYS_REBOOT:
 		ret = sys_reboot(p)
 	case defs.SYS_NANOSLEEP:
 		ret = sys_nanosleep(p, a1, a2)
+	case defs.SYS_OPENAT:
+		ret = sys_openat(p, a1, a2, a3, a4)
+	case defs.SYS_MKDIRAT:
+		ret = sys_mkdirat(p, a1, a2, a3)
+	case defs.SYS_MKNODAT:
+		ret = sys_mknodat(p, a1, a2, a3, a4)
+	case defs.SYS_FSTATAT:
+		ret = sys_fstatat(p, a1, a2, a3, a4)
+	case defs.SYS_UNLINKAT:
+		ret = sys_unlinkat(p, a1, a2, a3)
+	case defs.SYS_RENAMEAT:
+		ret = sys_renameat(p, a1, a2, a3, a4)
+	case defs.SYS_LINKAT:
+		ret = sys_linkat(p, a1, a2, a3, a4, a5)
+	case defs.SYS_FACCESSAT:
+		ret = sys_faccessat(p, a1, a2, a3, a4)
+	case defs.SYS_FALLOCATE:
+		ret = sys_fallocate(p, a1, a2, a3, a4)
+	case defs.SYS_COPY_FILE_RANGE:
+		ret = sys_copy_file_range(p, a1, a2, a3, a4, a5)
 	case defs.SYS_PIPE2:
 		ret = sys_pipe2(p, a1, a2)
 	case defs.SYS_PROF:
@@ -254,6 +305,8 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_futex(p, a1, a2, a3, a4, a5)
 	case defs.SYS_GETTID:
 		ret = sys_gettid(p, tid)
+	case defs.SYS_CRYPTSETUP:
+		ret = sys_cryptsetup(p, a1, a2, a3)
 	default:
 		fmt.Printf("unexpected syscall %v\n", sysno)
 		s.Sys_exit(p, tid, defs.SIGNALED|defs.Mkexitsig(31))
@@ -360,6 +413,30 @@ func sys_write(p *proc.Proc_t, fdn int, bufp int, sz int) int {
 }
 
 func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
+	return sys_openat(p, defs.AT_FDCWD, pathn, _flags, mode)
+}
+
+// returns the directory relative to which an *at system call resolves path,
+// which is either the cwd or the directory open as dirfd. the caller must
+// call _atcwd_done once it is done with the directory.
+func _atcwd(p *proc.Proc_t, dirfd int, path ustr.Ustr) (*fd.Cwd_t, defs.Err_t) {
+	if dirfd == defs.AT_FDCWD || path.IsAbsolute() {
+		return p.Cwd, 0
+	}
+	f, ok := p.Fd_get(dirfd)
+	if !ok {
+		return nil, -defs.EBADF
+	}
+	return thevfs.Fs_atcwd(f)
+}
+
+func _atcwd_done(p *proc.Proc_t, cwd *fd.Cwd_t) {
+	if cwd != p.Cwd {
+		fd.Close_panic(cwd.Fd)
+	}
+}
+
+func sys_openat(p *proc.Proc_t, dirfd, pathn int, _flags int, mode int) int {
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
@@ -387,7 +464,12 @@ func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	file, err := thefs.Fs_open(path, flags, mode, p.Cwd, 0, 0)
+	cwd, err := _atcwd(p, dirfd, path)
+	if err != 0 {
+		return int(err)
+	}
+	file, err := thevfs.Fs_open(path, flags, mode, cwd, 0, 0)
+	_atcwd_done(p, cwd)
 	if err != 0 {
 		return int(err)
 	}
@@ -414,11 +496,12 @@ func sys_pause(p *proc.Proc_t) int {
 }
 
 func (s *syscall_t) Sys_close(p *proc.Proc_t, fdn int) int {
-	fd, ok := p.Fd_del(fdn)
+	f, ok := p.Fd_del(fdn)
 	if !ok {
 		return int(-defs.EBADF)
 	}
-	ret := fd.Fops.Close()
+	fd.Unlock(f, p.Pid)
+	ret := f.Fops.Close()
 	return int(ret)
 }
 
@@ -468,6 +551,11 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 				f.Perms&fd.FD_WRITE == 0) {
 			return int(-defs.EACCES)
 		}
+		// the pages of a shared mapping are pinned in the cache of
+		// the file's file system
+		if _, ok := f.Fops.(mem.Unpin_i); shared && !ok {
+			return int(-defs.ENODEV)
+		}
 	}
 
 	p.Vm.Lock_pmap()
@@ -501,7 +589,7 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 		// vmadd_*file will increase the open count on the file
 		if shared {
 			p.Vm.Vmadd_sharefile(addr, lenn, perms, fops, offset,
-				thefs)
+				fops.(mem.Unpin_i))
 		} else {
 			p.Vm.Vmadd_file(addr, lenn, perms, fops, offset)
 		}
@@ -620,6 +708,10 @@ func sys_sigaction(p *proc.Proc_t, sig, actn, oactn int) int {
 }
 
 func sys_access(p *proc.Proc_t, pathn, mode int) int {
+	return sys_faccessat(p, defs.AT_FDCWD, pathn, mode, 0)
+}
+
+func sys_faccessat(p *proc.Proc_t, dirfd, pathn, mode, flags int) int {
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
@@ -627,8 +719,18 @@ func sys_access(p *proc.Proc_t, pathn, mode int) int {
 	if mode == 0 {
 		return int(-defs.EINVAL)
 	}
+	// no permissions nor symlinks, thus the flags don't matter
+	if flags&^(defs.AT_EACCESS|defs.AT_SYMLINK_NOFOLLOW) != 0 {
+		return int(-defs.EINVAL)
+	}
 
-	fsf, err := thefs.Fs_open_inner(path, defs.O_RDONLY, 0, p.Cwd, 0, 0)
+	cwd, err := _atcwd(p, dirfd, path)
+	if err != 0 {
+		return int(err)
+	}
+	st := &stat.Stat_t{}
+	err = thevfs.Fs_stat(path, st, cwd)
+	_atcwd_done(p, cwd)
 	if err != 0 {
 		return int(err)
 	}
@@ -637,12 +739,7 @@ func sys_access(p *proc.Proc_t, pathn, mode int) int {
 	//R_OK := 1 << 0
 	//W_OK := 1 << 1
 	//X_OK := 1 << 2
-	ret := 0
-
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
-	return ret
+	return 0
 }
 
 func sys_dup2(p *proc.Proc_t, oldn, newn int) int {
@@ -654,18 +751,32 @@ func sys_dup2(p *proc.Proc_t, oldn, newn int) int {
 		return int(err)
 	}
 	if needclose {
+		fd.Unlock(ofd, p.Pid)
 		fd.Close_panic(ofd)
 	}
 	return newn
 }
 
 func sys_stat(p *proc.Proc_t, pathn, statn int) int {
+	return sys_fstatat(p, defs.AT_FDCWD, pathn, statn, 0)
+}
+
+func sys_fstatat(p *proc.Proc_t, dirfd, pathn, statn, flags int) int {
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
 	}
+	// there are no symlinks
+	if flags&^defs.AT_SYMLINK_NOFOLLOW != 0 {
+		return int(-defs.EINVAL)
+	}
+	cwd, err := _atcwd(p, dirfd, path)
+	if err != 0 {
+		return int(err)
+	}
 	buf := &stat.Stat_t{}
-	err = thefs.Fs_stat(path, buf, p.Cwd)
+	err = thevfs.Fs_stat(path, buf, cwd)
+	_atcwd_done(p, cwd)
 	if err != 0 {
 		return int(err)
 	}
@@ -1146,6 +1257,22 @@ func (of *pipefops_t) Truncate(uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (of *pipefops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (of *pipefops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (of *pipefops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (of *pipefops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (of *pipefops_t) Pread(fdops.Userio_i, int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1214,6 +1341,10 @@ func (of *pipefops_t) Shutdown(read, write bool) defs.Err_t {
 }
 
 func sys_rename(p *proc.Proc_t, oldn int, newn int) int {
+	return sys_renameat(p, defs.AT_FDCWD, oldn, defs.AT_FDCWD, newn)
+}
+
+func sys_renameat(p *proc.Proc_t, odirfd, oldn, ndirfd, newn int) int {
 	old, err1 := p.Vm.Userstr(oldn, fs.NAME_MAX)
 	new, err2 := p.Vm.Userstr(newn, fs.NAME_MAX)
 	if err1 != 0 {
@@ -1230,11 +1361,25 @@ func sys_rename(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_rename(old, new, p.Cwd)
+	ocwd, err := _atcwd(p, odirfd, old)
+	if err != 0 {
+		return int(err)
+	}
+	defer _atcwd_done(p, ocwd)
+	ncwd, err := _atcwd(p, ndirfd, new)
+	if err != 0 {
+		return int(err)
+	}
+	defer _atcwd_done(p, ncwd)
+	err = thevfs.Fs_renameat(old, ocwd, new, ncwd)
 	return int(err)
 }
 
 func sys_mkdir(p *proc.Proc_t, pathn int, mode int) int {
+	return sys_mkdirat(p, defs.AT_FDCWD, pathn, mode)
+}
+
+func sys_mkdirat(p *proc.Proc_t, dirfd, pathn int, mode int) int {
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
@@ -1243,11 +1388,24 @@ func sys_mkdir(p *proc.Proc_t, pathn int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	err = thefs.Fs_mkdir(path, mode, p.Cwd)
+	cwd, err := _atcwd(p, dirfd, path)
+	if err != 0 {
+		return int(err)
+	}
+	err = thevfs.Fs_mkdir(path, mode, cwd)
+	_atcwd_done(p, cwd)
 	return int(err)
 }
 
 func sys_link(p *proc.Proc_t, oldn int, newn int) int {
+	return sys_linkat(p, defs.AT_FDCWD, oldn, defs.AT_FDCWD, newn, 0)
+}
+
+func sys_linkat(p *proc.Proc_t, odirfd, oldn, ndirfd, newn, flags int) int {
+	// there are no symlinks
+	if flags&^defs.AT_SYMLINK_FOLLOW != 0 {
+		return int(-defs.EINVAL)
+	}
 	old, err1 := p.Vm.Userstr(oldn, fs.NAME_MAX)
 	new, err2 := p.Vm.Userstr(newn, fs.NAME_MAX)
 	if err1 != 0 {
@@ -1264,11 +1422,32 @@ func sys_link(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_link(old, new, p.Cwd)
+	ocwd, err := _atcwd(p, odirfd, old)
+	if err != 0 {
+		return int(err)
+	}
+	defer _atcwd_done(p, ocwd)
+	ncwd, err := _atcwd(p, ndirfd, new)
+	if err != 0 {
+		return int(err)
+	}
+	defer _atcwd_done(p, ncwd)
+	err = thevfs.Fs_linkat(old, ocwd, new, ncwd)
 	return int(err)
 }
 
 func sys_unlink(p *proc.Proc_t, pathn, isdiri int) int {
+	flags := 0
+	if isdiri != 0 {
+		flags = defs.AT_REMOVEDIR
+	}
+	return sys_unlinkat(p, defs.AT_FDCWD, pathn, flags)
+}
+
+func sys_unlinkat(p *proc.Proc_t, dirfd, pathn, flags int) int {
+	if flags&^defs.AT_REMOVEDIR != 0 {
+		return int(-defs.EINVAL)
+	}
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
@@ -1277,8 +1456,13 @@ func sys_unlink(p *proc.Proc_t, pathn, isdiri int) int {
 	if err != 0 {
 		return int(err)
 	}
-	wantdir := isdiri != 0
-	err = thefs.Fs_unlink(path, p.Cwd, wantdir)
+	cwd, err := _atcwd(p, dirfd, path)
+	if err != 0 {
+		return int(err)
+	}
+	wantdir := flags&defs.AT_REMOVEDIR != 0
+	err = thevfs.Fs_unlink(path, cwd, wantdir)
+	_atcwd_done(p, cwd)
 	return int(err)
 }
 
@@ -1369,6 +1553,10 @@ func sys_getrusage(p *proc.Proc_t, who, rusagep int) int {
 }
 
 func sys_mknod(p *proc.Proc_t, pathn, moden, devn int) int {
+	return sys_mknodat(p, defs.AT_FDCWD, pathn, moden, devn)
+}
+
+func sys_mknodat(p *proc.Proc_t, dirfd, pathn, moden, devn int) int {
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
@@ -1378,22 +1566,95 @@ func sys_mknod(p *proc.Proc_t, pathn, moden, devn int) int {
 	if err != 0 {
 		return int(err)
 	}
+	cwd, err := _atcwd(p, dirfd, path)
+	if err != 0 {
+		return int(err)
+	}
 	maj, min := defs.Unmkdev(uint(devn))
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT, 0, p.Cwd, maj, min)
+	_, err = thevfs.Fs_mknod(path, false, cwd, maj, min)
+	_atcwd_done(p, cwd)
+	return int(err)
+}
+
+func sys_sync(p *proc.Proc_t) int {
+	return int(thevfs.Fs_sync())
+}
+
+// constructors of the file systems that mount(2) can mount, by type. a
+// constructor creates a file system from the source string.
+var fstypes = map[string]func(ustr.Ustr) (vfs.Fs_i, defs.Err_t){
+	"biscuit": mkbiscuit,
+	"devfs":   mkdevfs,
+	"ext2":    mkext2,
+	"tmpfs":   mktmpfs,
+}
+
+func sys_mount(p *proc.Proc_t, srcn, targetn, typen, flags, datan int) int {
+	src, err := p.Vm.Userstr(srcn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
 	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	fstype, err := p.Vm.Userstr(typen, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	// no mount flags nor file system options yet
+	if flags != 0 {
+		return int(-defs.EINVAL)
+	}
+	if err := badpath(target); err != 0 {
+		return int(err)
+	}
+	mkfs, ok := fstypes[fstype.String()]
+	if !ok {
+		return int(-defs.ENODEV)
+	}
+	nfs, err := mkfs(src)
+	if err != 0 {
+		return int(err)
+	}
+	if err := thevfs.Mount(target, p.Cwd, nfs); err != 0 {
+		if nfs.Fs_unmount() != 0 {
+			panic("must succeed")
+		}
+		return int(err)
 	}
 	return 0
 }
 
-func sys_sync(p *proc.Proc_t) int {
-	return int(thefs.Fs_sync())
+func sys_umount2(p *proc.Proc_t, targetn, flags int) int {
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	// no forced nor lazy unmounts
+	if flags != 0 {
+		return int(-defs.EINVAL)
+	}
+	if err := badpath(target); err != 0 {
+		return int(err)
+	}
+	return int(thevfs.Umount(target, p.Cwd))
+}
+
+func sys_fsync(p *proc.Proc_t, fdn int, datasync bool) int {
+	fd, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(fd.Fops.Fsync(datasync))
 }
 
 func sys_reboot(p *proc.Proc_t) int {
+	// the root mirror needn't be resynchronized at the next boot
+	if rootraid != nil {
+		thefs.Fs_sync()
+		rootraid.Markclean()
+	}
 	// mov'ing to cr3 does not flush global pages. if, before loading the
 	// zero page into cr3 below, there are just enough TLB entries to
 	// dispatch a fault, but not enough to complete the fault handler, the
@@ -1934,6 +2195,22 @@ func (sf *sudfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sf *sudfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (sf *sudfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *sudfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *sudfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (sf *sudfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1974,15 +2251,11 @@ func (sf *sudfops_t) Bind(sa []uint8) defs.Err_t {
 	path := ustr.MkUstrSlice(sa[poff:])
 	// try to create the specified file as a special device
 	bid := allbuds.bud_id_new()
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUD, int(bid))
+	inum, err := thevfs.Fs_mknod(path, true, proc.CurrentProc().Cwd, defs.D_SUD, int(bid))
 	if err != 0 {
 		return err
 	}
-	inum := fsf.Inum
 	bud := allbuds.bud_new(bid, path, inum)
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sf.bud = bud
 	sf.bound = true
 	return 0
@@ -2008,7 +2281,7 @@ func (sf *sudfops_t) Sendmsg(src fdops.Userio_i, sa []uint8,
 	st := &stat.Stat_t{}
 	path := ustr.MkUstrSlice(sa[poff:])
 
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	err := thevfs.Fs_stat(path, st, proc.CurrentProc().Cwd)
 	if err != 0 {
 		return 0, err
 	}
@@ -2440,6 +2713,22 @@ func (sus *susfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sus *susfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (sus *susfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sus *susfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sus *susfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (sus *susfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -2464,13 +2753,10 @@ func (sus *susfops_t) Bind(saddr []uint8) defs.Err_t {
 	sid := susid_new()
 
 	// create special file
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUS, sid)
+	_, err := thevfs.Fs_mknod(path, true, proc.CurrentProc().Cwd, defs.D_SUS, sid)
 	if err != 0 {
 		return err
 	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sus.myaddr = path
 	sus.mysid = sid
 	sus.bound = true
@@ -2489,7 +2775,7 @@ func (sus *susfops_t) Connect(saddr []uint8) defs.Err_t {
 
 	// lookup sid
 	st := &stat.Stat_t{}
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	err := thevfs.Fs_stat(path, st, proc.CurrentProc().Cwd)
 	if err != 0 {
 		return err
 	}
@@ -2964,6 +3250,22 @@ func (sf *suslfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sf *suslfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (sf *suslfops_t) Fsync(datasync bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *suslfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *suslfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (sf *suslfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3304,7 +3606,7 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	}
 
 	// load binary image -- get first block of file
-	file, err := thefs.Fs_open(paths, defs.O_RDONLY, 0, p.Cwd, 0, 0)
+	file, err := thevfs.Fs_open(paths, defs.O_RDONLY, 0, p.Cwd, 0, 0)
 	if err != 0 {
 		restore()
 		return int(err)
@@ -3926,6 +4228,27 @@ func sys_gettid(p *proc.Proc_t, tid defs.Tid_t) int {
 	return int(tid)
 }
 
+// attaches the disk named by the user string namen, encrypted with the keylen
+// bytes at keyn, as crypt-<name>; detaches crypt-<name> if keylen is 0
+func sys_cryptsetup(p *proc.Proc_t, namen, keyn, keylen int) int {
+	name, err := p.Vm.Userstr(namen, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if keylen < 0 || keylen > 64 {
+		return int(-defs.EINVAL)
+	}
+	key := make([]uint8, keylen)
+	if err := p.Vm.User2k(key, keyn); err != 0 {
+		return int(err)
+	}
+	ret := fs.Crypt_attach(name.String(), key, ahci.Blockmem)
+	for i := range key {
+		key[i] = 0
+	}
+	return int(ret)
+}
+
 func sys_fcntl(p *proc.Proc_t, fdn, cmd, opt int) int {
 	f, ok := p.Fd_get(fdn)
 	if !ok {
@@ -3945,11 +4268,104 @@ func sys_fcntl(p *proc.Proc_t, fdn, cmd, opt int) int {
 	// fd specific fcntl(2) ops
 	case defs.F_GETFL, defs.F_SETFL:
 		return f.Fops.Fcntl(cmd, opt)
+	case defs.F_GETLK, defs.F_SETLK, defs.F_SETLKW:
+		return _fcntl_lock(p, f, cmd, opt)
 	default:
 		return int(-defs.EINVAL)
 	}
 }
 
+func sys_ioctl(p *proc.Proc_t, fdn, cmd, arg int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	io, ok := f.Fops.(fdops.Ioctl_i)
+	if !ok {
+		return int(-defs.ENOTTY)
+	}
+	var argf fdops.Fdops_i
+	switch cmd {
+	case defs.LOOP_SET_FD:
+		// the loop device reads and writes the file
+		af, ok := p.Fd_get(arg)
+		if !ok {
+			return int(-defs.EBADF)
+		}
+		rw := fd.FD_READ | fd.FD_WRITE
+		if af.Perms&rw != rw {
+			return int(-defs.EBADF)
+		}
+		argf = af.Fops
+	}
+	ret, err := io.Ioctl(cmd, arg, argf)
+	if err != 0 {
+		return int(err)
+	}
+	return ret
+}
+
+// struct flock layout
+const (
+	FLOCK_TYPE   = 0
+	FLOCK_WHENCE = 2
+	FLOCK_START  = 8
+	FLOCK_LEN    = 16
+	FLOCK_PID    = 24
+)
+
+func _fcntl_lock(p *proc.Proc_t, f *fd.Fd_t, cmd, flockn int) int {
+	lk := &fdops.Flock_t{}
+	var err defs.Err_t
+	if lk.Type, err = p.Vm.Userreadn(flockn+FLOCK_TYPE, 2); err != 0 {
+		return int(err)
+	}
+	if lk.Whence, err = p.Vm.Userreadn(flockn+FLOCK_WHENCE, 2); err != 0 {
+		return int(err)
+	}
+	if lk.Start, err = p.Vm.Userreadn(flockn+FLOCK_START, 8); err != 0 {
+		return int(err)
+	}
+	if lk.Len, err = p.Vm.Userreadn(flockn+FLOCK_LEN, 8); err != 0 {
+		return int(err)
+	}
+	if cmd != defs.F_GETLK {
+		if lk.Type == defs.F_RDLCK && f.Perms&fd.FD_READ == 0 ||
+			lk.Type == defs.F_WRLCK && f.Perms&fd.FD_WRITE == 0 {
+			return int(-defs.EBADF)
+		}
+	}
+	if err := f.Fops.Lockrec(p.Pid, cmd, lk); err != 0 {
+		return int(err)
+	}
+	if cmd == defs.F_GETLK {
+		writes := []struct {
+			off, sz, val int
+		}{
+			{FLOCK_TYPE, 2, lk.Type},
+			{FLOCK_WHENCE, 2, lk.Whence},
+			{FLOCK_START, 8, lk.Start},
+			{FLOCK_LEN, 8, lk.Len},
+			{FLOCK_PID, 4, lk.Pid},
+		}
+		for _, w := range writes {
+			err := p.Vm.Userwriten(flockn+w.off, w.sz, w.val)
+			if err != 0 {
+				return int(err)
+			}
+		}
+	}
+	return 0
+}
+
+func sys_flock(p *proc.Proc_t, fdn, op int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(f.Fops.Flock(op))
+}
+
 func sys_truncate(p *proc.Proc_t, pathn int, newlen uint) int {
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
@@ -3958,7 +4374,7 @@ func sys_truncate(p *proc.Proc_t, pathn int, newlen uint) int {
 	if err := badpath(path); err != 0 {
 		return int(err)
 	}
-	f, err := thefs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, 0, 0)
+	f, err := thevfs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, 0, 0)
 	if err != 0 {
 		return int(err)
 	}
@@ -3975,6 +4391,62 @@ func sys_ftruncate(p *proc.Proc_t, fdn int, newlen uint) int {
 	return int(fd.Fops.Truncate(newlen))
 }
 
+func sys_fallocate(p *proc.Proc_t, fdn, mode, off, length int) int {
+	fd, err := _fd_write(p, fdn)
+	if err != 0 {
+		return int(-defs.EBADF)
+	}
+	return int(fd.Fops.Fallocate(mode, off, length))
+}
+
+// the offset pointers may be NULL, in which case the copy uses and advances the
+// file's offset
+func sys_copy_file_range(p *proc.Proc_t, ifdn, ioffn, ofdn, ooffn, n int) int {
+	ifd, err := _fd_read(p, ifdn)
+	if err != 0 {
+		return int(err)
+	}
+	ofd, err := _fd_write(p, ofdn)
+	if err != 0 {
+		return int(err)
+	}
+	if n < 0 {
+		return int(-defs.EINVAL)
+	}
+	getoff := func(f *fd.Fd_t, offn int) (int, defs.Err_t) {
+		if offn == 0 {
+			return f.Fops.Lseek(0, defs.SEEK_CUR)
+		}
+		return p.Vm.Userreadn(offn, 8)
+	}
+	putoff := func(f *fd.Fd_t, offn, off int) defs.Err_t {
+		if offn == 0 {
+			_, err := f.Fops.Lseek(off, defs.SEEK_SET)
+			return err
+		}
+		return p.Vm.Userwriten(offn, 8, off)
+	}
+	ioff, err := getoff(ifd, ioffn)
+	if err != 0 {
+		return int(err)
+	}
+	ooff, err := getoff(ofd, ooffn)
+	if err != 0 {
+		return int(err)
+	}
+	ret, err := fs.Copy_range(ifd.Fops, ofd.Fops, ioff, ooff, n)
+	if ret > 0 {
+		if err1 := putoff(ifd, ioffn, ioff+ret); err1 != 0 {
+			return int(err1)
+		}
+		if err1 := putoff(ofd, ooffn, ooff+ret); err1 != 0 {
+			return int(err1)
+		}
+		return ret
+	}
+	return int(err)
+}
+
 func sys_getcwd(p *proc.Proc_t, bufn, sz int) int {
 	dst := p.Vm.Mkuserbuf(bufn, sz)
 	_, err := dst.Uiowrite([]uint8(p.Cwd.Path))
@@ -4000,7 +4472,7 @@ func sys_chdir(p *proc.Proc_t, dirn int) int {
 	p.Cwd.Lock()
 	defer p.Cwd.Unlock()
 
-	newfd, err := thefs.Fs_open(path, defs.O_RDONLY|defs.O_DIRECTORY, 0, p.Cwd, 0, 0)
+	newfd, err := thevfs.Fs_open(path, defs.O_RDONLY|defs.O_DIRECTORY, 0, p.Cwd, 0, 0)
 	if err != 0 {
 		return int(err)
 	}
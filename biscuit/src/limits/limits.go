@@ -46,6 +46,8 @@ func MkSysLimit() *Syslimit_t {
 		Socks:    1e5,
 		Vnodes:   20000, // 1e6,
 		Pipes:    1e4,
+		// 256MB of tmpfs pages
+		Mfspgs: 1 << 16,
 		// 8GB of block pages
 		Blocks: 100000, // 1 << 21,
 	}
@@ -0,0 +1,415 @@
+package loop
+
+import "fmt"
+import "sync"
+
+import "defs"
+import "devfs"
+import "fdops"
+import "fs"
+import "mem"
+import "stat"
+import "vm"
+
+// Loop devices present a regular file as a disk, so that a file system image
+// stored in a file can be mounted or checked. ioctl(LOOP_SET_FD) on
+// /dev/loopN binds the device to an open file and attaches the device as the
+// disk loopN (e.g., for mount("/dev/loop0", ..., "biscuit")); ioctl(LOOP_CLR_FD)
+// unbinds it. Reading and writing /dev/loopN reads and writes the file, and
+// blocks past its end fail with EIO. A loop device cannot be bound to a file
+// stored on itself, and it cannot be unbound while a file system uses it.
+
+const NLOOP = 4
+
+type Loop_t struct {
+	// serializes I/O with binding and unbinding
+	sync.Mutex
+	name  string
+	minor int
+	// the backing file; nil if unbound
+	f     fdops.Fdops_i
+	nblks int
+}
+
+var loops [NLOOP]*Loop_t
+
+// serializes the binding of loop devices, so that no two bindings can make a
+// cycle of loop devices
+var setmu sync.Mutex
+
+// Loop_init registers the loop devices' files
+func Loop_init() {
+	for i := range loops {
+		l := &Loop_t{name: fmt.Sprintf("loop%d", i), minor: i}
+		if err := devfs.Register(l.name, defs.D_LOOP, i); err != 0 {
+			panic("register loop")
+		}
+		loops[i] = l
+	}
+	devfs.Major(defs.D_LOOP, loopopen)
+}
+
+func loopopen(min int) (fdops.Fdops_i, defs.Err_t) {
+	if min >= len(loops) || loops[min] == nil {
+		return nil, -defs.ENXIO
+	}
+	return &loopfops_t{l: loops[min]}, 0
+}
+
+// Set binds l to the regular file f and attaches l as a disk
+func (l *Loop_t) Set(f fdops.Fdops_i) defs.Err_t {
+	setmu.Lock()
+	defer setmu.Unlock()
+
+	if _, ok := f.(*loopfops_t); ok {
+		return -defs.EINVAL
+	}
+	if err := l.validate(f); err != 0 {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.f != nil {
+		return -defs.EBUSY
+	}
+	st := &stat.Stat_t{}
+	if err := f.Fstat(st); err != 0 {
+		return err
+	}
+	if st.Mode()&stat.S_IFMT != stat.S_IFREG {
+		return -defs.EINVAL
+	}
+	if err := f.Reopen(); err != 0 {
+		return err
+	}
+	l.f = f
+	l.nblks = int(st.Size()) / fs.BSIZE
+	if err := fs.Disk_attach(l.name, l); err != 0 {
+		l.f = nil
+		f.Close()
+		return err
+	}
+	return 0
+}
+
+// validate fails with -EBUSY if f is stored on l, or on a loop device bound
+// to a file stored on l, and so on, like Linux's loop_validate_file: l's I/O
+// writes f while holding l's lock, and would wait for itself. the caller
+// holds setmu.
+func (l *Loop_t) validate(f fdops.Fdops_i) defs.Err_t {
+	d, ok := fs.File_disk(f)
+	if !ok {
+		return 0
+	}
+	for _, o := range loops {
+		if o == nil || !fs.Layered(d, o) {
+			continue
+		}
+		if o == l {
+			return -defs.EBUSY
+		}
+		if of, _ := o.bound(); of != nil {
+			if err := l.validate(of); err != 0 {
+				return err
+			}
+		}
+	}
+	return 0
+}
+
+// Clr detaches l and unbinds it from its file, failing with -EBUSY while a
+// file system uses l
+func (l *Loop_t) Clr() defs.Err_t {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.f == nil {
+		return -defs.ENXIO
+	}
+	if fs.Disk_claimed(l) {
+		return -defs.EBUSY
+	}
+	fs.Disk_detach(l.name)
+	err := l.f.Close()
+	l.f = nil
+	l.nblks = 0
+	return err
+}
+
+func (l *Loop_t) Start(req *fs.Bdev_req_t) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	switch req.Cmd {
+	case fs.BDEV_READ, fs.BDEV_WRITE:
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if err := l.rw(b, req.Cmd == fs.BDEV_WRITE); err != 0 {
+				fmt.Printf("%v: block %v: I/O error %v\n", l.name,
+					b.Block, err)
+				req.Err = err
+			}
+			if req.Cmd == fs.BDEV_WRITE {
+				b.Done("loop")
+			}
+		}
+	case fs.BDEV_FLUSH:
+		if l.f != nil {
+			l.f.Fsync(false)
+		}
+	case fs.BDEV_DISCARD:
+		// free the file's blocks; a file system that cannot punch
+		// holes just keeps them
+		if l.f != nil {
+			mode := defs.FALLOC_FL_PUNCH_HOLE | defs.FALLOC_FL_KEEP_SIZE
+			for _, r := range req.Runs {
+				l.f.Fallocate(mode, r.Block*fs.BSIZE, r.N*fs.BSIZE)
+			}
+		}
+	}
+	// the I/O is done
+	return false
+}
+
+// rw reads (or writes) block b from (or to) the backing file. the part of a
+// block beyond the file's end reads as zeros.
+func (l *Loop_t) rw(b *fs.Bdev_block_t, write bool) defs.Err_t {
+	if l.f == nil {
+		return -defs.ENXIO
+	}
+	if b.Block < 0 || b.Block >= l.nblks {
+		return -defs.EIO
+	}
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(b.Data[:])
+	off := b.Block * fs.BSIZE
+	if write {
+		n, err := l.f.Pwrite(ub, off)
+		if err == 0 && n != fs.BSIZE {
+			err = -defs.EIO
+		}
+		return err
+	}
+	n, err := l.f.Pread(ub, off)
+	for i := n; i < fs.BSIZE; i++ {
+		b.Data[i] = 0
+	}
+	return err
+}
+
+func (l *Loop_t) Stats() string {
+	return ""
+}
+
+func (l *Loop_t) Nblocks() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.nblks
+}
+
+// bound returns l's backing file, or nil if l is unbound, and l's size in
+// blocks
+func (l *Loop_t) bound() (fdops.Fdops_i, int) {
+	l.Lock()
+	defer l.Unlock()
+	return l.f, l.nblks
+}
+
+type loopfops_t struct {
+	l *Loop_t
+	// protects offset
+	sync.Mutex
+	offset int
+}
+
+func (lf *loopfops_t) Ioctl(cmd, arg int, argf fdops.Fdops_i) (int, defs.Err_t) {
+	switch cmd {
+	case defs.LOOP_SET_FD:
+		return 0, lf.l.Set(argf)
+	case defs.LOOP_CLR_FD:
+		return 0, lf.l.Clr()
+	default:
+		return 0, -defs.EINVAL
+	}
+}
+
+func (lf *loopfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	lf.Lock()
+	defer lf.Unlock()
+
+	did, err := lf.Pread(dst, lf.offset)
+	lf.offset += did
+	return did, err
+}
+
+func (lf *loopfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	lf.Lock()
+	defer lf.Unlock()
+
+	did, err := lf.Pwrite(src, lf.offset)
+	lf.offset += did
+	return did, err
+}
+
+// reads and writes end at the end of the device, even if the file grew past
+// it since it was bound
+func (lf *loopfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	f, nblks := lf.l.bound()
+	if f == nil {
+		return 0, -defs.ENXIO
+	}
+	if offset < 0 {
+		return 0, -defs.EINVAL
+	}
+	left := nblks*fs.BSIZE - offset
+	if left <= 0 {
+		return 0, 0
+	}
+	if dst.Remain() <= left {
+		return f.Pread(dst, offset)
+	}
+	buf := make([]uint8, left)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	n, err := f.Pread(ub, offset)
+	if err != 0 {
+		return 0, err
+	}
+	return dst.Uiowrite(buf[:n])
+}
+
+func (lf *loopfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	f, nblks := lf.l.bound()
+	if f == nil {
+		return 0, -defs.ENXIO
+	}
+	if offset < 0 {
+		return 0, -defs.EINVAL
+	}
+	left := nblks*fs.BSIZE - offset
+	if left <= 0 {
+		return 0, -defs.ENOSPC
+	}
+	if src.Remain() <= left {
+		return f.Pwrite(src, offset)
+	}
+	buf := make([]uint8, left)
+	n, err := src.Uioread(buf)
+	if err != 0 {
+		return 0, err
+	}
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf[:n])
+	return f.Pwrite(ub, offset)
+}
+
+func (lf *loopfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (lf *loopfops_t) Fallocate(mode, offset, length int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (lf *loopfops_t) Fsync(datasync bool) defs.Err_t {
+	f, _ := lf.l.bound()
+	if f == nil {
+		return -defs.ENXIO
+	}
+	return f.Fsync(datasync)
+}
+
+func (lf *loopfops_t) Flock(op int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (lf *loopfops_t) Lockrec(pid, cmd int, lk *fdops.Flock_t) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (lf *loopfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(defs.D_LOOP, lf.l.minor))
+	st.Wsize(uint(lf.l.Nblocks() * fs.BSIZE))
+	return 0
+}
+
+func (lf *loopfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (lf *loopfops_t) Pathi() defs.Inum_t {
+	panic("bad cwd")
+}
+
+func (lf *loopfops_t) Close() defs.Err_t {
+	return 0
+}
+
+func (lf *loopfops_t) Reopen() defs.Err_t {
+	return 0
+}
+
+func (lf *loopfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	lf.Lock()
+	defer lf.Unlock()
+
+	switch whence {
+	case defs.SEEK_SET:
+		lf.offset = off
+	case defs.SEEK_CUR:
+		lf.offset += off
+	case defs.SEEK_END:
+		lf.offset = lf.l.Nblocks()*fs.BSIZE + off
+	default:
+		return 0, -defs.EINVAL
+	}
+	return lf.offset, 0
+}
+
+func (lf *loopfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
+}
+
+func (lf *loopfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (lf *loopfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (lf *loopfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -0,0 +1,30 @@
+package main
+
+import "encoding/hex"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strings"
+
+import "ufs"
+
+func main() {
+	if len(os.Args) != 4 {
+		fmt.Printf("Usage: mkcrypt <key file> <image> <output image>\n")
+		os.Exit(1)
+	}
+
+	// the key file holds the key in hex, as typed at boot for CRYPT
+	kf, err := ioutil.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Printf("cannot read key: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(kf)))
+	if err != nil || (len(key) != 32 && len(key) != 64) {
+		fmt.Printf("key must be 32 or 64 bytes in hex\n")
+		os.Exit(1)
+	}
+
+	ufs.CryptDisk(os.Args[2], os.Args[3], key)
+}
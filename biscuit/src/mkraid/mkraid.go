@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+import "os"
+
+import "ufs"
+
+func main() {
+	if len(os.Args) < 4 {
+		fmt.Printf("Usage: mkraid <image> <member image> <member image>...\n")
+		os.Exit(1)
+	}
+
+	if err := ufs.RaidDisks(os.Args[1], os.Args[2:]); err != 0 {
+		fmt.Printf("cannot make the mirror: %v\n", err)
+		os.Exit(1)
+	}
+}
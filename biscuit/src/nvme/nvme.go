@@ -0,0 +1,736 @@
+package nvme
+
+import "fmt"
+import "runtime"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "unsafe"
+import "container/list"
+
+import "defs"
+import "devfs"
+import "fs"
+import "mem"
+import "msi"
+import "pci"
+import "stats"
+
+const nvme_debug = false
+
+func dbg(x string, args ...interface{}) {
+	if nvme_debug {
+		fmt.Printf(x, args...)
+	}
+}
+
+//
+// NVMe. the driver identifies the controller and its first namespace through
+// the admin queue, polling for completions, and then creates a pair of I/O
+// submission and completion queues for each CPU so that CPUs issuing
+// requests don't contend for one queue. a command moves blocks that are
+// contiguous on disk; since a block is a page, the command names the pages
+// directly or through a PRP list. all completion queues share one interrupt
+// vector.
+//
+// - https://nvmexpress.org/developers/nvme-specification/ (base spec 1.4)
+//
+
+// the class code of NVMe controllers, whoever makes them
+const (
+	PCI_CLASS_STORAGE = 0x01
+	PCI_SUBCLASS_NVM  = 0x08
+	PCI_PROGIF_NVME   = 0x02
+)
+
+// controller registers
+const (
+	NVME_CAP  = 0x00
+	NVME_VS   = 0x08
+	NVME_CC   = 0x14
+	NVME_CSTS = 0x1c
+	NVME_AQA  = 0x24
+	NVME_ASQ  = 0x28
+	NVME_ACQ  = 0x30
+	NVME_DBS  = 0x1000
+)
+
+const (
+	NVME_CC_EN = 1 << 0
+	// 64-byte submission and 16-byte completion queue entries
+	NVME_CC_IOSQES = 6 << 16
+	NVME_CC_IOCQES = 4 << 20
+
+	NVME_CSTS_RDY = 1 << 0
+	NVME_CSTS_CFS = 1 << 1
+)
+
+// admin commands
+const (
+	ADM_CREATE_SQ    uint8 = 0x01
+	ADM_CREATE_CQ    uint8 = 0x05
+	ADM_IDENTIFY     uint8 = 0x06
+	ADM_SET_FEATURES uint8 = 0x09
+)
+
+const (
+	IDENTIFY_NS   = 0
+	IDENTIFY_CTRL = 1
+)
+
+const FEAT_NQUEUES = 0x07
+
+// I/O commands
+const (
+	NVM_FLUSH uint8 = 0x00
+	NVM_WRITE uint8 = 0x01
+	NVM_READ  uint8 = 0x02
+)
+
+// a submission queue entry
+type cmd_t struct {
+	opc   uint8
+	flags uint8
+	cid   uint16
+	nsid  uint32
+	_     uint64
+	mptr  uint64
+	prp1  uint64
+	prp2  uint64
+	cdw10 uint32
+	cdw11 uint32
+	cdw12 uint32
+	cdw13 uint32
+	cdw14 uint32
+	cdw15 uint32
+}
+
+// the words of a completion queue entry. the last holds the command id and,
+// in its high half, the status, whose low bit is the phase.
+const (
+	cqe_dw0 = 0
+	cqe_st  = 3
+	cqelen  = 4
+)
+
+// the most entries in a queue, so that a submission queue fits in a page
+const qmax = mem.PGSIZE / 64
+
+// the number of PRP entries in a list page
+const nprp = mem.PGSIZE / 8
+
+// the disk of the first NVMe controller, if there is one
+var Disk fs.Disk_i
+
+// number of attached controllers, which name their device files
+var nctrls int
+
+// the number of CPUs, for which the driver creates I/O queues
+var ncpu int
+
+// a request, and the number of its parts not yet done
+type ioreq_t struct {
+	req  *fs.Bdev_req_t
+	left int
+}
+
+// the part of a request that one command carries: blocks that are contiguous
+// on disk, no more than the controller takes at once
+type part_t struct {
+	br   *ioreq_t
+	blks []*fs.Bdev_block_t
+}
+
+// a submission queue and its completion queue
+type queue_t struct {
+	sync.Mutex
+	id    int
+	sz    int
+	sq    *[qmax]cmd_t
+	sqpa  mem.Pa_t
+	cq    []uint32
+	cqpa  mem.Pa_t
+	sqdb  *uint32
+	cqdb  *uint32
+	tail  int
+	head  int
+	phase uint32
+	// free command ids; a queue has one fewer commands in flight than
+	// entries so that the submission queue never overflows
+	cids []int
+	// in-flight parts and, for I/O queues, their PRP list pages, by
+	// command id
+	infl   []*part_t
+	prps   []mem.Pa_t
+	queued *list.List
+}
+
+type nvme_stat_t struct {
+	Nwrite  stats.Counter_t
+	Nread   stats.Counter_t
+	Nflush  stats.Counter_t
+	Nsplit  stats.Counter_t
+	Nqueued stats.Counter_t
+	Nintr   stats.Counter_t
+	Nerr    stats.Counter_t
+}
+
+type nvme_t struct {
+	// protects nbusy and nflush
+	sync.Mutex
+	cond_flush *sync.Cond
+	tag        pci.Pcitag_t
+	regs       []uint32
+	// the doorbell stride, in bytes
+	dstrd int
+	// the time the controller may take to become ready, in nanoseconds
+	timeout int
+	adminq  *queue_t
+	qs      []*queue_t
+	nsid    uint32
+	nlbas   uint64
+	// the logical blocks in a file system block
+	lbaperblk int
+	// the most blocks in one command
+	maxblks int
+	// the controller has a volatile write cache
+	vwc bool
+	// parts queued or in flight on all queues
+	nbusy  int
+	nflush int
+	stat   nvme_stat_t
+}
+
+func (d *nvme_t) rd32(off int) uint32 {
+	return atomic.LoadUint32(&d.regs[off/4])
+}
+
+func (d *nvme_t) wr32(off int, v uint32) {
+	runtime.Store32(&d.regs[off/4], v)
+}
+
+// 64-bit registers are accessed as two 32-bit halves, the low one first
+func (d *nvme_t) rd64(off int) uint64 {
+	return uint64(d.rd32(off)) | uint64(d.rd32(off+4))<<32
+}
+
+func (d *nvme_t) wr64(off int, v uint64) {
+	d.wr32(off, uint32(v))
+	d.wr32(off+4, uint32(v>>32))
+}
+
+// returns true if start is asynchronous
+func (d *nvme_t) Start(req *fs.Bdev_req_t) bool {
+	if req.Cmd == fs.BDEV_DISCARD {
+		// no dataset management support
+		return false
+	}
+	if req.Cmd == fs.BDEV_FLUSH {
+		// a flush waits for the writes before it to finish and then
+		// flushes the controller's cache, if it has one
+		d.Lock()
+		for d.nbusy > 0 {
+			d.nflush++
+			d.cond_flush.Wait()
+			d.nflush--
+		}
+		d.stat.Nflush.Inc()
+		if !d.vwc {
+			d.Unlock()
+			return false
+		}
+		d.nbusy++
+		d.Unlock()
+		d.enqueue([]*part_t{{br: &ioreq_t{req: req, left: 1}}})
+		return true
+	}
+
+	switch req.Cmd {
+	case fs.BDEV_WRITE:
+		d.stat.Nwrite.Inc()
+	case fs.BDEV_READ:
+		d.stat.Nread.Inc()
+	}
+	br := &ioreq_t{req: req}
+	var parts []*part_t
+	var blks []*fs.Bdev_block_t
+	for blk := req.Blks.FrontBlock(); blk != nil; blk = req.Blks.NextBlock() {
+		if n := len(blks); n == d.maxblks ||
+			(n > 0 && blk.Block != blks[n-1].Block+1) {
+			parts = append(parts, &part_t{br: br, blks: blks})
+			blks = nil
+		}
+		blks = append(blks, blk)
+	}
+	if len(blks) == 0 {
+		return false
+	}
+	parts = append(parts, &part_t{br: br, blks: blks})
+	br.left = len(parts)
+	if br.left > 1 {
+		d.stat.Nsplit.Inc()
+	}
+	d.Lock()
+	d.nbusy += len(parts)
+	d.Unlock()
+	d.enqueue(parts)
+	return true
+}
+
+// queues the parts on the queue of the current CPU and issues as many as it
+// has room for. all parts of a request go to one queue.
+func (d *nvme_t) enqueue(parts []*part_t) {
+	q := d.qs[runtime.CPUHint()%len(d.qs)]
+	q.Lock()
+	defer q.Unlock()
+
+	for _, p := range parts {
+		q.queued.PushBack(p)
+	}
+	q.pump(d)
+	if q.queued.Len() > 0 {
+		d.stat.Nqueued.Inc()
+	}
+}
+
+func (d *nvme_t) Stats() string {
+	s := "nvme:" + stats.Stats2String(d.stat)
+	d.stat = nvme_stat_t{}
+	return s
+}
+
+func (d *nvme_t) Nblocks() int {
+	return int(d.nlbas / uint64(d.lbaperblk))
+}
+
+// copies c to the tail of the submission queue. the controller doesn't see
+// it until ring.
+func (q *queue_t) submit(c *cmd_t) {
+	q.sq[q.tail] = *c
+	q.tail = (q.tail + 1) % q.sz
+}
+
+func (q *queue_t) ring() {
+	runtime.Store32(q.sqdb, uint32(q.tail))
+}
+
+// returns the result, command id, and status of the next completion, if the
+// controller has posted one
+func (q *queue_t) poll() (uint32, int, uint32, bool) {
+	e := q.cq[q.head*cqelen : (q.head+1)*cqelen]
+	st := atomic.LoadUint32(&e[cqe_st])
+	if (st>>16)&1 != q.phase {
+		return 0, 0, 0, false
+	}
+	dw0 := e[cqe_dw0]
+	q.head++
+	if q.head == q.sz {
+		q.head = 0
+		q.phase ^= 1
+	}
+	return dw0, int(st & 0xffff), st >> 17, true
+}
+
+// tells the controller that the completions so far have been consumed
+func (q *queue_t) cqack() {
+	runtime.Store32(q.cqdb, uint32(q.head))
+}
+
+// issues queued parts, in order, while the queue has room for them
+func (q *queue_t) pump(d *nvme_t) {
+	did := false
+	for q.queued.Len() > 0 && len(q.cids) > 0 {
+		e := q.queued.Front()
+		q.queued.Remove(e)
+		q.issue(d, e.Value.(*part_t))
+		did = true
+	}
+	if did {
+		q.ring()
+	}
+}
+
+func (q *queue_t) issue(d *nvme_t, p *part_t) {
+	cid := q.cids[len(q.cids)-1]
+	q.cids = q.cids[:len(q.cids)-1]
+
+	c := &cmd_t{cid: uint16(cid), nsid: d.nsid}
+	switch p.br.req.Cmd {
+	case fs.BDEV_WRITE:
+		c.opc = NVM_WRITE
+	case fs.BDEV_READ:
+		c.opc = NVM_READ
+	case fs.BDEV_FLUSH:
+		c.opc = NVM_FLUSH
+	}
+	if n := len(p.blks); n > 0 {
+		lba := uint64(p.blks[0].Block) * uint64(d.lbaperblk)
+		c.cdw10 = uint32(lba)
+		c.cdw11 = uint32(lba >> 32)
+		c.cdw12 = uint32(n*d.lbaperblk - 1)
+		var l *[nprp]uint64
+		if n > 2 {
+			l = (*[nprp]uint64)(unsafe.Pointer(mem.Physmem.Dmap(q.prps[cid])))
+		}
+		c.setprp(p.blks, l, q.prps[cid])
+	}
+	q.infl[cid] = p
+	q.submit(c)
+	dbg("nvme: q%v issued %v lba %v n %v cid %v\n", q.id, c.opc,
+		uint64(c.cdw11)<<32|uint64(c.cdw10), len(p.blks), cid)
+}
+
+// points c at the pages of blks. the first goes in prp1; the second goes in
+// prp2 if there are only two, and otherwise the rest go in the PRP list l,
+// whose page is at lpa.
+func (c *cmd_t) setprp(blks []*fs.Bdev_block_t, l *[nprp]uint64, lpa mem.Pa_t) {
+	if len(blks) > nprp {
+		panic("nvme: too many blocks for a PRP list")
+	}
+	c.prp1 = uint64(blks[0].Pa)
+	if len(blks) == 2 {
+		c.prp2 = uint64(blks[1].Pa)
+	} else if len(blks) > 2 {
+		for i, blk := range blks[1:] {
+			l[i] = uint64(blk.Pa)
+		}
+		c.prp2 = uint64(lpa)
+	}
+}
+
+// finishes req once all of its parts are done
+func done(req *fs.Bdev_req_t) {
+	if req.Cmd == fs.BDEV_WRITE {
+		// page has been written, don't need a reference to it
+		// and can be removed from cache.
+		req.Blks.Apply(func(blk *fs.Bdev_block_t) {
+			blk.Done("interrupt")
+		})
+	}
+	if req.Sync {
+		// writing to channel while holding the lock, but should be ok
+		req.AckCh <- true
+	}
+}
+
+// handles the queue's completions, returning the number of parts done
+func (q *queue_t) intr(d *nvme_t) int {
+	q.Lock()
+	defer q.Unlock()
+
+	n := 0
+	for {
+		_, cid, st, ok := q.poll()
+		if !ok {
+			break
+		}
+		p := q.infl[cid]
+		if p == nil {
+			panic("nvme: spurious completion")
+		}
+		q.infl[cid] = nil
+		q.cids = append(q.cids, cid)
+		if st != 0 {
+			d.stat.Nerr.Inc()
+			p.br.req.Err = -defs.EIO
+			blk := -1
+			if len(p.blks) > 0 {
+				blk = p.blks[0].Block
+			}
+			fmt.Printf("nvme: command %v block %v failed: %#x\n",
+				p.br.req.Cmd, blk, st)
+		}
+		n++
+		p.br.left--
+		if p.br.left == 0 {
+			done(p.br.req)
+		}
+	}
+	if n > 0 {
+		q.cqack()
+		q.pump(d)
+	}
+	return n
+}
+
+func (d *nvme_t) intr() {
+	d.stat.Nintr.Inc()
+	n := 0
+	for _, q := range d.qs {
+		n += q.intr(d)
+	}
+	d.Lock()
+	d.nbusy -= n
+	if d.nflush > 0 && d.nbusy == 0 {
+		d.cond_flush.Broadcast()
+	}
+	d.Unlock()
+}
+
+// Go routine for handling interrupts
+func (d *nvme_t) int_handler(vec msi.Msivec_t) {
+	for {
+		runtime.IRQsched(uint(vec))
+		d.intr()
+	}
+}
+
+func pg_new() mem.Pa_t {
+	_, pa, ok := mem.Physmem.Refpg_new()
+	if !ok {
+		panic("oom during nvme attach")
+	}
+	mem.Physmem.Refup(pa)
+	return pa
+}
+
+func (d *nvme_t) mkQueue(id, sz int) *queue_t {
+	q := &queue_t{id: id, sz: sz, phase: 1}
+	q.sqpa = pg_new()
+	q.sq = (*[qmax]cmd_t)(unsafe.Pointer(mem.Physmem.Dmap(q.sqpa)))
+	q.cqpa = pg_new()
+	q.cq = mem.Dmaplen32(uintptr(q.cqpa), sz*cqelen*4)
+	q.sqdb = &d.regs[(NVME_DBS+2*id*d.dstrd)/4]
+	q.cqdb = &d.regs[(NVME_DBS+(2*id+1)*d.dstrd)/4]
+	for i := sz - 2; i >= 0; i-- {
+		q.cids = append(q.cids, i)
+	}
+	q.infl = make([]*part_t, sz)
+	// allocate the PRP list pages now, since the I/O path cannot fail
+	// a request for want of memory. the admin queue doesn't use them.
+	q.prps = make([]mem.Pa_t, sz)
+	if id != 0 {
+		for _, cid := range q.cids {
+			q.prps[cid] = pg_new()
+		}
+	}
+	q.queued = list.New()
+	return q
+}
+
+// waits for the controller's ready bit to become rdy. returns false if it
+// doesn't in time or the controller reports a fatal error.
+func (d *nvme_t) waitrdy(rdy bool) bool {
+	want := uint32(0)
+	if rdy {
+		want = NVME_CSTS_RDY
+	}
+	deadline := runtime.Nanotime() + d.timeout
+	for {
+		st := d.rd32(NVME_CSTS)
+		if st == 0xffffffff || st&NVME_CSTS_CFS != 0 {
+			return false
+		}
+		if st&NVME_CSTS_RDY == want {
+			return true
+		}
+		if runtime.Nanotime() > deadline {
+			return false
+		}
+	}
+}
+
+// submits the admin command c and polls for its completion, returning the
+// command's result and status. -1 is the status of a command that timed out.
+func (d *nvme_t) admin(c *cmd_t) (uint32, int) {
+	q := d.adminq
+	q.Lock()
+	defer q.Unlock()
+
+	q.submit(c)
+	q.ring()
+	deadline := runtime.Nanotime() + d.timeout
+	for {
+		if dw0, _, st, ok := q.poll(); ok {
+			q.cqack()
+			return dw0, int(st)
+		}
+		if runtime.Nanotime() > deadline {
+			return 0, -1
+		}
+	}
+}
+
+// fetches the identify data structure cns for namespace nsid to a new page
+func (d *nvme_t) identify(cns int, nsid uint32) ([]uint8, bool) {
+	pa := pg_new()
+	c := &cmd_t{opc: ADM_IDENTIFY, nsid: nsid, prp1: uint64(pa),
+		cdw10: uint32(cns)}
+	if _, st := d.admin(c); st != 0 {
+		fmt.Printf("nvme: identify %v failed: %#x\n", cns, st)
+		return nil, false
+	}
+	return mem.Dmaplen(pa, mem.PGSIZE), true
+}
+
+// creates I/O queue pairs, one per CPU if the controller has that many.
+// returns false if it creates none.
+func (d *nvme_t) mkioqs(sz int) bool {
+	want := ncpu
+	if want < 1 {
+		want = 1
+	}
+	// the doorbells of the admin queue and the I/O queues must be in the
+	// BAR
+	if ndb := (len(d.regs)*4-NVME_DBS)/(2*d.dstrd) - 1; ndb < want {
+		want = ndb
+	}
+	c := &cmd_t{opc: ADM_SET_FEATURES, cdw10: FEAT_NQUEUES,
+		cdw11: uint32((want-1)<<16 | (want - 1))}
+	dw0, st := d.admin(c)
+	if st != 0 {
+		fmt.Printf("nvme: set number of queues failed: %#x\n", st)
+		return false
+	}
+	if nsq := int(dw0&0xffff) + 1; nsq < want {
+		want = nsq
+	}
+	if ncq := int(dw0>>16) + 1; ncq < want {
+		want = ncq
+	}
+	for id := 1; id <= want; id++ {
+		q := d.mkQueue(id, sz)
+		// physically contiguous, interrupts enabled, vector 0
+		c := &cmd_t{opc: ADM_CREATE_CQ, prp1: uint64(q.cqpa),
+			cdw10: uint32((sz-1)<<16 | id), cdw11: 1<<1 | 1}
+		if _, st := d.admin(c); st != 0 {
+			fmt.Printf("nvme: create completion queue %v failed: %#x\n",
+				id, st)
+			break
+		}
+		c = &cmd_t{opc: ADM_CREATE_SQ, prp1: uint64(q.sqpa),
+			cdw10: uint32((sz-1)<<16 | id), cdw11: uint32(id<<16 | 1)}
+		if _, st := d.admin(c); st != 0 {
+			fmt.Printf("nvme: create submission queue %v failed: %#x\n",
+				id, st)
+			break
+		}
+		d.qs = append(d.qs, q)
+	}
+	return len(d.qs) != 0
+}
+
+func attach_nvme(vid, did int, t pci.Pcitag_t) {
+	bus, dev, fnc := pci.Breakpcitag(t)
+	name := fmt.Sprintf("rnvme%dc", nctrls)
+	min := fs.Rawdisk_minor(name)
+	if min < 0 {
+		fmt.Printf("nvme: ignoring another controller (%v:%v:%v)\n", bus,
+			dev, fnc)
+		return
+	}
+
+	// enable memory decoding and bus mastering; disable legacy interrupts
+	cmd := pci.Pci_read(t, 0x4, 2)
+	cmd |= 0x6
+	cmd |= 1 << 10
+	pci.Pci_write(t, 0x4, cmd)
+
+	bar, blen := pci.Pci_bar_mem(t, 0)
+	d := &nvme_t{tag: t, regs: mem.Dmaplen32(bar, blen)}
+	d.cond_flush = sync.NewCond(d)
+	caps := d.rd64(NVME_CAP)
+	if (caps>>37)&1 == 0 {
+		fmt.Printf("nvme: no NVM command set\n")
+		return
+	}
+	if (caps>>48)&0xf != 0 {
+		fmt.Printf("nvme: no 4KB pages\n")
+		return
+	}
+	d.dstrd = 4 << ((caps >> 32) & 0xf)
+	d.timeout = int((caps>>24)&0xff+1) * 500e6
+	sz := int(caps&0xffff) + 1
+	if sz > qmax {
+		sz = qmax
+	}
+
+	// reset the controller and give it the admin queue
+	d.wr32(NVME_CC, 0)
+	if !d.waitrdy(false) {
+		fmt.Printf("nvme: reset failed\n")
+		return
+	}
+	d.adminq = d.mkQueue(0, sz)
+	d.wr32(NVME_AQA, uint32((sz-1)<<16|(sz-1)))
+	d.wr64(NVME_ASQ, uint64(d.adminq.sqpa))
+	d.wr64(NVME_ACQ, uint64(d.adminq.cqpa))
+	d.wr32(NVME_CC, NVME_CC_IOCQES|NVME_CC_IOSQES|NVME_CC_EN)
+	if !d.waitrdy(true) {
+		fmt.Printf("nvme: enable failed\n")
+		return
+	}
+
+	vec, _, ok := pci.Pci_msi_attach(t)
+	if !ok {
+		fmt.Printf("nvme: no MSI\n")
+		return
+	}
+
+	ctrl, ok := d.identify(IDENTIFY_CTRL, 0)
+	if !ok {
+		return
+	}
+	model := strings.TrimSpace(string(ctrl[24:64]))
+	d.vwc = ctrl[525]&1 != 0
+	// mdts is a power of two of the minimum page size; a PRP list page
+	// also bounds a command's pages
+	d.maxblks = nprp
+	if mdts := ctrl[77]; mdts != 0 && mdts < 9 {
+		d.maxblks = 1 << mdts
+	}
+
+	d.nsid = 1
+	ns, ok := d.identify(IDENTIFY_NS, d.nsid)
+	if !ok {
+		return
+	}
+	for i := 0; i < 8; i++ {
+		d.nlbas |= uint64(ns[i]) << (8 * uint(i))
+	}
+	lbaf := 128 + 4*int(ns[26]&0xf)
+	lbads := uint(ns[lbaf+2])
+	if d.nlbas == 0 || lbads < 9 || 1<<lbads > fs.BSIZE {
+		fmt.Printf("nvme: unusable namespace %v (%v blocks of 2^%v)\n",
+			d.nsid, d.nlbas, lbads)
+		return
+	}
+	d.lbaperblk = fs.BSIZE >> lbads
+
+	if !d.mkioqs(sz) {
+		return
+	}
+
+	go d.int_handler(vec)
+	if Disk == nil {
+		Disk = d
+	}
+	nctrls++
+
+	vs := d.rd32(NVME_VS)
+	fmt.Printf("NVMe %v %x %x (%v:%v:%v), %v, v%v.%v, %v MB, %v queues of %v,"+
+		" MSI %v\n", name, vid, did, bus, dev, fnc, model, vs>>16,
+		(vs>>8)&0xff, d.nlbas<<lbads>>20, len(d.qs), sz, vec)
+
+	if err := devfs.Register(name, defs.D_RAWDISK, min); err != 0 {
+		fmt.Printf("nvme: no device file: %v\n", err)
+	}
+	if err := fs.Disk_attach(name, d); err != 0 {
+		fmt.Printf("nvme: cannot attach disk: %v\n", err)
+	}
+}
+
+func nvme_verify() {
+	if unsafe.Sizeof(cmd_t{}) != 64 {
+		panic("cmd_t padded?")
+	}
+}
+
+// Nvme_init registers the NVMe driver, which creates I/O queues for n CPUs;
+// call it before the PCI bus is attached
+func Nvme_init(n int) {
+	nvme_verify()
+	ncpu = n
+	pci.Pci_register_class(PCI_CLASS_STORAGE, PCI_SUBCLASS_NVM,
+		PCI_PROGIF_NVME, attach_nvme)
+}
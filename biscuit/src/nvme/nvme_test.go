@@ -0,0 +1,79 @@
+package nvme
+
+import "testing"
+import "unsafe"
+
+import "fs"
+import "mem"
+
+func mkblks(n int) []*fs.Bdev_block_t {
+	blks := make([]*fs.Bdev_block_t, n)
+	for i := range blks {
+		// scattered pages, as the block cache hands them out
+		pa := mem.Pa_t((7*i + 3) * mem.PGSIZE)
+		blks[i] = &fs.Bdev_block_t{Block: 100 + i, Pa: pa}
+	}
+	return blks
+}
+
+// checks the PRP entries of commands of one, two, several, and the most
+// blocks a command takes
+func TestPrp(t *testing.T) {
+	if unsafe.Sizeof(cmd_t{}) != 64 {
+		t.Fatalf("cmd_t padded")
+	}
+	const lpa = mem.Pa_t(0x123000)
+	for _, n := range []int{1, 2, 3, 4, nprp - 1, nprp} {
+		blks := mkblks(n)
+		var l [nprp]uint64
+		for i := range l {
+			l[i] = 0xdead
+		}
+		c := &cmd_t{}
+		c.setprp(blks, &l, lpa)
+		if c.prp1 != uint64(blks[0].Pa) {
+			t.Fatalf("%v blocks: prp1 %#x", n, c.prp1)
+		}
+		nlist := 0
+		switch {
+		case n == 1:
+			if c.prp2 != 0 {
+				t.Fatalf("one block: prp2 %#x", c.prp2)
+			}
+		case n == 2:
+			if c.prp2 != uint64(blks[1].Pa) {
+				t.Fatalf("two blocks: prp2 %#x", c.prp2)
+			}
+		default:
+			if c.prp2 != uint64(lpa) {
+				t.Fatalf("%v blocks: prp2 %#x is not the list",
+					n, c.prp2)
+			}
+			nlist = n - 1
+			for i := 0; i < nlist; i++ {
+				if l[i] != uint64(blks[i+1].Pa) {
+					t.Fatalf("%v blocks: entry %v is %#x", n,
+						i, l[i])
+				}
+			}
+		}
+		for i := nlist; i < nprp; i++ {
+			if l[i] != 0xdead {
+				t.Fatalf("%v blocks: wrote entry %v", n, i)
+			}
+		}
+	}
+}
+
+// a command with more blocks than a list page holds would need a chained
+// list, which the driver never builds
+func TestPrpTooMany(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("no panic")
+		}
+	}()
+	var l [nprp]uint64
+	c := &cmd_t{}
+	c.setprp(mkblks(nprp+1), &l, 0x1000)
+}
@@ -3,8 +3,10 @@ package pci
 import "fmt"
 import "runtime"
 
+import "apic"
 import "defs"
 import "mem"
+import "msi"
 
 var IRQ_DISK int = -1
 var INT_DISK int = -1
@@ -16,6 +18,7 @@ const (
 	VENDOR   int = 0x0
 	DEVICE       = 0x02
 	STATUS       = 0x06
+	PROGIF       = 0x09
 	CLASS        = 0x0b
 	SUBCLASS     = 0x0a
 	HEADER       = 0x0e
@@ -25,6 +28,7 @@ const (
 	_BAR3        = 0x1c
 	_BAR4        = 0x20
 	BAR5         = 0x24
+	CAPPTR       = 0x34
 )
 
 // width is width of the register in bytes
@@ -63,7 +67,7 @@ func Pci_write(tag Pcitag_t, reg, val int) {
 }
 
 // don't forget to enable busmaster in pci command reg before attaching
-func pci_bar_pio(tag Pcitag_t, barn int) uintptr {
+func Pci_bar_pio(tag Pcitag_t, barn int) uintptr {
 	if barn < 0 || barn > 4 {
 		panic("bad bar #")
 	}
@@ -75,6 +79,79 @@ func pci_bar_pio(tag Pcitag_t, barn int) uintptr {
 	return uintptr(ret &^ 0x3)
 }
 
+// capability ids
+const (
+	PCI_CAP_MSI    = 0x05
+	PCI_CAP_VENDOR = 0x09
+	PCI_CAP_MSIX   = 0x11
+)
+
+// returns the config space offsets of the device's capabilities with the
+// given id, in list order
+func Pci_caps(tag Pcitag_t, id int) []int {
+	var ret []int
+	capslist := 1 << 4
+	if Pci_read(tag, STATUS, 2)&capslist == 0 {
+		return ret
+	}
+	// bound the walk in case of a looping list
+	c := Pci_read(tag, CAPPTR, 1) &^ 0x3
+	for i := 0; c != 0 && i < 48; i++ {
+		if Pci_read(tag, c, 1) == id {
+			ret = append(ret, c)
+		}
+		c = Pci_read(tag, c+1, 1) &^ 0x3
+	}
+	return ret
+}
+
+// routes the device's interrupts to a new vector, through MSI-X entry 0 if the
+// device has MSI-X and through MSI otherwise. returns the vector and whether
+// MSI-X is used, or false if the device has neither.
+func Pci_msi_attach(tag Pcitag_t) (msi.Msivec_t, bool, bool) {
+	msix := Pci_caps(tag, PCI_CAP_MSIX)
+	msicap := Pci_caps(tag, PCI_CAP_MSI)
+	if len(msix) == 0 && len(msicap) == 0 {
+		return 0, false, false
+	}
+	vec := msi.Msi_alloc()
+	// non-remapped interrupts to the BSP, with fixed delivery and edge
+	// trigger
+	maddr := 0xfee<<20 | apic.Bsp_apic_id<<12
+	mdata := int(vec)
+	if len(msix) != 0 {
+		c := msix[0]
+		tbl := Pci_read(tag, c+4, 4)
+		bar := tbl & 0x7
+		base, _ := Pci_bar_mem(tag, bar)
+		ent := mem.Dmaplen32(base+uintptr(tbl&^0x7), 16)
+		runtime.Store32(&ent[0], uint32(maddr))
+		runtime.Store32(&ent[1], 0)
+		runtime.Store32(&ent[2], uint32(mdata))
+		// unmask the entry
+		runtime.Store32(&ent[3], 0)
+		msixen := 1 << 31
+		fnmask := 1 << 30
+		ctl := Pci_read(tag, c, 4)
+		Pci_write(tag, c, (ctl|msixen)&^fnmask)
+		return vec, true, true
+	}
+	c := msicap[0]
+	ctl := Pci_read(tag, c, 4)
+	is64 := 1 << 23
+	Pci_write(tag, c+4, maddr)
+	data := c + 8
+	if ctl&is64 != 0 {
+		Pci_write(tag, c+8, 0)
+		data = c + 12
+	}
+	Pci_write(tag, data, mdata)
+	// one message only
+	msienable := 1 << 16
+	Pci_write(tag, c, (ctl&^(0x7<<20))|msienable)
+	return vec, false, true
+}
+
 // some memory bars include size in the low bits; this method doesn't mask such
 // bits out.
 func Pci_bar_mem(tag Pcitag_t, barn int) (uintptr, int) {
@@ -208,17 +285,28 @@ func Pci_register_intel(dev int, attach func(int, int, Pcitag_t)) {
 	Pci_register(PCI_VEND_INTEL, dev, attach)
 }
 
+// map from class, subclass, and programming interface to attach functions,
+// for devices that any vendor may make
+var allclasses = map[int]func(int, int, Pcitag_t){}
+
+// registers attach for the devices of the class, subclass, and programming
+// interface that no driver claims by vendor and device id
+func Pci_register_class(class, subclass, progif int,
+	attach func(int, int, Pcitag_t)) {
+	allclasses[class<<16|subclass<<8|progif] = attach
+}
+
 func pci_attach(vendorid, devid, bus, dev, fu int) {
 	tag := mkpcitag(bus, dev, fu)
-	devs, ok := alldevs[vendorid]
-	if !ok {
+	if attach, ok := alldevs[vendorid][devid]; ok {
+		attach(vendorid, devid, tag)
 		return
 	}
-	attach, ok := devs[devid]
-	if !ok {
-		return
+	class := Pci_read(tag, CLASS, 1)<<16 | Pci_read(tag, SUBCLASS, 1)<<8 |
+		Pci_read(tag, PROGIF, 1)
+	if attach, ok := allclasses[class]; ok {
+		attach(vendorid, devid, tag)
 	}
-	attach(vendorid, devid, tag)
 }
 
 type Pcitag_t uint
@@ -23,9 +23,9 @@ func attach_3400(vendorid, devid int, tag Pcitag_t) {
 
 	d := &pciide_disk_t{}
 	// 3400's PCI-native IDE command/control block
-	rbase := pci_bar_pio(tag, 0)
-	allstats := pci_bar_pio(tag, 1)
-	busmaster := pci_bar_pio(tag, 4)
+	rbase := Pci_bar_pio(tag, 0)
+	allstats := Pci_bar_pio(tag, 1)
+	busmaster := Pci_bar_pio(tag, 4)
 
 	d.init(rbase, allstats, busmaster)
 	Disk = d
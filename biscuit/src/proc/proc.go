@@ -652,6 +652,7 @@ func (p *Proc_t) terminate() {
 		if p.Fds[i] == nil {
 			continue
 		}
+		fd.Unlock(p.Fds[i], p.Pid)
 		fd.Close_panic(p.Fds[i])
 	}
 	p.Fdl.Unlock()
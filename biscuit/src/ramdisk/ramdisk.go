@@ -0,0 +1,124 @@
+package ramdisk
+
+import "fmt"
+import "sync"
+
+import "defs"
+import "devfs"
+import "fs"
+import "mem"
+
+// A disk in physical memory. It completes requests synchronously, so the file
+// system on it runs without device latency. Its contents are lost at reboot;
+// Copy fills it from another disk.
+
+type Ramdisk_t struct {
+	// serializes copies in and out of the pages
+	sync.Mutex
+	bm  fs.Blockmem_i
+	pas []mem.Pa_t
+	pgs []*mem.Bytepg_t
+}
+
+// the RAM disk, if any
+var Disk *Ramdisk_t
+
+// Ramdisk_init allocates a RAM disk of mb megabytes from bm and attaches it as
+// rram0c
+func Ramdisk_init(mb int, bm fs.Blockmem_i) {
+	if mb <= 0 {
+		return
+	}
+	d, ok := MkRamdisk(mb<<20/fs.BSIZE, bm)
+	if !ok {
+		fmt.Printf("RAM disk: no memory for %v MB\n", mb)
+		return
+	}
+	Disk = d
+	if err := devfs.Register("rram0c", defs.D_RAWDISK, 3); err != 0 {
+		fmt.Printf("RAM disk: no device file: %v\n", err)
+	}
+	if err := fs.Disk_attach("rram0c", d); err != 0 {
+		fmt.Printf("RAM disk: cannot attach disk: %v\n", err)
+	}
+	fmt.Printf("RAM disk: %v MB\n", mb)
+}
+
+// MkRamdisk allocates a RAM disk of n blocks from bm, which hands out zeroed
+// pages
+func MkRamdisk(n int, bm fs.Blockmem_i) (*Ramdisk_t, bool) {
+	d := &Ramdisk_t{bm: bm, pas: make([]mem.Pa_t, 0, n),
+		pgs: make([]*mem.Bytepg_t, 0, n)}
+	for i := 0; i < n; i++ {
+		pa, pg, ok := bm.Alloc()
+		if !ok {
+			d.free()
+			return nil, false
+		}
+		d.pas = append(d.pas, pa)
+		d.pgs = append(d.pgs, pg)
+	}
+	return d, true
+}
+
+func (d *Ramdisk_t) free() {
+	for _, pa := range d.pas {
+		d.bm.Free(pa)
+	}
+	d.pas = nil
+	d.pgs = nil
+}
+
+// page returns the page of block, which must be on the disk
+func (d *Ramdisk_t) page(block int) *mem.Bytepg_t {
+	return d.pgs[block]
+}
+
+func (d *Ramdisk_t) Start(req *fs.Bdev_req_t) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if !req.Inside(len(d.pgs)) {
+		fmt.Printf("RAM disk: request outside of disk\n")
+		return req.Fail(-defs.EIO)
+	}
+	switch req.Cmd {
+	case fs.BDEV_READ:
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			*b.Data = *d.page(b.Block)
+		}
+	case fs.BDEV_WRITE:
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			*d.page(b.Block) = *b.Data
+			b.Done("ramdisk")
+		}
+	case fs.BDEV_FLUSH, fs.BDEV_DISCARD:
+	}
+	// the request is complete
+	return false
+}
+
+func (d *Ramdisk_t) Stats() string {
+	return ""
+}
+
+func (d *Ramdisk_t) Nblocks() int {
+	return len(d.pgs)
+}
+
+// Copy fills d with the contents of the disk src, which must fit in d
+func (d *Ramdisk_t) Copy(src fs.Disk_i, bm fs.Blockmem_i) defs.Err_t {
+	n := src.Nblocks()
+	if n > d.Nblocks() {
+		return -defs.ENOSPC
+	}
+	for i := 0; i < n; i++ {
+		b := fs.MkBlock_newpage(i, "ramcopy", bm, src, nil)
+		b.Read()
+		d.Lock()
+		*d.page(i) = *b.Data
+		d.Unlock()
+		b.Free_page()
+	}
+	return 0
+}
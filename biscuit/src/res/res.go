@@ -29,6 +29,7 @@ var Resfail = caller.Distinct_caller_t{
 	Whitel: map[string]bool{
 		// XXX these need to be fixed to handle ENOHEAP
 		"fs.(*Fs_t).Fs_rename":      true,
+		"fs.(*Fs_t).Fs_renameat":    true,
 		"main.(*susfops_t)._fdrecv": true,
 	},
 }
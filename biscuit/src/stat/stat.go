@@ -14,6 +14,13 @@ type Stat_t struct {
 	_m_nsec uint
 }
 
+// the file type bits of the mode, as in litc.h
+const (
+	S_IFMT  uint = 0xffff0000
+	S_IFREG uint = 1 << 16
+	S_IFDIR uint = 2 << 16
+)
+
 func (st *Stat_t) Wdev(v uint) {
 	st._dev = v
 }
@@ -34,6 +41,11 @@ func (st *Stat_t) Wrdev(v uint) {
 	st._rdev = v
 }
 
+// in units of 512 bytes
+func (st *Stat_t) Wblocks(v uint) {
+	st._blocks = v
+}
+
 func (st *Stat_t) Mode() uint {
 	return st._mode
 }
@@ -46,6 +58,10 @@ func (st *Stat_t) Rdev() uint {
 	return st._rdev
 }
 
+func (st *Stat_t) Blocks() uint {
+	return st._blocks
+}
+
 func (st *Stat_t) Rino() uint {
 	return st._ino
 }
@@ -31,6 +31,13 @@ func (c *Counter_t) Inc() {
 	}
 }
 
+func (c *Counter_t) Add(m int64) {
+	if Stats {
+		n := (*int64)(unsafe.Pointer(c))
+		atomic.AddInt64(n, m)
+	}
+}
+
 func (c *Cycles_t) Add(m uint64) {
 	if Timing {
 		n := (*int64)(unsafe.Pointer(c))
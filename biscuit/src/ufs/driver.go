@@ -2,6 +2,7 @@ package ufs
 
 import "os"
 import "sync"
+import "syscall"
 
 import "defs"
 import "fdops"
@@ -16,6 +17,8 @@ type ahci_disk_t struct {
 	sync.Mutex
 	f *os.File
 	t *tracef_t
+	// the number of blocks discarded
+	ndiscard int
 }
 
 func (ahci *ahci_disk_t) StartTrace() {
@@ -45,7 +48,11 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 		if n != fs.BSIZE || err != nil {
 			panic(err)
 		}
-		blk.Data = &mem.Bytepg_t{}
+		// a partition hands the disk a copy of the block that shares
+		// the original's page
+		if blk.Data == nil {
+			blk.Data = &mem.Bytepg_t{}
+		}
 		for i, _ := range b {
 			blk.Data[i] = uint8(b[i])
 		}
@@ -70,14 +77,41 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 		if ahci.t != nil {
 			ahci.t.sync()
 		}
+	case fs.BDEV_DISCARD:
+		// punch holes, so that the file system breaks if it discards
+		// blocks it still uses
+		for _, r := range req.Runs {
+			err := syscall.Fallocate(int(ahci.f.Fd()),
+				defs.FALLOC_FL_PUNCH_HOLE|defs.FALLOC_FL_KEEP_SIZE,
+				int64(r.Block*fs.BSIZE), int64(r.N*fs.BSIZE))
+			if err != nil {
+				panic(err)
+			}
+			ahci.ndiscard += r.N
+		}
 	}
 	return false
 }
 
+// discarded returns the number of blocks discarded so far
+func (ahci *ahci_disk_t) discarded() int {
+	ahci.Lock()
+	defer ahci.Unlock()
+	return ahci.ndiscard
+}
+
 func (ahci *ahci_disk_t) Stats() string {
 	return ""
 }
 
+func (ahci *ahci_disk_t) Nblocks() int {
+	fi, err := ahci.f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	return int(fi.Size() / fs.BSIZE)
+}
+
 func (ahci *ahci_disk_t) close() {
 	if ahci.t != nil {
 		ahci.t.close()
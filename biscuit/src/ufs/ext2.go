@@ -0,0 +1,95 @@
+package ufs
+
+import "defs"
+import "fd"
+import "fs"
+import "stat"
+import "ustr"
+import "vm"
+
+//
+// read-only ext2 file system on an image made by the host's tools
+//
+
+type Ext2fs_t struct {
+	ahci *ahci_disk_t
+	fs   *fs.Ext2_t
+	cwd  *fd.Cwd_t
+}
+
+func BootExt2(dst string) (*Ext2fs_t, defs.Err_t) {
+	e := &Ext2fs_t{}
+	e.ahci = openDisk(dst)
+	efs, err := fs.MkExt2(blockmem, e.ahci)
+	if err != 0 {
+		e.ahci.close()
+		return nil, err
+	}
+	e.fs = efs
+	e.cwd = e.fs.MkRootCwd()
+	return e, 0
+}
+
+func (e *Ext2fs_t) Stat(p ustr.Ustr) (*stat.Stat_t, defs.Err_t) {
+	s := &stat.Stat_t{}
+	err := e.fs.Fs_stat(p, s, e.cwd)
+	if err != 0 {
+		return nil, err
+	}
+	return s, err
+}
+
+// reads the whole file or directory at p
+func (e *Ext2fs_t) Read(p ustr.Ustr) ([]byte, defs.Err_t) {
+	fd, err := e.fs.Fs_open(p, defs.O_RDONLY, 0, e.cwd, 0, 0)
+	if err != 0 {
+		return nil, err
+	}
+	var v []byte
+	hdata := make([]uint8, 3*fs.BSIZE)
+	for {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(hdata)
+		n, err := fd.Fops.Read(ub)
+		if err != 0 {
+			fd.Fops.Close()
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		v = append(v, hdata[:n]...)
+	}
+	fd.Fops.Close()
+	return v, 0
+}
+
+func (e *Ext2fs_t) Ls(p ustr.Ustr) (map[string]*stat.Stat_t, defs.Err_t) {
+	res := make(map[string]*stat.Stat_t, 100)
+	d, err := e.Read(p)
+	if err != 0 {
+		return nil, err
+	}
+	for i := 0; i < len(d)/fs.BSIZE; i++ {
+		dd := fs.Dirdata_t{d[i*fs.BSIZE:]}
+		for j := 0; j < fs.NDIRENTS; j++ {
+			tfn := dd.Filename(j)
+			if len(tfn) > 0 {
+				st, err := e.Stat(p.Extend(tfn))
+				if err != 0 {
+					return nil, err
+				}
+				res[string(tfn)] = st
+			}
+		}
+	}
+	return res, 0
+}
+
+func ShutdownExt2(e *Ext2fs_t) defs.Err_t {
+	if err := e.fs.Fs_unmount(); err != 0 {
+		return err
+	}
+	e.ahci.close()
+	return 0
+}
@@ -0,0 +1,11 @@
+package ufs
+
+import "fs"
+
+// Fsck checks the file system on the disk image dst, and repairs it if repair
+// is true
+func Fsck(dst string, repair bool) *fs.Fsck_t {
+	d := openDisk(dst)
+	defer d.close()
+	return fs.Fsck(blockmem, d, repair)
+}
@@ -1,8 +1,10 @@
 package ufs
 
+import "io"
 import "os"
 import "fmt"
 
+import "defs"
 import "fs"
 import "mem"
 import "ustr"
@@ -18,12 +20,19 @@ import "util"
 // log blocks
 // orphan map
 // inode map
+// reference map
 // block map
 // inode blocks
 // data blocks
+//
+// a file system grown after mkfs (see fs.Fs_grow) has groups of maps and inode
+// blocks among its data blocks.
+//
+// the superblock, the maps, the inode blocks, and directory blocks end with a
+// checksum (see fs.Cksum_set).
 
 const (
-	nbitsperblock = fs.BSIZE * 8
+	nbitsperblock = (fs.BSIZE - fs.CKSUMLEN) * 8
 )
 
 func bytepg2byte(d *mem.Bytepg_t) []byte {
@@ -46,6 +55,12 @@ func mkBlock() []byte {
 	return make([]byte, fs.BSIZE)
 }
 
+// writes the metadata block d with its checksum
+func writeMeta(f *os.File, d []byte) {
+	fs.Cksum_set(d)
+	f.Write(d)
+}
+
 func writeBootBlock(f *os.File, superb int) {
 	d := &mem.Bytepg_t{}
 	util.Writen(d[:], 4, fs.FSOFF, superb)
@@ -58,23 +73,27 @@ func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks int)
 	}
 	d := &mem.Bytepg_t{}
 	sb := fs.Superblock_t{d}
+	sb.SetVersion(fs.FSVERSION)
 	sb.SetLoglen(nlogblks)
-	ninode := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	ninode := ninodeblks * fs.IPERBLK
 	ni := ninode/nbitsperblock + 1
 	sb.SetIorphanblock(start + 1 + nlogblks)
 	sb.SetIorphanlen(ni)
 	sb.SetImaplen(ni)
-	sb.SetFreeblock(start + 1 + nlogblks + 2*ni)
+	rblock := ndatablks/fs.REFPERBLK + 1
+	sb.SetRefmapblock(start + 1 + nlogblks + 2*ni)
+	sb.SetRefmaplen(rblock)
+	sb.SetFreeblock(start + 1 + nlogblks + 2*ni + rblock)
 	bblock := ndatablks/nbitsperblock + 1
 	sb.SetFreeblocklen(bblock)
 	sb.SetInodelen(ninodeblks)
-	sb.SetLastblock(start + 1 + nlogblks + 2*ni + bblock + ninodeblks + ndatablks)
-	f.Write(bytepg2byte(sb.Data))
+	sb.SetLastblock(start + 1 + nlogblks + 2*ni + rblock + bblock + ninodeblks + ndatablks)
+	writeMeta(f, sb.Data[:])
 	return &sb
 }
 
 func markAllocated(d []byte, startbit int) {
-	for i := (startbit / 8) + 1; i < fs.BSIZE; i++ {
+	for i := (startbit / 8) + 1; i < nbitsperblock/8; i++ {
 		d[i] = byte(0xff)
 	}
 	rem := startbit % 8
@@ -94,21 +113,21 @@ func writeInodeMap(f *os.File, sb *fs.Superblock_t, ninodeblks int) {
 	if Tell(f) != sb.Iorphanblock()+sb.Iorphanlen() {
 		panic("incorrect inode map start\n")
 	}
-	ninode := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	ninode := ninodeblks * fs.IPERBLK
 	oneblock := mkBlock()
 	oneblock[0] |= 1 << 0 // mark root inode as allocated
 	if sb.Imaplen() == 1 {
 		markAllocated(oneblock, ninode)
-		f.Write(oneblock)
+		writeMeta(f, oneblock)
 	} else {
-		f.Write(oneblock)
+		writeMeta(f, oneblock)
 		block := mkBlock()
 		for i := 1; i < sb.Imaplen()-1; i++ {
-			f.Write(block)
+			writeMeta(f, block)
 		}
-		start := nbitsperblock - ninode%nbitsperblock
+		start := ninode % nbitsperblock
 		markAllocated(block, start)
-		f.Write(block)
+		writeMeta(f, block)
 	}
 }
 
@@ -118,7 +137,18 @@ func writeOrphanMap(f *os.File, sb *fs.Superblock_t, ninodeblks int) {
 	}
 	block := mkBlock()
 	for i := 0; i < sb.Iorphanlen(); i++ {
-		f.Write(block)
+		writeMeta(f, block)
+	}
+}
+
+// no block is shared yet
+func writeRefMap(f *os.File, sb *fs.Superblock_t) {
+	if Tell(f) != sb.Refmapblock() {
+		panic("incorrect reference map start\n")
+	}
+	block := mkBlock()
+	for i := 0; i < sb.Refmaplen(); i++ {
+		writeMeta(f, block)
 	}
 }
 
@@ -131,21 +161,21 @@ func writeBlockMap(f *os.File, sb *fs.Superblock_t, ndatablks int) {
 		block := mkBlock()
 		block[0] |= 1 << 0 // mark root dir block as allocated
 		markAllocated(block, ndatablks)
-		f.Write(block)
+		writeMeta(f, block)
 	} else {
 		block := mkBlock()
 		block[0] |= 1 << 0 // mark root dir block as allocated
-		f.Write(block)
+		writeMeta(f, block)
 
 		block = mkBlock()
 		for i := 1; i < sb.Freeblocklen()-1; i++ {
-			f.Write(block)
+			writeMeta(f, block)
 		}
 
 		// write last block
 		o := ndatablks % nbitsperblock
 		markAllocated(block, o)
-		f.Write(block)
+		writeMeta(f, block)
 	}
 	if Tell(f) != sb.Freeblock()+sb.Freeblocklen() {
 		panic("incorrect free block map\n")
@@ -170,10 +200,10 @@ func writeInodes(f *os.File, sb *fs.Superblock_t) {
 		panic("inodes don't line up")
 	}
 
-	f.Write(block)
+	writeMeta(f, block)
 	zeroblock := mkBlock()
 	for i := 1; i < sb.Inodelen(); i++ {
-		f.Write(zeroblock)
+		writeMeta(f, zeroblock)
 	}
 }
 
@@ -195,7 +225,7 @@ func writeDataBlocks(f *os.File, sb *fs.Superblock_t, ndatablks int) {
 		panic("inodes don't line up")
 	}
 
-	f.Write(d) // first block for root
+	writeMeta(f, d) // first block for root
 	zeroblock := mkBlock()
 	for i := 1; i < ndatablks; i++ {
 		f.Write(zeroblock)
@@ -305,6 +335,7 @@ func MkDisk(disk string, images []string, nlogblks, ninodeblks, ndatablks int) {
 	writeLog(f, nlogblks)
 	writeOrphanMap(f, sb, ninodeblks)
 	writeInodeMap(f, sb, ninodeblks)
+	writeRefMap(f, sb)
 	writeBlockMap(f, sb, ndatablks)
 	writeInodes(f, sb)
 	writeDataBlocks(f, sb, ndatablks)
@@ -312,3 +343,76 @@ func MkDisk(disk string, images []string, nlogblks, ninodeblks, ndatablks int) {
 	f.Sync()
 	f.Close()
 }
+
+// CryptDisk writes to dst the disk image src encrypted with the AES-XTS key
+// key, as fs.Crypt_t encrypts it
+func CryptDisk(src, dst string, key []uint8) {
+	x, kerr := fs.MkXts(key)
+	if kerr != 0 {
+		panic("bad key")
+	}
+	s, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	d, err := os.Create(dst)
+	if err != nil {
+		panic(err)
+	}
+	b := make([]uint8, fs.BSIZE)
+	for bn := 0; ; bn++ {
+		n, err := io.ReadFull(s, b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			panic(err)
+		}
+		// the disk ignores a partial last block
+		if n != fs.BSIZE {
+			break
+		}
+		x.EncryptBlock(b, b, bn)
+		if _, err := d.Write(b); err != nil {
+			panic(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// RaidDisks makes dsts the members of a new fs.Raid1_t mirror that holds the
+// disk image src: each is a copy of src with room for the mirror's metadata.
+func RaidDisks(src string, dsts []string) defs.Err_t {
+	fi, err := os.Stat(src)
+	if err != nil {
+		panic(err)
+	}
+	n := fs.Raid1_blocks(int(fi.Size()/fs.BSIZE), len(dsts))
+	var disks []fs.Disk_i
+	for _, dst := range dsts {
+		s, err := os.Open(src)
+		if err != nil {
+			panic(err)
+		}
+		d, err := os.Create(dst)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := io.Copy(d, s); err != nil {
+			panic(err)
+		}
+		s.Close()
+		if err := d.Truncate(int64(n * fs.BSIZE)); err != nil {
+			panic(err)
+		}
+		d.Close()
+		da := openDisk(dst)
+		defer da.close()
+		disks = append(disks, da)
+	}
+	_, kerr := fs.MkRaid1(disks, blockmem)
+	return kerr
+}
@@ -104,6 +104,13 @@ func (trace trace_t) permTrace(index int, o order_t) trace_t {
 	return new
 }
 
+// returns the trace till end, in which the write at index is torn
+func (trace trace_t) tornTrace(index int, end int) trace_t {
+	new := trace.copyTrace(0, end)
+	new[index].Cmd = "torn"
+	return new
+}
+
 func (t *tracef_t) write(n int, v *mem.Bytepg_t) {
 	r := record_t{}
 	r.BlkNo = n
@@ -130,6 +130,22 @@ func (ufs *Ufs_t) Append(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 	return err
 }
 
+// Copy copies n bytes at offset soff of src to offset doff of dst, which must
+// exist. returns the number of bytes copied.
+func (ufs *Ufs_t) Copy(src ustr.Ustr, soff int, dst ustr.Ustr, doff, n int) (int, defs.Err_t) {
+	sfd, err := ufs.fs.Fs_open(src, defs.O_RDONLY, 0, ufs.cwd, 0, 0)
+	if err != 0 {
+		return 0, err
+	}
+	defer sfd.Fops.Close()
+	dfd, err := ufs.fs.Fs_open(dst, defs.O_RDWR, 0, ufs.cwd, 0, 0)
+	if err != 0 {
+		return 0, err
+	}
+	defer dfd.Fops.Close()
+	return fs.Copy_range(sfd.Fops, dfd.Fops, soff, doff, n)
+}
+
 func (ufs *Ufs_t) Unlink(p ustr.Ustr) defs.Err_t {
 	err := ufs.fs.Fs_unlink(p, ufs.cwd, false)
 	if err != 0 {
@@ -208,6 +224,16 @@ func (ufs *Ufs_t) Statistics() string {
 	return ufs.fs.Fs_statistics()
 }
 
+// returns the number of free inodes and blocks
+func (ufs *Ufs_t) Free() (uint, uint) {
+	return ufs.fs.Fs_size()
+}
+
+// Grow extends the file system to the end of its disk image
+func (ufs *Ufs_t) Grow() defs.Err_t {
+	return ufs.fs.Fs_grow(ufs.ahci.Nblocks())
+}
+
 func (ufs *Ufs_t) Evict() {
 	ufs.fs.Fs_evict()
 }
@@ -230,17 +256,53 @@ func BootFS(dst string) *Ufs_t {
 	//log.Printf("reboot %v ...\n", dst)
 	ufs := &Ufs_t{}
 	ufs.ahci = openDisk(dst)
-	ufs.cwd = ufs.fs.MkRootCwd()
 	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, true)
+	ufs.cwd = ufs.fs.MkRootCwd()
 	return ufs
 }
 
+// BootPart boots the file system in the partition of disk dst that spec names
+// (PARTUUID=<uuid> or PARTLABEL=<label>)
+func BootPart(dst, spec string) (*Ufs_t, defs.Err_t) {
+	ufs := &Ufs_t{}
+	ufs.ahci = openDisk(dst)
+	parts, err := fs.Disk_parts(ufs.ahci, blockmem)
+	if err != 0 {
+		ufs.ahci.close()
+		return nil, err
+	}
+	for _, p := range parts {
+		if p.Match(spec) {
+			_, ufs.fs = fs.StartFS(blockmem, p, c, true)
+			ufs.cwd = ufs.fs.MkRootCwd()
+			return ufs, 0
+		}
+	}
+	ufs.ahci.close()
+	return nil, -defs.ENOENT
+}
+
+// BootCrypt boots the file system on disk dst, which is encrypted with the
+// AES-XTS key key
+func BootCrypt(dst string, key []uint8) (*Ufs_t, defs.Err_t) {
+	ufs := &Ufs_t{}
+	ufs.ahci = openDisk(dst)
+	cd, err := fs.MkCrypt(ufs.ahci, key, blockmem)
+	if err != 0 {
+		ufs.ahci.close()
+		return nil, err
+	}
+	_, ufs.fs = fs.StartFS(blockmem, cd, c, true)
+	ufs.cwd = ufs.fs.MkRootCwd()
+	return ufs, 0
+}
+
 func BootMemFS(dst string) *Ufs_t {
 	log.Printf("reboot %v ...\n", dst)
 	ufs := &Ufs_t{}
 	ufs.ahci = openDisk(dst)
-	ufs.cwd = ufs.fs.MkRootCwd()
 	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, false)
+	ufs.cwd = ufs.fs.MkRootCwd()
 	return ufs
 }
 
@@ -1,19 +1,37 @@
 package ufs
 
 import "testing"
+import "bytes"
+import "encoding/binary"
+import "encoding/hex"
 import "fmt"
+import "hash/crc32"
 import "io"
+import "io/ioutil"
 import "os"
+import "os/exec"
+import "path/filepath"
 import "strconv"
+import "strings"
 import "sync"
+import "syscall"
 import "time"
 
 import "bpath"
 import "defs"
+import "devfs"
 import "fd"
+import "fdops"
 import "fs"
+import "limits"
+import "loop"
 import "mem"
+import "ramdisk"
+import "stat"
 import "ustr"
+import "util"
+import "vfs"
+import "vm"
 
 const (
 	SMALL = 512
@@ -401,7 +419,7 @@ func TestFSInodeReuse(t *testing.T) {
 	fmt.Printf("Test FSInodeReuce %v ...\n", dst)
 
 	tfs := BootFS(dst)
-	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	n := ninodeblks * fs.IPERBLK
 	for i := 0; i < n; i++ {
 		doTestInodeReuse(tfs, 10, t)
 	}
@@ -439,7 +457,7 @@ func TestFSInodeReuseRename(t *testing.T) {
 	fmt.Printf("Test FSInodeReuseRename %v ...\n", dst)
 
 	tfs := BootFS(dst)
-	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	n := ninodeblks * fs.IPERBLK
 	for i := 0; i < n; i++ {
 		doTestInodeReuseRename(tfs, 10, t)
 	}
@@ -576,6 +594,7 @@ func TestFSOrphansMany(t *testing.T) {
 	ninode, nblock := tfs.fs.Fs_size()
 	doTestOrphans(tfs, t, OrphanFiles)
 	ShutdownFS(tfs) // causes the unlink to be committed
+	checkFsck(t, dst, false, 0)
 
 	tfs = BootFS(dst)
 	ninode1, nblock1 := tfs.fs.Fs_size()
@@ -1036,15 +1055,19 @@ func genDisk(trace trace_t, dst string) {
 	}
 	for i := 0; i < len(trace); i++ {
 		r := trace[i]
-		if r.Cmd == "write" {
+		if r.Cmd == "write" || r.Cmd == "torn" {
 			// fmt.Printf("update block %v\n", r.BlkNo)
 			f.Seek(int64(r.BlkNo*fs.BSIZE), 0)
 			buf := make([]byte, fs.BSIZE)
 			for i, _ := range buf {
 				buf[i] = byte(r.BlkData[i])
 			}
+			// only the first half of a torn write reaches the disk
+			if r.Cmd == "torn" {
+				buf = buf[:fs.BSIZE/2]
+			}
 			n, err := f.Write(buf)
-			if n != fs.BSIZE || err != nil {
+			if n != len(buf) || err != nil {
 				panic(err)
 			}
 		}
@@ -1055,13 +1078,32 @@ func genDisk(trace trace_t, dst string) {
 	}
 }
 
-func applyTrace(trace trace_t, cnt int, t *testing.T, disk string, check func(*Ufs_t) (string, bool)) {
+// applies trace to a copy of disk, and checks the result with check and, if
+// fsck is true, the offline checker
+func applyTrace(trace trace_t, cnt int, t *testing.T, disk string, fsck bool, check func(*Ufs_t) (string, bool)) {
 	dst := "tmp" + strconv.Itoa(cnt) + ".img"
 	copyDisk(disk, dst)
 	genDisk(trace, dst)
 	wg.Add(1)
 	go func(d string, trace trace_t) {
 		defer wg.Done()
+		// the recovered disk must be consistent
+		if fsck {
+			// the log may need replaying, which checking must do
+			// without writing the disk
+			before, err := ioutil.ReadFile(d)
+			if err != nil {
+				panic(err)
+			}
+			if fk := Fsck(d, false); len(fk.Problems) != 0 {
+				fmt.Printf("fsck failed on disk %s: %v\n", d, fk.Problems)
+				trace.printTrace(0, len(trace))
+				panic("fsck")
+			}
+			if after, _ := ioutil.ReadFile(d); !bytes.Equal(before, after) {
+				panic("fsck wrote disk " + d)
+			}
+		}
 		tfs := BootFS(d)
 		s, ok := check(tfs)
 		ShutdownFS(tfs)
@@ -1079,8 +1121,25 @@ var wg sync.WaitGroup
 func genTraces(trace trace_t, t *testing.T, disk string, apply bool, check func(*Ufs_t) (string, bool)) int {
 	cnt := 0
 	index := 0
+	prev := -1
 	for index < len(trace) {
 		n := trace.findSync(index)
+		// a single write after a sync commits the log header. tear each
+		// write to the log since the previous sync, as a disk that lies
+		// about flushing might, and apply the header write.
+		if n-index == 1 && prev >= 0 {
+			hdr := trace[index].BlkNo
+			for i := prev; i < index-1; i++ {
+				if b := trace[i].BlkNo; b > hdr && b < hdr+nlogblks {
+					tc := trace.tornTrace(i, n)
+					if apply {
+						applyTrace(tc, cnt, t, disk, true, check)
+					}
+					cnt++
+				}
+			}
+		}
+		prev = index
 		fmt.Printf("Extensions starting from %d till %d\n", index, n)
 		so := make([]int, n-index)
 		for i := 0; i < len(so); i++ {
@@ -1093,7 +1152,7 @@ func genTraces(trace trace_t, t *testing.T, disk string, apply bool, check func(
 			tc := trace.permTrace(index, e)
 			// tc.printTrace(0, len(tc))
 			if apply {
-				applyTrace(tc, cnt, t, disk, check)
+				applyTrace(tc, cnt, t, disk, true, check)
 				ngo++
 				if ngo%100 == 0 { // don't get more than 100 disks ahead
 					wg.Wait()
@@ -1246,9 +1305,10 @@ func FillDisk(disk string) {
 		if err != nil {
 			panic(err)
 		}
-		for j := 1; j < fs.BSIZE; j++ {
+		for j := 1; j < fs.BSIZE-fs.CKSUMLEN; j++ {
 			b[j] = 0xFF // mark as allocated
 		}
+		fs.Cksum_set(b)
 		_, err = f.Seek(int64(-fs.BSIZE), 1)
 		if err != nil {
 			panic(err)
@@ -1272,7 +1332,9 @@ func genSyncTraces(trace trace_t, t *testing.T, disk string, apply bool, check f
 		tc := trace.copyTrace(0, n)
 		// tc.printTrace(0, len(tc))
 		if apply {
-			applyTrace(tc, cnt, t, disk, check)
+			// FillDisk leaks blocks on purpose, which fsck would
+			// report
+			applyTrace(tc, cnt, t, disk, false, check)
 		}
 		cnt++
 		index = n + 1
@@ -1293,3 +1355,2544 @@ func TestBigFree(t *testing.T) {
 	fmt.Printf("#traces = %v\n", cnt)
 	os.Remove(disk)
 }
+
+//
+// Test preallocation with fallocate
+//
+
+func TestFallocate(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Fallocate %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	fn := ustr.Ustr("f")
+	e := tfs.MkFile(fn, nil)
+	if e != 0 {
+		t.Fatalf("mkFile %v failed", fn)
+	}
+	f, e := tfs.fs.Fs_open(fn, defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+	n := 10 * fs.BSIZE
+	if e := f.Fops.Fallocate(0, 0, n); e != 0 {
+		t.Fatalf("fallocate failed %v", e)
+	}
+	if e := f.Fops.Fallocate(defs.FALLOC_FL_KEEP_SIZE, n, 2*fs.BSIZE); e != 0 {
+		t.Fatalf("fallocate keep size failed %v", e)
+	}
+	if e := f.Fops.Fallocate(0, -1, fs.BSIZE); e != -defs.EINVAL {
+		t.Fatalf("fallocate bad offset %v", e)
+	}
+	ub := mkData(1, SMALL)
+	if _, e := f.Fops.Pwrite(ub, n-SMALL); e != 0 {
+		t.Fatalf("pwrite failed %v", e)
+	}
+	f.Fops.Close()
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	d, e := tfs.Read(fn)
+	if e != 0 {
+		t.Fatalf("read %v failed %v", fn, e)
+	}
+	if len(d) != n {
+		t.Fatalf("wrong size %v", len(d))
+	}
+	for i, v := range d {
+		if i < n-SMALL && v != 0 || i >= n-SMALL && v != 1 {
+			t.Fatalf("wrong byte %v at %v", v, i)
+		}
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test sparse files and hole punching
+//
+
+func TestSparse(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Sparse %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	fn := ustr.Ustr("f")
+	e := tfs.MkFile(fn, nil)
+	if e != 0 {
+		t.Fatalf("mkFile %v failed", fn)
+	}
+	f, e := tfs.fs.Fs_open(fn, defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+	// data in blocks 0-3 and 50; the rest is a hole
+	if _, e := f.Fops.Pwrite(mkData(1, 4*fs.BSIZE), 0); e != 0 {
+		t.Fatalf("pwrite failed %v", e)
+	}
+	if _, e := f.Fops.Pwrite(mkData(2, fs.BSIZE), 50*fs.BSIZE); e != 0 {
+		t.Fatalf("pwrite failed %v", e)
+	}
+	st := &stat.Stat_t{}
+	f.Fops.Fstat(st)
+	// five data blocks and an indirect block
+	if st.Size() != 51*fs.BSIZE || st.Blocks() != 6*fs.BSIZE/512 {
+		t.Fatalf("wrong size %v or blocks %v", st.Size(), st.Blocks())
+	}
+	if o, e := f.Fops.Lseek(5*fs.BSIZE, defs.SEEK_DATA); e != 0 || o != 50*fs.BSIZE {
+		t.Fatalf("seek data %v %v", o, e)
+	}
+	if o, e := f.Fops.Lseek(fs.BSIZE, defs.SEEK_HOLE); e != 0 || o != 4*fs.BSIZE {
+		t.Fatalf("seek hole %v %v", o, e)
+	}
+	if _, e := f.Fops.Lseek(51*fs.BSIZE, defs.SEEK_DATA); e != -defs.ENXIO {
+		t.Fatalf("seek data past end %v", e)
+	}
+	mode := defs.FALLOC_FL_PUNCH_HOLE | defs.FALLOC_FL_KEEP_SIZE
+	if e := f.Fops.Fallocate(mode, fs.BSIZE/2, 3*fs.BSIZE); e != 0 {
+		t.Fatalf("punch failed %v", e)
+	}
+	f.Fops.Fstat(st)
+	if st.Size() != 51*fs.BSIZE || st.Blocks() != 4*fs.BSIZE/512 {
+		t.Fatalf("wrong size %v or blocks %v after punch", st.Size(), st.Blocks())
+	}
+	f.Fops.Close()
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	d, e := tfs.Read(fn)
+	if e != 0 {
+		t.Fatalf("read %v failed %v", fn, e)
+	}
+	if len(d) != 51*fs.BSIZE {
+		t.Fatalf("wrong size %v", len(d))
+	}
+	for i, v := range d {
+		var w uint8
+		if i < fs.BSIZE/2 || i >= 7*fs.BSIZE/2 && i < 4*fs.BSIZE {
+			w = 1
+		} else if i >= 50*fs.BSIZE {
+			w = 2
+		}
+		if v != w {
+			t.Fatalf("wrong byte %v at %v", v, i)
+		}
+	}
+	st, e = tfs.Stat(fn)
+	if e != 0 || st.Blocks() != 4*fs.BSIZE/512 {
+		t.Fatalf("wrong blocks %v after reboot", st.Blocks())
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test fsync and fdatasync: they commit the file's transactions, but not
+// unrelated ones.
+//
+
+func checkFsync(t *testing.T, disk string, fn ustr.Ustr, n int, v uint8) {
+	tfs := BootFS(disk)
+	d, e := tfs.Read(fn)
+	if e != 0 {
+		t.Fatalf("read %v failed %v", fn, e)
+	}
+	if len(d) != n {
+		t.Fatalf("%v: wrong size %v", fn, len(d))
+	}
+	for i, b := range d {
+		if b != v {
+			t.Fatalf("%v: wrong byte %v at %v", fn, b, i)
+		}
+	}
+	ShutdownFS(tfs)
+}
+
+func TestFsync(t *testing.T) {
+	dst := "tmp.img"
+	crash := "crash.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Fsync %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	fn1 := ustr.Ustr("f1")
+	fn2 := ustr.Ustr("f2")
+	for _, fn := range []ustr.Ustr{fn1, fn2} {
+		if e := tfs.MkFile(fn, nil); e != 0 {
+			t.Fatalf("mkFile %v failed", fn)
+		}
+	}
+	tfs.Sync()
+	f1, e := tfs.fs.Fs_open(fn1, defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn1, e)
+	}
+	f2, e := tfs.fs.Fs_open(fn2, defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn2, e)
+	}
+
+	if _, e := f1.Fops.Write(mkData(1, 2*fs.BSIZE)); e != 0 {
+		t.Fatalf("write %v failed %v", fn1, e)
+	}
+	if e := f1.Fops.Fsync(false); e != 0 {
+		t.Fatalf("fsync failed %v", e)
+	}
+	if _, e := f2.Fops.Write(mkData(2, SMALL)); e != 0 {
+		t.Fatalf("write %v failed %v", fn2, e)
+	}
+	// f1 is clean, so this shouldn't commit the write to f2
+	if e := f1.Fops.Fsync(false); e != 0 {
+		t.Fatalf("fsync failed %v", e)
+	}
+	copyDisk(dst, crash)
+	checkFsync(t, crash, fn1, 2*fs.BSIZE, 1)
+	checkFsync(t, crash, fn2, 0, 0)
+
+	if e := f2.Fops.Fsync(true); e != 0 {
+		t.Fatalf("fdatasync failed %v", e)
+	}
+	copyDisk(dst, crash)
+	checkFsync(t, crash, fn2, SMALL, 2)
+
+	f1.Fops.Close()
+	f2.Fops.Close()
+	ShutdownFS(tfs)
+	os.Remove(crash)
+	os.Remove(dst)
+}
+
+//
+// Test metadata checksums: corrupt metadata blocks are detected on read and
+// reported as EIO.
+//
+
+func readSuper(disk string) *fs.Superblock_t {
+	f, err := os.Open(disk)
+	if err != nil {
+		panic(err)
+	}
+	super := mkBlock()
+	if _, err := f.ReadAt(super, fs.BSIZE); err != nil {
+		panic(err)
+	}
+	f.Close()
+	return &fs.Superblock_t{blk2bytepg(super)}
+}
+
+// flips a byte in block blkno of disk
+func corruptBlock(disk string, blkno int) {
+	f, err := os.OpenFile(disk, os.O_RDWR, 0755)
+	if err != nil {
+		panic(err)
+	}
+	b := mkBlock()
+	if _, err := f.ReadAt(b, int64(blkno*fs.BSIZE)); err != nil {
+		panic(err)
+	}
+	b[100] ^= 0xff
+	if _, err := f.WriteAt(b, int64(blkno*fs.BSIZE)); err != nil {
+		panic(err)
+	}
+	f.Sync()
+	f.Close()
+}
+
+func checkCksumerrs(t *testing.T, tfs *Ufs_t) {
+	if tfs.fs.Fs_cksumerrs() == 0 {
+		t.Fatalf("no checksum errors counted")
+	}
+	if !strings.Contains(tfs.Statistics(), "checksum errors: ") {
+		t.Fatalf("no checksum errors in statistics")
+	}
+}
+
+func TestCksum(t *testing.T) {
+	dst := "tmp.img"
+	n := fs.IPERBLK + 2
+
+	fmt.Printf("Test Cksum %v ...\n", dst)
+
+	mk := func() *fs.Superblock_t {
+		MkDisk(dst, nil, nlogblks, 2, ndatablks)
+		tfs := BootFS(dst)
+		if tfs.fs.Fs_cksumerrs() != 0 {
+			t.Fatalf("checksum errors on a fresh disk")
+		}
+		for i := 0; i < n; i++ {
+			if e := tfs.MkFile(ustr.Ustr(uniqfile(i)), nil); e != 0 {
+				t.Fatalf("mkFile %v failed %v", i, e)
+			}
+		}
+		ShutdownFS(tfs)
+		tfs = BootFS(dst)
+		if tfs.fs.Fs_cksumerrs() != 0 {
+			t.Fatalf("checksum errors after reboot")
+		}
+		ShutdownFS(tfs)
+		return readSuper(dst)
+	}
+
+	// the second inode block holds the last files' inodes
+	sb := mk()
+	corruptBlock(dst, sb.Freeblock()+sb.Freeblocklen()+1)
+	tfs := BootFS(dst)
+	if _, e := tfs.Stat(ustr.Ustr(uniqfile(0))); e != 0 {
+		t.Fatalf("stat of intact inode failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr(uniqfile(n - 1))); e != -defs.EIO {
+		t.Fatalf("stat of corrupt inode %v", e)
+	}
+	checkCksumerrs(t, tfs)
+	ShutdownFS(tfs)
+
+	// the root directory's block
+	sb = mk()
+	corruptBlock(dst, sb.Freeblock()+sb.Freeblocklen()+sb.Inodelen())
+	tfs = BootFS(dst)
+	if _, e := tfs.Stat(ustr.Ustr(uniqfile(0))); e != -defs.EIO {
+		t.Fatalf("lookup in corrupt directory %v", e)
+	}
+	checkCksumerrs(t, tfs)
+	ShutdownFS(tfs)
+
+	// the block bitmap; its blocks appear allocated
+	sb = mk()
+	corruptBlock(dst, sb.Freeblock())
+	tfs = BootFS(dst)
+	if e := tfs.MkFile(ustr.Ustr("big"), mkData(1, SMALL)); e == 0 {
+		t.Fatalf("allocated blocks from corrupt bitmap")
+	}
+	checkCksumerrs(t, tfs)
+	ShutdownFS(tfs)
+
+	// images from before the format version, whose superblock has no
+	// checksum, and images of an unknown version are refused
+	for _, v := range []int{0, fs.FSVERSION + 1} {
+		mk()
+		patchBlock(dst, 1, func(b []byte) {
+			sb := fs.Superblock_t{blk2bytepg(b)}
+			sb.SetVersion(v)
+			copy(b, sb.Data[:])
+		})
+		if v == 0 {
+			corruptBlock(dst, 1)
+		}
+		a := openDisk(dst)
+		if _, e := fs.MountFS(blockmem, a); e != -defs.EINVAL {
+			t.Fatalf("mounted format version %v %v", v, e)
+		}
+		a.close()
+		fk := Fsck(dst, false)
+		if len(fk.Problems) != 1 ||
+			!strings.Contains(fk.Problems[0], "superblock: file system image") {
+			t.Fatalf("fsck of format version %v: %v", v, fk.Problems)
+		}
+	}
+
+	os.Remove(dst)
+}
+
+//
+// Test the offline checker
+//
+
+// applies f to block blkno of disk, keeping its checksum valid
+func patchBlock(disk string, blkno int, f func([]byte)) {
+	fl, err := os.OpenFile(disk, os.O_RDWR, 0755)
+	if err != nil {
+		panic(err)
+	}
+	b := mkBlock()
+	if _, err := fl.ReadAt(b, int64(blkno*fs.BSIZE)); err != nil {
+		panic(err)
+	}
+	f(b)
+	fs.Cksum_set(b)
+	if _, err := fl.WriteAt(b, int64(blkno*fs.BSIZE)); err != nil {
+		panic(err)
+	}
+	fl.Sync()
+	fl.Close()
+}
+
+func checkFsck(t *testing.T, disk string, repair bool, nproblem int) {
+	fk := Fsck(disk, repair)
+	if len(fk.Problems) != nproblem {
+		t.Fatalf("expected %v problems, found %v: %v", nproblem,
+			len(fk.Problems), fk.Problems)
+	}
+	if repair && fk.Nfixed != nproblem {
+		t.Fatalf("repaired %v of %v: %v", fk.Nfixed, nproblem, fk.Problems)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Fsck %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	if e := tfs.MkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("mkdir failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("d/f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("g"), nil); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	// leave an orphan, which isn't a problem
+	doTestOrphans(tfs, t, 1)
+	ShutdownFS(tfs)
+	checkFsck(t, dst, false, 0)
+
+	sb := readSuper(dst)
+	ifirst := sb.Freeblock() + sb.Freeblocklen()
+	// the root dir, d, f, and g are inodes 0 to 3, and use the first
+	// data blocks
+	patchBlock(dst, ifirst, func(b []byte) {
+		util.Writen(b, 8, 3*fs.ISIZE+8, 5) // g's link count
+	})
+	patchBlock(dst, sb.Freeblock(), func(b []byte) {
+		b[0] &^= 1 << 2 // f's block
+		b[1] |= 1 << 7  // an unused block
+	})
+	patchBlock(dst, ifirst+sb.Inodelen(), func(b []byte) {
+		// an entry for a free inode in the root dir
+		dd := fs.Dirdata_t{b}
+		dd.W_filename(fs.NDIRENTS-1, ustr.Ustr("bad"))
+		dd.W_inodenext(fs.NDIRENTS-1, 20)
+	})
+	checkFsck(t, dst, false, 4)
+	checkFsck(t, dst, true, 4)
+	checkFsck(t, dst, false, 0)
+
+	tfs = BootFS(dst)
+	if _, e := tfs.Stat(ustr.Ustr("bad")); e != -defs.ENOENT {
+		t.Fatalf("bad entry not removed %v", e)
+	}
+	d, e := tfs.Read(ustr.Ustr("d/f"))
+	if e != 0 || len(d) != SMALL {
+		t.Fatalf("read d/f after repair %v %v", e, len(d))
+	}
+	ShutdownFS(tfs)
+	checkFsck(t, dst, false, 0)
+
+	// an unreferenced inode goes on the orphan list and is freed by the
+	// next mount
+	patchBlock(dst, ifirst+sb.Inodelen(), func(b []byte) {
+		dd := fs.Dirdata_t{b}
+		for i := 0; i < fs.NDIRENTS; i++ {
+			if dd.Filename(i).Eq(ustr.Ustr("g")) {
+				dd.W_filename(i, ustr.MkUstr())
+			}
+		}
+	})
+	checkFsck(t, dst, true, 1)
+	tfs = BootFS(dst)
+	ShutdownFS(tfs)
+	checkFsck(t, dst, false, 0)
+
+	os.Remove(dst)
+}
+
+//
+// Test growing a file system onto a larger disk
+//
+
+// appends n zero blocks to disk
+func extendDisk(disk string, n int) {
+	fi, err := os.Stat(disk)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Truncate(disk, fi.Size()+int64(n*fs.BSIZE)); err != nil {
+		panic(err)
+	}
+}
+
+func TestGrow(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Grow %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	if e := tfs.Grow(); e != -defs.EINVAL {
+		t.Fatalf("grow without new blocks %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	ni, nb := tfs.Free()
+	extendDisk(dst, 1000)
+	if e := tfs.Grow(); e != 0 {
+		t.Fatalf("grow failed %v", e)
+	}
+	ni1, nb1 := tfs.Free()
+	if ni1 <= ni || nb1 <= nb+900 {
+		t.Fatalf("grow added %v inodes and %v blocks", ni1-ni, nb1-nb)
+	}
+	// more inodes and blocks than the disk had before
+	for i := 0; i < 100; i++ {
+		fn := ustr.Ustr(uniqfile(i))
+		if e := tfs.MkFile(fn, mkData(uint8(i), SMALL)); e != 0 {
+			t.Fatalf("mkFile %v failed %v", fn, e)
+		}
+	}
+	if e := tfs.MkFile(ustr.Ustr("big"), mkData(2, 4*LARGE)); e != 0 {
+		t.Fatalf("mkFile big failed %v", e)
+	}
+	// grow again through an open file, past the blocks the first maps
+	// cover, which adds map blocks
+	extendDisk(dst, 2*(fs.BSIZE-fs.CKSUMLEN)*8)
+	f, e := tfs.fs.Fs_open(ustr.Ustr("f"), defs.O_RDONLY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open f failed %v", e)
+	}
+	ioc, ok := f.Fops.(fdops.Ioctl_i)
+	if !ok {
+		t.Fatalf("no ioctls")
+	}
+	if _, e := ioc.Ioctl(defs.FS_IOC_GROW, 0, nil); e != 0 {
+		t.Fatalf("second grow failed %v", e)
+	}
+	if _, e := ioc.Ioctl(defs.FS_IOC_GROW, 0, nil); e != -defs.EINVAL {
+		t.Fatalf("grow without new blocks %v", e)
+	}
+	f.Fops.Close()
+	ni2, nb2 := tfs.Free()
+	if nb2 <= nb1 {
+		t.Fatalf("second grow added %v blocks", nb2-nb1)
+	}
+	// the grown file system is in use before a remount
+	if e := tfs.MkFile(ustr.Ustr("big2"), mkData(4, 4*LARGE)); e != 0 {
+		t.Fatalf("mkFile big2 failed %v", e)
+	}
+	ShutdownFS(tfs)
+	checkFsck(t, dst, false, 0)
+
+	tfs = BootFS(dst)
+	ni2, nb2 = tfs.Free()
+	if nb2 <= nb1 || ni2 == 0 {
+		t.Fatalf("grown fs not mounted: %v inodes %v blocks free", ni2, nb2)
+	}
+	for i := 0; i < 100; i++ {
+		fn := ustr.Ustr(uniqfile(i))
+		d, e := tfs.Read(fn)
+		if e != 0 || len(d) != SMALL || d[0] != uint8(i) {
+			t.Fatalf("read %v failed %v", fn, e)
+		}
+	}
+	d, e := tfs.Read(ustr.Ustr("big"))
+	if e != 0 || len(d) != 4*LARGE {
+		t.Fatalf("read big failed %v %v", e, len(d))
+	}
+	d, e = tfs.Read(ustr.Ustr("big2"))
+	if e != 0 || len(d) != 4*LARGE || d[0] != 4 {
+		t.Fatalf("read big2 failed %v %v", e, len(d))
+	}
+	if e := tfs.MkFile(ustr.Ustr("bigger"), mkData(3, 8*LARGE)); e != 0 {
+		t.Fatalf("mkFile bigger failed %v", e)
+	}
+	ShutdownFS(tfs)
+	checkFsck(t, dst, false, 0)
+
+	os.Remove(dst)
+}
+
+//
+// Test copies that share blocks
+//
+
+func checkData(t *testing.T, tfs *Ufs_t, fn string, want func(int) uint8, n int) {
+	d, e := tfs.Read(ustr.Ustr(fn))
+	if e != 0 || len(d) != n {
+		t.Fatalf("read %v failed %v %v", fn, e, len(d))
+	}
+	for i, v := range d {
+		if v != want(i) {
+			t.Fatalf("%v: wrong byte %v at %v", fn, v, i)
+		}
+	}
+}
+
+func TestReflink(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, 200)
+
+	fmt.Printf("Test Reflink %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	_, nb := tfs.Free()
+	n := 8 * LARGE
+	ones := func(int) uint8 { return 1 }
+	if e := tfs.MkFile(ustr.Ustr("a"), mkData(1, n)); e != 0 {
+		t.Fatalf("mkFile a failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("b"), nil); e != 0 {
+		t.Fatalf("mkFile b failed %v", e)
+	}
+	_, nb1 := tfs.Free()
+	if c, e := tfs.Copy(ustr.Ustr("a"), 0, ustr.Ustr("b"), 0, 2*n); c != n || e != 0 {
+		t.Fatalf("copy a to b %v %v", c, e)
+	}
+	// b shares a's data blocks and only has its own indirect block
+	if _, nb2 := tfs.Free(); nb1-nb2 > 1 {
+		t.Fatalf("copy used %v blocks", nb1-nb2)
+	}
+	checkData(t, tfs, "b", ones, n)
+
+	// writing either copy leaves the other alone
+	if e := tfs.Update(ustr.Ustr("b"), mkData(2, SMALL)); e != 0 {
+		t.Fatalf("update b failed %v", e)
+	}
+	checkData(t, tfs, "a", ones, n)
+	twos := func(i int) uint8 {
+		if i < SMALL {
+			return 2
+		}
+		return 1
+	}
+	checkData(t, tfs, "b", twos, n)
+
+	// an unaligned copy copies bytes
+	if e := tfs.MkFile(ustr.Ustr("c"), nil); e != 0 {
+		t.Fatalf("mkFile c failed %v", e)
+	}
+	if c, e := tfs.Copy(ustr.Ustr("b"), 1, ustr.Ustr("c"), 0, fs.BSIZE); c != fs.BSIZE || e != 0 {
+		t.Fatalf("copy b to c %v %v", c, e)
+	}
+	if c, e := tfs.Copy(ustr.Ustr("a"), 0, ustr.Ustr("a"), fs.BSIZE, 2*fs.BSIZE); e != -defs.EINVAL {
+		t.Fatalf("overlapping copy %v %v", c, e)
+	}
+	ShutdownFS(tfs)
+	checkFsck(t, dst, false, 0)
+
+	// fsck restores the counts of the blocks a and b share
+	sb := readSuper(dst)
+	patchBlock(dst, sb.Refmapblock(), func(b []byte) {
+		for i := range b {
+			b[i] = 0
+		}
+	})
+	nshared := n/fs.BSIZE - 1
+	checkFsck(t, dst, true, nshared)
+	checkFsck(t, dst, false, 0)
+
+	tfs = BootFS(dst)
+	checkData(t, tfs, "c", func(i int) uint8 { return twos(i + 1) }, fs.BSIZE)
+	if e := tfs.Unlink(ustr.Ustr("a")); e != 0 {
+		t.Fatalf("unlink a failed %v", e)
+	}
+	checkData(t, tfs, "b", twos, n)
+	for _, fn := range []string{"b", "c"} {
+		if e := tfs.Unlink(ustr.Ustr(fn)); e != 0 {
+			t.Fatalf("unlink %v failed %v", fn, e)
+		}
+	}
+	tfs.Sync()
+	if _, nb3 := tfs.Free(); nb3 != nb {
+		t.Fatalf("%v blocks free, %v before", nb3, nb)
+	}
+	ShutdownFS(tfs)
+	checkFsck(t, dst, false, 0)
+
+	os.Remove(dst)
+}
+
+//
+// Test flock and record locks
+//
+
+func TestLock(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Lock %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	fn := ustr.Ustr("f")
+	if e := tfs.MkFile(fn, nil); e != 0 {
+		t.Fatalf("mkFile %v failed", fn)
+	}
+	f1, e := tfs.fs.Fs_open(fn, defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+	f2, e := tfs.fs.Fs_open(fn, defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+
+	// flock
+	if e := f1.Fops.Flock(defs.LOCK_SH); e != 0 {
+		t.Fatalf("flock sh failed %v", e)
+	}
+	if e := f2.Fops.Flock(defs.LOCK_SH | defs.LOCK_NB); e != 0 {
+		t.Fatalf("flock sh failed %v", e)
+	}
+	if e := f2.Fops.Flock(defs.LOCK_EX | defs.LOCK_NB); e != -defs.EWOULDBLOCK {
+		t.Fatalf("flock ex succeeded %v", e)
+	}
+	done := make(chan defs.Err_t)
+	go func() {
+		done <- f2.Fops.Flock(defs.LOCK_EX)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if e := f1.Fops.Flock(defs.LOCK_UN); e != 0 {
+		t.Fatalf("flock un failed %v", e)
+	}
+	if e := <-done; e != 0 {
+		t.Fatalf("flock ex failed %v", e)
+	}
+	if e := f1.Fops.Flock(defs.LOCK_SH | defs.LOCK_NB); e != -defs.EWOULDBLOCK {
+		t.Fatalf("flock sh succeeded %v", e)
+	}
+
+	// record locks of processes 1 and 2
+	lk := &fdops.Flock_t{Type: defs.F_WRLCK, Whence: defs.SEEK_SET, Len: 100}
+	if e := f1.Fops.Lockrec(1, defs.F_SETLK, lk); e != 0 {
+		t.Fatalf("setlk failed %v", e)
+	}
+	lk = &fdops.Flock_t{Type: defs.F_RDLCK, Whence: defs.SEEK_SET, Start: 50}
+	if e := f2.Fops.Lockrec(2, defs.F_SETLK, lk); e != -defs.EAGAIN {
+		t.Fatalf("setlk succeeded %v", e)
+	}
+	if e := f2.Fops.Lockrec(2, defs.F_GETLK, lk); e != 0 {
+		t.Fatalf("getlk failed %v", e)
+	}
+	if lk.Type != defs.F_WRLCK || lk.Start != 0 || lk.Len != 100 || lk.Pid != 1 {
+		t.Fatalf("getlk wrong lock %v", lk)
+	}
+	// unlocking part of the range splits the lock
+	lk = &fdops.Flock_t{Type: defs.F_UNLCK, Whence: defs.SEEK_SET, Start: 40, Len: 20}
+	if e := f1.Fops.Lockrec(1, defs.F_SETLK, lk); e != 0 {
+		t.Fatalf("unlock failed %v", e)
+	}
+	lk = &fdops.Flock_t{Type: defs.F_WRLCK, Whence: defs.SEEK_SET, Start: 40, Len: 20}
+	if e := f2.Fops.Lockrec(2, defs.F_SETLK, lk); e != 0 {
+		t.Fatalf("setlk failed %v", e)
+	}
+
+	// process 1 waits for 2, so 2 waiting for 1 deadlocks
+	go func() {
+		lk := &fdops.Flock_t{Type: defs.F_WRLCK, Whence: defs.SEEK_SET, Start: 45, Len: 1}
+		done <- f1.Fops.Lockrec(1, defs.F_SETLKW, lk)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	lk = &fdops.Flock_t{Type: defs.F_WRLCK, Whence: defs.SEEK_SET, Start: 0, Len: 1}
+	if e := f2.Fops.Lockrec(2, defs.F_SETLKW, lk); e != -defs.EDEADLK {
+		t.Fatalf("setlkw didn't deadlock %v", e)
+	}
+	// closing releases the locks of the closer
+	f3, e := tfs.fs.Fs_open(fn, defs.O_RDONLY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+	fd.Unlock(f3, 2)
+	f3.Fops.Close()
+	if e := <-done; e != 0 {
+		t.Fatalf("setlkw failed %v", e)
+	}
+
+	f1.Fops.Close()
+	f2.Fops.Close()
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestAt(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test At %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	dn := ustr.Ustr("d")
+	if e := tfs.MkDir(dn); e != 0 {
+		t.Fatalf("mkDir %v failed", dn)
+	}
+	if e := tfs.MkFile(ustr.Ustr("f"), nil); e != 0 {
+		t.Fatalf("mkFile f failed")
+	}
+	df, e := tfs.fs.Fs_open(dn, defs.O_RDONLY|defs.O_DIRECTORY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", dn, e)
+	}
+	dcwd, e := tfs.fs.Fs_atcwd(df)
+	if e != 0 {
+		t.Fatalf("atcwd %v failed %v", dn, e)
+	}
+
+	// paths are relative to d
+	f, e := tfs.fs.Fs_open(ustr.Ustr("x"), defs.O_CREAT|defs.O_RDWR, 0, dcwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("openat x failed %v", e)
+	}
+	f.Fops.Close()
+	if _, e := tfs.Stat(ustr.Ustr("d/x")); e != 0 {
+		t.Fatalf("stat d/x failed %v", e)
+	}
+	if e := tfs.fs.Fs_renameat(ustr.Ustr("x"), dcwd, ustr.Ustr("y"), tfs.cwd); e != 0 {
+		t.Fatalf("renameat failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("y")); e != 0 {
+		t.Fatalf("stat y failed %v", e)
+	}
+	if e := tfs.fs.Fs_linkat(ustr.Ustr("y"), tfs.cwd, ustr.Ustr("z"), dcwd); e != 0 {
+		t.Fatalf("linkat failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d/z")); e != 0 {
+		t.Fatalf("stat d/z failed %v", e)
+	}
+	if e := tfs.fs.Fs_unlink(ustr.Ustr("z"), dcwd, false); e != 0 {
+		t.Fatalf("unlinkat failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d/z")); e != -defs.ENOENT {
+		t.Fatalf("d/z exists %v", e)
+	}
+
+	// only directories can be used as a cwd
+	ff, e := tfs.fs.Fs_open(ustr.Ustr("f"), defs.O_RDONLY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open f failed %v", e)
+	}
+	if _, e := tfs.fs.Fs_atcwd(ff); e != -defs.ENOTDIR {
+		t.Fatalf("atcwd f succeeded %v", e)
+	}
+	ff.Fops.Close()
+
+	dcwd.Fd.Fops.Close()
+	df.Fops.Close()
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestMount(t *testing.T) {
+	dst := "tmp.img"
+	dst2 := "tmp2.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	MkDisk(dst2, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Mount %v %v ...\n", dst, dst2)
+
+	tfs := BootFS(dst)
+	tfs2 := BootFS(dst2)
+	if e := tfs.MkDir(ustr.Ustr("mnt")); e != 0 {
+		t.Fatalf("mkDir mnt failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("f"), nil); e != 0 {
+		t.Fatalf("mkFile f failed %v", e)
+	}
+	if e := tfs2.MkFile(ustr.Ustr("f2"), nil); e != 0 {
+		t.Fatalf("mkFile f2 failed %v", e)
+	}
+
+	v := vfs.MkVfs(tfs.fs)
+	if e := v.Mount(ustr.Ustr("f"), tfs.cwd, tfs2.fs); e != -defs.ENOTDIR {
+		t.Fatalf("mount on file succeeded %v", e)
+	}
+	if e := v.Mount(ustr.Ustr("/mnt"), tfs.cwd, tfs2.fs); e != 0 {
+		t.Fatalf("mount failed %v", e)
+	}
+
+	st := &stat.Stat_t{}
+	if e := v.Fs_stat(ustr.Ustr("/mnt/f2"), st, tfs.cwd); e != 0 {
+		t.Fatalf("stat /mnt/f2 failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("mnt/../mnt/./f2"), st, tfs.cwd); e != 0 {
+		t.Fatalf("stat mnt/../mnt/./f2 failed %v", e)
+	}
+	f, e := v.Fs_open(ustr.Ustr("mnt/g"), defs.O_CREAT, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open mnt/g failed %v", e)
+	}
+	f.Fops.Close()
+	if _, e := tfs2.Stat(ustr.Ustr("g")); e != 0 {
+		t.Fatalf("g not on mounted fs %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("mnt/g")); e != -defs.ENOENT {
+		t.Fatalf("g on root fs %v", e)
+	}
+
+	// paths relative to a directory of the mounted file system
+	df, e := v.Fs_open(ustr.Ustr("/mnt"), defs.O_RDONLY|defs.O_DIRECTORY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open /mnt failed %v", e)
+	}
+	dcwd, e := v.Fs_atcwd(df)
+	if e != 0 {
+		t.Fatalf("atcwd /mnt failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("f2"), st, dcwd); e != 0 {
+		t.Fatalf("stat f2 failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("../f"), st, dcwd); e != 0 {
+		t.Fatalf("stat ../f failed %v", e)
+	}
+	if e := v.Fs_mkdir(ustr.Ustr("../d"), 0, dcwd); e != 0 {
+		t.Fatalf("mkdir ../d failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("d not on root fs %v", e)
+	}
+
+	if e := v.Fs_renameat(ustr.Ustr("f2"), dcwd, ustr.Ustr("f3"), tfs.cwd); e != -defs.EXDEV {
+		t.Fatalf("rename across mounts succeeded %v", e)
+	}
+	if e := v.Fs_linkat(ustr.Ustr("/f"), tfs.cwd, ustr.Ustr("f3"), dcwd); e != -defs.EXDEV {
+		t.Fatalf("link across mounts succeeded %v", e)
+	}
+	if e := v.Fs_unlink(ustr.Ustr("mnt"), tfs.cwd, true); e != -defs.EBUSY {
+		t.Fatalf("rmdir mount point succeeded %v", e)
+	}
+
+	// the mounted file system is busy while it has open files
+	if e := v.Umount(ustr.Ustr("/"), tfs.cwd); e != -defs.EBUSY {
+		t.Fatalf("umount / succeeded %v", e)
+	}
+	if e := v.Umount(ustr.Ustr("/mnt"), tfs.cwd); e != -defs.EBUSY {
+		t.Fatalf("umount busy /mnt succeeded %v", e)
+	}
+	dcwd.Fd.Fops.Close()
+	df.Fops.Close()
+	if e := v.Umount(ustr.Ustr("/mnt"), tfs.cwd); e != 0 {
+		t.Fatalf("umount /mnt failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/mnt/f2"), st, tfs.cwd); e != -defs.ENOENT {
+		t.Fatalf("stat /mnt/f2 after umount %v", e)
+	}
+
+	// renaming an ancestor of a mount point moves the mount with it
+	if e := tfs.MkDir(ustr.Ustr("a")); e != 0 {
+		t.Fatalf("mkDir a failed %v", e)
+	}
+	if e := tfs.MkDir(ustr.Ustr("a/mnt")); e != 0 {
+		t.Fatalf("mkDir a/mnt failed %v", e)
+	}
+	tmp := fs.MkTmpfs(blockmem)
+	if e := v.Mount(ustr.Ustr("/a/mnt"), tfs.cwd, tmp); e != 0 {
+		t.Fatalf("mount tmpfs failed %v", e)
+	}
+	if e := v.Fs_mkdir(ustr.Ustr("/a/mnt/t"), 0, tfs.cwd); e != 0 {
+		t.Fatalf("mkdir /a/mnt/t failed %v", e)
+	}
+	if e := v.Fs_renameat(ustr.Ustr("a"), tfs.cwd, ustr.Ustr("b"), tfs.cwd); e != 0 {
+		t.Fatalf("rename a failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/b/mnt/t"), st, tfs.cwd); e != 0 {
+		t.Fatalf("stat /b/mnt/t failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/a/mnt/t"), st, tfs.cwd); e != -defs.ENOENT {
+		t.Fatalf("stat /a/mnt/t after rename %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("b/mnt/t/../../mnt/t"), st, tfs.cwd); e != 0 {
+		t.Fatalf("stat b/mnt/t/../../mnt/t failed %v", e)
+	}
+	if e := v.Fs_mkdir(ustr.Ustr("/b/mnt/t/u"), 0, tfs.cwd); e != 0 {
+		t.Fatalf("mkdir /b/mnt/t/u failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("b/./mnt/t/u/../u/../../t/u"), st, tfs.cwd); e != 0 {
+		t.Fatalf("stat b/./mnt/t/u/../u/../../t/u failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("b/nothere/mnt/t"), st, tfs.cwd); e != -defs.ENOENT {
+		t.Fatalf("stat b/nothere/mnt/t %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("f/mnt"), st, tfs.cwd); e != -defs.ENOTDIR {
+		t.Fatalf("stat f/mnt %v", e)
+	}
+	if e := v.Umount(ustr.Ustr("/b/mnt"), tfs.cwd); e != 0 {
+		t.Fatalf("umount /b/mnt failed %v", e)
+	}
+	// the mount dropped its references to the covered directory and the
+	// root of the tmpfs
+	if e := v.Fs_unlink(ustr.Ustr("b/mnt"), tfs.cwd, true); e != 0 {
+		t.Fatalf("rmdir b/mnt failed %v", e)
+	}
+	if e := v.Mount(ustr.Ustr("/b"), tfs.cwd, tmp); e != 0 {
+		t.Fatalf("remount tmpfs failed %v", e)
+	}
+	if e := v.Umount(ustr.Ustr("/b"), tfs.cwd); e != 0 {
+		t.Fatalf("umount /b failed %v", e)
+	}
+
+	ShutdownFS(tfs)
+	tfs2.ahci.close()
+	os.Remove(dst)
+	os.Remove(dst2)
+}
+
+func TestTmpfs(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Tmpfs %v ...\n", dst)
+
+	tmp := fs.MkTmpfs(blockmem)
+	root := tmp.MkRootCwd()
+	if e := tmp.Fs_mkdir(ustr.Ustr("d"), 0, root); e != 0 {
+		t.Fatalf("mkdir d failed %v", e)
+	}
+	f, e := tmp.Fs_open(ustr.Ustr("d/f"), defs.O_CREAT|defs.O_RDWR, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open d/f failed %v", e)
+	}
+	// a sparse file
+	if n, e := f.Fops.Pwrite(mkData(1, SMALL), 3*mem.PGSIZE); e != 0 || n != SMALL {
+		t.Fatalf("pwrite failed %v %v", n, e)
+	}
+	hdata := make([]uint8, 3*mem.PGSIZE+SMALL)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(hdata)
+	if n, e := f.Fops.Read(ub); e != 0 || n != len(hdata) {
+		t.Fatalf("read failed %v %v", n, e)
+	}
+	for i, v := range hdata {
+		if (i < 3*mem.PGSIZE && v != 0) || (i >= 3*mem.PGSIZE && v != 1) {
+			t.Fatalf("bad byte %v at %v", v, i)
+		}
+	}
+	if off, e := f.Fops.Lseek(0, defs.SEEK_DATA); e != 0 || off != 3*mem.PGSIZE {
+		t.Fatalf("seek data %v %v", off, e)
+	}
+	st := &stat.Stat_t{}
+	if e := tmp.Fs_stat(ustr.Ustr("/d/f"), st, root); e != 0 {
+		t.Fatalf("stat failed %v", e)
+	}
+	if st.Size() != uint(len(hdata)) || st.Mode() != stat.S_IFREG {
+		t.Fatalf("bad stat %v %v", st.Size(), st.Mode())
+	}
+
+	// mappings share the file's pages
+	mmi, e := f.Fops.Mmapi(0, -1, true)
+	if e != 0 || len(mmi) != 4 {
+		t.Fatalf("mmapi failed %v %v", len(mmi), e)
+	}
+	mem.Pg2bytes(mmi[0].Pg)[0] = 2
+	b := make([]uint8, 1)
+	ub.Fake_init(b)
+	if n, e := f.Fops.Pread(ub, 0); e != 0 || n != 1 || b[0] != 2 {
+		t.Fatalf("write through mapping lost %v %v %v", n, e, b[0])
+	}
+
+	if e := tmp.Fs_linkat(ustr.Ustr("d/f"), root, ustr.Ustr("g"), root); e != 0 {
+		t.Fatalf("link failed %v", e)
+	}
+	if e := tmp.Fs_renameat(ustr.Ustr("d"), root, ustr.Ustr("d/e"), root); e != -defs.EINVAL {
+		t.Fatalf("rename below itself succeeded %v", e)
+	}
+	if e := tmp.Fs_renameat(ustr.Ustr("d"), root, ustr.Ustr("e"), root); e != 0 {
+		t.Fatalf("rename failed %v", e)
+	}
+	if e := tmp.Fs_unlink(ustr.Ustr("e"), root, true); e != -defs.ENOTEMPTY {
+		t.Fatalf("rmdir non-empty succeeded %v", e)
+	}
+	if e := tmp.Fs_unlink(ustr.Ustr("e/f"), root, false); e != 0 {
+		t.Fatalf("unlink failed %v", e)
+	}
+	if e := tmp.Fs_unlink(ustr.Ustr("e"), root, true); e != 0 {
+		t.Fatalf("rmdir failed %v", e)
+	}
+
+	// the directory lists like a ufs directory
+	df, e := tmp.Fs_open(ustr.Ustr("/"), defs.O_RDONLY|defs.O_DIRECTORY, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open / failed %v", e)
+	}
+	d := make([]uint8, fs.BSIZE)
+	ub.Fake_init(d)
+	if n, e := df.Fops.Read(ub); e != 0 || n != fs.BSIZE {
+		t.Fatalf("read / failed %v %v", n, e)
+	}
+	df.Fops.Close()
+	names := make(map[string]bool)
+	dd := fs.Dirdata_t{d}
+	for j := 0; j < fs.NDIRENTS; j++ {
+		if fn := dd.Filename(j); len(fn) > 0 {
+			names[string(fn)] = true
+		}
+	}
+	if len(names) != 3 || !names["."] || !names[".."] || !names["g"] {
+		t.Fatalf("bad listing %v", names)
+	}
+
+	// every page is charged to the limit, even a small file's only one
+	old := limits.Syslimit.Mfspgs
+	if e := f.Fops.Truncate(0); e != 0 {
+		t.Fatalf("truncate failed %v", e)
+	}
+	limits.Syslimit.Mfspgs = 2
+	if _, e := f.Fops.Pwrite(mkData(1, 3*mem.PGSIZE), 5*mem.PGSIZE); e != -defs.ENOSPC {
+		t.Fatalf("write past limit succeeded %v", e)
+	}
+	if e := f.Fops.Truncate(0); e != 0 {
+		t.Fatalf("truncate failed %v", e)
+	}
+	if n, e := f.Fops.Pwrite(mkData(1, 2*mem.PGSIZE), 0); e != 0 || n != 2*mem.PGSIZE {
+		t.Fatalf("write after truncate failed %v %v", n, e)
+	}
+	sf, e := tmp.Fs_open(ustr.Ustr("small"), defs.O_CREAT|defs.O_RDWR, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open small failed %v", e)
+	}
+	if _, e := sf.Fops.Write(mkData(1, 1)); e != -defs.ENOSPC {
+		t.Fatalf("small write past limit succeeded %v", e)
+	}
+	sf.Fops.Close()
+	if e := tmp.Fs_unlink(ustr.Ustr("small"), root, false); e != 0 {
+		t.Fatalf("unlink small failed %v", e)
+	}
+	if limits.Syslimit.Mfspgs != 0 {
+		t.Fatalf("bad charge %v", limits.Syslimit.Mfspgs)
+	}
+	limits.Syslimit.Mfspgs = old
+
+	// mounted on a ufs directory
+	tfs := BootFS(dst)
+	if e := tfs.MkDir(ustr.Ustr("tmp")); e != 0 {
+		t.Fatalf("mkDir tmp failed %v", e)
+	}
+	v := vfs.MkVfs(tfs.fs)
+	if e := v.Mount(ustr.Ustr("/tmp"), tfs.cwd, tmp); e != 0 {
+		t.Fatalf("mount failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/tmp/g"), st, tfs.cwd); e != 0 || st.Size() != uint(2*mem.PGSIZE) {
+		t.Fatalf("stat /tmp/g failed %v %v", e, st.Size())
+	}
+	if e := v.Umount(ustr.Ustr("/tmp"), tfs.cwd); e != -defs.EBUSY {
+		t.Fatalf("umount busy /tmp succeeded %v", e)
+	}
+	f.Fops.Close()
+	if e := v.Umount(ustr.Ustr("/tmp"), tfs.cwd); e != 0 {
+		t.Fatalf("umount /tmp failed %v", e)
+	}
+
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestDevfs(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Devfs %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	if e := tfs.MkDir(ustr.Ustr("dev")); e != 0 {
+		t.Fatalf("mkDir dev failed %v", e)
+	}
+	if e := devfs.Register("null", defs.D_DEVNULL, 0); e != 0 {
+		t.Fatalf("register null failed %v", e)
+	}
+	if e := devfs.Register("rsd0c", defs.D_RAWDISK, 0); e != 0 {
+		t.Fatalf("register rsd0c failed %v", e)
+	}
+	if e := devfs.Register("null", defs.D_DEVNULL, 1); e != -defs.EEXIST {
+		t.Fatalf("register null twice succeeded %v", e)
+	}
+	if e := devfs.Register("averyverylongname", defs.D_DEVNULL, 1); e != -defs.ENAMETOOLONG {
+		t.Fatalf("register long name succeeded %v", e)
+	}
+	devfs.Major(defs.D_DEVNULL, func(min int) (fdops.Fdops_i, defs.Err_t) {
+		return tfs.fs.Devopen(defs.D_DEVNULL, min)
+	})
+
+	v := vfs.MkVfs(tfs.fs)
+	if e := v.Mount(ustr.Ustr("/dev"), tfs.cwd, devfs.MkDevfs()); e != 0 {
+		t.Fatalf("mount failed %v", e)
+	}
+	f, e := v.Fs_open(ustr.Ustr("/dev/null"), defs.O_WRONLY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open /dev/null failed %v", e)
+	}
+	if n, e := f.Fops.Write(mkData(1, SMALL)); e != 0 || n != SMALL {
+		t.Fatalf("write /dev/null failed %v %v", n, e)
+	}
+	f.Fops.Close()
+	st := &stat.Stat_t{}
+	if e := v.Fs_stat(ustr.Ustr("dev/null"), st, tfs.cwd); e != 0 {
+		t.Fatalf("stat dev/null failed %v", e)
+	}
+	if st.Mode() != defs.Mkdev(defs.D_DEVNULL, 0) {
+		t.Fatalf("bad mode %x", st.Mode())
+	}
+	// no driver implements the major
+	if _, e := v.Fs_open(ustr.Ustr("/dev/rsd0c"), defs.O_RDONLY, 0, tfs.cwd, 0, 0); e != -defs.ENXIO {
+		t.Fatalf("open /dev/rsd0c succeeded %v", e)
+	}
+	if _, e := v.Fs_mknod(ustr.Ustr("/dev/null"), false, tfs.cwd, defs.D_DEVNULL, 0); e != -defs.EEXIST {
+		t.Fatalf("mknod /dev/null succeeded %v", e)
+	}
+	if _, e := v.Fs_mknod(ustr.Ustr("/dev/foo"), false, tfs.cwd, defs.D_DEVNULL, 0); e != -defs.EPERM {
+		t.Fatalf("mknod /dev/foo succeeded %v", e)
+	}
+
+	df, e := v.Fs_open(ustr.Ustr("/dev"), defs.O_RDONLY|defs.O_DIRECTORY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open /dev failed %v", e)
+	}
+	d := make([]uint8, fs.BSIZE)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(d)
+	if n, e := df.Fops.Read(ub); e != 0 || n != fs.BSIZE {
+		t.Fatalf("read /dev failed %v %v", n, e)
+	}
+	names := make(map[string]bool)
+	dd := fs.Dirdata_t{d}
+	for j := 0; j < fs.NDIRENTS; j++ {
+		if fn := dd.Filename(j); len(fn) > 0 {
+			names[string(fn)] = true
+		}
+	}
+	if len(names) != 4 || !names["null"] || !names["rsd0c"] {
+		t.Fatalf("bad listing %v", names)
+	}
+
+	if e := devfs.Unregister("rsd0c"); e != 0 {
+		t.Fatalf("unregister failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/dev/rsd0c"), st, tfs.cwd); e != -defs.ENOENT {
+		t.Fatalf("stat unregistered device %v", e)
+	}
+	if e := v.Umount(ustr.Ustr("/dev"), tfs.cwd); e != -defs.EBUSY {
+		t.Fatalf("umount busy /dev succeeded %v", e)
+	}
+	df.Fops.Close()
+	if e := v.Umount(ustr.Ustr("/dev"), tfs.cwd); e != 0 {
+		t.Fatalf("umount /dev failed %v", e)
+	}
+	devfs.Unregister("null")
+
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestRawDisk(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	raw := "raw.img"
+	if err := ioutil.WriteFile(raw, make([]byte, 4*fs.BSIZE), 0644); err != nil {
+		t.Fatalf("create %v failed %v", raw, err)
+	}
+
+	fmt.Printf("Test RawDisk %v ...\n", raw)
+
+	tfs := BootFS(dst)
+	before, _ := ioutil.ReadFile(dst)
+	d := openDisk(raw)
+	if e := fs.Disk_attach("rvd0c", d); e != 0 {
+		t.Fatalf("attach failed %v", e)
+	}
+	if _, e := tfs.fs.Devopen(defs.D_RAWDISK, 2); e != -defs.ENXIO {
+		t.Fatalf("open unattached disk succeeded %v", e)
+	}
+	f, e := tfs.fs.Devopen(defs.D_RAWDISK, 1)
+	if e != 0 {
+		t.Fatalf("open rvd0c failed %v", e)
+	}
+	// a write that straddles two blocks
+	data := bytes.Repeat([]uint8{7}, fs.BSIZE)
+	off := fs.BSIZE + 10
+	if _, e := f.Lseek(off, defs.SEEK_SET); e != 0 {
+		t.Fatalf("lseek failed %v", e)
+	}
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(data)
+	if n, e := f.Write(ub); e != 0 || n != len(data) {
+		t.Fatalf("write failed %v %v", n, e)
+	}
+	img, _ := ioutil.ReadFile(raw)
+	if !bytes.Equal(img[off:off+len(data)], data) {
+		t.Fatalf("write didn't reach the disk")
+	}
+	if img[off-1] != 0 || img[off+len(data)] != 0 {
+		t.Fatalf("write clobbered its neighbors")
+	}
+	if after, _ := ioutil.ReadFile(dst); !bytes.Equal(before, after) {
+		t.Fatalf("write reached the root disk")
+	}
+
+	f.Lseek(off, defs.SEEK_SET)
+	got := make([]uint8, len(data))
+	ub.Fake_init(got)
+	if n, e := f.Read(ub); e != 0 || n != len(data) || !bytes.Equal(got, data) {
+		t.Fatalf("read failed %v %v", n, e)
+	}
+	// reads stop at the end of the disk and writes fail there
+	f.Lseek(4*fs.BSIZE, defs.SEEK_SET)
+	ub.Fake_init(got)
+	if n, e := f.Read(ub); e != 0 || n != 0 {
+		t.Fatalf("read past end %v %v", n, e)
+	}
+	ub.Fake_init(data)
+	if n, e := f.Write(ub); e != -defs.ENOSPC {
+		t.Fatalf("write past end %v %v", n, e)
+	}
+	f.Close()
+
+	fs.Disk_detach("rvd0c")
+	d.close()
+	ShutdownFS(tfs)
+	os.Remove(dst)
+	os.Remove(raw)
+}
+
+// starts a request for the blocks blks of d, which completes at once
+func ramReq(t *testing.T, d fs.Disk_i, cmd fs.Bdevcmd_t, blks ...int) (defs.Err_t, []*fs.Bdev_block_t) {
+	l := fs.MkBlkList()
+	var bs []*fs.Bdev_block_t
+	for _, n := range blks {
+		b := fs.MkBlock_newpage(n, "test", blockmem, d, &testcb_t{})
+		bs = append(bs, b)
+		l.PushBack(b)
+	}
+	req := fs.MkRequest(l, cmd, true)
+	if d.Start(req) {
+		t.Fatalf("RAM disk request is asynchronous")
+	}
+	return req.Err, bs
+}
+
+func TestRamdisk(t *testing.T) {
+	const n = 8
+	d, ok := ramdisk.MkRamdisk(n, blockmem)
+	if !ok || d.Nblocks() != n {
+		t.Fatalf("MkRamdisk failed")
+	}
+	if e, bs := ramReq(t, d, fs.BDEV_READ, 0, n-1); e != 0 ||
+		bs[0].Data[0] != 0 || bs[1].Data[fs.BSIZE-1] != 0 {
+		t.Fatalf("new disk not zeroed %v", e)
+	}
+
+	// a request of several blocks, out of order, reads back
+	l := fs.MkBlkList()
+	for _, i := range []int{3, 0, 7, 1} {
+		b := fs.MkBlock_newpage(i, "test", blockmem, d, &testcb_t{})
+		for j := range b.Data {
+			b.Data[j] = uint8(i + j)
+		}
+		l.PushBack(b)
+	}
+	req := fs.MkRequest(l, fs.BDEV_WRITE, true)
+	if d.Start(req) || req.Err != 0 {
+		t.Fatalf("write failed %v", req.Err)
+	}
+	// the disk has its own copy of the blocks
+	l.Apply(func(b *fs.Bdev_block_t) {
+		b.Data[0] = 0xff
+	})
+	e, bs := ramReq(t, d, fs.BDEV_READ, 0, 1, 2, 3, 7)
+	if e != 0 {
+		t.Fatalf("read failed %v", e)
+	}
+	for _, b := range bs {
+		for j, v := range b.Data {
+			want := uint8(b.Block + j)
+			if b.Block == 2 {
+				want = 0
+			}
+			if v != want {
+				t.Fatalf("block %v byte %v is %v", b.Block, j, v)
+			}
+		}
+	}
+
+	// requests that reach outside of the disk fail whole
+	for _, blks := range [][]int{{n}, {-1}, {n - 1, n}} {
+		for _, cmd := range []fs.Bdevcmd_t{fs.BDEV_READ, fs.BDEV_WRITE} {
+			if e, _ := ramReq(t, d, cmd, blks...); e != -defs.EIO {
+				t.Fatalf("cmd %v of %v succeeded %v", cmd, blks, e)
+			}
+		}
+	}
+	if e, bs := ramReq(t, d, fs.BDEV_READ, n-1); e != 0 || bs[0].Data[1] != n {
+		t.Fatalf("failed write changed the disk %v", e)
+	}
+	if e, _ := ramReq(t, d, fs.BDEV_FLUSH); e != 0 {
+		t.Fatalf("flush failed %v", e)
+	}
+
+	// Copy fills the disk from a smaller one but not a larger one
+	src, _ := ramdisk.MkRamdisk(2, blockmem)
+	if e, _ := ramReq(t, src, fs.BDEV_WRITE, 1); e != 0 {
+		t.Fatalf("write failed %v", e)
+	}
+	if e := d.Copy(src, blockmem); e != 0 {
+		t.Fatalf("copy failed %v", e)
+	}
+	if e, bs := ramReq(t, d, fs.BDEV_READ, 1, 3); e != 0 ||
+		bs[0].Data[0] != 0 || bs[1].Data[0] != 3 {
+		t.Fatalf("copy wrote wrong blocks %v", e)
+	}
+	big, _ := ramdisk.MkRamdisk(n+1, blockmem)
+	if e := d.Copy(big, blockmem); e != -defs.ENOSPC {
+		t.Fatalf("copy of a larger disk %v", e)
+	}
+}
+
+// makes an ext2 image of the tree at dir with the host's mke2fs
+func mkExt2(t *testing.T, dst, dir string, bsize int) {
+	cmd := exec.Command("mke2fs", "-q", "-F", "-t", "ext2", "-b",
+		strconv.Itoa(bsize), "-d", dir, dst, "4096")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs failed %v: %s", err, out)
+	}
+}
+
+func TestExt2(t *testing.T) {
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("no mke2fs")
+	}
+	dir := "ext2.d"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	big := make([]byte, 400*1024+5)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	sparse := []byte("after the hole")
+	slow := strings.Repeat("./", 40) + "small"
+	files := map[string][]byte{
+		"small":   []byte("hello\n"),
+		"big":     big,
+		"d/e/f":   []byte("nested"),
+		"d/empty": nil,
+	}
+	for p, d := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, p), d, 0644); err != nil {
+			t.Fatalf("write %v: %v", p, err)
+		}
+	}
+	sf, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatalf("create sparse: %v", err)
+	}
+	sf.WriteAt(sparse, 300*1024)
+	sf.Close()
+	os.MkdirAll(filepath.Join(dir, "many"), 0755)
+	for i := 0; i < 300; i++ {
+		ioutil.WriteFile(filepath.Join(dir, "many", "f"+strconv.Itoa(i)), nil, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "averyverylongname"), nil, 0644)
+	os.Symlink("small", filepath.Join(dir, "ln"))
+	os.Symlink("../small", filepath.Join(dir, "d/up"))
+	os.Symlink("/d/e", filepath.Join(dir, "abs"))
+	os.Symlink(slow, filepath.Join(dir, "slow"))
+	os.Symlink("loop", filepath.Join(dir, "d/loop"))
+	syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644)
+
+	for _, bsize := range []int{1024, 4096} {
+		dst := "ext2.img"
+		mkExt2(t, dst, dir, bsize)
+
+		fmt.Printf("Test Ext2 %v bsize %v ...\n", dst, bsize)
+
+		e, err := BootExt2(dst)
+		if err != 0 {
+			t.Fatalf("boot ext2 failed %v", err)
+		}
+		expect := map[string][]byte{
+			"small":   files["small"],
+			"big":     big,
+			"/d/e/f":  files["d/e/f"],
+			"d/empty": nil,
+			"ln":      files["small"],
+			"d/up":    files["small"],
+			"abs/f":   files["d/e/f"],
+			"slow":    files["small"],
+		}
+		for p, d := range expect {
+			v, err := e.Read(ustr.Ustr(p))
+			if err != 0 {
+				t.Fatalf("read %v failed %v", p, err)
+			}
+			if !bytes.Equal(v, d) {
+				t.Fatalf("bad contents of %v", p)
+			}
+			st, err := e.Stat(ustr.Ustr(p))
+			if err != 0 || st.Mode() != stat.S_IFREG || st.Size() != uint(len(d)) {
+				t.Fatalf("bad stat of %v %v", p, err)
+			}
+		}
+
+		v, err := e.Read(ustr.Ustr("sparse"))
+		if err != 0 || len(v) != 300*1024+len(sparse) {
+			t.Fatalf("read sparse failed %v %v", len(v), err)
+		}
+		for _, b := range v[:300*1024] {
+			if b != 0 {
+				t.Fatalf("hole not zero")
+			}
+		}
+		if !bytes.Equal(v[300*1024:], sparse) {
+			t.Fatalf("bad data after hole")
+		}
+
+		ls, err := e.Ls(ustr.Ustr("/"))
+		if err != 0 {
+			t.Fatalf("ls failed %v", err)
+		}
+		for _, n := range []string{".", "..", "small", "big", "d", "many", "sparse", "ln"} {
+			if _, ok := ls[n]; !ok {
+				t.Fatalf("%v missing from listing", n)
+			}
+		}
+		if _, ok := ls["averyverylongname"]; ok {
+			t.Fatalf("long name listed")
+		}
+		if ls["d"].Mode() != stat.S_IFDIR {
+			t.Fatalf("d not a directory")
+		}
+		ls, err = e.Ls(ustr.Ustr("many"))
+		if err != 0 || len(ls) != 302 {
+			t.Fatalf("ls many failed %v %v", len(ls), err)
+		}
+		if _, err := e.Stat(ustr.Ustr("averyverylongname")); err != 0 {
+			t.Fatalf("stat long name failed %v", err)
+		}
+
+		if _, err := e.Stat(ustr.Ustr("d/loop")); err != -defs.ELOOP {
+			t.Fatalf("stat loop %v", err)
+		}
+		if _, err := e.Stat(ustr.Ustr("small/x")); err != -defs.ENOTDIR {
+			t.Fatalf("stat through file %v", err)
+		}
+		if _, err := e.Stat(ustr.Ustr("nothere")); err != -defs.ENOENT {
+			t.Fatalf("stat missing file %v", err)
+		}
+		_, err = e.fs.Fs_open(ustr.Ustr("fifo"), defs.O_RDONLY, 0, e.cwd, 0, 0)
+		if err != -defs.ENXIO {
+			t.Fatalf("open fifo %v", err)
+		}
+
+		_, err = e.fs.Fs_open(ustr.Ustr("new"), defs.O_CREAT|defs.O_RDWR, 0, e.cwd, 0, 0)
+		if err != -defs.EROFS {
+			t.Fatalf("create %v", err)
+		}
+		_, err = e.fs.Fs_open(ustr.Ustr("small"), defs.O_WRONLY, 0, e.cwd, 0, 0)
+		if err != -defs.EROFS {
+			t.Fatalf("open for writing %v", err)
+		}
+		_, err = e.fs.Fs_open(ustr.Ustr("d"), defs.O_RDWR, 0, e.cwd, 0, 0)
+		if err != -defs.EISDIR {
+			t.Fatalf("open dir for writing %v", err)
+		}
+		if err := e.fs.Fs_mkdir(ustr.Ustr("nd"), 0755, e.cwd); err != -defs.EROFS {
+			t.Fatalf("mkdir %v", err)
+		}
+		if err := e.fs.Fs_unlink(ustr.Ustr("small"), e.cwd, false); err != -defs.EROFS {
+			t.Fatalf("unlink %v", err)
+		}
+		f, err := e.fs.Fs_open(ustr.Ustr("big"), defs.O_RDONLY, 0, e.cwd, 0, 0)
+		if err != 0 {
+			t.Fatalf("open big failed %v", err)
+		}
+		if _, err := f.Fops.Write(mkData(1, SMALL)); err != -defs.EROFS {
+			t.Fatalf("write %v", err)
+		}
+		mi, err := f.Fops.Mmapi(mem.PGSIZE, mem.PGSIZE, false)
+		if err != 0 || len(mi) != 1 {
+			t.Fatalf("mmap failed %v", err)
+		}
+		pg := mem.Pg2bytes(mi[0].Pg)
+		if !bytes.Equal(pg[:], big[mem.PGSIZE:2*mem.PGSIZE]) {
+			t.Fatalf("bad mapped page")
+		}
+		if err := ShutdownExt2(e); err != -defs.EBUSY {
+			t.Fatalf("unmount busy %v", err)
+		}
+		f.Fops.Close()
+
+		// mounted on a tmpfs
+		tmp := fs.MkTmpfs(blockmem)
+		root := tmp.MkRootCwd()
+		if err := tmp.Fs_mkdir(ustr.Ustr("mnt"), 0755, root); err != 0 {
+			t.Fatalf("mkdir mnt failed %v", err)
+		}
+		vf := vfs.MkVfs(tmp)
+		if err := vf.Mount(ustr.Ustr("/mnt"), root, e.fs); err != 0 {
+			t.Fatalf("mount failed %v", err)
+		}
+		st := &stat.Stat_t{}
+		if err := vf.Fs_stat(ustr.Ustr("/mnt/d/e/f"), st, root); err != 0 || st.Size() != 6 {
+			t.Fatalf("stat through mount failed %v", err)
+		}
+		if err := vf.Fs_mkdir(ustr.Ustr("/mnt/x"), 0755, root); err != -defs.EROFS {
+			t.Fatalf("mkdir through mount %v", err)
+		}
+		if err := vf.Umount(ustr.Ustr("/mnt"), root); err != 0 {
+			t.Fatalf("umount failed %v", err)
+		}
+
+		if err := ShutdownExt2(e); err != 0 {
+			t.Fatalf("unmount failed %v", err)
+		}
+		os.Remove(dst)
+	}
+}
+
+//
+// Test partitions
+//
+
+const partlba = 2048
+
+// mkPartDisk copies the file system image src into the first partition of a
+// new disk dst, which has a GPT or an MBR partition table
+func mkPartDisk(t *testing.T, src, dst string, gpt bool) {
+	img, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("read %v: %v", src, err)
+	}
+	nsec := len(img) / 512
+	d := make([]byte, (partlba+nsec)*512)
+	copy(d[partlba*512:], img)
+	mbr := d[446:]
+	if gpt {
+		mbr[4] = 0xee
+		binary.LittleEndian.PutUint32(mbr[8:], 1)
+		binary.LittleEndian.PutUint32(mbr[12:], uint32(len(d)/512-1))
+
+		ent := d[2*512 : 2*512+128]
+		ent[0] = 0xaf // any non-zero type
+		copy(ent[16:], []byte{0x67, 0x45, 0x23, 0x01, 0xab, 0x89, 0xef, 0xcd,
+			0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+		binary.LittleEndian.PutUint64(ent[32:], partlba)
+		binary.LittleEndian.PutUint64(ent[40:], uint64(partlba+nsec-1))
+		for i, c := range "biscuit" {
+			binary.LittleEndian.PutUint16(ent[56+2*i:], uint16(c))
+		}
+
+		h := d[512:]
+		copy(h, "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x10000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], 1)
+		binary.LittleEndian.PutUint64(h[40:], 34)
+		binary.LittleEndian.PutUint64(h[48:], uint64(len(d)/512-1))
+		binary.LittleEndian.PutUint64(h[72:], 2)
+		binary.LittleEndian.PutUint32(h[80:], 128)
+		binary.LittleEndian.PutUint32(h[84:], 128)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(d[2*512:34*512]))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+	} else {
+		binary.LittleEndian.PutUint32(d[440:], 0xdeadbeef)
+		mbr[4] = 0x83
+		binary.LittleEndian.PutUint32(mbr[8:], partlba)
+		binary.LittleEndian.PutUint32(mbr[12:], uint32(nsec))
+	}
+	d[510] = 0x55
+	d[511] = 0xaa
+	if err := ioutil.WriteFile(dst, d, 0644); err != nil {
+		t.Fatalf("write %v: %v", dst, err)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	src := "tmp.img"
+	dst := "part.img"
+	MkDisk(src, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(src)
+	defer os.Remove(dst)
+
+	// a whole-disk image has no partitions
+	a := openDisk(src)
+	parts, err := fs.Disk_parts(a, blockmem)
+	if err != 0 || len(parts) != 0 {
+		t.Fatalf("whole disk has partitions %v %v", len(parts), err)
+	}
+	a.close()
+
+	specs := map[bool][]string{
+		true:  {"PARTLABEL=biscuit", "PARTUUID=01234567-89AB-cdef-0123-456789abcdef"},
+		false: {"PARTUUID=deadbeef-01"},
+	}
+	for _, gpt := range []bool{true, false} {
+		fmt.Printf("Test Partition gpt %v ...\n", gpt)
+		mkPartDisk(t, src, dst, gpt)
+
+		a := openDisk(dst)
+		parts, err := fs.Disk_parts(a, blockmem)
+		if err != 0 || len(parts) != 1 || parts[0].Num != 1 {
+			t.Fatalf("bad partitions %v %v", len(parts), err)
+		}
+		p := parts[0]
+		if n, _ := os.Stat(src); p.Nblocks() != int(n.Size())/fs.BSIZE {
+			t.Fatalf("bad partition size %v", p.Nblocks())
+		}
+		b := fs.MkBlock_newpage(p.Nblocks(), "test", blockmem, p, nil)
+		l := fs.MkBlkList()
+		l.PushBack(b)
+		req := fs.MkRequest(l, fs.BDEV_READ, true)
+		if p.Start(req) || req.Err != -defs.EIO {
+			t.Fatalf("read outside of partition %v", req.Err)
+		}
+		a.close()
+
+		d := ustr.Ustr("d/")
+		for i, spec := range specs[gpt] {
+			tfs, err := BootPart(dst, spec)
+			if err != 0 {
+				t.Fatalf("boot %v failed %v", spec, err)
+			}
+			if i == 0 {
+				if s := doTestSimple(tfs, d); s != "" {
+					t.Fatalf("doTestSimple failed %s\n", s)
+				}
+			}
+			doCheckSimple(tfs, d, t)
+			ShutdownFS(tfs)
+		}
+		if _, err := BootPart(dst, "PARTLABEL=nothere"); err != -defs.ENOENT {
+			t.Fatalf("boot missing partition %v", err)
+		}
+	}
+
+	// a corrupt GPT is rejected
+	mkPartDisk(t, src, dst, true)
+	img, _ := ioutil.ReadFile(dst)
+	img[2*512+32] ^= 1
+	ioutil.WriteFile(dst, img, 0644)
+	a = openDisk(dst)
+	if _, err := fs.Disk_parts(a, blockmem); err != -defs.EINVAL {
+		t.Fatalf("corrupt GPT accepted %v", err)
+	}
+	a.close()
+
+	// a partition whose byte offset overflows is ignored
+	mkPartDisk(t, src, dst, true)
+	img, _ = ioutil.ReadFile(dst)
+	ent := img[2*512:]
+	binary.LittleEndian.PutUint64(ent[32:], 1<<55)
+	binary.LittleEndian.PutUint64(ent[40:], 1<<55+7)
+	h := img[512:]
+	binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(img[2*512:34*512]))
+	binary.LittleEndian.PutUint32(h[16:], 0)
+	binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+	ioutil.WriteFile(dst, img, 0644)
+	a = openDisk(dst)
+	if parts, err := fs.Disk_parts(a, blockmem); err != 0 || len(parts) != 0 {
+		t.Fatalf("overflowing partition accepted %v %v", len(parts), err)
+	}
+	a.close()
+}
+
+//
+// Test loop devices
+//
+
+// completes writes of blocks that no cache holds
+type testcb_t struct {
+}
+
+func (cb *testcb_t) Relse(*fs.Bdev_block_t, string) {
+}
+
+// checks the loop devices stacked on the native file system mounted on /nmnt
+// from loop0
+func doTestLoopChain(t *testing.T, v *vfs.Vfs_t, tfs *Ufs_t, ioc fdops.Ioctl_i) {
+	if _, e := ioc.Ioctl(defs.LOOP_CLR_FD, 0, nil); e != -defs.EBUSY {
+		t.Fatalf("LOOP_CLR_FD of a mounted loop0 %v", e)
+	}
+	f, e := v.Fs_open(ustr.Ustr("/nmnt/img"), defs.O_RDWR|defs.O_CREAT, 0644, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open /nmnt/img failed %v", e)
+	}
+	defer f.Fops.Close()
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(make([]uint8, 2*fs.BSIZE))
+	if _, e := f.Fops.Write(ub); e != 0 {
+		t.Fatalf("write /nmnt/img failed %v", e)
+	}
+	// loop0's I/O cannot wait for a file on loop0
+	if _, e := ioc.Ioctl(defs.LOOP_SET_FD, 0, f.Fops); e != -defs.EBUSY {
+		t.Fatalf("loop0 over a file on loop0 %v", e)
+	}
+	l1, e := v.Fs_open(ustr.Ustr("/dev/loop1"), defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open /dev/loop1 failed %v", e)
+	}
+	defer l1.Fops.Close()
+	ioc1 := l1.Fops.(fdops.Ioctl_i)
+	if _, e := ioc1.Ioctl(defs.LOOP_SET_FD, 0, f.Fops); e != 0 {
+		t.Fatalf("loop1 over a file on loop0 %v", e)
+	}
+	d1, _ := fs.Disk_lookup("loop1")
+	b := fs.MkBlock_newpage(1, "test", blockmem, d1, &testcb_t{})
+	b.Data[0] = 0x55
+	b.Write()
+	buf := make([]uint8, 1)
+	ub.Fake_init(buf)
+	if c, e := f.Fops.Pread(ub, fs.BSIZE); e != 0 || c != 1 || buf[0] != 0x55 {
+		t.Fatalf("write through loop1 %v %v", c, e)
+	}
+	if _, e := ioc1.Ioctl(defs.LOOP_CLR_FD, 0, nil); e != 0 {
+		t.Fatalf("LOOP_CLR_FD loop1 failed %v", e)
+	}
+}
+
+func TestLoop(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, 2000)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test Loop %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	loop.Loop_init()
+	defer func() {
+		for i := 0; i < loop.NLOOP; i++ {
+			devfs.Unregister("loop" + strconv.Itoa(i))
+		}
+	}()
+	v := vfs.MkVfs(tfs.fs)
+	if e := tfs.MkDir(ustr.Ustr("dev")); e != 0 {
+		t.Fatalf("mkDir dev failed %v", e)
+	}
+	if e := v.Mount(ustr.Ustr("/dev"), tfs.cwd, devfs.MkDevfs()); e != 0 {
+		t.Fatalf("mount failed %v", e)
+	}
+	lf, e := v.Fs_open(ustr.Ustr("/dev/loop0"), defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open /dev/loop0 failed %v", e)
+	}
+	ioc, ok := lf.Fops.(fdops.Ioctl_i)
+	if !ok {
+		t.Fatalf("no ioctls")
+	}
+
+	// a file of 8 blocks, each filled with its block number
+	n := 8
+	img := make([]byte, n*fs.BSIZE)
+	for i := range img {
+		img[i] = byte(i / fs.BSIZE)
+	}
+	if e := tfs.MkFile(ustr.Ustr("img"), MkBuf(img)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	ff, e := tfs.fs.Fs_open(ustr.Ustr("img"), defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open img failed %v", e)
+	}
+	df, e := tfs.fs.Fs_open(ustr.Ustr("dev"), defs.O_RDONLY|defs.O_DIRECTORY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open dev failed %v", e)
+	}
+	if _, e := ioc.Ioctl(defs.LOOP_SET_FD, 0, df.Fops); e != -defs.EINVAL {
+		t.Fatalf("loop over a directory %v", e)
+	}
+	df.Fops.Close()
+	if _, e := ioc.Ioctl(defs.LOOP_SET_FD, 0, ff.Fops); e != 0 {
+		t.Fatalf("LOOP_SET_FD failed %v", e)
+	}
+	// the loop device holds its own reference to the file
+	ff.Fops.Close()
+	if _, e := ioc.Ioctl(defs.LOOP_SET_FD, 0, ff.Fops); e != -defs.EBUSY {
+		t.Fatalf("LOOP_SET_FD twice %v", e)
+	}
+
+	d, ok := fs.Disk_lookup("loop0")
+	if !ok || d.Nblocks() != n {
+		t.Fatalf("no loop0 disk %v", ok)
+	}
+	for i := 0; i < n; i++ {
+		b := fs.MkBlock_newpage(i, "test", blockmem, d, nil)
+		b.Read()
+		if b.Data[0] != uint8(i) || b.Data[fs.BSIZE-1] != uint8(i) {
+			t.Fatalf("bad block %v", i)
+		}
+	}
+	b := fs.MkBlock_newpage(n, "test", blockmem, d, nil)
+	l := fs.MkBlkList()
+	l.PushBack(b)
+	req := fs.MkRequest(l, fs.BDEV_READ, true)
+	if d.Start(req) || req.Err != -defs.EIO {
+		t.Fatalf("read past the end of loop0 %v", req.Err)
+	}
+	// the file doesn't hold a file system
+	if _, e := fs.MountFS(blockmem, d); e != -defs.EINVAL {
+		t.Fatalf("mounted a file without a file system %v", e)
+	}
+	b = fs.MkBlock_newpage(3, "test", blockmem, d, &testcb_t{})
+	for i := range b.Data {
+		b.Data[i] = 0xaa
+	}
+	b.Write()
+
+	// reading /dev/loop0 reads the file
+	buf := make([]uint8, fs.BSIZE)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	if c, e := lf.Fops.Pread(ub, 3*fs.BSIZE); e != 0 || c != fs.BSIZE || buf[0] != 0xaa {
+		t.Fatalf("pread /dev/loop0 %v %v", c, e)
+	}
+	// and stops at the end of the device
+	end := n * fs.BSIZE
+	ub.Fake_init(buf[:4])
+	if c, e := lf.Fops.Pread(ub, end-2); e != 0 || c != 2 {
+		t.Fatalf("pread across the end of /dev/loop0 %v %v", c, e)
+	}
+	ub.Fake_init(buf[:4])
+	if c, e := lf.Fops.Pread(ub, end); e != 0 || c != 0 {
+		t.Fatalf("pread past the end of /dev/loop0 %v %v", c, e)
+	}
+	ub.Fake_init(buf[:4])
+	if c, e := lf.Fops.Pwrite(ub, end-2); e != 0 || c != 2 {
+		t.Fatalf("pwrite across the end of /dev/loop0 %v %v", c, e)
+	}
+	ub.Fake_init(buf[:4])
+	if _, e := lf.Fops.Pwrite(ub, end); e != -defs.ENOSPC {
+		t.Fatalf("pwrite past the end of /dev/loop0 %v", e)
+	}
+	if st, e := tfs.Stat(ustr.Ustr("img")); e != 0 || int(st.Size()) != end {
+		t.Fatalf("img grew %v", e)
+	}
+
+	if _, e := ioc.Ioctl(defs.LOOP_CLR_FD, 0, nil); e != 0 {
+		t.Fatalf("LOOP_CLR_FD failed %v", e)
+	}
+	if _, ok := fs.Disk_lookup("loop0"); ok {
+		t.Fatalf("loop0 still attached")
+	}
+	if _, e := ioc.Ioctl(defs.LOOP_CLR_FD, 0, nil); e != -defs.ENXIO {
+		t.Fatalf("LOOP_CLR_FD twice %v", e)
+	}
+	data, e := tfs.Read(ustr.Ustr("img"))
+	if e != 0 || len(data) != len(img) || data[3*fs.BSIZE] != 0xaa || data[2*fs.BSIZE] != 2 {
+		t.Fatalf("bad img after write %v", e)
+	}
+
+	// mount an ext2 image stored in a file
+	if _, err := exec.LookPath("mke2fs"); err == nil {
+		dir := "loop.d"
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, "f"), []byte("in a loop"), 0644)
+		mkExt2(t, "ext2.img", dir, 1024)
+		defer os.Remove("ext2.img")
+		e2, _ := ioutil.ReadFile("ext2.img")
+		if e := tfs.MkFile(ustr.Ustr("e2"), MkBuf(e2)); e != 0 {
+			t.Fatalf("mkFile e2 failed %v", e)
+		}
+		ff, e := tfs.fs.Fs_open(ustr.Ustr("e2"), defs.O_RDWR, 0, tfs.cwd, 0, 0)
+		if e != 0 {
+			t.Fatalf("open e2 failed %v", e)
+		}
+		if _, e := ioc.Ioctl(defs.LOOP_SET_FD, 0, ff.Fops); e != 0 {
+			t.Fatalf("LOOP_SET_FD failed %v", e)
+		}
+		ff.Fops.Close()
+		d, _ := fs.Disk_lookup("loop0")
+		efs, e := fs.MkExt2(blockmem, d)
+		if e != 0 {
+			t.Fatalf("mkExt2 failed %v", e)
+		}
+		if e := tfs.MkDir(ustr.Ustr("mnt")); e != 0 {
+			t.Fatalf("mkDir mnt failed %v", e)
+		}
+		if e := v.Mount(ustr.Ustr("/mnt"), tfs.cwd, efs); e != 0 {
+			t.Fatalf("mount ext2 failed %v", e)
+		}
+		f, e := v.Fs_open(ustr.Ustr("/mnt/f"), defs.O_RDONLY, 0, tfs.cwd, 0, 0)
+		if e != 0 {
+			t.Fatalf("open /mnt/f failed %v", e)
+		}
+		ub.Fake_init(buf)
+		if c, e := f.Fops.Read(ub); e != 0 || string(buf[:c]) != "in a loop" {
+			t.Fatalf("read /mnt/f %v %v", c, e)
+		}
+		f.Fops.Close()
+		if e := v.Umount(ustr.Ustr("/mnt"), tfs.cwd); e != 0 {
+			t.Fatalf("umount failed %v", e)
+		}
+		if _, e := ioc.Ioctl(defs.LOOP_CLR_FD, 0, nil); e != 0 {
+			t.Fatalf("LOOP_CLR_FD failed %v", e)
+		}
+	}
+
+	// mount an image of the native file system stored in a file
+	MkDisk("native.img", nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove("native.img")
+	ni, _ := ioutil.ReadFile("native.img")
+	if e := tfs.MkFile(ustr.Ustr("ni"), MkBuf(ni)); e != 0 {
+		t.Fatalf("mkFile ni failed %v", e)
+	}
+	ff, e = tfs.fs.Fs_open(ustr.Ustr("ni"), defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open ni failed %v", e)
+	}
+	if _, e := ioc.Ioctl(defs.LOOP_SET_FD, 0, ff.Fops); e != 0 {
+		t.Fatalf("LOOP_SET_FD failed %v", e)
+	}
+	ff.Fops.Close()
+	d, _ = fs.Disk_lookup("loop0")
+	for round := 0; round < 2; round++ {
+		nfs, e := fs.MountFS(blockmem, d)
+		if e != 0 {
+			t.Fatalf("MountFS failed %v", e)
+		}
+		if _, e := fs.MountFS(blockmem, d); e != -defs.EBUSY {
+			t.Fatalf("MountFS of a mounted disk %v", e)
+		}
+		if _, e := fs.MkExt2(blockmem, d); e != -defs.EBUSY {
+			t.Fatalf("mkExt2 of a mounted disk %v", e)
+		}
+		if e := tfs.MkDir(ustr.Ustr("nmnt")); e != 0 && e != -defs.EEXIST {
+			t.Fatalf("mkDir nmnt failed %v", e)
+		}
+		if e := v.Mount(ustr.Ustr("/nmnt"), tfs.cwd, nfs); e != 0 {
+			t.Fatalf("mount native failed %v", e)
+		}
+		if round == 0 {
+			doTestLoopChain(t, v, tfs, ioc)
+		}
+		fl := defs.O_RDWR
+		if round == 0 {
+			fl |= defs.O_CREAT
+		}
+		f, e := v.Fs_open(ustr.Ustr("/nmnt/f"), fl, 0644, tfs.cwd, 0, 0)
+		if e != 0 {
+			t.Fatalf("open /nmnt/f failed %v", e)
+		}
+		if round == 0 {
+			ub.Fake_init([]uint8("native"))
+			if c, e := f.Fops.Write(ub); e != 0 || c != 6 {
+				t.Fatalf("write /nmnt/f %v %v", c, e)
+			}
+		} else {
+			ub.Fake_init(buf)
+			if c, e := f.Fops.Read(ub); e != 0 || string(buf[:c]) != "native" {
+				t.Fatalf("read /nmnt/f %v %v", c, e)
+			}
+		}
+		f.Fops.Close()
+		if e := v.Umount(ustr.Ustr("/nmnt"), tfs.cwd); e != 0 {
+			t.Fatalf("umount native failed %v", e)
+		}
+	}
+	if _, e := ioc.Ioctl(defs.LOOP_CLR_FD, 0, nil); e != 0 {
+		t.Fatalf("LOOP_CLR_FD failed %v", e)
+	}
+
+	lf.Fops.Close()
+	if e := v.Umount(ustr.Ustr("/dev"), tfs.cwd); e != 0 {
+		t.Fatalf("umount /dev failed %v", e)
+	}
+	ShutdownFS(tfs)
+}
+
+//
+// Test RAID-1
+//
+
+// a disk whose requests fail while fail is set
+type faildisk_t struct {
+	*ahci_disk_t
+	fail bool
+}
+
+func (fd *faildisk_t) Start(req *fs.Bdev_req_t) bool {
+	if fd.fail {
+		req.Err = -defs.EIO
+		return false
+	}
+	return fd.ahci_disk_t.Start(req)
+}
+
+func waitRaid(t *testing.T, r *fs.Raid1_t, i int) {
+	for n := 0; r.State(i) != fs.RAID_OK; n++ {
+		if n > 1000 {
+			t.Fatalf("member %v not in sync: %v", i, r.State(i))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaid1(t *testing.T) {
+	s := "s.img"
+	a := "a.img"
+	b := "b.img"
+	n := "n.img"
+	MkDisk(s, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(s)
+	defer os.Remove(a)
+	defer os.Remove(b)
+	defer os.Remove(n)
+	if err := RaidDisks(s, []string{a, b}); err != 0 {
+		t.Fatalf("RaidDisks failed %v", err)
+	}
+
+	fmt.Printf("Test RAID-1 ...\n")
+
+	da := openDisk(a)
+	db := &faildisk_t{ahci_disk_t: openDisk(b)}
+	if _, err := fs.MkRaid1([]fs.Disk_i{da}, blockmem); err != -defs.EINVAL {
+		t.Fatalf("mirror of one disk %v", err)
+	}
+	r, err := fs.Raid1_assemble([]fs.Disk_i{da, db}, blockmem)
+	if err != 0 {
+		t.Fatalf("Raid1_assemble failed %v", err)
+	}
+	if r.State(1) != fs.RAID_OK {
+		t.Fatalf("new member not in sync %v", r.State(1))
+	}
+	tfs := &Ufs_t{}
+	_, tfs.fs = fs.StartFS(blockmem, r, c, true)
+	tfs.cwd = tfs.fs.MkRootCwd()
+
+	d1 := ustr.Ustr("d1/")
+	if s := doTestSimple(tfs, d1); s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+
+	// the file system keeps going on one disk
+	db.fail = true
+	d2 := ustr.Ustr("d2/")
+	if s := doTestSimple(tfs, d2); s != "" {
+		t.Fatalf("doTestSimple degraded failed %s\n", s)
+	}
+	if r.State(1) != fs.RAID_FAILED {
+		t.Fatalf("member not failed %v", r.State(1))
+	}
+	doCheckSimple(tfs, d1, t)
+	if r.Readd(0) != -defs.EBUSY {
+		t.Fatalf("readd of a good member")
+	}
+
+	// the recovered disk gets the writes it missed
+	db.fail = false
+	if err := r.Readd(1); err != 0 {
+		t.Fatalf("readd failed %v", err)
+	}
+	waitRaid(t, r, 1)
+	tfs.fs.StopFS()
+	da.close()
+	db.close()
+
+	for _, m := range []string{a, b} {
+		tfs := BootFS(m)
+		doCheckSimple(tfs, d1, t)
+		doCheckSimple(tfs, d2, t)
+		ShutdownFS(tfs)
+	}
+
+	// a new disk gets all of the mirror's blocks
+	f, uerr := os.Create(n)
+	if uerr != nil {
+		t.Fatalf("create failed %v", uerr)
+	}
+	st, _ := os.Stat(a)
+	f.Truncate(st.Size())
+	f.Close()
+	da = openDisk(a)
+	db = &faildisk_t{ahci_disk_t: openDisk(b)}
+	dn := openDisk(n)
+	r, _ = fs.Raid1_assemble([]fs.Disk_i{da, db}, blockmem)
+	if r.Replace(1, dn) != -defs.EBUSY {
+		t.Fatalf("replace of a good member")
+	}
+	r.Fail(1)
+	if err := r.Replace(1, dn); err != 0 {
+		t.Fatalf("replace failed %v", err)
+	}
+	waitRaid(t, r, 1)
+	da.close()
+	db.close()
+	dn.close()
+	ia, _ := ioutil.ReadFile(a)
+	in, _ := ioutil.ReadFile(n)
+	sz := r.Nblocks() * fs.BSIZE
+	if !bytes.Equal(ia[:sz], in[:sz]) {
+		t.Fatalf("new member differs")
+	}
+}
+
+// rwBlock reads block bn of image p into buf, or writes buf to it
+func rwBlock(t *testing.T, p string, bn int, buf []uint8, write bool) {
+	f, err := os.OpenFile(p, os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatalf("open %v failed %v", p, err)
+	}
+	defer f.Close()
+	if write {
+		_, err = f.WriteAt(buf, int64(bn*fs.BSIZE))
+	} else {
+		_, err = f.ReadAt(buf, int64(bn*fs.BSIZE))
+	}
+	if err != nil {
+		t.Fatalf("rw %v failed %v", p, err)
+	}
+}
+
+func assembleRaid(t *testing.T, ps ...string) (*fs.Raid1_t, []*ahci_disk_t) {
+	var ds []*ahci_disk_t
+	var dis []fs.Disk_i
+	for _, p := range ps {
+		d := openDisk(p)
+		ds = append(ds, d)
+		dis = append(dis, d)
+	}
+	r, err := fs.Raid1_assemble(dis, blockmem)
+	if err != 0 {
+		t.Fatalf("Raid1_assemble failed %v", err)
+	}
+	return r, ds
+}
+
+func TestRaid1Assemble(t *testing.T) {
+	s := "s.img"
+	a := "a.img"
+	b := "b.img"
+	MkDisk(s, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(s)
+	defer os.Remove(a)
+	defer os.Remove(b)
+	if err := RaidDisks(s, []string{a, b}); err != 0 {
+		t.Fatalf("RaidDisks failed %v", err)
+	}
+
+	fmt.Printf("Test RAID-1 assembly ...\n")
+
+	ds0 := openDisk(s)
+	if _, err := fs.Raid1_assemble([]fs.Disk_i{ds0}, blockmem); err != -defs.ENODEV {
+		t.Fatalf("assembled a disk without metadata %v", err)
+	}
+	ds0.close()
+
+	// member 1 fails and misses writes, and the mirror isn't shut down
+	// cleanly
+	da := openDisk(a)
+	db := &faildisk_t{ahci_disk_t: openDisk(b)}
+	r, err := fs.Raid1_assemble([]fs.Disk_i{da, db}, blockmem)
+	if err != 0 {
+		t.Fatalf("Raid1_assemble failed %v", err)
+	}
+	tfs := &Ufs_t{}
+	_, tfs.fs = fs.StartFS(blockmem, r, c, true)
+	tfs.cwd = tfs.fs.MkRootCwd()
+	d1 := ustr.Ustr("d1/")
+	if s := doTestSimple(tfs, d1); s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+	db.fail = true
+	d2 := ustr.Ustr("d2/")
+	if s := doTestSimple(tfs, d2); s != "" {
+		t.Fatalf("doTestSimple degraded failed %s\n", s)
+	}
+	tfs.fs.StopFS()
+	da.close()
+	db.close()
+
+	// without member 1, the mirror runs degraded
+	r, ds := assembleRaid(t, a)
+	if r.State(0) != fs.RAID_OK || r.State(1) != fs.RAID_FAILED {
+		t.Fatalf("degraded states %v %v", r.State(0), r.State(1))
+	}
+	if r.Readd(1) != -defs.EINVAL {
+		t.Fatalf("readd of an absent member")
+	}
+	ds[0].close()
+
+	// member 1 gets the writes it missed
+	r, ds = assembleRaid(t, b, a)
+	waitRaid(t, r, 1)
+	ds[0].close()
+	ds[1].close()
+	tfs = BootFS(b)
+	doCheckSimple(tfs, d1, t)
+	doCheckSimple(tfs, d2, t)
+	ShutdownFS(tfs)
+
+	// after an unclean shutdown, member 1 gets all blocks, even one that
+	// differs without a dirty bit
+	last := r.Nblocks() - 1
+	junk := bytes.Repeat([]uint8{0xa5}, fs.BSIZE)
+	good := make([]uint8, fs.BSIZE)
+	rwBlock(t, a, last, good, false)
+	rwBlock(t, b, last, junk, true)
+	r, ds = assembleRaid(t, a, b)
+	if r.State(1) == fs.RAID_OK {
+		t.Fatalf("member in sync after an unclean shutdown")
+	}
+	waitRaid(t, r, 1)
+
+	// after a clean shutdown, no member is resynchronized
+	if err := r.Markclean(); err != 0 {
+		t.Fatalf("Markclean failed %v", err)
+	}
+	ds[0].close()
+	ds[1].close()
+	got := make([]uint8, fs.BSIZE)
+	rwBlock(t, b, last, got, false)
+	if !bytes.Equal(got, good) {
+		t.Fatalf("resync missed a block")
+	}
+	rwBlock(t, b, last, junk, true)
+	r, ds = assembleRaid(t, a, b)
+	if r.State(0) != fs.RAID_OK || r.State(1) != fs.RAID_OK {
+		t.Fatalf("clean states %v %v", r.State(0), r.State(1))
+	}
+	ds[0].close()
+	ds[1].close()
+	rwBlock(t, b, last, got, false)
+	if !bytes.Equal(got, junk) {
+		t.Fatalf("clean member resynchronized")
+	}
+}
+
+//
+// Test disk encryption
+//
+
+func TestXts(t *testing.T) {
+	// IEEE 1619 test vectors 1, 2, and 4 (first 32 bytes)
+	vecs := []struct {
+		key    string
+		sector uint64
+		pt, ct string
+	}{
+		{strings.Repeat("00", 32), 0, strings.Repeat("00", 32),
+			"917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e"},
+		{strings.Repeat("11", 16) + strings.Repeat("22", 16), 0x3333333333,
+			strings.Repeat("44", 32),
+			"c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0"},
+		{"2718281828459045235360287471352631415926535897932384626433832795", 0,
+			"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"27a7479befa1d476489f308cd4cfa6e2a96e4bbe3208ff25287dd3819616e89c"},
+	}
+	for i, v := range vecs {
+		key, _ := hex.DecodeString(v.key)
+		pt, _ := hex.DecodeString(v.pt)
+		x, err := fs.MkXts(key)
+		if err != 0 {
+			t.Fatalf("MkXts failed %v", err)
+		}
+		ct := make([]uint8, len(pt))
+		x.Encrypt(ct, pt, v.sector)
+		if hex.EncodeToString(ct) != v.ct {
+			t.Fatalf("vector %v: bad ciphertext %x", i+1, ct)
+		}
+		x.Decrypt(ct, ct, v.sector)
+		if !bytes.Equal(ct, pt) {
+			t.Fatalf("vector %v: bad plaintext %x", i+1, ct)
+		}
+	}
+	if _, err := fs.MkXts(make([]uint8, 16)); err != -defs.EINVAL {
+		t.Fatalf("short key %v", err)
+	}
+}
+
+func TestCrypt(t *testing.T) {
+	src := "tmp.img"
+	dst := "crypt.img"
+	MkDisk(src, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(src)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test Crypt ...\n")
+
+	key := make([]uint8, 64)
+	for i := range key {
+		key[i] = uint8(i * 7)
+	}
+	CryptDisk(src, dst, key)
+
+	// the superblock isn't in the clear
+	plain, _ := ioutil.ReadFile(src)
+	enc, _ := ioutil.ReadFile(dst)
+	if len(plain) != len(enc) {
+		t.Fatalf("bad size %v %v", len(plain), len(enc))
+	}
+	sb := plain[fs.BSIZE : 2*fs.BSIZE]
+	if bytes.Equal(sb, enc[fs.BSIZE:2*fs.BSIZE]) {
+		t.Fatalf("superblock not encrypted")
+	}
+
+	d := ustr.Ustr("d/")
+	tfs, err := BootCrypt(dst, key)
+	if err != 0 {
+		t.Fatalf("boot failed %v", err)
+	}
+	if s := doTestSimple(tfs, d); s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+	secret := []byte("attack at dawn")
+	if e := tfs.MkFile(ustr.Ustr("secret"), MkBuf(secret)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	doCheckSimple(tfs, d, t)
+	ShutdownFS(tfs)
+
+	tfs, err = BootCrypt(dst, key)
+	if err != 0 {
+		t.Fatalf("reboot failed %v", err)
+	}
+	doCheckSimple(tfs, d, t)
+	if data, e := tfs.Read(ustr.Ustr("secret")); e != 0 || !bytes.Equal(data, secret) {
+		t.Fatalf("bad secret %v", e)
+	}
+	ShutdownFS(tfs)
+
+	// the file data isn't in the clear either
+	enc, _ = ioutil.ReadFile(dst)
+	if bytes.Contains(enc, secret) {
+		t.Fatalf("data not encrypted")
+	}
+	if _, err := BootCrypt(dst, key[:10]); err != -defs.EINVAL {
+		t.Fatalf("boot with a bad key %v", err)
+	}
+}
+
+//
+// Test discarding freed blocks
+//
+
+func diskBlocks(t *testing.T, dst string) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dst, &st); err != nil {
+		t.Fatalf("stat %v failed %v", dst, err)
+	}
+	return st.Blocks
+}
+
+func TestDiscard(t *testing.T) {
+	dst := "tmp.img"
+	nblk := 100
+	MkDisk(dst, nil, nlogblks, ninodeblks, 2*nblk)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test Discard ...\n")
+
+	d := ustr.Ustr("d/")
+	tfs := BootFS(dst)
+	if s := doTestSimple(tfs, d); s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+	fn := ustr.Ustr("f")
+	if e := tfs.MkFile(fn, mkData(1, nblk*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", fn, e)
+	}
+	tfs.Sync()
+	before := diskBlocks(t, dst)
+
+	if e := tfs.Unlink(fn); e != 0 {
+		t.Fatalf("unlink %v failed %v", fn, e)
+	}
+	tfs.Sync()
+	for n := 0; tfs.ahci.discarded() < nblk; n++ {
+		if n > 1000 {
+			t.Fatalf("only %v blocks discarded", tfs.ahci.discarded())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := diskBlocks(t, dst); before-after < int64(nblk*fs.BSIZE/512) {
+		t.Fatalf("discarded blocks still on disk %v %v", before, after)
+	}
+
+	// the discarded blocks are allocated again
+	if e := tfs.MkFile(fn, mkData(2, nblk*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", fn, e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	doCheckSimple(tfs, d, t)
+	data, e := tfs.Read(fn)
+	if e != 0 || len(data) != nblk*fs.BSIZE {
+		t.Fatalf("read %v failed %v %v", fn, e, len(data))
+	}
+	for i, v := range data {
+		if v != 2 {
+			t.Fatalf("wrong byte %v at %v", v, i)
+		}
+	}
+	ShutdownFS(tfs)
+}
+
+// a disk whose first discard waits until resume is closed
+type trimdisk_t struct {
+	*ahci_disk_t
+	once    sync.Once
+	started chan bool
+	resume  chan bool
+}
+
+func (td *trimdisk_t) Start(req *fs.Bdev_req_t) bool {
+	if req.Cmd == fs.BDEV_DISCARD {
+		td.once.Do(func() {
+			td.started <- true
+			<-td.resume
+		})
+	}
+	return td.ahci_disk_t.Start(req)
+}
+
+func TestDiscardAlloc(t *testing.T) {
+	dst := "tmp.img"
+	nblk := 100
+	MkDisk(dst, nil, nlogblks, ninodeblks, 3*nblk)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test allocation during a discard ...\n")
+
+	tfs := &Ufs_t{ahci: openDisk(dst)}
+	td := &trimdisk_t{ahci_disk_t: tfs.ahci, started: make(chan bool),
+		resume: make(chan bool)}
+	_, tfs.fs = fs.StartFS(blockmem, td, c, true)
+	tfs.cwd = tfs.fs.MkRootCwd()
+	f1 := ustr.Ustr("f1")
+	if e := tfs.MkFile(f1, mkData(1, nblk*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f1, e)
+	}
+	tfs.Sync()
+	if e := tfs.Unlink(f1); e != 0 {
+		t.Fatalf("unlink %v failed %v", f1, e)
+	}
+	tfs.Sync()
+	select {
+	case <-td.started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no discard")
+	}
+
+	// blocks are allocated while the discard is in flight, but not the
+	// blocks it discards
+	f2 := ustr.Ustr("f2")
+	done := make(chan defs.Err_t)
+	go func() {
+		done <- tfs.MkFile(f2, mkData(2, nblk*fs.BSIZE))
+	}()
+	select {
+	case e := <-done:
+		if e != 0 {
+			t.Fatalf("mkFile %v failed %v", f2, e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("allocation waited for the discard")
+	}
+	close(td.resume)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	data, e := tfs.Read(f2)
+	if e != 0 || len(data) != nblk*fs.BSIZE {
+		t.Fatalf("read %v failed %v %v", f2, e, len(data))
+	}
+	for i, v := range data {
+		if v != 2 {
+			t.Fatalf("wrong byte %v at %v", v, i)
+		}
+	}
+	ShutdownFS(tfs)
+}
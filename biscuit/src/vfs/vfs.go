@@ -0,0 +1,505 @@
+package vfs
+
+import "sync"
+
+import "bpath"
+import "defs"
+import "fd"
+import "stat"
+import "ustr"
+
+// The virtual file system layer.  Every file system implements Fs_i, and the
+// mount table records, for each mounted file system, the directory it covers:
+// the mount on which the directory is and the directory's inode number.  A
+// path is resolved component by component, starting at the root mount or at
+// the mount of the cwd; whenever a component names a covered directory, the
+// walk continues at the root of the file system mounted on it, and ".." at
+// the root of a mounted file system continues at the covered directory.  The
+// rest of the path is passed to the file system on which the walk ends, which
+// resolves it relative to the last directory crossed, or to the cwd.  Since
+// mounts are keyed by inode, renaming a covered directory or its ancestors
+// doesn't change which mounts a path crosses.  Each mount holds references to
+// the directory it covers and to the root of its file system.
+
+// operations of a file system on paths. all paths relative to cwd, which
+// belongs to the same file system, except if the path is absolute, in which
+// case it is relative to the file system's root.
+type Fs_i interface {
+	Fs_open(ustr.Ustr, defs.Fdopt_t, int, *fd.Cwd_t, int, int) (*fd.Fd_t, defs.Err_t)
+	// creates a special file, failing with EEXIST if it exists and excl is
+	// true, and returns its inode number
+	Fs_mknod(paths ustr.Ustr, excl bool, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t)
+	Fs_stat(ustr.Ustr, *stat.Stat_t, *fd.Cwd_t) defs.Err_t
+	Fs_mkdir(ustr.Ustr, int, *fd.Cwd_t) defs.Err_t
+	Fs_unlink(ustr.Ustr, *fd.Cwd_t, bool) defs.Err_t
+	Fs_linkat(ustr.Ustr, *fd.Cwd_t, ustr.Ustr, *fd.Cwd_t) defs.Err_t
+	Fs_renameat(ustr.Ustr, *fd.Cwd_t, ustr.Ustr, *fd.Cwd_t) defs.Err_t
+	// returns a Cwd_t for the directory open as the file system's file f
+	Fs_atcwd(f *fd.Fd_t) (*fd.Cwd_t, defs.Err_t)
+	// returns true if f is open on the file system. only directories need
+	// be recognized.
+	Fs_owns(f *fd.Fd_t) bool
+	MkRootCwd() *fd.Cwd_t
+	Fs_sync() defs.Err_t
+	// fails with EBUSY if a file of the file system is in use, i.e., open
+	// or the cwd of a process. otherwise, the file system is written to
+	// disk and stopped.
+	Fs_unmount() defs.Err_t
+}
+
+type mount_t struct {
+	fs Fs_i
+	// the root directory, open, and its inode number
+	root  *fd.Cwd_t
+	rinum defs.Inum_t
+	// the mount of the covered directory, the directory, open, and its
+	// inode number. nil for the root file system.
+	parent  *mount_t
+	covered *fd.Cwd_t
+	cinum   defs.Inum_t
+}
+
+type Vfs_t struct {
+	// readers are path operations, writers mount and unmount
+	sync.RWMutex
+	// in the order of mounting, the root file system first
+	mounts []*mount_t
+}
+
+func MkVfs(root Fs_i) *Vfs_t {
+	vfs := &Vfs_t{}
+	m := &mount_t{fs: root, root: root.MkRootCwd()}
+	inum, err := m.inum(ustr.MkUstrRoot(), m.root)
+	if err != 0 {
+		panic("no root directory")
+	}
+	m.rinum = inum
+	vfs.mounts = append(vfs.mounts, m)
+	return vfs
+}
+
+// returns the canonical absolute path of paths relative to cwd. unlike
+// bpath.Canonicalize, it doesn't modify paths.
+func canonical(paths ustr.Ustr, cwd *fd.Cwd_t) ustr.Ustr {
+	var p ustr.Ustr
+	if paths.IsAbsolute() {
+		p = append(p, paths...)
+	} else {
+		p = append(p, cwd.Path...)
+		p = append(p, '/')
+		p = append(p, paths...)
+	}
+	if len(p) == 0 || p[0] != '/' {
+		p = append(ustr.Ustr{'/'}, p...)
+	}
+	return bpath.Canonicalize(p)
+}
+
+// returns the inode number of rel, relative to cwd, on m's file system
+func (m *mount_t) inum(rel ustr.Ustr, cwd *fd.Cwd_t) (defs.Inum_t, defs.Err_t) {
+	p := ustr.MkUstrDot()
+	if len(rel) != 0 {
+		p = append(ustr.Ustr{}, rel...)
+	}
+	st := &stat.Stat_t{}
+	if err := m.fs.Fs_stat(p, st, cwd); err != 0 {
+		return 0, err
+	}
+	return defs.Inum_t(st.Rino()), 0
+}
+
+// returns the mount whose file system the directory f belongs to, or nil.
+// the caller holds the vfs lock.
+func (vfs *Vfs_t) owner(f *fd.Fd_t) *mount_t {
+	for i := len(vfs.mounts) - 1; i >= 0; i-- {
+		if vfs.mounts[i].fs.Fs_owns(f) {
+			return vfs.mounts[i]
+		}
+	}
+	return nil
+}
+
+// returns the mount last mounted on the directory inum of m, or nil. the
+// caller holds the vfs lock.
+func (vfs *Vfs_t) covering(m *mount_t, inum defs.Inum_t) *mount_t {
+	for i := len(vfs.mounts) - 1; i >= 0; i-- {
+		o := vfs.mounts[i]
+		if o.parent == m && o.cinum == inum {
+			return o
+		}
+	}
+	return nil
+}
+
+// returns true if a file system is mounted on a directory of m
+func (vfs *Vfs_t) covers(m *mount_t) bool {
+	for _, o := range vfs.mounts {
+		if o.parent == m {
+			return true
+		}
+	}
+	return false
+}
+
+func join(rel, c ustr.Ustr) ustr.Ustr {
+	if len(rel) != 0 {
+		rel = append(rel, '/')
+	}
+	return append(rel, c...)
+}
+
+// a walk on a mount's file system: dir is the directory reached so far, open,
+// and pend the components of the path past dir. the walk opens the
+// directories of pend only when it needs the inode number of the path, and
+// then looks up each component relative to the one before, so a path is
+// walked once rather than from its start for every component.
+type walk_t struct {
+	m    *mount_t
+	dir  *fd.Cwd_t
+	own  bool // the walk opened dir
+	pend []ustr.Ustr
+}
+
+// moves the walk to the directory dir of m
+func (w *walk_t) reset(m *mount_t, dir *fd.Cwd_t) {
+	w.close()
+	w.m, w.dir, w.pend = m, dir, w.pend[:0]
+}
+
+func (w *walk_t) close() {
+	if w.own {
+		w.dir.Fd.Fops.Close()
+		w.own = false
+	}
+}
+
+// returns the inode number of the path walked so far
+func (w *walk_t) inum() (defs.Inum_t, defs.Err_t) {
+	if len(w.pend) == 0 {
+		return w.m.inum(nil, w.dir)
+	}
+	last := len(w.pend) - 1
+	for _, c := range w.pend[:last] {
+		f, err := w.m.fs.Fs_open(append(ustr.Ustr{}, c...),
+			defs.O_RDONLY|defs.O_DIRECTORY, 0, w.dir, 0, 0)
+		if err != 0 {
+			return 0, err
+		}
+		w.close()
+		w.dir, w.own = &fd.Cwd_t{Fd: f}, true
+	}
+	w.pend = append(w.pend[:0], w.pend[last])
+	return w.m.inum(w.pend[0], w.dir)
+}
+
+// returns the mount on which paths, relative to cwd, resides and the path and
+// cwd to pass to the mount's file system. the caller holds the vfs lock.
+func (vfs *Vfs_t) resolve(paths ustr.Ustr, cwd *fd.Cwd_t) (*mount_t, ustr.Ustr, *fd.Cwd_t, defs.Err_t) {
+	m := vfs.mounts[0]
+	base := m.root
+	if !paths.IsAbsolute() {
+		if m = vfs.owner(cwd.Fd); m == nil {
+			return nil, nil, nil, -defs.ENOENT
+		}
+		base = cwd
+	}
+	if len(vfs.mounts) == 1 {
+		return m, paths, base, 0
+	}
+
+	// rel is relative to base, and cur is its inode number if known
+	var rel ustr.Ustr
+	cur, known := m.rinum, base == m.root
+	w := &walk_t{m: m, dir: base}
+	defer w.close()
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for c, ok := pp.Next(); ok; c, ok = pp.Next() {
+		if c.Isdotdot() {
+			for m.parent != nil {
+				if !known {
+					inum, err := w.inum()
+					if err != 0 {
+						return nil, nil, nil, err
+					}
+					cur, known = inum, true
+				}
+				if cur != m.rinum {
+					break
+				}
+				// continue at the covered directory
+				cur = m.cinum
+				base = m.covered
+				m = m.parent
+				rel = nil
+				w.reset(m, base)
+			}
+			rel = join(rel, c)
+			w.pend = append(w.pend, c)
+			known = false
+			continue
+		}
+		rel = join(rel, c)
+		w.pend = append(w.pend, c)
+		known = false
+		if !vfs.covers(m) {
+			continue
+		}
+		inum, err := w.inum()
+		if err != 0 {
+			// the file system fails, or creates the last component
+			for c, ok = pp.Next(); ok; c, ok = pp.Next() {
+				rel = join(rel, c)
+			}
+			break
+		}
+		cur, known = inum, true
+		for o := vfs.covering(m, cur); o != nil; o = vfs.covering(m, cur) {
+			m, base, rel = o, o.root, nil
+			cur = o.rinum
+			w.reset(m, base)
+		}
+	}
+	if len(rel) == 0 {
+		if base == m.root {
+			rel = ustr.MkUstrRoot()
+		} else {
+			rel = ustr.MkUstrDot()
+		}
+	}
+	return m, rel, base, 0
+}
+
+// returns true if rel, relative to cwd, is the root of m, which covers a
+// directory and which cannot be removed or replaced while m is mounted
+func (vfs *Vfs_t) ismntpt(m *mount_t, rel ustr.Ustr, cwd *fd.Cwd_t) bool {
+	if m.parent == nil {
+		return false
+	}
+	inum, err := m.inum(rel, cwd)
+	return err == 0 && inum == m.rinum
+}
+
+func (vfs *Vfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	m, rel, rcwd, err := vfs.resolve(paths, cwd)
+	if err != 0 {
+		return nil, err
+	}
+	f, err := m.fs.Fs_open(rel, flags, mode, rcwd, major, minor)
+	if err != 0 {
+		return nil, err
+	}
+	f.Path = canonical(paths, cwd)
+	return f, 0
+}
+
+func (vfs *Vfs_t) Fs_mknod(paths ustr.Ustr, excl bool, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	m, rel, rcwd, err := vfs.resolve(paths, cwd)
+	if err != 0 {
+		return 0, err
+	}
+	return m.fs.Fs_mknod(rel, excl, rcwd, major, minor)
+}
+
+func (vfs *Vfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	m, rel, rcwd, err := vfs.resolve(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	return m.fs.Fs_stat(rel, st, rcwd)
+}
+
+func (vfs *Vfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	m, rel, rcwd, err := vfs.resolve(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	return m.fs.Fs_mkdir(rel, mode, rcwd)
+}
+
+func (vfs *Vfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	m, rel, rcwd, err := vfs.resolve(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	if vfs.ismntpt(m, rel, rcwd) {
+		return -defs.EBUSY
+	}
+	return m.fs.Fs_unlink(rel, rcwd, wantdir)
+}
+
+func (vfs *Vfs_t) Fs_linkat(old ustr.Ustr, ocwd *fd.Cwd_t, new ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	om, orel, orcwd, err := vfs.resolve(old, ocwd)
+	if err != 0 {
+		return err
+	}
+	nm, nrel, nrcwd, err := vfs.resolve(new, ncwd)
+	if err != 0 {
+		return err
+	}
+	if om != nm {
+		return -defs.EXDEV
+	}
+	return om.fs.Fs_linkat(orel, orcwd, nrel, nrcwd)
+}
+
+func (vfs *Vfs_t) Fs_renameat(oldp ustr.Ustr, ocwd *fd.Cwd_t, newp ustr.Ustr, ncwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	om, orel, orcwd, err := vfs.resolve(oldp, ocwd)
+	if err != 0 {
+		return err
+	}
+	nm, nrel, nrcwd, err := vfs.resolve(newp, ncwd)
+	if err != 0 {
+		return err
+	}
+	if om != nm {
+		return -defs.EXDEV
+	}
+	if vfs.ismntpt(om, orel, orcwd) || vfs.ismntpt(nm, nrel, nrcwd) {
+		return -defs.EBUSY
+	}
+	return om.fs.Fs_renameat(orel, orcwd, nrel, nrcwd)
+}
+
+// returns a Cwd_t for resolving paths relative to the directory open as f.
+// the caller drops the Cwd_t's reference to the directory by closing its Fd.
+func (vfs *Vfs_t) Fs_atcwd(f *fd.Fd_t) (*fd.Cwd_t, defs.Err_t) {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	m := vfs.owner(f)
+	if m == nil {
+		return nil, -defs.ENOTDIR
+	}
+	cwd, err := m.fs.Fs_atcwd(f)
+	if err != 0 {
+		return nil, err
+	}
+	cwd.Path = f.Path
+	return cwd, 0
+}
+
+// syncs all mounted file systems
+func (vfs *Vfs_t) Fs_sync() defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+
+	var ret defs.Err_t
+	for _, m := range vfs.mounts {
+		if err := m.fs.Fs_sync(); err != 0 && ret == 0 {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// opens the root directory of fs
+func openroot(fs Fs_i) (*fd.Cwd_t, defs.Err_t) {
+	f, err := fs.Fs_open(ustr.MkUstrRoot(), defs.O_RDONLY|defs.O_DIRECTORY,
+		0, fs.MkRootCwd(), 0, 0)
+	if err != 0 {
+		return nil, err
+	}
+	return fd.MkRootCwd(f), 0
+}
+
+// mounts fs on the directory target
+func (vfs *Vfs_t) Mount(target ustr.Ustr, cwd *fd.Cwd_t, fs Fs_i) defs.Err_t {
+	vfs.Lock()
+	defer vfs.Unlock()
+
+	m, rel, rcwd, err := vfs.resolve(target, cwd)
+	if err != 0 {
+		return err
+	}
+	st := &stat.Stat_t{}
+	if err := m.fs.Fs_stat(rel, st, rcwd); err != 0 {
+		return err
+	}
+	if st.Mode()&stat.S_IFMT != stat.S_IFDIR {
+		return -defs.ENOTDIR
+	}
+	cf, err := m.fs.Fs_open(rel, defs.O_RDONLY|defs.O_DIRECTORY, 0, rcwd, 0, 0)
+	if err != 0 {
+		return err
+	}
+	root, err := openroot(fs)
+	if err != 0 {
+		cf.Fops.Close()
+		return err
+	}
+	nm := &mount_t{fs: fs, root: root, parent: m, cinum: defs.Inum_t(st.Rino())}
+	nm.covered = &fd.Cwd_t{Fd: cf, Path: canonical(target, cwd)}
+	if nm.rinum, err = nm.inum(ustr.MkUstrRoot(), root); err != 0 {
+		root.Fd.Fops.Close()
+		cf.Fops.Close()
+		return err
+	}
+	vfs.mounts = append(vfs.mounts, nm)
+	return 0
+}
+
+// unmounts the file system last mounted on target
+func (vfs *Vfs_t) Umount(target ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.Lock()
+	defer vfs.Unlock()
+
+	m, rel, rcwd, err := vfs.resolve(target, cwd)
+	if err != 0 {
+		return err
+	}
+	if m == vfs.mounts[0] {
+		if inum, err := m.inum(rel, rcwd); err == 0 && inum == m.rinum {
+			return -defs.EBUSY
+		}
+		return -defs.EINVAL
+	}
+	if !vfs.ismntpt(m, rel, rcwd) {
+		return -defs.EINVAL
+	}
+	// file systems mounted below m keep it busy
+	if vfs.covers(m) {
+		return -defs.EBUSY
+	}
+	// the mount's own reference to the root doesn't make it busy
+	m.root.Fd.Fops.Close()
+	if err := m.fs.Fs_unmount(); err != 0 {
+		root, rerr := openroot(m.fs)
+		if rerr != 0 {
+			panic("cannot reopen root")
+		}
+		m.root = root
+		return err
+	}
+	m.covered.Fd.Fops.Close()
+	for i, o := range vfs.mounts {
+		if o == m {
+			copy(vfs.mounts[i:], vfs.mounts[i+1:])
+			vfs.mounts[len(vfs.mounts)-1] = nil
+			vfs.mounts = vfs.mounts[:len(vfs.mounts)-1]
+			break
+		}
+	}
+	return 0
+}
@@ -0,0 +1,374 @@
+package virtio
+
+import "fmt"
+import "runtime"
+import "sync"
+import "unsafe"
+import "container/list"
+
+import "defs"
+import "devfs"
+import "fs"
+import "mem"
+import "msi"
+import "pci"
+import "stats"
+
+//
+// virtio-blk. a request is a chain of descriptors: a header naming the
+// command and the first sector, the blocks' pages, and a status byte the
+// device writes. many requests are in flight at once, as many as the queue
+// has descriptors for; the rest wait in a queue.
+//
+
+const (
+	PCI_DEV_VIRTIO_BLK  = 0x1001 // transitional
+	PCI_DEV_VIRTIO_BLK1 = 0x1042 // modern only
+)
+
+const (
+	VIRTIO_BLK_F_SEG_MAX uint64 = 1 << 2
+	VIRTIO_BLK_F_RO      uint64 = 1 << 5
+	VIRTIO_BLK_F_FLUSH   uint64 = 1 << 9
+)
+
+const (
+	VIRTIO_BLK_T_IN    uint32 = 0
+	VIRTIO_BLK_T_OUT   uint32 = 1
+	VIRTIO_BLK_T_FLUSH uint32 = 4
+)
+
+const VIRTIO_BLK_S_OK uint8 = 0
+
+// offsets in the device config
+const (
+	BLKCFG_CAPACITY = 0
+	BLKCFG_SEGMAX   = 12
+)
+
+// the first virtio disk, if there is one
+var Disk fs.Disk_i
+
+// number of attached disks, which name their device files
+var ndisks int
+
+// a request's header, which the device reads, and its status, which the
+// device writes
+type blkhdr_t struct {
+	typ    uint32
+	_      uint32
+	sector uint64
+	status uint8
+	_      [15]uint8
+}
+
+const blkhdrlen = 16
+
+// the number of headers per page
+const nhdrpg = mem.PGSIZE / 32
+
+// a request, and the number of its parts not yet done
+type blkreq_t struct {
+	req  *fs.Bdev_req_t
+	left int
+}
+
+// the part of a request that one chain of descriptors carries: blocks that
+// are contiguous on disk, no more than the device takes at once
+type blkpart_t struct {
+	br   *blkreq_t
+	blks []*fs.Bdev_block_t
+}
+
+type blk_stat_t struct {
+	Nwrite  stats.Counter_t
+	Nread   stats.Counter_t
+	Nflush  stats.Counter_t
+	Nsplit  stats.Counter_t
+	Nqueued stats.Counter_t
+	Nintr   stats.Counter_t
+	Nerr    stats.Counter_t
+}
+
+type blk_t struct {
+	sync.Mutex
+	cond_flush *sync.Cond
+	dev        *vdev_t
+	vq         *vq_t
+	nsectors   uint64
+	// the most blocks in one request
+	maxseg int
+	// the device has a volatile write cache
+	cache bool
+	// headers and in-flight parts, by head descriptor
+	hdrs      []*blkhdr_t
+	hdrpa     []mem.Pa_t
+	inflight  []*blkpart_t
+	ninflight int
+	queued    *list.List
+	nflush    int
+	stat      blk_stat_t
+}
+
+// returns true if start is asynchronous
+func (b *blk_t) Start(req *fs.Bdev_req_t) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if req.Cmd == fs.BDEV_DISCARD {
+		// no VIRTIO_BLK_F_DISCARD support
+		return false
+	}
+	if req.Cmd == fs.BDEV_FLUSH {
+		// a flush waits for the writes before it to finish and then
+		// flushes the device's cache, if it has one
+		for b.ninflight > 0 || b.queued.Len() > 0 {
+			b.nflush++
+			b.cond_flush.Wait()
+			b.nflush--
+		}
+		b.stat.Nflush++
+		if !b.cache {
+			return false
+		}
+		b.queued.PushBack(&blkpart_t{br: &blkreq_t{req: req, left: 1}})
+		b.pump()
+		return true
+	}
+
+	switch req.Cmd {
+	case fs.BDEV_WRITE:
+		b.stat.Nwrite++
+	case fs.BDEV_READ:
+		b.stat.Nread++
+	}
+	br := &blkreq_t{req: req}
+	var blks []*fs.Bdev_block_t
+	for blk := req.Blks.FrontBlock(); blk != nil; blk = req.Blks.NextBlock() {
+		if n := len(blks); n == b.maxseg ||
+			(n > 0 && blk.Block != blks[n-1].Block+1) {
+			b.queued.PushBack(&blkpart_t{br: br, blks: blks})
+			br.left++
+			blks = nil
+		}
+		blks = append(blks, blk)
+	}
+	if len(blks) == 0 {
+		return false
+	}
+	b.queued.PushBack(&blkpart_t{br: br, blks: blks})
+	br.left++
+	if br.left > 1 {
+		b.stat.Nsplit++
+	}
+	b.pump()
+	if b.queued.Len() > 0 {
+		b.stat.Nqueued++
+	}
+	return true
+}
+
+func (b *blk_t) Stats() string {
+	b.Lock()
+	defer b.Unlock()
+	s := "virtio-blk:" + stats.Stats2String(b.stat)
+	b.stat = blk_stat_t{}
+	return s
+}
+
+func (b *blk_t) Nblocks() int {
+	return int(b.nsectors * 512 / fs.BSIZE)
+}
+
+// issues queued parts, in order, while the queue has descriptors for them
+func (b *blk_t) pump() {
+	kick := false
+	for b.queued.Len() > 0 {
+		e := b.queued.Front()
+		p := e.Value.(*blkpart_t)
+		if b.vq.nfree < len(p.blks)+2 {
+			break
+		}
+		b.queued.Remove(e)
+		b.issue(p)
+		kick = true
+	}
+	if kick {
+		b.vq.kick()
+	}
+}
+
+func (b *blk_t) issue(p *blkpart_t) {
+	s := b.vq.next()
+	h := b.hdrs[s]
+	write := false
+	switch p.br.req.Cmd {
+	case fs.BDEV_WRITE:
+		h.typ = VIRTIO_BLK_T_OUT
+	case fs.BDEV_READ:
+		h.typ = VIRTIO_BLK_T_IN
+		write = true
+	case fs.BDEV_FLUSH:
+		h.typ = VIRTIO_BLK_T_FLUSH
+	}
+	h.sector = 0
+	if len(p.blks) > 0 {
+		h.sector = uint64(p.blks[0].Block) * uint64(fs.BSIZE/512)
+	}
+	h.status = 0xff
+
+	bufs := make([]vbuf_t, 0, len(p.blks)+2)
+	bufs = append(bufs, vbuf_t{pa: b.hdrpa[s], len: blkhdrlen})
+	for _, blk := range p.blks {
+		bufs = append(bufs, vbuf_t{pa: blk.Pa, len: fs.BSIZE, write: write})
+	}
+	bufs = append(bufs, vbuf_t{pa: b.hdrpa[s] + blkhdrlen, len: 1, write: true})
+	if b.vq.add(bufs) != s {
+		panic("virtio-blk: wrong head")
+	}
+	b.inflight[s] = p
+	b.ninflight++
+	dbg("virtio-blk: issued %v sector %v n %v head %v\n", h.typ, h.sector,
+		len(p.blks), s)
+}
+
+// finishes req once all of its parts are done
+func (b *blk_t) done(req *fs.Bdev_req_t) {
+	if req.Cmd == fs.BDEV_WRITE {
+		// page has been written, don't need a reference to it
+		// and can be removed from cache.
+		req.Blks.Apply(func(blk *fs.Bdev_block_t) {
+			blk.Done("interrupt")
+		})
+	}
+	if req.Sync {
+		// writing to channel while holding the lock, but should be ok
+		req.AckCh <- true
+	}
+}
+
+func (b *blk_t) intr() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.stat.Nintr++
+	for {
+		s, _, ok := b.vq.reap()
+		if !ok {
+			break
+		}
+		p := b.inflight[s]
+		if p == nil {
+			panic("virtio-blk: spurious completion")
+		}
+		b.inflight[s] = nil
+		b.ninflight--
+		if st := b.hdrs[s].status; st != VIRTIO_BLK_S_OK {
+			b.stat.Nerr++
+			p.br.req.Err = -defs.EIO
+			fmt.Printf("virtio-blk: request %v sector %v failed: %v\n",
+				b.hdrs[s].typ, b.hdrs[s].sector, st)
+		}
+		p.br.left--
+		if p.br.left == 0 {
+			b.done(p.br.req)
+		}
+	}
+	b.pump()
+	if b.nflush > 0 && b.ninflight == 0 && b.queued.Len() == 0 {
+		b.cond_flush.Broadcast()
+	}
+}
+
+// Go routine for handling interrupts
+func (b *blk_t) int_handler(vec msi.Msivec_t) {
+	for {
+		runtime.IRQsched(uint(vec))
+		b.intr()
+	}
+}
+
+func attach_blk(vid, did int, t pci.Pcitag_t) {
+	bus, dev, fnc := pci.Breakpcitag(t)
+	name := fmt.Sprintf("rvd%dc", ndisks)
+	min := fs.Rawdisk_minor(name)
+	if min < 0 {
+		fmt.Printf("virtio-blk: ignoring another disk (%v:%v:%v)\n", bus,
+			dev, fnc)
+		return
+	}
+	vd, ok := mkVdev(t)
+	if !ok {
+		return
+	}
+	if !vd.negotiate(VIRTIO_BLK_F_SEG_MAX | VIRTIO_BLK_F_RO |
+		VIRTIO_BLK_F_FLUSH) {
+		vd.fail()
+		return
+	}
+	vq, ok := vd.mkVq(0)
+	if !ok {
+		vd.fail()
+		return
+	}
+
+	b := &blk_t{dev: vd, vq: vq}
+	b.cond_flush = sync.NewCond(b)
+	// XXX the two halves of the capacity may be read across a config
+	// change; disks don't resize under us
+	b.nsectors = vd.trans.cfg(BLKCFG_CAPACITY, 8)
+	b.maxseg = vq.sz - 2
+	if vd.feats&VIRTIO_BLK_F_SEG_MAX != 0 {
+		sm := int(vd.trans.cfg(BLKCFG_SEGMAX, 4))
+		if sm > 0 && sm < b.maxseg {
+			b.maxseg = sm
+		}
+	}
+	b.cache = vd.feats&VIRTIO_BLK_F_FLUSH != 0
+	if vd.feats&VIRTIO_BLK_F_RO != 0 {
+		fmt.Printf("virtio-blk: disk is read-only\n")
+	}
+
+	n := (vq.sz + nhdrpg - 1) / nhdrpg
+	b.hdrs = make([]*blkhdr_t, 0, vq.sz)
+	b.hdrpa = make([]mem.Pa_t, 0, vq.sz)
+	for i := 0; i < n; i++ {
+		pa := pg_contig(1)
+		hs := (*[nhdrpg]blkhdr_t)(unsafe.Pointer(mem.Physmem.Dmap(pa)))
+		for j := range hs {
+			b.hdrs = append(b.hdrs, &hs[j])
+			b.hdrpa = append(b.hdrpa, pa+mem.Pa_t(j*32))
+		}
+	}
+	b.inflight = make([]*blkpart_t, vq.sz)
+	b.queued = list.New()
+
+	vd.ready()
+	go b.int_handler(vd.vec)
+	if Disk == nil {
+		Disk = b
+	}
+	ndisks++
+
+	trans := "legacy"
+	if vd.modern {
+		trans = "modern"
+	}
+	fmt.Printf("virtio-blk %v %x %x (%v:%v:%v), %v, %v MB, queue %v, MSI %v\n",
+		name, vid, did, bus, dev, fnc, trans, b.nsectors*512>>20, vq.sz,
+		vd.vec)
+
+	if err := devfs.Register(name, defs.D_RAWDISK, min); err != 0 {
+		fmt.Printf("virtio-blk: no device file: %v\n", err)
+	}
+	if err := fs.Disk_attach(name, b); err != 0 {
+		fmt.Printf("virtio-blk: cannot attach disk: %v\n", err)
+	}
+}
+
+func blk_verify() {
+	h := &blkhdr_t{}
+	if unsafe.Offsetof(h.status) != blkhdrlen || unsafe.Sizeof(*h) != 32 {
+		panic("blkhdr_t padded?")
+	}
+}
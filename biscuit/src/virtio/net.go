@@ -0,0 +1,542 @@
+package virtio
+
+import "fmt"
+import "runtime"
+import "sync"
+import "unsafe"
+
+import "bnet"
+import "bounds"
+import . "inet"
+import "mem"
+import "msi"
+import "pci"
+import "res"
+
+//
+// virtio-net. every frame, received or sent, is preceded by a virtio-net
+// header in a descriptor of its own, which legacy devices without
+// ANY_LAYOUT require. transmitted frames are copied to pages of the driver
+// so that the caller's buffers can be reused at once. when the device offers
+// them, TCP checksums and segmentation are offloaded; otherwise the driver
+// computes the checksums and segments large TCP frames itself. the device
+// never computes the IPv4 header checksum, so the driver always does.
+//
+
+const (
+	PCI_DEV_VIRTIO_NET  = 0x1000 // transitional
+	PCI_DEV_VIRTIO_NET1 = 0x1041 // modern only
+)
+
+const (
+	VIRTIO_NET_F_CSUM      uint64 = 1 << 0
+	VIRTIO_NET_F_MAC       uint64 = 1 << 5
+	VIRTIO_NET_F_HOST_TSO4 uint64 = 1 << 11
+)
+
+const (
+	VIRTIO_NET_HDR_F_NEEDS_CSUM uint8 = 1
+	VIRTIO_NET_HDR_GSO_NONE     uint8 = 0
+	VIRTIO_NET_HDR_GSO_TCPV4    uint8 = 1
+)
+
+// offsets in the device config
+const (
+	NETCFG_MAC = 0
+)
+
+const (
+	rxq = 0
+	txq = 1
+)
+
+type nethdr_t struct {
+	flags      uint8
+	gso_type   uint8
+	hdr_len    uint16
+	gso_size   uint16
+	csum_start uint16
+	csum_off   uint16
+	// only present for modern devices
+	num_buffers uint16
+	_           [4]uint8
+}
+
+// the bytes of headers we may need to fix up: ethernet, IPv4, and TCP with
+// the most options
+const maxhdr = 14 + 20 + 60
+
+// the offset of the IPv4 header's identification
+const ip4_id = 4
+
+// offsets of TCP header fields
+const (
+	tcp_seq   = 4
+	tcp_off   = 12
+	tcp_flags = 13
+	tcp_cksum = 16
+)
+
+const (
+	tcp_fin = 1 << 0
+	tcp_psh = 1 << 3
+	tcp_cwr = 1 << 7
+)
+
+type vionet_t struct {
+	dev *vdev_t
+	mac Mac_t
+	ip  Ip4_t
+	// the length of the header preceding each frame
+	hdrlen int
+	csum   bool
+	tso    bool
+	rx     struct {
+		vq   *vq_t
+		hdrs []mem.Pa_t
+		// the page of each posted buffer, by head descriptor
+		pa  []mem.Pa_t
+		pkt [][]uint8
+		// the pages that rx_consume reaped, to post again
+		done []mem.Pa_t
+	}
+	tx struct {
+		sync.Mutex
+		vq     *vq_t
+		hdrs   []*nethdr_t
+		hdrpas []mem.Pa_t
+		// free pages, and the pages of each frame in flight, by head
+		// descriptor
+		pgs  []mem.Pa_t
+		infl [][]mem.Pa_t
+	}
+}
+
+// a cursor over a scatter-gather buffer
+type sgcur_t struct {
+	buf [][]uint8
+}
+
+// copies the next bytes of the buffer to dst, returning the number copied
+func (c *sgcur_t) read(dst []uint8) int {
+	did := 0
+	for did < len(dst) && len(c.buf) != 0 {
+		n := copy(dst[did:], c.buf[0])
+		did += n
+		c.buf[0] = c.buf[0][n:]
+		if len(c.buf[0]) == 0 {
+			c.buf = c.buf[1:]
+		}
+	}
+	return did
+}
+
+// a running internet checksum over bytes that may start at odd offsets
+type cksum_t struct {
+	sum uint64
+	odd bool
+}
+
+func (ck *cksum_t) add(b []uint8) {
+	for _, v := range b {
+		if ck.odd {
+			ck.sum += uint64(v)
+		} else {
+			ck.sum += uint64(v) << 8
+		}
+		ck.odd = !ck.odd
+	}
+}
+
+func (ck *cksum_t) fold() uint16 {
+	s := ck.sum
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+func rd16(b []uint8) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func wr16(b []uint8, v uint16) {
+	b[0] = uint8(v >> 8)
+	b[1] = uint8(v)
+}
+
+// allocates n 16-byte header slots, returning their physical addresses
+func hdrslots(n int) []mem.Pa_t {
+	ret := make([]mem.Pa_t, 0, n)
+	for len(ret) < n {
+		pa := pg_contig(1)
+		for off := 0; off < mem.PGSIZE && len(ret) < n; off += 16 {
+			ret = append(ret, pa+mem.Pa_t(off))
+		}
+	}
+	return ret
+}
+
+func (n *vionet_t) Lmac() *Mac_t {
+	return &n.mac
+}
+
+// returns after buf is enqueued to be trasmitted. buf's contents are copied to
+// the DMA buffer, so buf's memory can be reused/freed
+func (n *vionet_t) Tx_raw(buf [][]uint8) bool {
+	return n._tx_nowait(buf, false, false, false, 0)
+}
+
+func (n *vionet_t) Tx_ipv4(buf [][]uint8) bool {
+	return n._tx_nowait(buf, true, false, false, 0)
+}
+
+func (n *vionet_t) Tx_tcp(buf [][]uint8) bool {
+	return n._tx_nowait(buf, true, true, false, 0)
+}
+
+func (n *vionet_t) Tx_tcp_tso(buf [][]uint8, tcphlen, mss int) bool {
+	return n._tx_nowait(buf, true, true, true, mss)
+}
+
+func (n *vionet_t) _tx_nowait(buf [][]uint8, ipv4, tcp, tso bool, mss int) bool {
+	n.tx.Lock()
+	ok := n._tx(buf, ipv4, tcp, tso, mss)
+	n.tx.Unlock()
+	if !ok {
+		fmt.Printf("tx packet(s) dropped!\n")
+	}
+	return ok
+}
+
+// caller must hold the tx lock. returns true if buf was copied to the
+// transmission queue.
+func (n *vionet_t) _tx(buf [][]uint8, ipv4, tcp, tso bool, mss int) bool {
+	if tso && !tcp {
+		panic("tso is only for tcp")
+	}
+	tlen := 0
+	for _, b := range buf {
+		tlen += len(b)
+	}
+	if tlen == 0 {
+		panic("wut")
+	}
+	if tlen-ETHERLEN > 1500 && !tso {
+		panic("should use tso")
+	}
+	// pull the headers out of buf, leaving c at the payload
+	c := &sgcur_t{buf: append([][]uint8(nil), buf...)}
+	var hdr [maxhdr]uint8
+	hlen := ETHERLEN
+	if ipv4 {
+		hlen += IP4LEN
+	}
+	tcpoff := hlen
+	if c.read(hdr[:hlen]) != hlen {
+		return false
+	}
+	if tcp {
+		if c.read(hdr[hlen:hlen+TCPLEN]) != TCPLEN {
+			return false
+		}
+		thl := int(hdr[tcpoff+tcp_off]>>4) * 4
+		if thl < TCPLEN || c.read(hdr[hlen+TCPLEN:hlen+thl]) != thl-TCPLEN {
+			return false
+		}
+		hlen += thl
+	}
+	plen := tlen - hlen
+
+	n.tx_reap()
+	defer n.tx.vq.kick()
+
+	if !tso || (n.tso && plen > mss) {
+		h := hdr[:hlen]
+		vh := nethdr_t{}
+		if tso {
+			// the host segments the frame; its checksums follow the
+			// headers of the whole frame
+			vh.gso_type = VIRTIO_NET_HDR_GSO_TCPV4
+			vh.gso_size = uint16(mss)
+			vh.hdr_len = uint16(hlen)
+			n.pseudolen(h, tcpoff, hlen-tcpoff+plen)
+		}
+		n.fixup(h, ipv4, tcp, tcpoff, &vh)
+		return n.txframe(h, c, plen, &vh, tcp && !n.csum, tcpoff)
+	}
+
+	// segment the frame ourselves
+	var sh [maxhdr]uint8
+	for off := 0; off < plen || off == 0; off += mss {
+		slen := plen - off
+		if slen > mss {
+			slen = mss
+		}
+		h := sh[:hlen]
+		seghdr(h, hdr[:hlen], tcpoff, off/mss, off, slen, plen)
+		n.pseudolen(h, tcpoff, hlen-tcpoff+slen)
+		vh := nethdr_t{}
+		n.fixup(h, ipv4, tcp, tcpoff, &vh)
+		if !n.txframe(h, c, slen, &vh, !n.csum, tcpoff) {
+			return false
+		}
+	}
+	return true
+}
+
+// writes to h the headers of segment i of a frame with the headers hdr,
+// which holds slen of the frame's plen payload bytes from off. every segment
+// gets its own length, sequence number, and flags, and the frame's IP ID plus
+// i, as a device that segments does.
+func seghdr(h, hdr []uint8, tcpoff, i, off, slen, plen int) {
+	copy(h, hdr)
+	wr16(h[ETHERLEN+2:], uint16(IP4LEN+len(hdr)-tcpoff+slen))
+	wr16(h[ETHERLEN+ip4_id:], rd16(hdr[ETHERLEN+ip4_id:])+uint16(i))
+	seq := uint32(rd16(hdr[tcpoff+tcp_seq:]))<<16 |
+		uint32(rd16(hdr[tcpoff+tcp_seq+2:]))
+	s := seq + uint32(off)
+	wr16(h[tcpoff+tcp_seq:], uint16(s>>16))
+	wr16(h[tcpoff+tcp_seq+2:], uint16(s))
+	if off+slen < plen {
+		h[tcpoff+tcp_flags] &^= tcp_fin | tcp_psh
+	}
+	if off != 0 {
+		h[tcpoff+tcp_flags] &^= tcp_cwr
+	}
+}
+
+// adds the TCP length to the pseudo-header sum in the TCP checksum field,
+// which lacks it for TSO frames
+func (n *vionet_t) pseudolen(h []uint8, tcpoff, l4len int) {
+	ck := cksum_t{sum: uint64(rd16(h[tcpoff+tcp_cksum:])) + uint64(l4len)}
+	wr16(h[tcpoff+tcp_cksum:], ck.fold())
+}
+
+// computes the IPv4 header checksum and asks the device for the TCP one, if
+// it offloads them
+func (n *vionet_t) fixup(h []uint8, ipv4, tcp bool, tcpoff int, vh *nethdr_t) {
+	if ipv4 {
+		ip := h[ETHERLEN : ETHERLEN+IP4LEN]
+		wr16(ip[10:], 0)
+		ck := cksum_t{}
+		ck.add(ip)
+		wr16(ip[10:], ^ck.fold())
+	}
+	if tcp && n.csum {
+		vh.flags = VIRTIO_NET_HDR_F_NEEDS_CSUM
+		vh.csum_start = uint16(tcpoff)
+		vh.csum_off = tcp_cksum
+	}
+}
+
+// queues the frame made of the headers h and the next plen bytes of c,
+// computing its TCP checksum if swcsum. returns false if the queue is full.
+func (n *vionet_t) txframe(h []uint8, c *sgcur_t, plen int, vh *nethdr_t,
+	swcsum bool, tcpoff int) bool {
+	flen := len(h) + plen
+	npg := (flen + mem.PGSIZE - 1) / mem.PGSIZE
+	if n.tx.vq.nfree < npg+1 || len(n.tx.pgs) < npg {
+		return false
+	}
+	k := len(n.tx.pgs) - npg
+	pgs := append([]mem.Pa_t(nil), n.tx.pgs[k:]...)
+	n.tx.pgs = n.tx.pgs[:k]
+
+	s := n.tx.vq.next()
+	*n.tx.hdrs[s] = *vh
+	bufs := make([]vbuf_t, 0, npg+1)
+	bufs = append(bufs, vbuf_t{pa: n.tx.hdrpas[s], len: n.hdrlen})
+	// the checksum field holds the pseudo-header sum, so a sum over the
+	// TCP header and payload is the whole checksum
+	ck := cksum_t{}
+	if swcsum {
+		ck.add(h[tcpoff:])
+	}
+	var first []uint8
+	left := flen
+	for i, pa := range pgs {
+		l := left
+		if l > mem.PGSIZE {
+			l = mem.PGSIZE
+		}
+		d := mem.Dmaplen(pa, l)
+		if i == 0 {
+			first = d
+			copy(d, h)
+			d = d[len(h):]
+		}
+		if c.read(d) != len(d) {
+			panic("short frame")
+		}
+		if swcsum {
+			ck.add(d)
+		}
+		bufs = append(bufs, vbuf_t{pa: pa, len: l})
+		left -= l
+	}
+	if swcsum {
+		wr16(first[tcpoff+tcp_cksum:], ^ck.fold())
+	}
+	if n.tx.vq.add(bufs) != s {
+		panic("virtio-net: wrong head")
+	}
+	n.tx.infl[s] = pgs
+	return true
+}
+
+// frees the pages of sent frames. caller must hold the tx lock.
+func (n *vionet_t) tx_reap() {
+	for {
+		s, _, ok := n.tx.vq.reap()
+		if !ok {
+			return
+		}
+		n.tx.pgs = append(n.tx.pgs, n.tx.infl[s]...)
+		n.tx.infl[s] = nil
+	}
+}
+
+// posts the page at pa for a received frame
+func (n *vionet_t) rx_post(pa mem.Pa_t) {
+	s := n.rx.vq.next()
+	bufs := []vbuf_t{{pa: n.rx.hdrs[s], len: n.hdrlen, write: true},
+		{pa: pa, len: mem.PGSIZE, write: true}}
+	if n.rx.vq.add(bufs) != s {
+		panic("virtio-net: wrong head")
+	}
+	n.rx.pa[s] = pa
+}
+
+// takes the received frames. the buffers are posted again only after the
+// loop, so that it takes at most a queue's worth of frames, as the bound of
+// the interrupt handler assumes.
+func (n *vionet_t) rx_consume() {
+	for {
+		s, l, ok := n.rx.vq.reap()
+		if !ok {
+			break
+		}
+		pa := n.rx.pa[s]
+		if plen := l - n.hdrlen; plen > 0 && plen <= mem.PGSIZE {
+			pkt := n.rx.pkt[0:1]
+			pkt[0] = mem.Dmaplen(pa, plen)
+			bnet.Net_start(pkt, plen)
+		}
+		n.rx.done = append(n.rx.done, pa)
+	}
+	if len(n.rx.done) == 0 {
+		return
+	}
+	for _, pa := range n.rx.done {
+		n.rx_post(pa)
+	}
+	n.rx.done = n.rx.done[:0]
+	n.rx.vq.kick()
+}
+
+func (n *vionet_t) int_handler(vec msi.Msivec_t) {
+	r := bounds.Bounds(bounds.B_VIONET_T_INT_HANDLER)
+	res.Kreswait(r, "virtio-net int handler")
+	for {
+		res.Kunres()
+		runtime.IRQsched(uint(vec))
+		res.Kreswait(r, "virtio-net int handler")
+
+		n.rx_consume()
+		n.tx.Lock()
+		n.tx_reap()
+		n.tx.Unlock()
+	}
+}
+
+// number of attached NICs, which name their device files
+var nnets int
+
+func attach_net(vid, did int, t pci.Pcitag_t) {
+	bus, dev, fnc := pci.Breakpcitag(t)
+	vd, ok := mkVdev(t)
+	if !ok {
+		return
+	}
+	want := VIRTIO_NET_F_CSUM | VIRTIO_NET_F_MAC | VIRTIO_NET_F_HOST_TSO4
+	if vd.trans.features()&VIRTIO_NET_F_CSUM == 0 {
+		// TSO needs checksum offload
+		want &^= VIRTIO_NET_F_HOST_TSO4
+	}
+	if !vd.negotiate(want) {
+		vd.fail()
+		return
+	}
+	rx, ok1 := vd.mkVq(rxq)
+	tx, ok2 := vd.mkVq(txq)
+	if !ok1 || !ok2 {
+		vd.fail()
+		return
+	}
+
+	n := &vionet_t{dev: vd}
+	n.csum = vd.feats&VIRTIO_NET_F_CSUM != 0
+	n.tso = vd.feats&VIRTIO_NET_F_HOST_TSO4 != 0
+	// num_buffers is part of the header only for modern devices
+	n.hdrlen = 10
+	if vd.modern {
+		n.hdrlen = 12
+	}
+	if vd.feats&VIRTIO_NET_F_MAC != 0 {
+		for i := range n.mac {
+			n.mac[i] = uint8(vd.trans.cfg(NETCFG_MAC+i, 1))
+		}
+	} else {
+		// QEMU's default, locally administered
+		n.mac = Mac_t{0x52, 0x54, 0x00, 0x12, 0x34, 0x56 + uint8(nnets)}
+	}
+
+	n.rx.vq = rx
+	n.rx.hdrs = hdrslots(rx.sz)
+	n.rx.pa = make([]mem.Pa_t, rx.sz)
+	n.rx.done = make([]mem.Pa_t, 0, rx.sz)
+	n.rx.pkt = make([][]uint8, 1)
+	for i := 0; i < rx.sz/2; i++ {
+		n.rx_post(pg_contig(1))
+	}
+
+	n.tx.vq = tx
+	n.tx.hdrpas = hdrslots(tx.sz)
+	for _, pa := range n.tx.hdrpas {
+		h := (*nethdr_t)(unsafe.Pointer(&mem.Physmem.Dmap8(pa)[0]))
+		n.tx.hdrs = append(n.tx.hdrs, h)
+	}
+	n.tx.infl = make([][]mem.Pa_t, tx.sz)
+	for i := 0; i < tx.sz; i++ {
+		n.tx.pgs = append(n.tx.pgs, pg_contig(1))
+	}
+
+	vd.ready()
+	go n.int_handler(vd.vec)
+	rx.kick()
+
+	trans := "legacy"
+	if vd.modern {
+		trans = "modern"
+	}
+	fmt.Printf("virtio-net %x %x (%v:%v:%v), %v, MAC %s, csum %v, tso %v, "+
+		"MSI %v\n", vid, did, bus, dev, fnc, trans, Mac2str(n.mac[:]),
+		n.csum, n.tso, vd.vec)
+
+	if ip, ok := bnet.Nic_usernet(n); ok {
+		n.ip = ip
+	}
+
+	name := fmt.Sprintf("vio%d", nnets)
+	nnets++
+	if err := bnet.Nic_attach(name, n); err != 0 {
+		fmt.Printf("virtio-net: no device file %s: %v\n", name, err)
+	}
+}
+
+func net_verify() {
+	if unsafe.Sizeof(nethdr_t{}) != 16 {
+		panic("nethdr_t padded?")
+	}
+}
@@ -0,0 +1,126 @@
+package virtio
+
+import "testing"
+
+import . "inet"
+
+// the one's complement sum of b as big-endian 16-bit words, added to s
+func sum16(s uint32, b []uint8) uint32 {
+	for i := 0; i < len(b); i += 2 {
+		w := uint32(b[i]) << 8
+		if i+1 < len(b) {
+			w |= uint32(b[i+1])
+		}
+		s += w
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return s
+}
+
+// builds the headers of a TCP frame with options, as the stack hands them to
+// Tx_tcp_tso: the checksum field holds the pseudo-header sum without the
+// length
+func mkTsohdr(ipid uint16, seq uint32, flags uint8) ([]uint8, int) {
+	const thl = TCPLEN + 12
+	h := make([]uint8, ETHERLEN+IP4LEN+thl)
+	ip := h[ETHERLEN:]
+	ip[0] = 0x45
+	wr16(ip[ip4_id:], ipid)
+	ip[8] = 0xff
+	ip[9] = 6
+	copy(ip[12:], []uint8{10, 0, 2, 15, 10, 0, 2, 2})
+	tcpoff := ETHERLEN + IP4LEN
+	tcp := h[tcpoff:]
+	wr16(tcp[0:], 1234)
+	wr16(tcp[2:], 80)
+	wr16(tcp[tcp_seq:], uint16(seq>>16))
+	wr16(tcp[tcp_seq+2:], uint16(seq))
+	tcp[tcp_off] = uint8(thl / 4 << 4)
+	tcp[tcp_flags] = flags
+	for i := TCPLEN; i < thl; i++ {
+		tcp[i] = uint8(i)
+	}
+	ps := sum16(0, ip[12:20]) + 6
+	wr16(tcp[tcp_cksum:], uint16(sum16(ps, nil)))
+	return h, tcpoff
+}
+
+// segments a frame the way _tx does without TSO offload and checks every
+// segment's headers and checksums
+func TestTsoSegment(t *testing.T) {
+	const mss = 1000
+	const ack = 1 << 4
+	flags := uint8(tcp_fin | tcp_psh | tcp_cwr | ack)
+	for _, plen := range []int{1, mss, mss + 1, 3*mss + 100} {
+		hdr, tcpoff := mkTsohdr(0xfffe, 0xfffffff0, flags)
+		hlen := len(hdr)
+		pay := make([]uint8, plen)
+		for i := range pay {
+			pay[i] = uint8(i * 7)
+		}
+		n := &vionet_t{}
+		var sh [maxhdr]uint8
+		nseg := 0
+		for off := 0; off < plen || off == 0; off += mss {
+			slen := plen - off
+			if slen > mss {
+				slen = mss
+			}
+			h := sh[:hlen]
+			seghdr(h, hdr, tcpoff, off/mss, off, slen, plen)
+			n.pseudolen(h, tcpoff, hlen-tcpoff+slen)
+			vh := nethdr_t{}
+			n.fixup(h, true, true, tcpoff, &vh)
+			if vh.flags != 0 {
+				t.Fatalf("asked for offload")
+			}
+			// the checksum txframe computes without offload
+			seg := pay[off : off+slen]
+			ck := cksum_t{}
+			ck.add(h[tcpoff:])
+			ck.add(seg)
+			wr16(h[tcpoff+tcp_cksum:], ^ck.fold())
+
+			ip := h[ETHERLEN : ETHERLEN+IP4LEN]
+			if sum16(0, ip) != 0xffff {
+				t.Fatalf("seg %v: bad IP checksum", nseg)
+			}
+			if tl := int(rd16(ip[2:])); tl != IP4LEN+hlen-tcpoff+slen {
+				t.Fatalf("seg %v: IP length %v", nseg, tl)
+			}
+			if id := rd16(ip[ip4_id:]); id != 0xfffe+uint16(nseg) {
+				t.Fatalf("seg %v: IP ID %#x", nseg, id)
+			}
+			tcp := h[tcpoff:]
+			l4len := len(tcp) + slen
+			ps := sum16(0, ip[12:20]) + 6 + uint32(l4len)
+			if sum16(sum16(ps, tcp), seg) != 0xffff {
+				t.Fatalf("seg %v: bad TCP checksum", nseg)
+			}
+			seq := uint32(rd16(tcp[tcp_seq:]))<<16 |
+				uint32(rd16(tcp[tcp_seq+2:]))
+			if seq != 0xfffffff0+uint32(off) {
+				t.Fatalf("seg %v: seq %#x", nseg, seq)
+			}
+			last := off+slen == plen
+			f := tcp[tcp_flags]
+			if (f&tcp_fin != 0) != last || (f&tcp_psh != 0) != last {
+				t.Fatalf("seg %v: FIN/PSH %#x", nseg, f)
+			}
+			if (f&tcp_cwr != 0) != (off == 0) || f&ack == 0 {
+				t.Fatalf("seg %v: flags %#x", nseg, f)
+			}
+			for i := TCPLEN; i < len(tcp); i++ {
+				if tcp[i] != hdr[tcpoff+i] {
+					t.Fatalf("seg %v: options changed", nseg)
+				}
+			}
+			nseg++
+		}
+		if want := (plen + mss - 1) / mss; nseg != want {
+			t.Fatalf("%v segments, want %v", nseg, want)
+		}
+	}
+}
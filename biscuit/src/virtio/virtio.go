@@ -0,0 +1,629 @@
+package virtio
+
+import "fmt"
+import "runtime"
+import "sync/atomic"
+import "unsafe"
+
+import "mem"
+import "msi"
+import "pci"
+
+const virtio_debug = false
+
+func dbg(x string, args ...interface{}) {
+	if virtio_debug {
+		fmt.Printf(x, args...)
+	}
+}
+
+//
+// Virtio PCI devices, over either the legacy transport (registers in an I/O
+// port BAR) or the modern one (registers in memory BARs, found through
+// vendor capabilities). QEMU's devices are transitional, and speak both,
+// unless given disable-legacy=on; we use the modern transport when the device
+// has it.
+//
+// - https://docs.oasis-open.org/virtio/virtio/v1.1/virtio-v1.1.html
+//
+
+const PCI_VEND_VIRTIO = 0x1af4
+
+// device status bits
+const (
+	VIRTIO_STAT_ACK         uint8 = 1
+	VIRTIO_STAT_DRIVER      uint8 = 2
+	VIRTIO_STAT_DRIVER_OK   uint8 = 4
+	VIRTIO_STAT_FEATURES_OK uint8 = 8
+	VIRTIO_STAT_FAILED      uint8 = 0x80
+)
+
+const VIRTIO_F_VERSION_1 uint64 = 1 << 32
+
+// the registers of a device, whatever its transport
+type transport_i interface {
+	features() uint64
+	setfeatures(uint64)
+	status() uint8
+	setstatus(uint8)
+	// tells the transport that the device's MSI-X is enabled
+	msix()
+	// returns the size of queue q, or 0 if there is no such queue
+	qsize(q int) int
+	// gives the device the rings of queue q, which has sz entries, and
+	// routes the queue's interrupts to MSI-X entry 0 if msix
+	qsetup(q, sz int, desc, avail, used mem.Pa_t, msix bool) bool
+	notify(q int)
+	// reads n bytes, at most 8, of the device config at off
+	cfg(off, n int) uint64
+}
+
+// legacy registers, as offsets in the I/O BAR
+const (
+	LEG_DEVFEAT = 0x00
+	LEG_DRVFEAT = 0x04
+	LEG_QADDR   = 0x08
+	LEG_QSIZE   = 0x0c
+	LEG_QSEL    = 0x0e
+	LEG_QNOTIFY = 0x10
+	LEG_STATUS  = 0x12
+	LEG_ISR     = 0x13
+	LEG_CFGVEC  = 0x14
+	LEG_QVEC    = 0x16
+	// the device config, which moves past the MSI-X vectors once MSI-X is
+	// enabled
+	LEG_CFG     = 0x14
+	LEG_CFGMSIX = 0x18
+)
+
+type legacy_t struct {
+	io    int
+	msion bool
+}
+
+func (l *legacy_t) features() uint64 {
+	return uint64(uint32(runtime.Inl(l.io + LEG_DEVFEAT)))
+}
+
+func (l *legacy_t) setfeatures(f uint64) {
+	runtime.Outl(l.io+LEG_DRVFEAT, int(uint32(f)))
+}
+
+func (l *legacy_t) status() uint8 {
+	return uint8(runtime.Inb(uint16(l.io + LEG_STATUS)))
+}
+
+func (l *legacy_t) setstatus(s uint8) {
+	runtime.Outb(uint16(l.io+LEG_STATUS), s)
+}
+
+func (l *legacy_t) msix() {
+	l.msion = true
+}
+
+// there are no 16-bit port reads; a 16-bit register is read as part of the
+// dword holding it
+func (l *legacy_t) in16(reg int) int {
+	return (runtime.Inl(l.io+reg&^3) >> (8 * uint(reg&3))) & 0xffff
+}
+
+func (l *legacy_t) qsize(q int) int {
+	runtime.Outw(l.io+LEG_QSEL, q)
+	return l.in16(LEG_QSIZE)
+}
+
+func (l *legacy_t) qsetup(q, sz int, desc, avail, used mem.Pa_t, msix bool) bool {
+	// the legacy transport takes only the address of the descriptors;
+	// the rings must follow them as laid out by mkVq
+	if int(desc)%mem.PGSIZE != 0 || l.qsize(q) != sz {
+		return false
+	}
+	if msix {
+		runtime.Outw(l.io+LEG_QVEC, 0)
+		if l.in16(LEG_QVEC) != 0 {
+			return false
+		}
+	}
+	runtime.Outl(l.io+LEG_QADDR, int(desc)/mem.PGSIZE)
+	return true
+}
+
+func (l *legacy_t) notify(q int) {
+	runtime.Outw(l.io+LEG_QNOTIFY, q)
+}
+
+func (l *legacy_t) cfg(off, n int) uint64 {
+	base := l.io + LEG_CFG
+	if l.msion {
+		base = l.io + LEG_CFGMSIX
+	}
+	ret := uint64(0)
+	for i := n - 1; i >= 0; i-- {
+		ret = ret<<8 | uint64(runtime.Inb(uint16(base+off+i)))
+	}
+	return ret
+}
+
+// vendor capability types of the modern transport
+const (
+	VIRTIO_PCI_CAP_COMMON = 1
+	VIRTIO_PCI_CAP_NOTIFY = 2
+	VIRTIO_PCI_CAP_ISR    = 3
+	VIRTIO_PCI_CAP_DEVICE = 4
+)
+
+type common_cfg_t struct {
+	dfselect   uint32
+	dfeature   uint32
+	gfselect   uint32
+	gfeature   uint32
+	msixcfg    uint16
+	nqueues    uint16
+	status     uint8
+	cfggen     uint8
+	qselect    uint16
+	qsize      uint16
+	qmsix      uint16
+	qenable    uint16
+	qnotifyoff uint16
+	qdesc      uint64
+	qavail     uint64
+	qused      uint64
+}
+
+const VIRTIO_MSI_NO_VECTOR = 0xffff
+
+type modern_t struct {
+	common    *common_cfg_t
+	notifyva  []uint8
+	notifymul int
+	qnotify   map[int]*uint16
+	devcfg    []uint8
+}
+
+// finds the modern transport's registers through the vendor capabilities of
+// the device at tag. returns false if the device has no modern transport.
+func mkModern(tag pci.Pcitag_t) (*modern_t, bool) {
+	m := &modern_t{qnotify: make(map[int]*uint16)}
+	for _, c := range pci.Pci_caps(tag, pci.PCI_CAP_VENDOR) {
+		typ := pci.Pci_read(tag, c+3, 1)
+		bar := pci.Pci_read(tag, c+4, 1)
+		off := pci.Pci_read(tag, c+8, 4)
+		l := pci.Pci_read(tag, c+12, 4)
+		bari := 0x10 + 4*bar
+		ispio := 1
+		if bar > 4 || l == 0 || pci.Pci_read(tag, bari, 4)&ispio != 0 {
+			continue
+		}
+		// the first capability of each type is the preferred one
+		switch typ {
+		case VIRTIO_PCI_CAP_COMMON:
+			if m.common != nil {
+				continue
+			}
+		case VIRTIO_PCI_CAP_NOTIFY:
+			if m.notifyva != nil {
+				continue
+			}
+		case VIRTIO_PCI_CAP_DEVICE:
+			if m.devcfg != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		base, _ := pci.Pci_bar_mem(tag, bar)
+		va := mem.Dmaplen(mem.Pa_t(base+uintptr(off)), l)
+		switch typ {
+		case VIRTIO_PCI_CAP_COMMON:
+			if l < int(unsafe.Sizeof(common_cfg_t{})) {
+				return nil, false
+			}
+			m.common = (*common_cfg_t)(unsafe.Pointer(&va[0]))
+		case VIRTIO_PCI_CAP_NOTIFY:
+			m.notifyva = va
+			m.notifymul = pci.Pci_read(tag, c+16, 4)
+		case VIRTIO_PCI_CAP_DEVICE:
+			m.devcfg = va
+		}
+	}
+	if m.common == nil || m.notifyva == nil || m.devcfg == nil {
+		return nil, false
+	}
+	st16(&m.common.msixcfg, VIRTIO_MSI_NO_VECTOR)
+	return m, true
+}
+
+// the common config wants accesses of each field's width. these aren't
+// inlined, so the compiler can't fold a read into the store before it.
+
+//go:noinline
+func ld8(p *uint8) uint8 {
+	return *p
+}
+
+//go:noinline
+func st8(p *uint8, v uint8) {
+	*p = v
+}
+
+//go:noinline
+func ld16(p *uint16) uint16 {
+	return *p
+}
+
+//go:noinline
+func st16(p *uint16, v uint16) {
+	*p = v
+}
+
+func (m *modern_t) features() uint64 {
+	c := m.common
+	runtime.Store32(&c.dfselect, 0)
+	lo := atomic.LoadUint32(&c.dfeature)
+	runtime.Store32(&c.dfselect, 1)
+	hi := atomic.LoadUint32(&c.dfeature)
+	return uint64(hi)<<32 | uint64(lo)
+}
+
+func (m *modern_t) setfeatures(f uint64) {
+	c := m.common
+	runtime.Store32(&c.gfselect, 0)
+	runtime.Store32(&c.gfeature, uint32(f))
+	runtime.Store32(&c.gfselect, 1)
+	runtime.Store32(&c.gfeature, uint32(f>>32))
+}
+
+func (m *modern_t) status() uint8 {
+	return ld8(&m.common.status)
+}
+
+func (m *modern_t) setstatus(s uint8) {
+	st8(&m.common.status, s)
+}
+
+func (m *modern_t) msix() {
+}
+
+func (m *modern_t) qsize(q int) int {
+	st16(&m.common.qselect, uint16(q))
+	return int(ld16(&m.common.qsize))
+}
+
+func (m *modern_t) qsetup(q, sz int, desc, avail, used mem.Pa_t, msix bool) bool {
+	c := m.common
+	st16(&c.qselect, uint16(q))
+	if int(ld16(&c.qsize)) < sz {
+		return false
+	}
+	st16(&c.qsize, uint16(sz))
+	st64 := func(f *uint64, v mem.Pa_t) {
+		p := (*[2]uint32)(unsafe.Pointer(f))
+		runtime.Store32(&p[0], uint32(v))
+		runtime.Store32(&p[1], uint32(v>>32))
+	}
+	st64(&c.qdesc, desc)
+	st64(&c.qavail, avail)
+	st64(&c.qused, used)
+	if msix {
+		st16(&c.qmsix, 0)
+		if ld16(&c.qmsix) != 0 {
+			return false
+		}
+	}
+	off := int(ld16(&c.qnotifyoff)) * m.notifymul
+	if off+2 > len(m.notifyva) {
+		return false
+	}
+	m.qnotify[q] = (*uint16)(unsafe.Pointer(&m.notifyva[off]))
+	st16(&c.qenable, 1)
+	return true
+}
+
+func (m *modern_t) notify(q int) {
+	st16(m.qnotify[q], uint16(q))
+}
+
+func (m *modern_t) cfg(off, n int) uint64 {
+	ret := uint64(0)
+	for i := n - 1; i >= 0; i-- {
+		ret = ret<<8 | uint64(m.devcfg[off+i])
+	}
+	return ret
+}
+
+// a virtio device
+type vdev_t struct {
+	tag    pci.Pcitag_t
+	trans  transport_i
+	modern bool
+	// the negotiated features
+	feats uint64
+	vec   msi.Msivec_t
+	msix  bool
+}
+
+// finds the transport of the device at tag, resets the device, routes its
+// interrupts, and acknowledges it. returns false if the device has no usable
+// transport or interrupts.
+func mkVdev(tag pci.Pcitag_t) (*vdev_t, bool) {
+	vd := &vdev_t{tag: tag}
+
+	// enable I/O and memory decoding and bus mastering; disable legacy
+	// interrupts
+	cmd := pci.Pci_read(tag, 0x4, 2)
+	cmd |= 0x7
+	cmd |= 1 << 10
+	pci.Pci_write(tag, 0x4, cmd)
+
+	if m, ok := mkModern(tag); ok {
+		vd.trans = m
+		vd.modern = true
+	} else if pci.Pci_read(tag, 0x10, 4)&1 != 0 {
+		vd.trans = &legacy_t{io: int(pci.Pci_bar_pio(tag, 0))}
+	} else {
+		fmt.Printf("virtio: no transport\n")
+		return nil, false
+	}
+
+	vd.trans.setstatus(0)
+	for c := 0; vd.trans.status() != 0; c++ {
+		if c > 100000 {
+			fmt.Printf("virtio: reset timed out\n")
+			return nil, false
+		}
+	}
+	vd.trans.setstatus(VIRTIO_STAT_ACK)
+	vd.trans.setstatus(VIRTIO_STAT_ACK | VIRTIO_STAT_DRIVER)
+
+	var ok bool
+	vd.vec, vd.msix, ok = pci.Pci_msi_attach(tag)
+	if !ok {
+		fmt.Printf("virtio: no MSI\n")
+		vd.fail()
+		return nil, false
+	}
+	if vd.msix {
+		vd.trans.msix()
+	}
+	return vd, true
+}
+
+// negotiates the features in want that the device offers. returns false if
+// the device rejects them.
+func (vd *vdev_t) negotiate(want uint64) bool {
+	if vd.modern {
+		want |= VIRTIO_F_VERSION_1
+	}
+	f := vd.trans.features() & want
+	if vd.modern && f&VIRTIO_F_VERSION_1 == 0 {
+		fmt.Printf("virtio: modern device without VERSION_1\n")
+		return false
+	}
+	vd.trans.setfeatures(f)
+	vd.feats = f
+	if !vd.modern {
+		return true
+	}
+	st := vd.trans.status() | VIRTIO_STAT_FEATURES_OK
+	vd.trans.setstatus(st)
+	if vd.trans.status()&VIRTIO_STAT_FEATURES_OK == 0 {
+		fmt.Printf("virtio: features %#x rejected\n", f)
+		return false
+	}
+	return true
+}
+
+// lets the device use its queues
+func (vd *vdev_t) ready() {
+	vd.trans.setstatus(vd.trans.status() | VIRTIO_STAT_DRIVER_OK)
+}
+
+func (vd *vdev_t) fail() {
+	vd.trans.setstatus(vd.trans.status() | VIRTIO_STAT_FAILED)
+}
+
+//
+// Virtqueues
+//
+
+type vdesc_t struct {
+	addr  uint64
+	len   uint32
+	flags uint16
+	next  uint16
+}
+
+const (
+	VRING_DESC_F_NEXT  uint16 = 1
+	VRING_DESC_F_WRITE uint16 = 2
+)
+
+type vused_t struct {
+	id  uint32
+	len uint32
+}
+
+// the largest queue we use, so that the descriptors fit in a page
+const vqmax = mem.PGSIZE / 16
+
+// a buffer of a request, which the device writes if write and reads
+// otherwise
+type vbuf_t struct {
+	pa    mem.Pa_t
+	len   int
+	write bool
+}
+
+type vq_t struct {
+	q     int
+	sz    int
+	trans transport_i
+	desc  *[vqmax]vdesc_t
+	// the avail ring's flags and index, which only we write, share a
+	// dword so the index can be published with one store
+	aflagsidx *uint32
+	aring     *[vqmax]uint16
+	uflagsidx *uint32
+	uring     *[vqmax]vused_t
+	// free descriptors are chained through their next fields
+	freehd   uint16
+	nfree    int
+	aidx     uint16
+	lastused uint16
+}
+
+// allocates n physically contiguous, zeroed pages. like the AHCI driver, this
+// relies on the page allocator handing out ascending pages during boot.
+func pg_contig(n int) mem.Pa_t {
+	var pa mem.Pa_t
+	for i := 0; i < n; i++ {
+		_, pa1, ok := mem.Physmem.Refpg_new()
+		if !ok {
+			panic("oom during virtio pg_contig")
+		}
+		mem.Physmem.Refup(pa1)
+		if i == 0 {
+			pa = pa1
+		} else if int(pa1-pa) != mem.PGSIZE*i {
+			panic("virtio: queue pages not in order")
+		}
+	}
+	return pa
+}
+
+func vqlen(b int) int {
+	return (b + mem.PGSIZE - 1) &^ (mem.PGSIZE - 1)
+}
+
+// sets up queue q of the device, using the legacy layout of its rings:
+// descriptors, then the avail ring, then, at the next page, the used ring
+func (vd *vdev_t) mkVq(q int) (*vq_t, bool) {
+	sz := vd.trans.qsize(q)
+	if sz == 0 || sz&(sz-1) != 0 {
+		fmt.Printf("virtio: bad queue %v size %v\n", q, sz)
+		return nil, false
+	}
+	if sz > vqmax {
+		if !vd.modern {
+			fmt.Printf("virtio: queue %v too large: %v\n", q, sz)
+			return nil, false
+		}
+		sz = vqmax
+	}
+	alen := vqlen(16*sz + 6 + 2*sz)
+	ulen := vqlen(6 + 8*sz)
+	pa := pg_contig((alen + ulen) / mem.PGSIZE)
+	desc := pa
+	avail := pa + mem.Pa_t(16*sz)
+	used := pa + mem.Pa_t(alen)
+
+	vq := &vq_t{q: q, sz: sz, trans: vd.trans, nfree: sz}
+	va := func(p mem.Pa_t) unsafe.Pointer {
+		return unsafe.Pointer(&mem.Physmem.Dmap8(p)[0])
+	}
+	vq.desc = (*[vqmax]vdesc_t)(va(desc))
+	vq.aflagsidx = (*uint32)(va(avail))
+	vq.aring = (*[vqmax]uint16)(va(avail + 4))
+	vq.uflagsidx = (*uint32)(va(used))
+	vq.uring = (*[vqmax]vused_t)(va(used + 4))
+	for i := 0; i < sz; i++ {
+		vq.desc[i].next = uint16(i + 1)
+	}
+	if !vd.trans.qsetup(q, sz, desc, avail, used, vd.msix) {
+		fmt.Printf("virtio: cannot set up queue %v\n", q)
+		return nil, false
+	}
+	dbg("virtio: queue %v size %v at %#x\n", q, sz, pa)
+	return vq, true
+}
+
+// returns the head descriptor the next add will use
+func (vq *vq_t) next() int {
+	return int(vq.freehd)
+}
+
+// makes the chain of bufs available to the device, returning its head
+// descriptor. the caller makes sure there are enough free descriptors and
+// notifies the device with kick.
+func (vq *vq_t) add(bufs []vbuf_t) int {
+	if len(bufs) == 0 || len(bufs) > vq.nfree {
+		panic("virtio: no descriptors")
+	}
+	head := vq.freehd
+	d := head
+	for i, b := range bufs {
+		desc := &vq.desc[d]
+		desc.addr = uint64(b.pa)
+		desc.len = uint32(b.len)
+		flags := uint16(0)
+		if b.write {
+			flags |= VRING_DESC_F_WRITE
+		}
+		if i != len(bufs)-1 {
+			flags |= VRING_DESC_F_NEXT
+			d = desc.next
+		} else {
+			vq.freehd = desc.next
+		}
+		desc.flags = flags
+	}
+	vq.nfree -= len(bufs)
+	vq.aring[int(vq.aidx)%vq.sz] = head
+	vq.aidx++
+	// the store orders the descriptors and ring entry before the new index
+	runtime.Store32(vq.aflagsidx, uint32(vq.aidx)<<16)
+	return int(head)
+}
+
+func (vq *vq_t) kick() {
+	vq.trans.notify(vq.q)
+}
+
+// returns the head of the next chain the device is done with and the number
+// of bytes it wrote, freeing the chain's descriptors. returns false if the
+// device hasn't finished any more chains.
+func (vq *vq_t) reap() (int, int, bool) {
+	uidx := uint16(atomic.LoadUint32(vq.uflagsidx) >> 16)
+	if uidx == vq.lastused {
+		return 0, 0, false
+	}
+	u := vq.uring[int(vq.lastused)%vq.sz]
+	vq.lastused++
+	head := uint16(u.id)
+	d := head
+	n := 1
+	for vq.desc[d].flags&VRING_DESC_F_NEXT != 0 {
+		d = vq.desc[d].next
+		n++
+	}
+	vq.desc[d].next = vq.freehd
+	vq.freehd = head
+	vq.nfree += n
+	return int(head), int(u.len), true
+}
+
+func common_verify() {
+	c := &common_cfg_t{}
+	if unsafe.Offsetof(c.status) != 0x14 ||
+		unsafe.Offsetof(c.qnotifyoff) != 0x1e ||
+		unsafe.Offsetof(c.qdesc) != 0x20 ||
+		unsafe.Sizeof(*c) != 0x38 {
+		panic("common_cfg_t padded?")
+	}
+	if unsafe.Sizeof(vdesc_t{}) != 16 {
+		panic("vdesc_t padded?")
+	}
+}
+
+// Virtio_init registers the virtio drivers; call it before the PCI bus is
+// attached
+func Virtio_init() {
+	common_verify()
+	blk_verify()
+	net_verify()
+	pci.Pci_register(PCI_VEND_VIRTIO, PCI_DEV_VIRTIO_BLK, attach_blk)
+	pci.Pci_register(PCI_VEND_VIRTIO, PCI_DEV_VIRTIO_BLK1, attach_blk)
+	pci.Pci_register(PCI_VEND_VIRTIO, PCI_DEV_VIRTIO_NET, attach_net)
+	pci.Pci_register(PCI_VEND_VIRTIO, PCI_DEV_VIRTIO_NET1, attach_net)
+}
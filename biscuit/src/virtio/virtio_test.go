@@ -0,0 +1,182 @@
+package virtio
+
+import "testing"
+import "unsafe"
+
+import "mem"
+
+// a transport whose queue is driven by the test
+type tdev_t struct {
+	nnotify int
+}
+
+func (d *tdev_t) features() uint64   { return 0 }
+func (d *tdev_t) setfeatures(uint64) {}
+func (d *tdev_t) status() uint8      { return 0 }
+func (d *tdev_t) setstatus(uint8)    {}
+func (d *tdev_t) msix()              {}
+func (d *tdev_t) qsize(q int) int    { return 0 }
+func (d *tdev_t) notify(q int)       { d.nnotify++ }
+func (d *tdev_t) cfg(off, n int) uint64 {
+	return 0
+}
+func (d *tdev_t) qsetup(q, sz int, desc, avail, used mem.Pa_t, msix bool) bool {
+	return true
+}
+
+// lays out a queue of sz entries in ordinary memory, as mkVq does in pages,
+// with both ring indices starting at idx
+func mkTestVq(sz int, idx uint16) *vq_t {
+	vq := &vq_t{sz: sz, trans: &tdev_t{}, nfree: sz}
+	vq.desc = &[vqmax]vdesc_t{}
+	vq.aflagsidx = new(uint32)
+	vq.aring = &[vqmax]uint16{}
+	vq.uflagsidx = new(uint32)
+	vq.uring = &[vqmax]vused_t{}
+	for i := 0; i < sz; i++ {
+		vq.desc[i].next = uint16(i + 1)
+	}
+	vq.aidx = idx
+	vq.lastused = idx
+	*vq.aflagsidx = uint32(idx) << 16
+	*vq.uflagsidx = uint32(idx) << 16
+	return vq
+}
+
+// the device side of a queue: takes the chains the driver made available and
+// returns them in the used ring
+type tvq_t struct {
+	vq    *vq_t
+	aidx  uint16
+	uidx  uint16
+	taken []int
+}
+
+// takes every newly available chain, checking its buffers against those
+// added with its head
+func (tv *tvq_t) take(t *testing.T, want map[int][]vbuf_t) {
+	vq := tv.vq
+	for aidx := uint16(*vq.aflagsidx >> 16); tv.aidx != aidx; tv.aidx++ {
+		head := int(vq.aring[int(tv.aidx)%vq.sz])
+		bufs, ok := want[head]
+		if !ok {
+			t.Fatalf("chain at %v not added", head)
+		}
+		d := head
+		for i, b := range bufs {
+			desc := &vq.desc[d]
+			if desc.addr != uint64(b.pa) || int(desc.len) != b.len {
+				t.Fatalf("chain %v buf %v: %#x %v", head, i,
+					desc.addr, desc.len)
+			}
+			w := desc.flags&VRING_DESC_F_WRITE != 0
+			next := desc.flags&VRING_DESC_F_NEXT != 0
+			if w != b.write || next != (i != len(bufs)-1) {
+				t.Fatalf("chain %v buf %v: flags %#x", head, i,
+					desc.flags)
+			}
+			d = int(desc.next)
+		}
+		tv.taken = append(tv.taken, head)
+	}
+}
+
+// returns the taken chain at i, which wrote n bytes
+func (tv *tvq_t) use(i int, n int) {
+	vq := tv.vq
+	head := tv.taken[i]
+	copy(tv.taken[i:], tv.taken[i+1:])
+	tv.taken = tv.taken[:len(tv.taken)-1]
+	vq.uring[int(tv.uidx)%vq.sz] = vused_t{id: uint32(head), len: uint32(n)}
+	tv.uidx++
+	*vq.uflagsidx = uint32(tv.uidx) << 16
+}
+
+// adds and reaps chains of different lengths, finished in and out of order,
+// across the wrap of the rings and of their 16-bit indices
+func TestVqWrap(t *testing.T) {
+	if unsafe.Sizeof(vdesc_t{}) != 16 {
+		t.Fatalf("vdesc_t padded")
+	}
+	for _, sz := range []int{1, 2, 8, vqmax} {
+		start := uint16(0x10000 - 3*sz)
+		vq := mkTestVq(sz, start)
+		tv := &tvq_t{vq: vq, aidx: start, uidx: start}
+		want := make(map[int][]vbuf_t)
+		pa := mem.Pa_t(mem.PGSIZE)
+		nadd := 0
+		for round := 0; round < 20*sz+50; round++ {
+			// fill the queue with chains of one to three buffers
+			for {
+				l := 1 + (nadd % 3)
+				if l > vq.nfree {
+					l = vq.nfree
+				}
+				if l == 0 {
+					break
+				}
+				bufs := make([]vbuf_t, l)
+				for i := range bufs {
+					bufs[i] = vbuf_t{pa: pa, len: i + 1,
+						write: (nadd+i)%2 == 0}
+					pa += mem.Pa_t(mem.PGSIZE)
+				}
+				next := vq.next()
+				if h := vq.add(bufs); h != next {
+					t.Fatalf("head %v, next said %v", h, next)
+				}
+				if _, ok := want[next]; ok {
+					t.Fatalf("head %v in use", next)
+				}
+				want[next] = bufs
+				nadd++
+			}
+			vq.kick()
+			tv.take(t, want)
+			if len(tv.taken) != len(want) {
+				t.Fatalf("device took %v of %v", len(tv.taken),
+					len(want))
+			}
+			// finish some chains, alternating between the oldest
+			// and the newest
+			nuse := 1 + round%len(tv.taken)
+			for i := 0; i < nuse; i++ {
+				j := 0
+				if i%2 == 1 {
+					j = len(tv.taken) - 1
+				}
+				tv.use(j, tv.taken[j]+1)
+			}
+			for i := 0; i < nuse; i++ {
+				head, n, ok := vq.reap()
+				if !ok {
+					t.Fatalf("reaped %v of %v", i, nuse)
+				}
+				if _, ok := want[head]; !ok {
+					t.Fatalf("reaped %v twice", head)
+				}
+				if n != head+1 {
+					t.Fatalf("chain %v wrote %v", head, n)
+				}
+				delete(want, head)
+			}
+			if _, _, ok := vq.reap(); ok {
+				t.Fatalf("reaped an unused chain")
+			}
+			used := 0
+			for _, bufs := range want {
+				used += len(bufs)
+			}
+			if vq.nfree+used != sz {
+				t.Fatalf("%v free and %v used of %v", vq.nfree,
+					used, sz)
+			}
+		}
+		if nadd <= 3*sz {
+			t.Fatalf("indices did not wrap: %v chains", nadd)
+		}
+		if vq.trans.(*tdev_t).nnotify == 0 {
+			t.Fatalf("never notified")
+		}
+	}
+}
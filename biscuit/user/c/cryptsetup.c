@@ -0,0 +1,64 @@
+#include <litc.h>
+
+static void
+usage(char *p)
+{
+	errx(-1, "usage: %s <disk> <key file>\n"
+	    "       %s -d <disk>\n"
+	    "the key file holds a 32 or 64 byte key in hex (see mkcrypt)\n",
+	    p, p);
+}
+
+static int
+hexval(char c)
+{
+	if (c >= '0' && c <= '9')
+		return c - '0';
+	if (c >= 'a' && c <= 'f')
+		return c - 'a' + 10;
+	if (c >= 'A' && c <= 'F')
+		return c - 'A' + 10;
+	return -1;
+}
+
+int main(int argc, char **argv)
+{
+	if (argc != 3)
+		usage(argv[0]);
+
+	if (strcmp(argv[1], "-d") == 0) {
+		if (cryptsetup(argv[2], NULL, 0) == -1)
+			err(-1, "cryptsetup %s", argv[2]);
+		return 0;
+	}
+
+	int fd = open(argv[2], O_RDONLY);
+	if (fd == -1)
+		err(-1, "open %s", argv[2]);
+	char hex[129];
+	ssize_t n = read(fd, hex, sizeof(hex) - 1);
+	if (n == -1)
+		err(-1, "read %s", argv[2]);
+	close(fd);
+	while (n > 0 && (hex[n-1] == '\n' || hex[n-1] == ' '))
+		n--;
+	if (n != 64 && n != 128)
+		usage(argv[0]);
+
+	unsigned char key[64];
+	size_t i;
+	for (i = 0; i < n/2; i++) {
+		int h = hexval(hex[2*i]);
+		int l = hexval(hex[2*i+1]);
+		if (h == -1 || l == -1)
+			usage(argv[0]);
+		key[i] = h << 4 | l;
+	}
+	int ret = cryptsetup(argv[1], key, n/2);
+	memset(key, 0, sizeof(key));
+	memset(hex, 0, sizeof(hex));
+	if (ret == -1)
+		err(-1, "cryptsetup %s", argv[1]);
+	printf("attached crypt-%s\n", argv[1]);
+	return 0;
+}
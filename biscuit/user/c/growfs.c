@@ -0,0 +1,15 @@
+#include <litc.h>
+
+int main(int argc, char **argv)
+{
+	if (argc != 2)
+		errx(-1, "usage: %s <file or directory in the file system>\n",
+		    argv[0]);
+
+	int fd = open(argv[1], O_RDONLY);
+	if (fd == -1)
+		err(-1, "open %s", argv[1]);
+	if (ioctl(fd, FS_IOC_GROW, 0) == -1)
+		err(-1, "FS_IOC_GROW");
+	return 0;
+}
@@ -20,6 +20,7 @@ extern "C" {
 #define		ESRCH		3
 #define		EINTR		4
 #define		EIO		5
+#define		ENXIO		6
 #define		E2BIG		7
 #define		EBADF		9
 #define		ECHILD		10
@@ -37,10 +38,14 @@ extern "C" {
 #define		EINVAL		22
 #define		ENFILE		23
 #define		EMFILE		24
+#define		ENOTTY		25
+#define		EFBIG		27
 #define		ENOSPC		28
 #define		ESPIPE		29
+#define		EROFS		30
 #define		EPIPE		32
 #define		ERANGE		34
+#define		EDEADLK		35
 #define		ENAMETOOLONG	36
 #define		ENOSYS		38
 #define		ENOTEMPTY	39
@@ -284,11 +289,17 @@ int access(const char *, int);
 #define		R_OK	(1 << 0)
 #define		W_OK	(1 << 1)
 #define		X_OK	(1 << 2)
+#define		AT_FDCWD		-100
+#define		AT_SYMLINK_NOFOLLOW	0x100
+#define		AT_REMOVEDIR		0x200
+#define		AT_EACCESS		0x200
+#define		AT_SYMLINK_FOLLOW	0x400
 int bind(int, const struct sockaddr *, socklen_t);
 int connect(int, const struct sockaddr *, socklen_t);
 int chmod(const char *, mode_t);
 int close(int);
 int chdir(const char *);
+ssize_t copy_file_range(int, off_t *, int, off_t *, size_t, uint);
 int dup(int);
 int dup2(int, int);
 void _exit(int)
@@ -296,8 +307,20 @@ void _exit(int)
 int execv(const char *, char * const[]);
 int execve(const char *, char * const[], char * const[]);
 int execvp(const char *, char * const[]);
+int faccessat(int, const char *, int, int);
+int fallocate(int, int, off_t, off_t);
+int fdatasync(int);
+int flock(int, int);
+#define		LOCK_SH		0x1
+#define		LOCK_EX		0x2
+#define		LOCK_NB		0x4
+#define		LOCK_UN		0x8
+#define		FALLOC_FL_KEEP_SIZE	0x1
+#define		FALLOC_FL_PUNCH_HOLE	0x2
 pid_t fork(void);
 int fstat(int, struct stat *);
+int fstatat(int, const char *, struct stat *, int);
+int fsync(int);
 int ftruncate(int, off_t);
 int futex(const int, void *, void *, int, const struct timespec *);
 #define		FUTEX_SLEEP	1
@@ -330,23 +353,31 @@ int fcntl(int, int, ...);
 #define		F_SETLK		5
 #define		F_SETLKW	6
 #define		F_SETOWN	7
+#define		F_GETLK		8
 
 #define		FD_CLOEXEC	0x4
 
 int kill(int, int);
 int link(const char *, const char *);
+int linkat(int, const char *, int, const char *, int);
 int listen(int, int);
 off_t lseek(int, off_t, int);
 #define		SEEK_SET	1
 #define		SEEK_CUR	2
 #define		SEEK_END	4
+#define		SEEK_DATA	8
+#define		SEEK_HOLE	16
 
 int mkdir(const char *, long);
+int mkdirat(int, const char *, long);
 int mknod(const char *, mode_t, dev_t);
+int mknodat(int, const char *, mode_t, dev_t);
 void *mmap(void *, size_t, int, int, int, long);
+int mount(const char *, const char *, const char *, ulong, const void *);
 int munmap(void *, size_t);
 int nanosleep(const struct timespec *, struct timespec *);
 int open(const char *, int, ...);
+int openat(int, const char *, int, ...);
 #define		O_RDONLY	0
 #define		O_WRONLY	1
 #define		O_RDWR		2
@@ -404,6 +435,7 @@ struct cmsghdr {
 
 ssize_t recvmsg(int, struct msghdr *, int);
 int rename(const char *, const char *);
+int renameat(int, const char *, int, const char *);
 int rmdir(const char *);
 int select(int, fd_set*, fd_set*, fd_set*, struct timeval *);
 ssize_t send(int, const void *, size_t, int);
@@ -515,7 +547,10 @@ long sys_info(long);
 #define		SINFO_PROCLIST				11l
 
 int truncate(const char *, off_t);
+int umount(const char *);
+int umount2(const char *, int);
 int unlink(const char *);
+int unlinkat(int, const char *, int);
 pid_t wait(int *);
 pid_t waitpid(pid_t, int *, int);
 pid_t wait3(int *, int, struct rusage *);
@@ -757,7 +792,6 @@ FILE *fdopen(int, const char *);
 FILE *fopen(const char *, const char *);
 int fprintf(FILE *, const char *, ...)
     __attribute__((format(printf, 2, 3)));
-int fsync(int);
 //int fputs(const char *, FILE *); /*REDIS*/
 size_t fread(void *, size_t, size_t, FILE *);
 off_t ftello(FILE *);
@@ -959,6 +993,7 @@ void globfree(glob_t *);
 
 struct flock {
 	short	l_type;
+#define		F_RDLCK		0
 #define		F_WRLCK		1
 #define		F_UNLCK		2
 	short	l_whence;
@@ -970,6 +1005,13 @@ struct flock {
 int socketpair(int, int, int, int[2]);
 int ioctl(int, ulong, ...);
 #define		FIOASYNC	3
+#define		LOOP_SET_FD	0x4c00
+#define		LOOP_CLR_FD	0x4c01
+// grows the file system holding the file to the end of its disk
+#define		FS_IOC_GROW	0x6610
+// attaches the disk, encrypted with the AES-XTS key, as crypt-<disk>;
+// detaches crypt-<disk> if keylen is 0
+int cryptsetup(const char *, const void *, size_t);
 
 int raise(int);
 mode_t umask(mode_t);
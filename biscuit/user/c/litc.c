@@ -12,6 +12,7 @@
 #define SYS_MMAP         9
 #define SYS_MUNMAP       11
 #define SYS_SIGACTION    13
+#define SYS_IOCTL        16
 #define SYS_READV        19
 #define SYS_WRITEV       20
 #define SYS_ACCESS       21
@@ -38,6 +39,9 @@
 #define SYS_WAIT4        61
 #define SYS_KILL         62
 #define SYS_FCNTL        72
+#define SYS_FLOCK        73
+#define SYS_FSYNC        74
+#define SYS_FDATASYNC    75
 #define SYS_TRUNC        76
 #define SYS_FTRUNC       77
 #define SYS_GETCWD       79
@@ -52,9 +56,21 @@
 #define SYS_MKNOD        133
 #define SYS_SETRLIMIT    160
 #define SYS_SYNC         162
+#define SYS_MOUNT        165
+#define SYS_UMOUNT2      166
 #define SYS_REBOOT       169
 #define SYS_NANOSLEEP    230
+#define SYS_OPENAT       257
+#define SYS_MKDIRAT      258
+#define SYS_MKNODAT      259
+#define SYS_FSTATAT      262
+#define SYS_UNLINKAT     263
+#define SYS_RENAMEAT     264
+#define SYS_LINKAT       265
+#define SYS_FACCESSAT    269
+#define SYS_FALLOCATE    285
 #define SYS_PIPE2        293
+#define SYS_COPY_FILE_RANGE 326
 #define SYS_PROF         31337
 #define SYS_THREXIT      31338
 #define SYS_INFO         31339
@@ -62,6 +78,7 @@
 #define SYS_PWRITE       31341
 #define SYS_FUTEX        31342
 #define SYS_GETTID       31343
+#define SYS_CRYPTSETUP   31344
 
 __thread int errno;
 
@@ -139,6 +156,15 @@ access(const char *p, int mode)
 	return ret;
 }
 
+int
+faccessat(int dirfd, const char *p, int mode, int flags)
+{
+	int ret = syscall(SA(dirfd), SA(p), SA(mode), SA(flags), 0,
+	    SYS_FACCESSAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 bind(int sockfd, const struct sockaddr *s, socklen_t sl)
 {
@@ -163,6 +189,20 @@ chdir(const char *path)
 	return ret;
 }
 
+ssize_t
+copy_file_range(int ifd, off_t *ioff, int ofd, off_t *ooff, size_t len,
+    uint flags)
+{
+	if (flags != 0) {
+		errno = EINVAL;
+		return -1;
+	}
+	ssize_t ret = syscall(SA(ifd), SA(ioff), SA(ofd), SA(ooff), SA(len),
+	    SYS_COPY_FILE_RANGE);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 int
 dup(int o)
 {
@@ -275,6 +315,15 @@ fcntl(int fd, int cmd, ...)
 		ERRNO_NEG(ret);
 		break;
 	}
+	case F_GETLK:
+	case F_SETLK:
+	case F_SETLKW:
+	{
+		struct flock *fl = va_arg(ap, struct flock *);
+		ret = syscall(a1, a2, SA(fl), 0, 0, SYS_FCNTL);
+		ERRNO_NZ(ret);
+		break;
+	}
 	case F_SETOWN:
 	{
 		fprintf(stderr, "warning: F_SETOWN is no-op\n");
@@ -288,6 +337,31 @@ fcntl(int fd, int cmd, ...)
 	return ret;
 }
 
+int
+fallocate(int fd, int mode, off_t off, off_t len)
+{
+	int ret = syscall(SA(fd), SA(mode), SA(off), SA(len), 0,
+	    SYS_FALLOCATE);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+fdatasync(int fd)
+{
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FDATASYNC);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+flock(int fd, int op)
+{
+	int ret = syscall(SA(fd), SA(op), 0, 0, 0, SYS_FLOCK);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 fork(void)
 {
@@ -305,6 +379,14 @@ fstat(int fd, struct stat *buf)
 	return ret;
 }
 
+int
+fsync(int fd)
+{
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FSYNC);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 char *
 getcwd(char *buf, size_t sz)
 {
@@ -370,6 +452,14 @@ gettid(void)
 	return syscall(0, 0, 0, 0, 0, SYS_GETTID);
 }
 
+int
+cryptsetup(const char *disk, const void *key, size_t keylen)
+{
+	int ret = syscall(SA(disk), SA(key), SA(keylen), 0, 0, SYS_CRYPTSETUP);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 getrlimit(int res, struct rlimit *rlp)
 {
@@ -406,6 +496,15 @@ link(const char *old, const char *new)
 	return ret;
 }
 
+int
+linkat(int odirfd, const char *old, int ndirfd, const char *new, int flags)
+{
+	int ret = syscall(SA(odirfd), SA(old), SA(ndirfd), SA(new), SA(flags),
+	    SYS_LINKAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 listen(int fd, int backlog)
 {
@@ -430,6 +529,14 @@ mkdir(const char *p, long mode)
 	return ret;
 }
 
+int
+mkdirat(int dirfd, const char *p, long mode)
+{
+	int ret = syscall(SA(dirfd), SA(p), mode, 0, 0, SYS_MKDIRAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 mknod(const char *p, mode_t m, dev_t d)
 {
@@ -440,6 +547,16 @@ mknod(const char *p, mode_t m, dev_t d)
 	return ret;
 }
 
+int
+mknodat(int dirfd, const char *p, mode_t m, dev_t d)
+{
+	if (MAJOR(d) == 0)
+		errx(-1, "bad major: 0");
+	int ret = syscall(SA(dirfd), SA(p), SA(m), SA(d), 0, SYS_MKNODAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 void *
 mmap(void *addr, size_t len, int prot, int flags, int fd, long offset)
 {
@@ -455,6 +572,16 @@ mmap(void *addr, size_t len, int prot, int flags, int fd, long offset)
 	return (void *)ret;
 }
 
+int
+mount(const char *src, const char *target, const char *fstype, ulong flags,
+    const void *data)
+{
+	int ret = syscall(SA(src), SA(target), SA(fstype), SA(flags), SA(data),
+	    SYS_MOUNT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 munmap(void *addr, size_t len)
 {
@@ -486,6 +613,21 @@ open(const char *path, int flags, ...)
 	return ret;
 }
 
+int
+openat(int dirfd, const char *path, int flags, ...)
+{
+	mode_t mode = 0;
+	if (flags & O_CREAT) {
+		va_list l;
+		va_start(l, flags);
+		mode = va_arg(l, mode_t);
+		va_end(l);
+	}
+	int ret = syscall(SA(dirfd), SA(path), flags, mode, 0, SYS_OPENAT);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 int
 pause(void)
 {
@@ -591,6 +733,15 @@ rename(const char *old, const char *new)
 	return ret;
 }
 
+int
+renameat(int odirfd, const char *old, int ndirfd, const char *new)
+{
+	int ret = syscall(SA(odirfd), SA(old), SA(ndirfd), SA(new), 0,
+	    SYS_RENAMEAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 ssize_t
 send(int fd, const void *buf, size_t len, int flags)
 {
@@ -721,6 +872,15 @@ stat(const char *path, struct stat *st)
 	return ret;
 }
 
+int
+fstatat(int dirfd, const char *path, struct stat *st, int flags)
+{
+	int ret = syscall(SA(dirfd), SA(path), SA(st), SA(flags), 0,
+	    SYS_FSTATAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 sync(void)
 {
@@ -761,6 +921,20 @@ _unlink(const char *path, int wantdir)
 	return ret;
 }
 
+int
+umount(const char *target)
+{
+	return umount2(target, 0);
+}
+
+int
+umount2(const char *target, int flags)
+{
+	int ret = syscall(SA(target), SA(flags), 0, 0, 0, SYS_UMOUNT2);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 unlink(const char *path)
 {
@@ -773,6 +947,14 @@ rmdir(const char *path)
 	return _unlink(path, 1);
 }
 
+int
+unlinkat(int dirfd, const char *path, int flags)
+{
+	int ret = syscall(SA(dirfd), SA(path), SA(flags), 0, 0, SYS_UNLINKAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 wait(int *status)
 {
@@ -1871,13 +2053,6 @@ futex(const int op, void *fut, void *fut2, int aux, const struct timespec *ts)
 	return ret;
 }
 
-int
-fsync(int fd)
-{
-	sync();
-	return 0;
-}
-
 static void
 _gcfrac(struct gcfrac_t *r)
 {
@@ -3046,6 +3221,7 @@ static const char * const _errstr[] = {
 	[ESRCH] = "No such process",
 	[EINTR] = "Interrupted system call",
 	[EIO] = "Input/output error",
+	[ENXIO] = "Device not configured",
 	[E2BIG] = "Argument list too long",
 	[EBADF] = "Bad file descriptor",
 	[EAGAIN] = "Resource temporarily unavailable",
@@ -3062,10 +3238,14 @@ static const char * const _errstr[] = {
 	[EINVAL] = "Invalid argument",
 	[ENFILE] = "Too many open files in system",
 	[EMFILE] = "Too many open files",
+	[ENOTTY] = "Inappropriate ioctl for device",
+	[EFBIG] = "File too large",
 	[ENOSPC] = "No space left on device",
 	[ESPIPE] = "Illegal seek",
+	[EROFS] = "Read-only file system",
 	[EPIPE] = "Broken pipe",
 	[ERANGE] = "Result too large",
+	[EDEADLK] = "Resource deadlock avoided",
 	[ENAMETOOLONG] = "File name too long",
 	[ENOSYS] = "Function not implemented",
 	[ENOTEMPTY] = "Directory not empty",
@@ -3712,9 +3892,16 @@ globfree(glob_t *a)
 int
 ioctl(int fd, ulong req, ...)
 {
-	if (req != FIOASYNC)
-		errx(-1, "nyet");
-	HACK(0);
+	if (req == FIOASYNC)
+		HACK(0);
+
+	va_list ap;
+	va_start(ap, req);
+	long arg = va_arg(ap, long);
+	va_end(ap);
+	int ret = syscall(SA(fd), SA(req), SA(arg), 0, 0, SYS_IOCTL);
+	ERRNO_NEG(ret);
+	return ret;
 }
 
 int
@@ -0,0 +1,33 @@
+#include <litc.h>
+
+static void
+usage(char *p)
+{
+	errx(-1, "usage: %s <loop device> <file>\n"
+	    "       %s -d <loop device>\n", p, p);
+}
+
+int main(int argc, char **argv)
+{
+	if (argc != 3)
+		usage(argv[0]);
+
+	if (strcmp(argv[1], "-d") == 0) {
+		int fd = open(argv[2], O_RDONLY);
+		if (fd == -1)
+			err(-1, "open %s", argv[2]);
+		if (ioctl(fd, LOOP_CLR_FD, 0) == -1)
+			err(-1, "LOOP_CLR_FD");
+		return 0;
+	}
+
+	int fd = open(argv[1], O_RDONLY);
+	if (fd == -1)
+		err(-1, "open %s", argv[1]);
+	int ffd = open(argv[2], O_RDWR);
+	if (ffd == -1)
+		err(-1, "open %s", argv[2]);
+	if (ioctl(fd, LOOP_SET_FD, ffd) == -1)
+		err(-1, "LOOP_SET_FD");
+	return 0;
+}